@@ -1,58 +1,198 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/emicklei/go-restful"
 	"github.com/fest-research/iot-addon/pkg/api/v1"
 	"github.com/fest-research/iot-addon/pkg/apiserver/api"
 	"github.com/fest-research/iot-addon/pkg/apiserver/api/handler"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
 	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/apiserver/ratelimit"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/healthz"
 	kube "github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/lifecycle"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 )
 
-var (
-	argApiserverHost = pflag.String("apiserver", "", "Kubernetes api server address")
-	argPort          = pflag.Int("port", 8083, "Port to listen on")
-	argKubeconfig    = pflag.String("kubeconfig", "", "Absolute path to the kubeconfig file")
-	iotDomain        = pflag.String("domain", "fujitsu.com", "custom domain name")
-)
+var argConfig = pflag.String("config", "",
+	"Path to YAML config file, reloaded on change. Command line flags take precedence over it")
 
-const rootPath = "/api/" + v1.APIVersion
+const (
+	rootPath             = "/api/" + v1.APIVersion
+	certificatesRootPath = "/apis/certificates.k8s.io/v1beta1"
+	metricsPath          = "/metrics"
+)
 
 func main() {
+	cfg := config.NewApiserverConfig()
+	cfg.AddFlags(pflag.CommandLine)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
-	log.SetOutput(os.Stdout)
-	log.Printf("Using HTTP port: %d", *argPort)
-	if *argKubeconfig == "" && *argApiserverHost == "" {
-		log.Println("Kubeconfig and apiserver arguments not provided. Falling back to inClusterConfig.")
+	if len(*argConfig) > 0 {
+		loaded, err := loadConfig(*argConfig)
+		if err != nil {
+			logging.Fatalf("%s", err.Error())
+		}
+		cfg = loaded
+	} else if err := cfg.Validate(); err != nil {
+		logging.Fatalf("%s", err.Error())
+	}
+	store := config.NewApiserverStore(cfg)
+
+	if err := logging.Configure(cfg.Logging.Level, cfg.Logging.Format); err != nil {
+		panic(err.Error())
+	}
+
+	logging.Infof("Listening on %s", cfg.Listen.Address)
+	if cfg.Kubernetes.Kubeconfig == "" && cfg.Kubernetes.Apiserver == "" {
+		logging.Infof("Kubeconfig and apiserver arguments not provided. Falling back to inClusterConfig.")
 	}
 
 	// Get config object
-	config := kube.NewClientConfig(*argApiserverHost, *argKubeconfig, *iotDomain)
+	clientConfig := kube.NewClientConfig(cfg.Kubernetes.Apiserver, cfg.Kubernetes.Kubeconfig, cfg.Kubernetes.Domain)
 
 	// Create a client for the kubernetes apis
-	tprClient := kube.NewDynamicClient(config)
+	tprClient := kube.NewDynamicClient(clientConfig)
 
 	// Create api installer
 	installer := api.APIInstaller{Root: rootPath, Version: v1.APIVersion}
 
-	// Create api proxy TODO: poll server and check if address is correct
-	serverProxy := proxy.NewProxy(tprClient, config.Host)
+	// Create api proxies, both authenticated with the client config
+	serverProxy := proxy.NewProxy(tprClient, clientConfig, store)
+
+	clientset := kube.NewClientset(clientConfig)
+
+	// Serve lists and watches of devices from caches kept by one upstream watch per resource
+	caches := watchcache.NewCaches(tprClient, clientset.CoreV1(), cfg.WatchCache.HistorySize,
+		cfg.WatchCache.Buffer)
 
 	// Create service factory
-	serviceFactory := handler.NewServiceFactory(serverProxy, *iotDomain)
+	serviceFactory := handler.NewServiceFactory(serverProxy, caches, clientset, store)
+
+	// Authenticate registered devices by client certificates or device tokens and new devices by bootstrap
+	// tokens
+	authenticator := auth.NewAuthenticator(clientset, caches.Devices, store)
 
-	ws := installer.NewWebService()
+	// Cap requests of every address ahead of authentication and of every device and tenant after it, so
+	// misbehaving kubelets don't reach the kubernetes apiserver
+	limiter := ratelimit.NewLimiter(store)
+
+	ws := installer.NewWebService(limiter.AddressFilter, authenticator.Filter, auth.DeviceFilter,
+		limiter.Filter)
 	installer.Install(ws, serviceFactory.GetRegisteredServices())
 
+	// Devices request their certificates the same way kubelets do
+	certificatesInstaller := api.APIInstaller{Root: certificatesRootPath, Version: "v1beta1"}
+	certificatesWs := certificatesInstaller.NewWebService(limiter.AddressFilter, authenticator.Filter,
+		limiter.Filter)
+	certificatesInstaller.Install(certificatesWs, serviceFactory.GetCertificateServices())
+
 	restful.Add(ws)
-	http.ListenAndServe(fmt.Sprintf(":%d", *argPort), nil)
+	restful.Add(certificatesWs)
+
+	// Expose prometheus metrics next to the API
+	http.Handle(metricsPath, promhttp.Handler())
+
+	// Expose health probes, readiness depends on the kubernetes apiserver, registered types and synced caches
+	http.Handle(healthz.HealthzPath, healthz.NewHandler(healthz.PingCheck))
+	http.Handle(healthz.ReadyzPath, healthz.NewHandler(
+		healthz.NamedCheck("apiserver", func() error { return kube.CheckAPIServer(clientset) }),
+		healthz.NamedCheck("registered-types", func() error {
+			return kube.CheckRegisteredTypes(clientset, cfg.Kubernetes.Domain)
+		}),
+		healthz.NamedCheck("watch-cache", caches.CheckSynced),
+		healthz.NamedCheck("bootstrap-tokens", authenticator.CheckSynced),
+	))
+
+	// Stop accepting requests and drain watch streams on SIGTERM
+	ctx := lifecycle.SetupSignalHandler()
+	caches.Run(ctx.Done())
+	authenticator.Run(ctx.Done())
+	server := &http.Server{Addr: cfg.Listen.Address}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		watch.Drain()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), store.Get().Timeouts.Shutdown.Duration)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logging.Warningf("Shutdown timeout exceeded, closing remaining connections: %s", err.Error())
+			server.Close()
+		}
+	}()
+
+	// Apply safe changes of the config file without restart
+	if len(*argConfig) > 0 {
+		go config.WatchFile(*argConfig, config.ReloadInterval, func() { reloadConfig(store, *argConfig) },
+			ctx.Done())
+	}
+
+	var err error
+	if cfg.Listen.TLS.Enabled() {
+		server.TLSConfig, err = cfg.Listen.TLS.ServerConfig()
+		if err != nil {
+			panic(err.Error())
+		}
+		err = server.ListenAndServeTLS(cfg.Listen.TLS.CertFile, cfg.Listen.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		panic(err.Error())
+	}
+	<-shutdownDone
+	logging.Infof("Server stopped")
+}
+
+// loadConfig reads config file and applies command line flags on top of it.
+func loadConfig(path string) (*config.ApiserverConfig, error) {
+	cfg, err := config.LoadApiserverConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	flags.String("config", path, "")
+	cfg.AddFlags(flags)
+	flags.AddGoFlagSet(flag.CommandLine)
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// reloadConfig applies changed config file. Invalid configs are rejected and the current one is kept.
+func reloadConfig(store *config.ApiserverStore, path string) {
+	updated, err := loadConfig(path)
+	if err != nil {
+		logging.Errorf("Rejected changed config: %s", err.Error())
+		return
+	}
+
+	reloaded, ignored := store.Get().Reload(updated)
+	if len(ignored) > 0 {
+		logging.Warningf("Changes of %s are not applied, they require restart", strings.Join(ignored, ", "))
+	}
+
+	if err := logging.Configure(reloaded.Logging.Level, reloaded.Logging.Format); err != nil {
+		logging.Errorf("Rejected changed config: %s", err.Error())
+		return
+	}
+	store.Set(reloaded)
+	logging.Infof("Reloaded config from %s", path)
 }
@@ -1,52 +1,247 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"net/http"
 	"os"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/controller/leaderelection"
 	"github.com/fest-research/iot-addon/pkg/controller/watch"
+	"github.com/fest-research/iot-addon/pkg/healthz"
 	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/lifecycle"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 )
 
-var (
-	apiserverArg  = pflag.String("apiserver", "", "apiserver adress in http://host:port format")
-	kubeconfigArg = pflag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-	iotDomain     = pflag.String("domain", "fujitsu.com", "custom domain name")
+var configArg = pflag.String("config", "",
+	"path to YAML config file, reloaded on change, command line flags take precedence over it")
+
+const (
+	leaderElectionLockName = "iot-controller"
+	eventComponentName     = "iot-controller"
+	metricsPath            = "/metrics"
 )
 
 func main() {
-	// Read command line arguments.
+	// Read configuration, command line arguments take precedence over the config file.
+	cfg := config.NewControllerConfig()
+	cfg.AddFlags(pflag.CommandLine)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 
+	if len(*configArg) > 0 {
+		loaded, err := loadConfig(*configArg)
+		if err != nil {
+			logging.Fatalf("%s", err.Error())
+		}
+		cfg = loaded
+	} else if err := cfg.Validate(); err != nil {
+		logging.Fatalf("%s", err.Error())
+	}
+	store := config.NewControllerStore(cfg)
+
 	// Setup logger.
-	log.SetOutput(os.Stdout)
-	log.Printf("IoT domain name %s", *iotDomain)
+	if err := logging.Configure(cfg.Logging.Level, cfg.Logging.Format); err != nil {
+		panic(err.Error())
+	}
+	logging.Infof("IoT domain name %s", cfg.Kubernetes.Domain)
+
+	// Stop everything on SIGTERM.
+	ctx := lifecycle.SetupSignalHandler()
+
+	// Apply safe changes of the config file without restart.
+	if len(*configArg) > 0 {
+		go config.WatchFile(*configArg, config.ReloadInterval, func() { reloadConfig(store, *configArg) },
+			ctx.Done())
+	}
 
 	// Read cluster configuration.
-	config := kubernetes.NewClientConfig(*apiserverArg, *kubeconfigArg, *iotDomain)
+	clientConfig := kubernetes.NewClientConfig(cfg.Kubernetes.Apiserver, cfg.Kubernetes.Kubeconfig,
+		cfg.Kubernetes.Domain)
 
 	// Create cluster clients.
-	dynamicClient := kubernetes.NewDynamicClient(config)
-	restClient := kubernetes.NewRESTClient(config)
-	clientset := kubernetes.NewClientset(config)
+	restClient := kubernetes.NewRESTClient(clientConfig)
+	clientset := kubernetes.NewClientset(clientConfig)
 
 	// Register custom types.
-	v1.RegisterType(clientset, v1.TprIotDevice+"."+*iotDomain)
-	v1.RegisterType(clientset, v1.TprIotDaemonSet+"."+*iotDomain)
-	v1.RegisterType(clientset, v1.TprIotPod+"."+*iotDomain)
+	v1.RegisterType(clientset, v1.TprIotDevice+"."+cfg.Kubernetes.Domain)
+	v1.RegisterType(clientset, v1.TprIotDaemonSet+"."+cfg.Kubernetes.Domain)
+	v1.RegisterType(clientset, v1.TprIotPod+"."+cfg.Kubernetes.Domain)
+	v1.RegisterType(clientset, v1.TprIotCertificateRequest+"."+cfg.Kubernetes.Domain)
+
+	// Watch checks are added once the replica starts leading, standbys only check the apiserver.
+	livenessHandler := healthz.NewHandler(healthz.PingCheck)
+	readinessHandler := healthz.NewHandler(
+		healthz.NamedCheck("apiserver", func() error { return kubernetes.CheckAPIServer(clientset) }),
+		healthz.NamedCheck("registered-types", func() error {
+			return kubernetes.CheckRegisteredTypes(clientset, cfg.Kubernetes.Domain)
+		}),
+	)
+
+	// Serve metrics and health probes on every replica, standbys expose them too.
+	http.Handle(metricsPath, promhttp.Handler())
+	http.Handle(healthz.HealthzPath, livenessHandler)
+	http.Handle(healthz.ReadyzPath, readinessHandler)
+	server := &http.Server{Addr: cfg.Listen.Address}
+	go func() {
+		logging.Infof("Serving metrics and health probes on %s", cfg.Listen.Address)
+		var err error
+		if cfg.Listen.TLS.Enabled() {
+			server.TLSConfig, err = cfg.Listen.TLS.ServerConfig()
+			if err != nil {
+				logging.Fatalf("%s", err.Error())
+			}
+			err = server.ListenAndServeTLS(cfg.Listen.TLS.CertFile, cfg.Listen.TLS.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			logging.Fatalf("%s", err.Error())
+		}
+	}()
+	defer server.Close()
 
-	// Start watches.
-	go watch.NewIotDeviceWatcher(dynamicClient, restClient, clientset, *iotDomain).Watch()
-	go watch.NewIotPodWatcher(dynamicClient, restClient, clientset, *iotDomain).Watch()
-	go watch.NewIotDaemonSetWatcher(dynamicClient, restClient, clientset, *iotDomain).Watch()
+	// Create event recorder, so corrections of IoT workloads are visible with "kubectl describe".
+	recorder := kubernetes.NewEventRecorder(clientset, eventComponentName)
+
+	// Load the IoT CA signing device certificates, signing is disabled without it.
+	var signer *certificates.Signer
+	if len(cfg.Certificates.CACertFile) > 0 {
+		var err error
+		signer, err = certificates.NewSigner(cfg.Certificates.CACertFile, cfg.Certificates.CAKeyFile)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	run := func(stopCh <-chan struct{}) {
+		// Create shared informers and watchers. Watchers register their event handlers, so they have to
+		// be created before informers are started.
+		informers := watch.NewIotInformers(restClient, 0)
+		daemonSetWatcher := watch.NewIotDaemonSetWatcher(restClient, informers, recorder)
+		deviceWatcher := watch.NewIotDeviceWatcher(restClient, clientset, informers, daemonSetWatcher, recorder,
+			store)
+		watch.NewIotPodWatcher(informers, daemonSetWatcher)
+		reconciler := watch.NewReconciler(informers, daemonSetWatcher, deviceWatcher,
+			cfg.Timeouts.ResyncPeriod.Duration)
+		certificateRequestWatcher := watch.NewIotCertificateRequestWatcher(restClient, informers, signer,
+			recorder, store)
+		credentialMonitor := watch.NewCredentialMonitor(restClient, clientset, informers, recorder, store)
+		prometheus.MustRegister(watch.NewFleetCollector(informers, store))
+		livenessHandler.AddChecks(informers.WatchChecks(cfg.Timeouts.WatchMaxAge.Duration)...)
+		readinessHandler.AddChecks(informers.SyncedCheck())
+
+		// Start informers and watches. Informers don't take part in shutdown, they only feed the caches.
+		go informers.Run(stopCh)
+
+		var wg sync.WaitGroup
+		for _, start := range []func(){
+			func() { daemonSetWatcher.Watch(cfg.Workers.DaemonSets, stopCh) },
+			func() { deviceWatcher.Watch(cfg.Workers.Devices, stopCh) },
+			func() { reconciler.Run(stopCh) },
+			func() { certificateRequestWatcher.Watch(stopCh) },
+			func() { credentialMonitor.Run(stopCh) },
+		} {
+			wg.Add(1)
+			go func(start func()) {
+				defer wg.Done()
+				start()
+			}(start)
+		}
+
+		<-stopCh
+		shutdownTimeout := store.Get().Timeouts.Shutdown.Duration
+		logging.Infof("Waiting up to %s for in-flight syncs", shutdownTimeout.String())
+		if !lifecycle.WaitTimeout(&wg, shutdownTimeout) {
+			logging.Warningf("Shutdown timeout exceeded, exiting with syncs in progress")
+		}
+	}
+
+	if !cfg.LeaderElection.Enabled {
+		run(ctx.Done())
+		return
+	}
+
+	identity := cfg.LeaderElection.Identity
+	if len(identity) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			panic(err.Error())
+		}
+		identity = hostname
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.Config{
+		Client:           clientset,
+		Namespace:        cfg.LeaderElection.Namespace,
+		Name:             leaderElectionLockName,
+		Identity:         identity,
+		LeaseDuration:    cfg.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:    cfg.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:      cfg.LeaderElection.RetryPeriod.Duration,
+		OnStartedLeading: run,
+		OnStoppedLeading: func() {
+			if ctx.Err() == context.Canceled {
+				logging.Infof("%s stopped leading on shutdown", identity)
+				return
+			}
+
+			// Exit, so watchers of the old leader can't race with the new one. Kubernetes restarts the
+			// container and it becomes a standby.
+			logging.Fatalf("Leader election lost by %s", identity)
+		},
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	elector.Run(ctx.Done())
+}
+
+// loadConfig reads config file and applies command line flags on top of it.
+func loadConfig(path string) (*config.ControllerConfig, error) {
+	cfg, err := config.LoadControllerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	flags.String("config", path, "")
+	cfg.AddFlags(flags)
+	flags.AddGoFlagSet(flag.CommandLine)
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// reloadConfig applies changed config file. Invalid configs are rejected and the current one is kept.
+func reloadConfig(store *config.ControllerStore, path string) {
+	updated, err := loadConfig(path)
+	if err != nil {
+		logging.Errorf("Rejected changed config: %s", err.Error())
+		return
+	}
+
+	reloaded, ignored := store.Get().Reload(updated)
+	if len(ignored) > 0 {
+		logging.Warningf("Changes of %s are not applied, they require restart", strings.Join(ignored, ", "))
+	}
 
-	// Avoid program exit.
-	for {
-		time.Sleep(time.Second)
+	if err := logging.Configure(reloaded.Logging.Level, reloaded.Logging.Format); err != nil {
+		logging.Errorf("Rejected changed config: %s", err.Error())
+		return
 	}
+	store.Set(reloaded)
+	logging.Infof("Reloaded config from %s", path)
 }
@@ -1,21 +1,20 @@
 package v1
 
 import (
-	"log"
-
+	"github.com/fest-research/iot-addon/pkg/logging"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 func RegisterType(clientset *kubernetes.Clientset, resourceName string) {
-	log.Printf("Trying to register %s type\n", resourceName)
+	logging.Debugf("Trying to register %s type", resourceName)
 
 	// Check if resource is already registered.
 	_, err := clientset.ExtensionsV1beta1().ThirdPartyResources().Get(resourceName, v1.GetOptions{})
 
 	if err != nil {
-		log.Printf("Registering new %s type\n", resourceName)
+		logging.Infof("Registering new %s type", resourceName)
 		tpr := &v1beta1.ThirdPartyResource{
 			ObjectMeta: v1.ObjectMeta{
 				Name: resourceName,
@@ -28,10 +27,10 @@ func RegisterType(clientset *kubernetes.Clientset, resourceName string) {
 
 		_, err := clientset.ExtensionsV1beta1().ThirdPartyResources().Create(tpr)
 		if err != nil {
-			log.Printf("Cannot register %s type\n", resourceName)
+			logging.Errorf("Cannot register %s type", resourceName)
 			panic(err.Error())
 		}
 
-		log.Printf("New %s type registered\n", resourceName)
+		logging.Infof("New %s type registered", resourceName)
 	}
 }
@@ -0,0 +1,17 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const DeviceCredentialsKind = "DeviceCredentials"
+
+// DeviceCredentials is served to devices authenticated by device token, so they can switch to the token
+// rotation issued before their current one expires.
+type DeviceCredentials struct {
+	metav1.TypeMeta `json:",inline"`
+	// Token is the new token in "<id>.<secret>" format, empty when the current token is not rotated yet.
+	Token string `json:"token,omitempty"`
+	// Expiration is expiry of the new token or of the current one when it's not rotated yet.
+	Expiration *metav1.Time `json:"expiration,omitempty"`
+}
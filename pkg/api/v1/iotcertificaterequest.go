@@ -0,0 +1,43 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+const (
+	IotCertificateRequestKind = "IotCertificateRequest"
+	IotCertificateRequestType = "iotcertificaterequests"
+)
+
+// IotCertificateRequest stores certificate signing request of a device. Requests are approved by adding
+// Approved condition to the status, the same way as CertificateSigningRequests.
+type IotCertificateRequest struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        metav1.ObjectMeta                            `json:"metadata,omitempty"`
+	Spec            certificates.CertificateSigningRequestSpec   `json:"spec,omitempty"`
+	Status          certificates.CertificateSigningRequestStatus `json:"status,omitempty"`
+}
+
+type IotCertificateRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        metav1.ListMeta         `json:"metadata,omitempty"`
+	Items           []IotCertificateRequest `json:"items"`
+}
+
+func (iotCertificateRequest *IotCertificateRequest) GetObjectKind() schema.ObjectKind {
+	return &iotCertificateRequest.TypeMeta
+}
+
+func (iotCertificateRequest *IotCertificateRequest) GetObjectMeta() metav1.Object {
+	return &iotCertificateRequest.Metadata
+}
+
+func (iotCertificateRequestList *IotCertificateRequestList) GetObjectKind() schema.ObjectKind {
+	return &iotCertificateRequestList.TypeMeta
+}
+
+func (iotCertificateRequestList *IotCertificateRequestList) GetListMeta() metav1.List {
+	return &iotCertificateRequestList.Metadata
+}
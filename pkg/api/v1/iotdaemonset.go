@@ -28,7 +28,7 @@ func (iotDaemonSet *IotDaemonSet) GetObjectKind() schema.ObjectKind {
 	return &iotDaemonSet.TypeMeta
 }
 
-func (iotDaemonSet *IotDaemonSet) GetObjectMeta() *metav1.ObjectMeta {
+func (iotDaemonSet *IotDaemonSet) GetObjectMeta() metav1.Object {
 	return &iotDaemonSet.Metadata
 }
 
@@ -31,7 +31,7 @@ func (iotDevice *IotDevice) GetObjectKind() schema.ObjectKind {
 	return &iotDevice.TypeMeta
 }
 
-func (iotDevice *IotDevice) GetObjectMeta() *metav1.ObjectMeta {
+func (iotDevice *IotDevice) GetObjectMeta() metav1.Object {
 	return &iotDevice.Metadata
 }
 
@@ -28,7 +28,7 @@ func (iotPod *IotPod) GetObjectKind() schema.ObjectKind {
 	return &iotPod.TypeMeta
 }
 
-func (iotPod *IotPod) GetObjectMeta() *metav1.ObjectMeta {
+func (iotPod *IotPod) GetObjectMeta() metav1.Object {
 	return &iotPod.Metadata
 }
 
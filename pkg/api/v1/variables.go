@@ -8,8 +8,45 @@ const (
 	DevicesAll     = "all"
 	Unschedulable  = "unschedulable"
 
+	// DeviceApproval labels IotDevices registered in approval mode. Pending devices are unschedulable until an
+	// operator sets the label to approved. Devices without the label are approved.
+	DeviceApproval   = "approval"
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+
 	APIVersion = "v1"
 
+	// FinalizerOrphan is set on IotDaemonSet deleted with orphaned dependents. Its IotPods are released
+	// before the finalizer is removed.
+	FinalizerOrphan = "orphan"
+	// FinalizerDeleteDependents is set on IotDaemonSet deleted in foreground. Its IotPods are deleted
+	// before the finalizer is removed.
+	FinalizerDeleteDependents = "foregroundDeletion"
+	// FinalizerDeviceCleanup is set on every IotDevice by the controller. IotPods bound to the device are
+	// deleted before the finalizer is removed.
+	FinalizerDeviceCleanup = "iot-controller/device-cleanup"
+
+	// Credential annotations are set on IotDevices by the controller, so operators can see devices close to
+	// expiry of their credentials and devices that failed to rotate them.
+	AnnotationCredentialType    = "iot-controller/credential-type"
+	AnnotationCredentialExpiry  = "iot-controller/credential-expiry"
+	AnnotationCredentialState   = "iot-controller/credential-state"
+	AnnotationCredentialMessage = "iot-controller/credential-message"
+
+	CredentialTypeCertificate = "certificate"
+	CredentialTypeToken       = "token"
+
+	// CredentialStateCurrent means credentials are valid longer than the rotation threshold.
+	CredentialStateCurrent = "Current"
+	// CredentialStateRotationDue means certificate is close to expiry and kubelet has not requested new one.
+	CredentialStateRotationDue = "RotationDue"
+	// CredentialStateRotating means new credentials are requested or issued and the device has not switched yet.
+	CredentialStateRotating = "Rotating"
+	// CredentialStateExpired means all credentials of the device expired.
+	CredentialStateExpired = "Expired"
+	// CredentialStateFailed means rotation failed and the device needs attention.
+	CredentialStateFailed = "Failed"
+
 	NodeKind     ResourceKind = "Node"
 	NodeListKind              = "NodeList"
 	PodKind                   = "Pod"
@@ -18,4 +55,6 @@ const (
 	TprIotDevice    = "iot-device"
 	TprIotDaemonSet = "iot-daemon-set"
 	TprIotPod       = "iot-pod"
+
+	TprIotCertificateRequest = "iot-certificate-request"
 )
@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/common"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	certificatesapi "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+const defaultCertificateRequestPrefix = "csr-"
+
+var (
+	iotCertificateRequestResource = &apimachinery.APIResource{Name: v1.IotCertificateRequestType, Namespaced: true}
+	certificateSigningRequests    = schema.GroupResource{Group: "certificates.k8s.io",
+		Resource: "certificatesigningrequests"}
+)
+
+type CertificateService struct {
+	proxy                 proxy.IServerProxy
+	cache                 *watchcache.Cache
+	certificateController controller.ICertificateController
+	store                 *config.ApiserverStore
+}
+
+// NewCertificateService creates the API service for translating k8s CertificateSigningRequests into
+// IotCertificateRequests. Bootstrap tokens and devices only see their own requests. Lists and watches are
+// served from the watch cache.
+func NewCertificateService(proxy proxy.IServerProxy, cache *watchcache.Cache,
+	controller controller.ICertificateController, store *config.ApiserverStore) CertificateService {
+	return CertificateService{proxy: proxy, cache: cache, certificateController: controller, store: store}
+}
+
+// Register creates the api routes for the CertificateService.
+func (this CertificateService) Register(ws *restful.WebService) {
+	// Create certificate signing request
+	ws.Route(
+		ws.Method("POST").
+			Path("/certificatesigningrequests").
+			To(this.createRequest).
+			Returns(http.StatusCreated, "Created", nil).
+			Writes(nil),
+	)
+
+	// Get certificate signing request
+	ws.Route(
+		ws.Method("GET").
+			Path("/certificatesigningrequests/{name}").
+			To(this.getRequest).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+
+	// List certificate signing requests
+	ws.Route(
+		ws.Method("GET").
+			Path("/certificatesigningrequests").
+			To(this.listRequests).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+
+	// Watch certificate signing requests
+	ws.Route(
+		ws.Method("GET").
+			Path("/watch/certificatesigningrequests").
+			To(this.watchRequests).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+}
+
+func (this CertificateService) createRequest(req *restful.Request, resp *restful.Response) {
+	identity, ok := this.authorize(req, resp)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+
+	csr := &certificatesapi.CertificateSigningRequest{}
+	if err := encoding.DecodeBody(req.Request, body, csr); err != nil {
+		handleStatusError(resp, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	_, device, err := certificates.ParseDeviceRequest(csr.Spec.Request)
+	if err != nil {
+		handleStatusError(resp, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	// Devices may only renew their own certificates and bound tokens only request certificate of their device
+	allowedDevice := identity.Device
+	if identity.BootstrapToken != nil {
+		allowedDevice = identity.BootstrapToken.Device
+	}
+	if len(allowedDevice) > 0 && device != allowedDevice {
+		handleStatusError(resp, errors.NewForbidden(certificateSigningRequests, csr.Name,
+			fmt.Errorf("%s may not request certificate of device %s", identity.Username, device)))
+		return
+	}
+
+	// Requester is set by the server, never trusted from the request
+	csr.Spec.Username = identity.Username
+	csr.Spec.Groups = identity.Groups
+	csr.Spec.UID = ""
+	csr.Status = certificatesapi.CertificateSigningRequestStatus{}
+	csr.ObjectMeta.Namespace = this.store.Get().Authentication.CertificateRequestNamespace
+	if len(csr.Name) == 0 {
+		prefix := csr.GenerateName
+		if len(prefix) == 0 {
+			prefix = defaultCertificateRequestPrefix
+		}
+		csr.Name = prefix + string(common.NewUUID())
+	}
+
+	unstructuredRequest, err := this.certificateController.ToUnstructured(csr)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+
+	unstructuredRequest, err = this.proxy.Create(iotCertificateRequestResource, csr.Namespace, unstructuredRequest)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	created, err := this.certificateController.FromUnstructured(unstructuredRequest)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+
+	resp.WriteHeaderAndJson(http.StatusCreated, this.certificateController.ToCertificateSigningRequest(created),
+		restful.MIME_JSON)
+}
+
+func (this CertificateService) getRequest(req *restful.Request, resp *restful.Response) {
+	identity, ok := this.authorize(req, resp)
+	if !ok {
+		return
+	}
+
+	namespace := this.store.Get().Authentication.CertificateRequestNamespace
+	name := req.PathParameter("name")
+
+	obj, err := this.proxy.Get(iotCertificateRequestResource, namespace, name)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	request, err := this.certificateController.FromUnstructured(obj)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+
+	// Requests of others are reported as missing, so their names don't leak
+	if !isOwnRequest(identity, request) {
+		handleStatusError(resp, errors.NewNotFound(certificateSigningRequests, name))
+		return
+	}
+
+	resp.WriteHeaderAndJson(http.StatusOK, this.certificateController.ToCertificateSigningRequest(request),
+		restful.MIME_JSON)
+}
+
+func (this CertificateService) listRequests(req *restful.Request, resp *restful.Response) {
+	identity, ok := this.authorize(req, resp)
+	if !ok {
+		return
+	}
+
+	options, err := parseListOptions(req)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	namespace := this.store.Get().Authentication.CertificateRequestNamespace
+	page, err := this.cache.List(namespace, identity.Username, nil, options)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	requestList := &v1.IotCertificateRequestList{Items: make([]v1.IotCertificateRequest, 0, len(page.Objects))}
+	for _, obj := range page.Objects {
+		requestList.Items = append(requestList.Items, *obj.(*v1.IotCertificateRequest))
+	}
+
+	csrList := this.certificateController.ToCertificateSigningRequestList(requestList)
+	writeList(req, resp, csrList, csrList.Items, page)
+}
+
+func (this CertificateService) watchRequests(req *restful.Request, resp *restful.Response) {
+	identity, ok := this.authorize(req, resp)
+	if !ok {
+		return
+	}
+
+	// Requests are cached by their requester, so only own requests are watched
+	namespace := this.store.Get().Authentication.CertificateRequestNamespace
+	watcher, err := this.cache.Watch(namespace, identity.Username, watch.WatchResourceVersion(req), nil)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	defer watcher.Stop()
+
+	notifier := watch.NewNotifier("certificatesigningrequests", this.store.Get().Timeouts.Watch.Duration)
+
+	notifier.Register(this.certificateController)
+	err = notifier.Start(watcher, req, resp)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+}
+
+// authorize returns identity of the request. Anonymous requests may not request certificates.
+func (this CertificateService) authorize(req *restful.Request, resp *restful.Response) (*auth.Identity, bool) {
+	identity := auth.GetIdentity(req)
+	if identity == nil {
+		handleStatusError(resp, errors.NewForbidden(certificateSigningRequests, "",
+			fmt.Errorf("anonymous requests may not request certificates")))
+		return nil, false
+	}
+	return identity, true
+}
+
+func isOwnRequest(identity *auth.Identity, request *v1.IotCertificateRequest) bool {
+	return request.Spec.Username == identity.Username
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type CredentialService struct {
+	clientset *kubernetes.Clientset
+	store     *config.ApiserverStore
+}
+
+// NewCredentialService creates the API service delivering rotated device tokens. Devices with client
+// certificates rotate them by certificate signing requests instead.
+func NewCredentialService(clientset *kubernetes.Clientset, store *config.ApiserverStore) CredentialService {
+	return CredentialService{clientset: clientset, store: store}
+}
+
+// Register creates the api routes for the CredentialService.
+func (this CredentialService) Register(ws *restful.WebService) {
+	// Get rotated device token
+	ws.Route(
+		ws.Method("GET").
+			Path("/nodes/{node}/credentials").
+			To(this.getCredentials).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+}
+
+func (this CredentialService) getCredentials(req *restful.Request, resp *restful.Response) {
+	identity := auth.GetIdentity(req)
+	if identity == nil || identity.DeviceToken == nil {
+		handleStatusError(resp, errors.NewBadRequest("only devices authenticated by device token have credentials"))
+		return
+	}
+
+	current := identity.DeviceToken
+	credentials := &v1.DeviceCredentials{
+		TypeMeta: apimachinery.TypeMeta{APIVersion: v1.APIVersion, Kind: v1.DeviceCredentialsKind},
+	}
+
+	if len(current.ReplacedBy) == 0 {
+		credentials.Expiration = toTime(current)
+		resp.WriteHeaderAndJson(http.StatusOK, credentials, restful.MIME_JSON)
+		return
+	}
+
+	namespace := this.store.Get().Authentication.BootstrapTokenNamespace
+	secret, err := this.clientset.CoreV1().Secrets(namespace).Get(
+		certificates.BootstrapTokenSecretName(current.ReplacedBy), apimachinery.GetOptions{})
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	replacement, err := certificates.ParseBootstrapTokenSecret(secret)
+	if err != nil || !replacement.Authentication || replacement.Device != current.Device {
+		handleInternalServerError(resp, fmt.Errorf("invalid replacement %s of device token %s",
+			current.ReplacedBy, current.ID))
+		return
+	}
+
+	credentials.Token = replacement.ID + "." + string(secret.Data[certificates.BootstrapTokenSecretKey])
+	credentials.Expiration = toTime(replacement)
+	resp.WriteHeaderAndJson(http.StatusOK, credentials, restful.MIME_JSON)
+}
+
+func toTime(token *certificates.BootstrapToken) *apimachinery.Time {
+	if token.Expiration.IsZero() {
+		return nil
+	}
+	expiration := apimachinery.NewTime(token.Expiration)
+	return &expiration
+}
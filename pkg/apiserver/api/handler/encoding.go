@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// writeObject writes the object as protobuf if the client accepts it, otherwise as JSON.
+func writeObject(req *restful.Request, resp *restful.Response, status int, obj runtime.Object) {
+	if !encoding.AcceptsProtobuf(req.Request) {
+		resp.WriteHeaderAndJson(status, obj, restful.MIME_JSON)
+		return
+	}
+
+	data, err := encoding.EncodeProtobuf(obj)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+	writeProtobuf(resp, status, data)
+}
+
+func writeProtobuf(resp *restful.Response, status int, data []byte) {
+	resp.AddHeader("Content-Type", encoding.ContentTypeProtobuf)
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
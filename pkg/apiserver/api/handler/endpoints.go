@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+type EndpointsService struct {
+	cache               *watchcache.Cache
+	endpointsController controller.IEndpointsController
+	store               *config.ApiserverStore
+}
+
+// NewEndpointsService creates the API service serving k8s Endpoints of the device namespace, rewritten so
+// edge pods can reach backends in the cluster. Endpoints are read from the watch cache.
+func NewEndpointsService(cache *watchcache.Cache, controller controller.IEndpointsController,
+	store *config.ApiserverStore) EndpointsService {
+	return EndpointsService{cache: cache, endpointsController: controller, store: store}
+}
+
+// Register creates the API routes for the EndpointsService.
+func (this EndpointsService) Register(ws *restful.WebService) {
+	// List endpoints
+	for _, path := range []string{"/endpoints", "/namespaces/{namespace}/endpoints"} {
+		ws.Route(
+			ws.Method("GET").
+				Path(path).
+				To(this.listEndpoints).
+				Returns(http.StatusOK, "OK", nil).
+				Writes(nil),
+		)
+	}
+
+	// Get endpoints
+	ws.Route(
+		ws.Method("GET").
+			Path("/namespaces/{namespace}/endpoints/{endpoints}").
+			To(this.getEndpoints).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+
+	// Watch endpoints
+	for _, path := range []string{"/watch/endpoints", "/watch/namespaces/{namespace}/endpoints"} {
+		ws.Route(
+			ws.Method("GET").
+				Path(path).
+				To(this.watchEndpoints).
+				Returns(http.StatusOK, "OK", nil).
+				Writes(nil),
+		)
+	}
+}
+
+func (this EndpointsService) getEndpoints(req *restful.Request, resp *restful.Response) {
+	namespace, err := getRequestNamespace(this.store, req, "endpoints")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	obj, err := this.cache.Get(namespace, req.PathParameter("endpoints"))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	writeObject(req, resp, http.StatusOK, this.endpointsController.ToEndpoints(obj.(*apiv1.Endpoints)))
+}
+
+func (this EndpointsService) listEndpoints(req *restful.Request, resp *restful.Response) {
+	namespace, err := getRequestNamespace(this.store, req, "endpoints")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	selector, err := parseListSelector(req, objectMetaFieldSet(apiv1.Endpoints{}.ObjectMeta))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	options, err := parseListOptions(req)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	page, err := this.cache.List(namespace, "", this.filter(selector), options)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	endpoints := make([]apiv1.Endpoints, 0, len(page.Objects))
+	for _, obj := range page.Objects {
+		endpoints = append(endpoints, *obj.(*apiv1.Endpoints))
+	}
+
+	endpointsList := this.endpointsController.ToEndpointsList(endpoints)
+	writeList(req, resp, endpointsList, endpointsList.Items, page)
+}
+
+func (this EndpointsService) watchEndpoints(req *restful.Request, resp *restful.Response) {
+	namespace, err := getRequestNamespace(this.store, req, "endpoints")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	selector, err := parseListSelector(req, objectMetaFieldSet(apiv1.Endpoints{}.ObjectMeta))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	watcher, err := this.cache.Watch(namespace, "", watch.WatchResourceVersion(req), this.filter(selector))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	defer watcher.Stop()
+
+	notifier := watch.NewNotifier("endpoints", this.store.Get().Timeouts.Watch.Duration)
+
+	notifier.Register(this.endpointsController)
+	notifier.EnableProtobuf()
+	err = notifier.Start(watcher, req, resp)
+	if err != nil {
+		handleInternalServerError(resp, err)
+		return
+	}
+}
+
+// filter returns filter of Endpoints matching the selector, nil if it selects all of them.
+func (this EndpointsService) filter(selector listSelector) watchcache.FilterFunc {
+	if selector.labels.Empty() && selector.fields.Empty() {
+		return nil
+	}
+
+	return func(obj runtime.Object) bool {
+		endpoints := obj.(*apiv1.Endpoints)
+		return selector.Matches(labels.Set(endpoints.Labels), objectMetaFieldSet(endpoints.ObjectMeta))
+	}
+}
@@ -4,10 +4,26 @@ import (
 	"net/http"
 
 	"github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful/log"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 func handleInternalServerError(response *restful.Response, err error) {
-	log.Print(err)
+	logging.Errorf("%s", err.Error())
 	response.WriteError(http.StatusInternalServerError, err)
 }
+
+// handleStatusError writes kubernetes API errors as Status with their code, so clients can tell why the
+// request failed. Other errors are internal server errors.
+func handleStatusError(response *restful.Response, err error) {
+	apiStatus, ok := err.(errors.APIStatus)
+	if !ok {
+		handleInternalServerError(response, err)
+		return
+	}
+
+	status := apiStatus.Status()
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	response.WriteHeaderAndJson(int(status.Code), status, restful.MIME_JSON)
+}
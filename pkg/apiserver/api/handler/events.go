@@ -1,19 +1,28 @@
 package handler
 
 import (
+	"io/ioutil"
 	"net/http"
 
 	"github.com/emicklei/go-restful"
-	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"github.com/fest-research/iot-addon/pkg/apiserver/events"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
 )
 
 type EventService struct {
-	proxy proxy.IRawProxy
+	aggregator *events.Aggregator
+	store      *config.ApiserverStore
 }
 
-// NewEventService creates the API service for handling k8s events.
-func NewEventService(proxy proxy.IRawProxy) EventService {
-	return EventService{proxy: proxy}
+// NewEventService creates the API service for handling k8s events. Events are written by the aggregator
+// into the namespace of the device.
+func NewEventService(aggregator *events.Aggregator, store *config.ApiserverStore) EventService {
+	return EventService{aggregator: aggregator, store: store}
 }
 
 // Register creates the API routes for the EventService.
@@ -39,21 +48,53 @@ func (this EventService) Register(ws *restful.WebService) {
 }
 
 func (this EventService) createEvent(req *restful.Request, resp *restful.Response) {
-	response, err := this.proxy.Post(req)
+	body, err := ioutil.ReadAll(req.Request.Body)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+
+	event := &apiv1.Event{}
+	if err := encoding.DecodeBody(req.Request, body, event); err != nil {
+		handleStatusError(resp, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	result, err := this.aggregator.Create(this.getDevice(req, event), getDeviceNamespace(this.store, req), event)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+	this.writeEvent(req, resp, http.StatusCreated, result)
 }
 
 func (this EventService) updateEvent(req *restful.Request, resp *restful.Response) {
-	response, err := this.proxy.Patch(req)
+	patch, err := ioutil.ReadAll(req.Request.Body)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+
+	result, err := this.aggregator.Update(this.getDevice(req, nil), getDeviceNamespace(this.store, req),
+		req.PathParameter("event"), patch)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+	this.writeEvent(req, resp, http.StatusOK, result)
+}
+
+// getDevice returns the device sending the request. Anonymous devices are known by source of their events,
+// which only names the device of the events, their namespace is the default one.
+func (this EventService) getDevice(req *restful.Request, event *apiv1.Event) string {
+	if device := auth.GetDevice(req); len(device) > 0 || event == nil {
+		return device
+	}
+	return event.Source.Host
+}
+
+func (this EventService) writeEvent(req *restful.Request, resp *restful.Response, status int,
+	event *apiv1.Event) {
+	event.TypeMeta = apimachinery.TypeMeta{APIVersion: "v1", Kind: "Event"}
+	writeObject(req, resp, status, event)
 }
@@ -2,22 +2,32 @@ package handler
 
 import (
 	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/events"
 	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/client-go/kubernetes"
 )
 
 type IServiceFactory interface {
 	GetRegisteredServices() []IService
+	GetCertificateServices() []IService
 }
 
 type ServiceFactory struct {
-	proxy     *proxy.Proxy
-	services  []IService
-	iotDomain string
+	proxy               *proxy.Proxy
+	caches              *watchcache.Caches
+	clientset           *kubernetes.Clientset
+	services            []IService
+	certificateServices []IService
+	store               *config.ApiserverStore
 }
 
 // NewServiceFactory creates a factory that registers all all supported services.
-func NewServiceFactory(proxy *proxy.Proxy, iotDomain string) *ServiceFactory {
-	factory := &ServiceFactory{proxy: proxy, services: make([]IService, 0), iotDomain: iotDomain}
+func NewServiceFactory(proxy *proxy.Proxy, caches *watchcache.Caches, clientset *kubernetes.Clientset,
+	store *config.ApiserverStore) *ServiceFactory {
+	factory := &ServiceFactory{proxy: proxy, caches: caches, clientset: clientset, services: make([]IService, 0),
+		certificateServices: make([]IService, 0), store: store}
 	factory.init()
 
 	return factory
@@ -28,23 +38,43 @@ func (this *ServiceFactory) registerService(service IService) {
 }
 
 func (this *ServiceFactory) init() {
+	// Domain requires restart, so controllers can keep it
+	iotDomain := this.store.Get().Kubernetes.Domain
+
 	// Version service
 	this.registerService(NewVersionService(this.proxy.RawProxy))
 
 	// Node service
-	this.registerService(NewNodeService(this.proxy.ServerProxy, controller.NewNodeController(this.iotDomain)))
+	this.registerService(NewNodeService(this.proxy.ServerProxy, this.caches.Devices, controller.NewNodeController(iotDomain),
+		this.store))
 
 	// Pod service
-	this.registerService(NewPodService(this.proxy.ServerProxy, controller.NewPodController(this.iotDomain)))
+	this.registerService(NewPodService(this.proxy.ServerProxy, this.caches.Pods,
+		controller.NewPodController(iotDomain, this.store), this.store))
 
 	// Event service
-	this.registerService(NewEventService(this.proxy.RawProxy))
+	this.registerService(NewEventService(events.NewAggregator(this.clientset.CoreV1(), this.caches.Devices, iotDomain,
+		this.store), this.store))
+
+	// Kubernetes service and endpoints service, limited to the device namespace
+	this.registerService(NewKubeService(this.caches.Services, controller.NewServiceController(), this.store))
+	this.registerService(NewEndpointsService(this.caches.Endpoints,
+		controller.NewEndpointsController(this.caches.Services, this.store), this.store))
+
+	// Credential service
+	this.registerService(NewCredentialService(this.clientset, this.store))
 
-	// Kubernetes service
-	this.registerService(NewKubeService(this.proxy.RawProxy))
+	// Certificate service, served under the certificates API group
+	this.certificateServices = append(this.certificateServices, NewCertificateService(this.proxy.ServerProxy,
+		this.caches.CertificateRequests, controller.NewCertificateController(iotDomain), this.store))
 }
 
 // GetRegisteredServices returns the list of all API services that are currently registered.
 func (this *ServiceFactory) GetRegisteredServices() []IService {
 	return this.services
 }
+
+// GetCertificateServices returns API services of the certificates.k8s.io group.
+func (this *ServiceFactory) GetCertificateServices() []IService {
+	return this.certificateServices
+}
@@ -1,19 +1,22 @@
 package handler
 
 import (
-	"fmt"
 	"io/ioutil"
 	"net/http"
 
 	"github.com/emicklei/go-restful"
 	"github.com/fest-research/iot-addon/pkg/api/v1"
 	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
 	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
 	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
 	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/json"
 	apiv1 "k8s.io/client-go/pkg/api/v1"
 )
@@ -22,12 +25,16 @@ var iotDeviceResource = &apimachinery.APIResource{Name: v1.IotDeviceType, Namesp
 
 type NodeService struct {
 	proxy          proxy.IServerProxy
+	cache          *watchcache.Cache
 	nodeController controller.INodeController
+	store          *config.ApiserverStore
 }
 
-// NewNodeService creates the API service for translating k8s Nodes into IotDevices.
-func NewNodeService(proxy proxy.IServerProxy, controller controller.INodeController) NodeService {
-	return NodeService{proxy: proxy, nodeController: controller}
+// NewNodeService creates the API service for translating k8s Nodes into IotDevices. Devices are read from
+// the watch cache, registrations and status updates go to the kubernetes apiserver.
+func NewNodeService(proxy proxy.IServerProxy, cache *watchcache.Cache, controller controller.INodeController,
+	store *config.ApiserverStore) NodeService {
+	return NodeService{proxy: proxy, cache: cache, nodeController: controller, store: store}
 }
 
 // Register creates the api routes for the NodeService.
@@ -72,7 +79,16 @@ func (this NodeService) Register(ws *restful.WebService) {
 	ws.Route(
 		ws.Method("PATCH").
 			Path("/nodes/{node}/status").
-			To(this.updateStatus).
+			To(this.patchStatus).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+
+	// Patch node - newest k8s versions patch node metadata, only status is applied
+	ws.Route(
+		ws.Method("PATCH").
+			Path("/nodes/{node}").
+			To(this.patchStatus).
 			Returns(http.StatusOK, "OK", nil).
 			Writes(nil),
 	)
@@ -89,8 +105,7 @@ func (this NodeService) Register(ws *restful.WebService) {
 
 // TODO: refactor this method
 func (this NodeService) createNode(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
+	namespace := getDeviceNamespace(this.store, req)
 
 	// Read post request
 	body, err := ioutil.ReadAll(req.Request.Body)
@@ -101,17 +116,29 @@ func (this NodeService) createNode(req *restful.Request, resp *restful.Response)
 
 	// Unmarshal request to a node object
 	node := &apiv1.Node{}
-	err = json.Unmarshal(body, node)
+	err = encoding.DecodeBody(req.Request, body, node)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 
+	// The name isn't part of the path, so devices are checked here
+	if err := checkNodeDevice(req, node.Name); err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
 	// TODO: pass the namespace in Transform() when it's refactored
 	node.ObjectMeta.Namespace = namespace
 
 	unstructuredIotDevice, err := this.proxy.Get(iotDeviceResource, namespace, node.Name)
-	if err != nil {
+	if err != nil && !errors.IsNotFound(err) {
+		handleStatusError(resp, err)
+		return
+	}
+	if errors.IsNotFound(err) {
+		this.admit(req, node)
+
 		// Transform the node to an unstructured iot device
 		unstructuredIotDevice, err = this.nodeController.ToUnstructured(node)
 		if err != nil {
@@ -139,133 +166,209 @@ func (this NodeService) createNode(req *restful.Request, resp *restful.Response)
 }
 
 func (this NodeService) getNode(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
+	namespace := getDeviceNamespace(this.store, req)
 	name := req.PathParameter("node")
 
-	obj, err := this.proxy.Get(iotDeviceResource, namespace, name)
+	obj, err := this.cache.Get(namespace, name)
+	if errors.IsNotFound(err) {
+		// Devices registered moments ago may not be cached yet
+		obj, err = this.getUpstream(namespace, name)
+	}
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	response, err := this.nodeController.ToBytes(obj)
+	writeObject(req, resp, http.StatusOK, this.nodeController.ToNode(obj.(*v1.IotDevice)))
+}
+
+func (this NodeService) getUpstream(namespace, name string) (runtime.Object, error) {
+	obj, err := this.proxy.Get(iotDeviceResource, namespace, name)
 	if err != nil {
-		handleInternalServerError(resp, err)
-		return
+		return nil, err
 	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	marshalledIotDevice, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	iotDevice := &v1.IotDevice{}
+	if err := json.Unmarshal(marshalledIotDevice, iotDevice); err != nil {
+		return nil, err
+	}
+	return iotDevice, nil
 }
 
 func (this NodeService) listNodes(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
+	namespace := getDeviceNamespace(this.store, req)
 
-	fieldSelector, err := this.parseFieldSelector(req)
+	selector, err := parseListSelector(req, nodeFieldSet(&apiv1.Node{}))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	obj, err := this.proxy.List(iotDeviceResource, namespace, &apimachinery.ListOptions{})
+	options, err := parseListOptions(req)
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	iotDeviceList := obj.(*v1.IotDeviceList)
+	// Devices are cached by name, so kubelets only read their own node
+	page, err := this.cache.List(namespace, getNodesDevice(req, selector), this.filter(selector), options)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
 
-	for i, device := range iotDeviceList.Items {
-		for _, req := range fieldSelector.Requirements() {
-			if device.Metadata.Name == req.Value {
-				iotDeviceList.Items = []v1.IotDevice{iotDeviceList.Items[i]}
-				break
-			}
-		}
+	iotDeviceList := &v1.IotDeviceList{Items: make([]v1.IotDevice, 0, len(page.Objects))}
+	for _, obj := range page.Objects {
+		iotDeviceList.Items = append(iotDeviceList.Items, *obj.(*v1.IotDevice))
 	}
 
 	nodeList := this.nodeController.ToNodeList(iotDeviceList)
-	response, _ := json.Marshal(nodeList)
-
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	writeList(req, resp, nodeList, nodeList.Items, page)
 }
 
 func (this NodeService) updateStatus(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
-	name := req.PathParameter("node")
-	unstructuredIotDevice := &unstructured.Unstructured{}
-
-	// Read post request
 	body, err := ioutil.ReadAll(req.Request.Body)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 
-	// Unmarshal request to a node object
+	// Kubelets send the whole node, only its status is taken
 	node := &apiv1.Node{}
-	err = json.Unmarshal(body, node)
-	if err != nil {
-		handleInternalServerError(resp, err)
+	if err := encoding.DecodeBody(req.Request, body, node); err != nil {
+		handleStatusError(resp, errors.NewBadRequest(err.Error()))
 		return
 	}
 
-	iotDevice := this.nodeController.ToIotDevice(node)
-	marshalledIotDevice, err := json.Marshal(iotDevice)
-	if err != nil {
-		handleInternalServerError(resp, err)
-		return
-	}
+	this.writeStatus(req, resp, func(*apiv1.Node) (*apiv1.NodeStatus, error) {
+		return &node.Status, nil
+	})
+}
 
-	// Update the IoTDevice
-	unstructuredIotDevice, err = this.proxy.Patch(iotDeviceResource, namespace, name, types.MergePatchType, marshalledIotDevice)
+func (this NodeService) patchStatus(req *restful.Request, resp *restful.Response) {
+	patchType, body, err := readPatch(req)
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	// Transform response back to unstructured node
-	response, err := this.nodeController.ToBytes(unstructuredIotDevice)
+	this.writeStatus(req, resp, func(current *apiv1.Node) (*apiv1.NodeStatus, error) {
+		patched := &apiv1.Node{}
+		if err := applyPatch(current, patchType, body, patched); err != nil {
+			return nil, err
+		}
+		return &patched.Status, nil
+	})
+}
+
+// writeStatus sets status returned by fn for the node as served to the kubelet on the IotDevice. Spec and
+// metadata of the IotDevice are kept, so devices can't approve or schedule themselves.
+func (this NodeService) writeStatus(req *restful.Request, resp *restful.Response,
+	fn func(*apiv1.Node) (*apiv1.NodeStatus, error)) {
+	namespace := getDeviceNamespace(this.store, req)
+	name := req.PathParameter("node")
+
+	var updated *v1.IotDevice
+	err := retryOnConflict(func() error {
+		obj, err := this.getUpstream(namespace, name)
+		if err != nil {
+			return err
+		}
+
+		iotDevice := obj.(*v1.IotDevice)
+		status, err := fn(this.nodeController.ToNode(iotDevice))
+		if err != nil {
+			return err
+		}
+		iotDevice.Status = *status
+
+		unstructuredIotDevice, err := toUnstructured(iotDevice)
+		if err != nil {
+			return err
+		}
+
+		unstructuredIotDevice, err = this.proxy.Update(iotDeviceResource, namespace, unstructuredIotDevice)
+		if err != nil {
+			return err
+		}
+
+		updated = &v1.IotDevice{}
+		return fromUnstructured(unstructuredIotDevice, updated)
+	})
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	writeObject(req, resp, http.StatusOK, this.nodeController.ToNode(updated))
 }
 
 func (this NodeService) watchNodes(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
+	namespace := getDeviceNamespace(this.store, req)
 
-	watcher, err := this.proxy.Watch(iotDeviceResource, namespace, &apimachinery.ListOptions{})
+	selector, err := parseListSelector(req, nodeFieldSet(&apiv1.Node{}))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
+		return
+	}
+
+	watcher, err := this.cache.Watch(namespace, getNodesDevice(req, selector), watch.WatchResourceVersion(req),
+		this.filter(selector))
+	if err != nil {
+		handleStatusError(resp, err)
 		return
 	}
 
 	defer watcher.Stop()
 
-	notifier := watch.NewNotifier()
+	notifier := watch.NewNotifier("nodes", this.store.Get().Timeouts.Watch.Duration)
 
 	notifier.Register(this.nodeController)
-	err = notifier.Start(watcher, resp)
+	notifier.EnableProtobuf()
+	notifier.EnableDelta()
+	err = notifier.Start(watcher, req, resp)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 }
 
-func (this NodeService) parseFieldSelector(req *restful.Request) (fields.Selector, error) {
-	selectorString := req.QueryParameter("fieldSelector")
-	selector, err := fields.ParseSelector(selectorString)
-	if err != nil {
-		return nil, fmt.Errorf("[pod service] failed to parse field selector: %s", err)
+// filter returns filter of IotDevices matching the selector as they are served to kubelets. Nodes selected
+// by name are selected by the cache itself.
+func (this NodeService) filter(selector listSelector) watchcache.FilterFunc {
+	if selector.SelectsOnly("metadata.name") {
+		return nil
+	}
+
+	return func(obj runtime.Object) bool {
+		node := this.nodeController.ToNode(obj.(*v1.IotDevice))
+		return selector.Matches(labels.Set(node.Labels), nodeFieldSet(node))
+	}
+}
+
+// admit sets approval label of a device registering itself. In approval mode devices matching no allow-list
+// rule wait for an operator as pending. Labels sent by the device are never trusted.
+func (this NodeService) admit(req *restful.Request, node *apiv1.Node) {
+	delete(node.ObjectMeta.Labels, v1.DeviceApproval)
+
+	admission := this.store.Get().Admission
+	if admission.Mode != config.AdmissionApproval {
+		return
+	}
+
+	approval := v1.ApprovalPending
+	if admission.IsAllowed(node.Name, node.Status.NodeInfo) {
+		approval = v1.ApprovalApproved
+	}
+
+	if node.ObjectMeta.Labels == nil {
+		node.ObjectMeta.Labels = make(map[string]string)
 	}
-	return selector, nil
+	node.ObjectMeta.Labels[v1.DeviceApproval] = approval
+	logging.RequestLogger(req).Infof("[Node service] Registering device %s as %s", node.Name, approval)
 }
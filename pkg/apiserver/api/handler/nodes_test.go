@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeProxy keeps objects created through it by namespace and name. Get fails with getErr if it's set.
+type fakeProxy struct {
+	proxy.IServerProxy
+
+	objects map[string]*unstructured.Unstructured
+	getErr  error
+}
+
+func newFakeProxy() *fakeProxy {
+	return &fakeProxy{objects: make(map[string]*unstructured.Unstructured)}
+}
+
+func (f *fakeProxy) Get(resource *metav1.APIResource, namespace, name string) (*unstructured.Unstructured,
+	error) {
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	obj, ok := f.objects[namespace+"/"+name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: resource.Name}, name)
+	}
+	return obj, nil
+}
+
+func (f *fakeProxy) Create(resource *metav1.APIResource, namespace string, obj *unstructured.Unstructured) (
+	*unstructured.Unstructured, error) {
+	f.objects[namespace+"/"+obj.GetName()] = obj
+	return obj, nil
+}
+
+func newTestNodeService(proxy *fakeProxy, cfg *config.ApiserverConfig) NodeService {
+	return NewNodeService(proxy, nil, controller.NewNodeController("fujitsu.com"), config.NewApiserverStore(cfg))
+}
+
+// createTestNode registers the node as the device, anonymously if it's empty, and returns the response.
+func createTestNode(service NodeService, device string, node *apiv1.Node) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(node)
+	httpReq := httptest.NewRequest(http.MethodPost, "/api/v1/nodes", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	req := restful.NewRequest(httpReq)
+	if len(device) > 0 {
+		auth.SetIdentity(req, auth.NewDeviceIdentity(device))
+	}
+
+	recorder := httptest.NewRecorder()
+	service.createNode(req, restful.NewResponse(recorder))
+	return recorder
+}
+
+func newTestNode(name string) *apiv1.Node {
+	node := &apiv1.Node{}
+	node.Name = name
+	return node
+}
+
+func TestCreateNode(t *testing.T) {
+	cases := []struct {
+		name, device, node string
+		getErr             error
+		code               int
+		created            bool
+	}{
+		{"own node", "raspi-1", "raspi-1", nil, http.StatusOK, true},
+		{"other node", "raspi-1", "raspi-2", nil, http.StatusForbidden, false},
+		{"anonymous", "", "raspi-2", nil, http.StatusOK, true},
+		{"failed get", "raspi-1", "raspi-1", errors.NewServiceUnavailable("apiserver is down"),
+			http.StatusServiceUnavailable, false},
+		{"failed get of other error", "raspi-1", "raspi-1", fmt.Errorf("connection refused"),
+			http.StatusInternalServerError, false},
+	}
+
+	for _, c := range cases {
+		fake := newFakeProxy()
+		fake.getErr = c.getErr
+		service := newTestNodeService(fake, config.NewApiserverConfig())
+
+		recorder := createTestNode(service, c.device, newTestNode(c.node))
+		if recorder.Code != c.code {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.code, recorder.Code, recorder.Body.String())
+		}
+		if _, created := fake.objects["default/"+c.node]; created != c.created {
+			t.Errorf("%s: expected created %t, got %t", c.name, c.created, created)
+		}
+	}
+}
+
+func TestCreateNodeAdmission(t *testing.T) {
+	cases := []struct {
+		name      string
+		mode      string
+		allowList []config.AdmissionRule
+		approval  string
+	}{
+		{"open", config.AdmissionOpen, nil, ""},
+		{"not allowed", config.AdmissionApproval, []config.AdmissionRule{{Name: "raspi-2"}}, v1.ApprovalPending},
+		{"allowed by name", config.AdmissionApproval, []config.AdmissionRule{{Name: "raspi-1"}},
+			v1.ApprovalApproved},
+		{"allowed by serial number", config.AdmissionApproval, []config.AdmissionRule{{MachineID: "0001"}},
+			v1.ApprovalApproved},
+		{"other serial number", config.AdmissionApproval,
+			[]config.AdmissionRule{{Name: "raspi-1", MachineID: "0002"}}, v1.ApprovalPending},
+	}
+
+	for _, c := range cases {
+		cfg := config.NewApiserverConfig()
+		cfg.Admission = config.AdmissionConfig{Mode: c.mode, AllowList: c.allowList}
+		fake := newFakeProxy()
+		service := newTestNodeService(fake, cfg)
+
+		// Devices can't approve themselves
+		node := newTestNode("raspi-1")
+		node.Labels = map[string]string{v1.DeviceApproval: v1.ApprovalApproved, "zone": "lab"}
+		node.Status.NodeInfo.MachineID = "0001"
+		if recorder := createTestNode(service, "raspi-1", node); recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected %d, got %d", c.name, http.StatusOK, recorder.Code)
+			continue
+		}
+
+		labels := fake.objects["default/raspi-1"].GetLabels()
+		if approval, ok := labels[v1.DeviceApproval]; approval != c.approval || ok != (len(c.approval) > 0) {
+			t.Errorf("%s: expected approval %q, got %q", c.name, c.approval, approval)
+		}
+		if labels["zone"] != "lab" {
+			t.Errorf("%s: expected other labels to be kept, got %v", c.name, labels)
+		}
+	}
+}
+
+func TestCreateNodeExisting(t *testing.T) {
+	cfg := config.NewApiserverConfig()
+	cfg.Admission.Mode = config.AdmissionApproval
+	fake := newFakeProxy()
+	service := newTestNodeService(fake, cfg)
+
+	// Pre-registered devices are never changed
+	existing := &unstructured.Unstructured{}
+	existing.SetName("raspi-1")
+	existing.SetLabels(map[string]string{v1.DeviceApproval: v1.ApprovalApproved})
+	fake.objects["default/raspi-1"] = existing
+
+	if recorder := createTestNode(service, "raspi-1", newTestNode("raspi-1")); recorder.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if approval := fake.objects["default/raspi-1"].GetLabels()[v1.DeviceApproval]; approval != v1.ApprovalApproved {
+		t.Errorf("expected approval to be kept, got %q", approval)
+	}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// listMeta is ListMeta with the continue token of paginated lists, which the vendored API types lack.
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Continue        string `json:"continue,omitempty"`
+}
+
+// pagedList is a page of a list served to devices and operator tooling.
+type pagedList struct {
+	apimachinery.TypeMeta `json:",inline"`
+	Metadata              listMeta    `json:"metadata"`
+	Items                 interface{} `json:"items"`
+}
+
+// parseListOptions parses limit and continue query parameters of list requests.
+func parseListOptions(req *restful.Request) (watchcache.ListOptions, error) {
+	options := watchcache.ListOptions{Continue: req.QueryParameter("continue")}
+
+	if limit := req.QueryParameter("limit"); len(limit) > 0 {
+		value, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || value < 0 {
+			return options, errors.NewBadRequest(fmt.Sprintf("invalid limit %q", limit))
+		}
+		options.Limit = value
+	}
+	return options, nil
+}
+
+// writeList writes items of a list page together with its resource version and continue token. The typed list
+// is written if the client accepts protobuf.
+func writeList(req *restful.Request, resp *restful.Response, list runtime.Object, items interface{},
+	page *watchcache.ListResult) {
+	if encoding.AcceptsProtobuf(req.Request) {
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			handleInternalServerError(resp, err)
+			return
+		}
+		listMeta.SetResourceVersion(page.ResourceVersion)
+
+		data, err := encoding.EncodeProtobufList(list, page.Continue)
+		if err != nil {
+			handleInternalServerError(resp, err)
+			return
+		}
+		writeProtobuf(resp, http.StatusOK, data)
+		return
+	}
+
+	kind := list.GetObjectKind().GroupVersionKind()
+	paged := &pagedList{
+		TypeMeta: apimachinery.TypeMeta{APIVersion: kind.GroupVersion().String(), Kind: kind.Kind},
+		Metadata: listMeta{ResourceVersion: page.ResourceVersion, Continue: page.Continue},
+		Items:    items,
+	}
+	resp.WriteHeaderAndJson(http.StatusOK, paged, restful.MIME_JSON)
+}
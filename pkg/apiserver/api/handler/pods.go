@@ -1,20 +1,22 @@
 package handler
 
 import (
-	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 
 	"github.com/emicklei/go-restful"
 	"github.com/fest-research/iot-addon/pkg/api/v1"
 	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
 	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
 	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
 	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/json"
 	apiv1 "k8s.io/client-go/pkg/api/v1"
 )
@@ -23,12 +25,16 @@ var iotPodResource = &apimachinery.APIResource{Name: v1.IotPodType, Namespaced:
 
 type PodService struct {
 	proxy         proxy.IServerProxy
+	cache         *watchcache.Cache
 	podController controller.IPodController
+	store         *config.ApiserverStore
 }
 
 // NewPodService creates the API service for translating IotPods into k8s Pods, sent back to the kubelet.
-func NewPodService(proxy proxy.IServerProxy, controller controller.IPodController) PodService {
-	return PodService{proxy: proxy, podController: controller}
+// Pods are read from the watch cache, updates go to the kubernetes apiserver.
+func NewPodService(proxy proxy.IServerProxy, cache *watchcache.Cache, controller controller.IPodController,
+	store *config.ApiserverStore) PodService {
+	return PodService{proxy: proxy, cache: cache, podController: controller, store: store}
 }
 
 // Register creates the API routes for the PodService.
@@ -68,159 +74,230 @@ func (this PodService) Register(ws *restful.WebService) {
 			Returns(http.StatusOK, "OK", nil).
 			Writes(nil),
 	)
+
+	// Patch pod status - newer k8s versions
+	ws.Route(
+		ws.Method("PATCH").
+			Path("/namespaces/{namespace}/pods/{pod}/status").
+			To(this.patchStatus).
+			Returns(http.StatusOK, "OK", nil).
+			Writes(nil),
+	)
+
+	// Create mirror pod
+	ws.Route(
+		ws.Method("POST").
+			Path("/namespaces/{namespace}/pods").
+			To(this.createPod).
+			Returns(http.StatusMethodNotAllowed, "Method Not Allowed", nil).
+			Writes(nil),
+	)
 }
 
 func (this PodService) updateStatus(req *restful.Request, resp *restful.Response) {
-	namespace := req.PathParameter("namespace")
-
-	// Read update request
 	body, err := ioutil.ReadAll(req.Request.Body)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 
-	// Unmarshal request to pod object
+	// Kubelets send the whole pod, only its status is taken
 	pod := &apiv1.Pod{}
-	err = json.Unmarshal(body, pod)
-	if err != nil {
-		handleInternalServerError(resp, err)
+	if err := encoding.DecodeBody(req.Request, body, pod); err != nil {
+		handleStatusError(resp, errors.NewBadRequest(err.Error()))
 		return
 	}
 
-	// Transform pod to unstructured iot pod
-	unstructuredIotPod, err := this.podController.ToUnstructured(pod)
+	this.writeStatus(req, resp, func(*apiv1.Pod) (*apiv1.PodStatus, error) {
+		return &pod.Status, nil
+	})
+}
+
+func (this PodService) patchStatus(req *restful.Request, resp *restful.Response) {
+	patchType, body, err := readPatch(req)
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	// Update iot pod
-	unstructuredIotPod, err = this.proxy.Update(iotPodResource, namespace, unstructuredIotPod)
+	this.writeStatus(req, resp, func(current *apiv1.Pod) (*apiv1.PodStatus, error) {
+		patched := &apiv1.Pod{}
+		if err := applyPatch(current, patchType, body, patched); err != nil {
+			return nil, err
+		}
+		return &patched.Status, nil
+	})
+}
+
+// writeStatus sets status returned by fn for the pod as served to the kubelet on the IotPod. Spec and
+// metadata of the IotPod are kept, whatever the kubelet sends. Devices only write status of their own pods.
+func (this PodService) writeStatus(req *restful.Request, resp *restful.Response,
+	fn func(*apiv1.Pod) (*apiv1.PodStatus, error)) {
+	namespace, err := getRequestNamespace(this.store, req, "pods")
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
+	name := req.PathParameter("pod")
 
-	// Transform response back to unstructured pod
-	response, err := this.podController.ToBytes(unstructuredIotPod)
+	var updated *v1.IotPod
+	err = retryOnConflict(func() error {
+		obj, err := this.getUpstream(namespace, name)
+		if err != nil {
+			return err
+		}
+
+		iotPod := obj.(*v1.IotPod)
+		if err := checkPodDevice(req, iotPod); err != nil {
+			return err
+		}
+		status, err := fn(this.podController.ToPod(iotPod))
+		if err != nil {
+			return err
+		}
+		iotPod.Status = *status
+
+		unstructuredIotPod, err := toUnstructured(iotPod)
+		if err != nil {
+			return err
+		}
+
+		unstructuredIotPod, err = this.proxy.Update(iotPodResource, namespace, unstructuredIotPod)
+		if err != nil {
+			return err
+		}
+
+		updated = &v1.IotPod{}
+		return fromUnstructured(unstructuredIotPod, updated)
+	})
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	writeObject(req, resp, http.StatusOK, this.podController.ToPod(updated))
+}
+
+// createPod rejects mirror pods of static pods, devices only run pods scheduled to them as IotPods.
+func (this PodService) createPod(req *restful.Request, resp *restful.Response) {
+	handleStatusError(resp, errors.NewMethodNotSupported(schema.GroupResource{Resource: "pods"}, "create"))
 }
 
 func (this PodService) getPod(req *restful.Request, resp *restful.Response) {
-	namespace := req.PathParameter("namespace")
+	namespace, err := getRequestNamespace(this.store, req, "pods")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
 	name := req.PathParameter("pod")
 
-	obj, err := this.proxy.Get(iotPodResource, namespace, name)
+	obj, err := this.cache.Get(namespace, name)
+	if errors.IsNotFound(err) {
+		// Pods created moments ago may not be cached yet
+		obj, err = this.getUpstream(namespace, name)
+	}
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	response, err := this.podController.ToBytes(obj)
-	if err != nil {
-		handleInternalServerError(resp, err)
+	iotPod := obj.(*v1.IotPod)
+	if err := checkPodDevice(req, iotPod); err != nil {
+		handleStatusError(resp, err)
 		return
 	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	writeObject(req, resp, http.StatusOK, this.podController.ToPod(iotPod))
+}
+
+func (this PodService) getUpstream(namespace, name string) (runtime.Object, error) {
+	obj, err := this.proxy.Get(iotPodResource, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	marshalledIotPod, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	iotPod := &v1.IotPod{}
+	if err := json.Unmarshal(marshalledIotPod, iotPod); err != nil {
+		return nil, err
+	}
+	return iotPod, nil
 }
 
 func (this PodService) listPods(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
+	namespace := getDeviceNamespace(this.store, req)
 
-	fieldSelector, err := this.parseFieldSelector(req)
+	selector, err := parseListSelector(req, podFieldSet(&apiv1.Pod{}))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
-	labelSelector, err := this.labelFromNodeSelector(fieldSelector)
+
+	options, err := parseListOptions(req)
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	obj, err := this.proxy.List(iotPodResource, namespace, &apimachinery.ListOptions{
-		LabelSelector: labelSelector.String(),
-	})
+	// Pods are cached by their device, so kubelets only read pods of their own node
+	page, err := this.cache.List(namespace, getPodsDevice(req, selector), this.filter(selector), options)
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	iotPodList := obj.(*v1.IotPodList)
-	podList := this.podController.ToPodList(iotPodList)
-	response, _ := json.Marshal(podList)
+	iotPodList := &v1.IotPodList{Items: make([]v1.IotPod, 0, len(page.Objects))}
+	for _, obj := range page.Objects {
+		iotPodList.Items = append(iotPodList.Items, *obj.(*v1.IotPod))
+	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	podList := this.podController.ToPodList(iotPodList)
+	writeList(req, resp, podList, podList.Items, page)
 }
 
 func (this PodService) watchPods(req *restful.Request, resp *restful.Response) {
-	// TODO: refactor this later, set based on tenant
-	namespace := "default"
-
-	fieldSelector, err := this.parseFieldSelector(req)
-	if err != nil {
-		handleInternalServerError(resp, err)
-		return
-	}
+	namespace := getDeviceNamespace(this.store, req)
 
-	labelSelector, err := this.labelFromNodeSelector(fieldSelector)
+	selector, err := parseListSelector(req, podFieldSet(&apiv1.Pod{}))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
-	watcher, err := this.proxy.Watch(iotPodResource, namespace, &apimachinery.ListOptions{
-		Watch:         true,
-		LabelSelector: labelSelector.String(),
-	})
+	watcher, err := this.cache.Watch(namespace, getPodsDevice(req, selector), watch.WatchResourceVersion(req),
+		this.filter(selector))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
 		return
 	}
 
 	defer watcher.Stop()
 
-	notifier := watch.NewNotifier()
+	notifier := watch.NewNotifier("pods", this.store.Get().Timeouts.Watch.Duration)
 
 	notifier.Register(this.podController)
-	err = notifier.Start(watcher, resp)
+	notifier.EnableProtobuf()
+	notifier.EnableDelta()
+	err = notifier.Start(watcher, req, resp)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 }
 
-func (this PodService) parseFieldSelector(req *restful.Request) (fields.Selector, error) {
-	selectorString := req.QueryParameter("fieldSelector")
-	selector, err := fields.ParseSelector(selectorString)
-	if err != nil {
-		return nil, fmt.Errorf("[pod service] failed to parse field selector: %s", err)
-	}
-	return selector, nil
-}
-
-func (this PodService) labelFromNodeSelector(fieldSelector fields.Selector) (labels.Selector, error) {
-	requiredVal, ok := fieldSelector.RequiresExactMatch("spec.nodeName")
-	if !ok {
-		return nil, errors.New("[pod service] pods fieldSelector coming from kubelet" +
-			" does not contain spec.nodeName")
+// filter returns filter of IotPods matching the selector as they are served to kubelets. Pods of a node are
+// selected by the cache itself.
+func (this PodService) filter(selector listSelector) watchcache.FilterFunc {
+	if selector.SelectsOnly("spec.nodeName") {
+		return nil
 	}
 
-	deviceRequirement, err := labels.NewRequirement(v1.DeviceSelector, selection.Equals, []string{requiredVal})
-	if err != nil {
-		return nil, fmt.Errorf("Could not construct deviceSelector from spec.nodeName: %s", err)
+	return func(obj runtime.Object) bool {
+		pod := this.podController.ToPod(obj.(*v1.IotPod))
+		return selector.Matches(labels.Set(pod.Labels), podFieldSet(pod))
 	}
-	labelSelector := labels.NewSelector().Add(*deviceRequirement)
-	return labelSelector, nil
 }
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimachinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+// listSelector selects objects of list and watch requests by their labels and fields, the same way the
+// kubernetes apiserver does.
+type listSelector struct {
+	labels labels.Selector
+	fields fields.Selector
+}
+
+// parseListSelector parses labelSelector and fieldSelector query parameters. Field selectors may only use
+// fields of the supported set.
+func parseListSelector(req *restful.Request, supported fields.Set) (listSelector, error) {
+	labelSelector, err := labels.Parse(req.QueryParameter("labelSelector"))
+	if err != nil {
+		return listSelector{}, errors.NewBadRequest(fmt.Sprintf("invalid label selector: %s", err))
+	}
+
+	fieldSelector, err := fields.ParseSelector(req.QueryParameter("fieldSelector"))
+	if err != nil {
+		return listSelector{}, errors.NewBadRequest(fmt.Sprintf("invalid field selector: %s", err))
+	}
+
+	for _, requirement := range fieldSelector.Requirements() {
+		if _, ok := supported[requirement.Field]; !ok {
+			return listSelector{}, errors.NewBadRequest(fmt.Sprintf("field label not supported: %s",
+				requirement.Field))
+		}
+	}
+
+	return listSelector{labels: labelSelector, fields: fieldSelector}, nil
+}
+
+// Matches returns true if both label and field selectors match.
+func (this listSelector) Matches(labelSet labels.Set, fieldSet fields.Set) bool {
+	return this.labels.Matches(labelSet) && this.fields.Matches(fieldSet)
+}
+
+// RequiresExactMatch returns value the field selector requires for the field.
+func (this listSelector) RequiresExactMatch(field string) (string, bool) {
+	return this.fields.RequiresExactMatch(field)
+}
+
+// SelectsOnly returns true if the selector has no other requirement than an exact match of the field, e.g.
+// kubelets watching pods of their node.
+func (this listSelector) SelectsOnly(field string) bool {
+	_, ok := this.fields.RequiresExactMatch(field)
+	return ok && this.labels.Empty() && len(this.fields.Requirements()) == 1
+}
+
+// nodeFieldSet returns fields of a node field selectors can use.
+func nodeFieldSet(node *apiv1.Node) fields.Set {
+	return fields.Set{
+		"metadata.name":      node.Name,
+		"spec.unschedulable": strconv.FormatBool(node.Spec.Unschedulable),
+	}
+}
+
+// podFieldSet returns fields of a pod field selectors can use. IotPods are bound to devices by their
+// deviceSelector label, which is their node name.
+func podFieldSet(pod *apiv1.Pod) fields.Set {
+	nodeName := pod.Spec.NodeName
+	if len(nodeName) == 0 {
+		nodeName = pod.Labels[v1.DeviceSelector]
+	}
+
+	return fields.Set{
+		"metadata.name":      pod.Name,
+		"metadata.namespace": pod.Namespace,
+		"spec.nodeName":      nodeName,
+		"spec.restartPolicy": string(pod.Spec.RestartPolicy),
+		"status.phase":       string(pod.Status.Phase),
+		"status.podIP":       pod.Status.PodIP,
+	}
+}
+
+// objectMetaFieldSet returns fields of services and endpoints field selectors can use.
+func objectMetaFieldSet(meta apimachinery.ObjectMeta) fields.Set {
+	return fields.Set{
+		"metadata.name":      meta.Name,
+		"metadata.namespace": meta.Namespace,
+	}
+}
@@ -4,58 +4,152 @@ import (
 	"net/http"
 
 	"github.com/emicklei/go-restful"
-	"github.com/fest-research/iot-addon/pkg/apiserver/proxy"
+	"github.com/fest-research/iot-addon/pkg/apiserver/controller"
 	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
 )
 
 type KubeService struct {
-	proxy proxy.IRawProxy
+	cache             *watchcache.Cache
+	serviceController controller.IServiceController
+	store             *config.ApiserverStore
 }
 
-// NewKubeService creates the API service as a proxy to k8s Service resources.
-func NewKubeService(proxy proxy.IRawProxy) KubeService {
-	return KubeService{proxy: proxy}
+// NewKubeService creates the API service serving k8s Services of the device namespace, so kube-proxy on
+// devices can route them. Services are read from the watch cache.
+func NewKubeService(cache *watchcache.Cache, controller controller.IServiceController,
+	store *config.ApiserverStore) KubeService {
+	return KubeService{cache: cache, serviceController: controller, store: store}
 }
 
 // Register creates the API routes for the KubeService.
 func (this KubeService) Register(ws *restful.WebService) {
 	// List services
+	for _, path := range []string{"/services", "/namespaces/{namespace}/services"} {
+		ws.Route(
+			ws.Method("GET").
+				Path(path).
+				To(this.listServices).
+				Returns(http.StatusOK, "OK", nil).
+				Writes(nil),
+		)
+	}
+
+	// Get service
 	ws.Route(
 		ws.Method("GET").
-			Path("/services").
-			To(this.listServices).
+			Path("/namespaces/{namespace}/services/{service}").
+			To(this.getService).
 			Returns(http.StatusOK, "OK", nil).
 			Writes(nil),
 	)
 
 	// Watch services
-	ws.Route(
-		ws.Method("GET").
-			Path("/watch/services").
-			To(this.watchServices).
-			Returns(http.StatusOK, "OK", nil).
-			Writes(nil),
-	)
+	for _, path := range []string{"/watch/services", "/watch/namespaces/{namespace}/services"} {
+		ws.Route(
+			ws.Method("GET").
+				Path(path).
+				To(this.watchServices).
+				Returns(http.StatusOK, "OK", nil).
+				Writes(nil),
+		)
+	}
+}
+
+func (this KubeService) getService(req *restful.Request, resp *restful.Response) {
+	namespace, err := getRequestNamespace(this.store, req, "services")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	obj, err := this.cache.Get(namespace, req.PathParameter("service"))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	writeObject(req, resp, http.StatusOK, this.serviceController.ToService(obj.(*apiv1.Service)))
 }
 
 func (this KubeService) listServices(req *restful.Request, resp *restful.Response) {
+	namespace, err := getRequestNamespace(this.store, req, "services")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
 
-	response, err := this.proxy.Get(req)
+	selector, err := parseListSelector(req, objectMetaFieldSet(apiv1.Service{}.ObjectMeta))
 	if err != nil {
-		handleInternalServerError(resp, err)
+		handleStatusError(resp, err)
+		return
 	}
 
-	resp.AddHeader("Content-Type", "application/json")
-	resp.Write(response)
+	options, err := parseListOptions(req)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	page, err := this.cache.List(namespace, "", this.filter(selector), options)
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	services := make([]apiv1.Service, 0, len(page.Objects))
+	for _, obj := range page.Objects {
+		services = append(services, *obj.(*apiv1.Service))
+	}
+
+	serviceList := this.serviceController.ToServiceList(services)
+	writeList(req, resp, serviceList, serviceList.Items, page)
 }
 
 func (this KubeService) watchServices(req *restful.Request, resp *restful.Response) {
-	watcher := this.proxy.Watch(req)
-	notifier := watch.NewRawNotifier()
+	namespace, err := getRequestNamespace(this.store, req, "services")
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
 
-	err := notifier.Start(watcher, resp)
+	selector, err := parseListSelector(req, objectMetaFieldSet(apiv1.Service{}.ObjectMeta))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	watcher, err := this.cache.Watch(namespace, "", watch.WatchResourceVersion(req), this.filter(selector))
+	if err != nil {
+		handleStatusError(resp, err)
+		return
+	}
+
+	defer watcher.Stop()
+
+	notifier := watch.NewNotifier("services", this.store.Get().Timeouts.Watch.Duration)
+
+	notifier.Register(this.serviceController)
+	notifier.EnableProtobuf()
+	err = notifier.Start(watcher, req, resp)
 	if err != nil {
 		handleInternalServerError(resp, err)
 		return
 	}
 }
+
+// filter returns filter of Services matching the selector, nil if it selects all of them.
+func (this KubeService) filter(selector listSelector) watchcache.FilterFunc {
+	if selector.labels.Empty() && selector.fields.Empty() {
+		return nil
+	}
+
+	return func(obj runtime.Object) bool {
+		service := obj.(*apiv1.Service)
+		return selector.Matches(labels.Set(service.Labels), objectMetaFieldSet(service.ObjectMeta))
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"io/ioutil"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/patch"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// maxConflictRetries is number of attempts to write status of an object changed concurrently.
+const maxConflictRetries = 5
+
+// retryOnConflict calls fn again while it fails with conflict, at most maxConflictRetries times.
+func retryOnConflict(fn func() error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		if err = fn(); !errors.IsConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// readPatch reads patch sent by a kubelet together with its type.
+func readPatch(req *restful.Request) (types.PatchType, []byte, error) {
+	patchType, err := patch.GetType(req.Request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	body, err := ioutil.ReadAll(req.Request.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return patchType, body, nil
+}
+
+// applyPatch applies the patch to the object as served to kubelets and decodes the result into patched.
+func applyPatch(obj interface{}, patchType types.PatchType, body []byte, patched interface{}) error {
+	original, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	result, err := patch.Apply(original, patchType, body, obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, patched)
+}
+
+func toUnstructured(obj interface{}) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &unstructured.Unstructured{}
+	if err := result.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func fromUnstructured(obj *unstructured.Unstructured, into interface{}) error {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
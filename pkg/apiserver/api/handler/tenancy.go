@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// getDeviceNamespace returns namespace of the device sending the request, as set by tenancy config.
+func getDeviceNamespace(store *config.ApiserverStore, req *restful.Request) string {
+	return store.Get().Tenancy.NamespaceOf(auth.GetDevice(req))
+}
+
+// getRequestNamespace returns namespace of the device for requests of the whole cluster or of the device
+// namespace. Requests of other namespaces are forbidden, devices only access objects of their tenant.
+func getRequestNamespace(store *config.ApiserverStore, req *restful.Request, resource string) (string, error) {
+	namespace := getDeviceNamespace(store, req)
+	if requested := req.PathParameter("namespace"); len(requested) > 0 && requested != namespace {
+		return "", errors.NewForbidden(schema.GroupResource{Resource: resource}, "",
+			fmt.Errorf("devices of namespace %s can't access namespace %s", namespace, requested))
+	}
+	return namespace, nil
+}
+
+// checkPodDevice returns error unless the IotPod is scheduled on the device sending the request. Anonymous
+// requests aren't checked.
+func checkPodDevice(req *restful.Request, iotPod *v1.IotPod) error {
+	identity := auth.GetIdentity(req)
+	if identity == nil || iotPod.Metadata.Labels[v1.DeviceSelector] == identity.Device {
+		return nil
+	}
+	return errors.NewForbidden(schema.GroupResource{Resource: "pods"}, iotPod.Metadata.Name,
+		fmt.Errorf("pod is not scheduled on device %s", identity.Device))
+}
+
+// checkNodeDevice returns error unless the node is the device sending the request. Anonymous requests aren't
+// checked.
+func checkNodeDevice(req *restful.Request, name string) error {
+	identity := auth.GetIdentity(req)
+	if identity == nil || name == identity.Device {
+		return nil
+	}
+	return errors.NewForbidden(schema.GroupResource{Resource: "nodes"}, name,
+		fmt.Errorf("device %s can't register other devices", identity.Device))
+}
+
+// getNodesDevice returns device whose node is listed or watched, empty for all devices. Devices only get
+// their own node, whatever they select.
+func getNodesDevice(req *restful.Request, selector listSelector) string {
+	if identity := auth.GetIdentity(req); identity != nil {
+		return identity.Device
+	}
+	device, _ := selector.RequiresExactMatch("metadata.name")
+	return device
+}
+
+// getPodsDevice returns device whose pods are listed or watched, empty for pods of all devices. Devices
+// only get pods scheduled on them, whatever they select.
+func getPodsDevice(req *restful.Request, selector listSelector) string {
+	if identity := auth.GetIdentity(req); identity != nil {
+		return identity.Device
+	}
+	device, _ := selector.RequiresExactMatch("spec.nodeName")
+	return device
+}
@@ -1,21 +1,35 @@
 package api
 
 import (
+	"time"
+
 	restful "github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful/log"
 	"github.com/fest-research/iot-addon/pkg/apiserver/api/handler"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/common"
+	"github.com/fest-research/iot-addon/pkg/logging"
 )
 
+// RequestIDHeader carries request ID. IDs sent by clients are kept, otherwise new one is generated.
+const RequestIDHeader = "X-Request-Id"
+
 // APIInstaller installs the APIs in the server
 type APIInstaller struct {
 	Root    string
 	Version string
 }
 
-// NewWebService creates the core web service
-func (installer *APIInstaller) NewWebService() *restful.WebService {
+// NewWebService creates the core web service. Filters run after request logging, metrics and response
+// encoding, in given order.
+func (installer *APIInstaller) NewWebService(filters ...restful.FilterFunction) *restful.WebService {
 	restful.EnableTracing(true) //Trace missing endpoints
-	ws := new(restful.WebService).Filter(logPath).Path(installer.Root).Consumes("*/*").Produces("application/json")
+	ws := new(restful.WebService).Filter(logRequest).Filter(metrics.RouteFilter).Filter(encoding.Filter).
+		Path(installer.Root).Consumes("*/*").Produces(encoding.ContentTypeJSON, encoding.ContentTypeProtobuf)
+	for _, filter := range filters {
+		ws.Filter(filter)
+	}
 	ws.ApiVersion(installer.Version)
 	return ws
 }
@@ -27,8 +41,24 @@ func (installer *APIInstaller) Install(ws *restful.WebService, services []handle
 	}
 }
 
-func logPath(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
-	log.Printf("[Request filter] method: %s ", req.Request.Method)
-	log.Printf("[Request filter] path: %s", req.Request.URL.String())
+// logRequest attaches logger with request ID and device identity to the request and logs its result.
+func logRequest(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
+	requestID := req.HeaderParameter(RequestIDHeader)
+	if len(requestID) == 0 {
+		requestID = string(common.NewUUID())
+	}
+	res.AddHeader(RequestIDHeader, requestID)
+
+	requestFields := logging.Fields{"requestID": requestID}
+	if device := auth.GetRequestedDevice(req); len(device) > 0 {
+		requestFields["device"] = device
+	}
+	logger := logging.WithFields(requestFields)
+	logging.SetRequestLogger(req, logger)
+
+	logger.Debugf("[Request filter] %s %s", req.Request.Method, req.Request.URL.String())
+	start := time.Now()
 	chain.ProcessFilter(req, res)
+	logger.Infof("[Request filter] %s %s %d %s", req.Request.Method, req.SelectedRoutePath(), res.StatusCode(),
+		time.Since(start).String())
 }
@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const bearerPrefix = "Bearer "
+
+// Authenticator authenticates devices by client certificates issued by the IoT CA and new devices by
+// bootstrap tokens. Devices are only authenticated while their IotDevice exists and is not being deleted.
+// Tokens are read from an informer of bootstrap token Secrets, so requests don't reach the kubernetes
+// apiserver.
+type Authenticator struct {
+	clientset *kubernetes.Clientset
+	tokens    cache.SharedIndexInformer
+	devices   *watchcache.Cache
+	store     *config.ApiserverStore
+}
+
+// NewAuthenticator creates authenticator reading tokens from the bootstrap token namespace of the config.
+// Changes of the namespace require restart.
+func NewAuthenticator(clientset *kubernetes.Clientset, devices *watchcache.Cache,
+	store *config.ApiserverStore) *Authenticator {
+	namespace := store.Get().Authentication.BootstrapTokenNamespace
+	tokens := cache.NewSharedIndexInformer(newTokenListWatch(clientset, namespace), &kubeapi.Secret{}, 0,
+		cache.Indexers{})
+	return &Authenticator{clientset: clientset, tokens: tokens, devices: devices, store: store}
+}
+
+// Run starts the token informer. It doesn't block.
+func (this *Authenticator) Run(stopCh <-chan struct{}) {
+	go this.tokens.Run(stopCh)
+}
+
+// CheckSynced returns error until tokens are synced.
+func (this *Authenticator) CheckSynced() error {
+	if !this.tokens.HasSynced() {
+		return fmt.Errorf("bootstrap tokens are not synced yet")
+	}
+	return nil
+}
+
+func newTokenListWatch(clientset *kubernetes.Clientset, namespace string) *cache.ListWatch {
+	selector := fields.OneTermEqualSelector("type", string(certificates.BootstrapTokenSecretType)).String()
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Secrets(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Secrets(namespace).Watch(options)
+		},
+	}
+}
+
+// unavailableError is returned when credentials can't be checked, the request is rejected without being
+// found unauthorized.
+type unavailableError struct {
+	error
+}
+
+// Filter attaches identity of the sender to the request. Requests with invalid credentials are rejected,
+// requests without credentials only when anonymous access is disabled.
+func (this *Authenticator) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	identity, err := this.authenticate(req)
+	if err == nil && identity != nil && len(identity.Device) > 0 {
+		err = this.checkDevice(identity.Device)
+	}
+	if _, ok := err.(unavailableError); ok {
+		logging.RequestLogger(req).Warningf("[Auth filter] Cannot authenticate: %s", err.Error())
+		writeStatus(resp, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable,
+			"Service Unavailable")
+		return
+	}
+	if err != nil {
+		logging.RequestLogger(req).Warningf("[Auth filter] Authentication failed: %s", err.Error())
+		writeStatus(resp, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "Unauthorized")
+		return
+	}
+
+	if identity == nil {
+		if !this.store.Get().Authentication.AllowAnonymous {
+			writeStatus(resp, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "Unauthorized")
+			return
+		}
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	SetIdentity(req, identity)
+	logging.SetRequestLogger(req, logging.RequestLogger(req).WithFields(logging.Fields{"user": identity.Username}))
+	chain.ProcessFilter(req, resp)
+}
+
+// authenticate returns identity of the request, nil if it carries no credentials.
+func (this *Authenticator) authenticate(req *restful.Request) (*Identity, error) {
+	if tls := req.Request.TLS; tls != nil && len(tls.VerifiedChains) > 0 && len(tls.VerifiedChains[0]) > 0 {
+		device, ok := certificates.GetDeviceName(tls.VerifiedChains[0][0].Subject)
+		if !ok {
+			return nil, fmt.Errorf("client certificate does not identify a device")
+		}
+		return NewDeviceIdentity(device), nil
+	}
+
+	authorization := req.HeaderParameter("Authorization")
+	if len(authorization) == 0 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return nil, fmt.Errorf("unsupported authorization scheme")
+	}
+
+	id, secret, err := certificates.ParseBootstrapToken(strings.TrimPrefix(authorization, bearerPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	tokenSecret, err := this.getTokenSecret(id)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := certificates.ValidateBootstrapToken(tokenSecret, id, secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Authentication {
+		return NewBootstrapIdentity(token), nil
+	}
+
+	if len(token.Replaces) > 0 {
+		this.retireReplacedToken(req, tokenSecret, token)
+	}
+	return NewDeviceTokenIdentity(token), nil
+}
+
+// getTokenSecret returns cached Secret of the token with given ID. Missing Secrets fail authentication, other
+// errors make it unavailable.
+func (this *Authenticator) getTokenSecret(id string) (*kubeapi.Secret, error) {
+	if err := this.CheckSynced(); err != nil {
+		return nil, unavailableError{err}
+	}
+
+	namespace := this.store.Get().Authentication.BootstrapTokenNamespace
+	obj, exists, err := this.tokens.GetIndexer().GetByKey(namespace + "/" + certificates.BootstrapTokenSecretName(id))
+	if err != nil {
+		return nil, unavailableError{err}
+	}
+	if !exists {
+		return nil, fmt.Errorf("token %s not found", id)
+	}
+	return obj.(*kubeapi.Secret), nil
+}
+
+// checkDevice returns error if IotDevice of the authenticated device doesn't exist or is being deleted, so
+// credentials of deleted devices can't be used any more.
+func (this *Authenticator) checkDevice(device string) error {
+	namespace := this.store.Get().Tenancy.NamespaceOf(device)
+	obj, err := this.devices.Get(namespace, device)
+	if errors.IsNotFound(err) {
+		return fmt.Errorf("device %s is not registered in namespace %s", device, namespace)
+	}
+	if err != nil {
+		return unavailableError{err}
+	}
+
+	if obj.(*v1.IotDevice).Metadata.DeletionTimestamp != nil {
+		return fmt.Errorf("device %s is being deleted", device)
+	}
+	return nil
+}
+
+// retireReplacedToken deletes device token replaced by rotation once the device authenticated with the
+// new one. Failures are only logged, the next request retries.
+func (this *Authenticator) retireReplacedToken(req *restful.Request, tokenSecret *kubeapi.Secret,
+	token *certificates.BootstrapToken) {
+	logger := logging.RequestLogger(req)
+	secrets := this.clientset.CoreV1().Secrets(tokenSecret.Namespace)
+
+	err := secrets.Delete(certificates.BootstrapTokenSecretName(token.Replaces), &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Warningf("[Auth filter] Cannot delete replaced device token %s: %s", token.Replaces, err.Error())
+		return
+	}
+
+	// Cached Secrets are shared, so the update is made on a copy
+	updated := *tokenSecret
+	updated.Data = make(map[string][]byte, len(tokenSecret.Data))
+	for key, value := range tokenSecret.Data {
+		if key != certificates.DeviceTokenReplacesKey {
+			updated.Data[key] = value
+		}
+	}
+	if _, err := secrets.Update(&updated); err != nil {
+		logger.Warningf("[Auth filter] Cannot update device token %s: %s", token.ID, err.Error())
+		return
+	}
+	logger.Infof("[Auth filter] Device switched to rotated token %s, deleted token %s", token.ID,
+		token.Replaces)
+}
+
+// DeviceFilter authorizes requests of the device API. Bootstrap tokens may only request certificates and
+// devices may only access themselves and their pods.
+func DeviceFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	identity := GetIdentity(req)
+	if identity == nil {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	if identity.BootstrapToken != nil {
+		writeStatus(resp, http.StatusForbidden, metav1.StatusReasonForbidden,
+			fmt.Sprintf("%s may only request certificates", identity.Username))
+		return
+	}
+
+	if requested := GetRequestedDevice(req); len(requested) > 0 && requested != identity.Device {
+		writeStatus(resp, http.StatusForbidden, metav1.StatusReasonForbidden,
+			fmt.Sprintf("%s may not access device %s", identity.Username, requested))
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+func writeStatus(resp *restful.Response, code int, reason metav1.StatusReason, message string) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	}
+	resp.WriteHeaderAndJson(code, status, restful.MIME_JSON)
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// identityAttribute is the restful.Request attribute holding authenticated identity of the request.
+const identityAttribute = "identity"
+
+// Identity is authenticated sender of a request.
+type Identity struct {
+	Username string
+	Groups   []string
+	// Device is name of the device authenticated by client certificate or device token, empty for bootstrap
+	// tokens.
+	Device string
+	// BootstrapToken is set for requests authenticated by bootstrap token.
+	BootstrapToken *certificates.BootstrapToken
+	// DeviceToken is set for devices authenticated by device token instead of client certificate.
+	DeviceToken *certificates.BootstrapToken
+}
+
+// NewDeviceIdentity returns identity of the device with given name.
+func NewDeviceIdentity(device string) *Identity {
+	return &Identity{
+		Username: certificates.DeviceUsername(device),
+		Groups:   []string{certificates.DeviceGroup},
+		Device:   device,
+	}
+}
+
+// NewDeviceTokenIdentity returns identity of the device the device token is bound to.
+func NewDeviceTokenIdentity(token *certificates.BootstrapToken) *Identity {
+	identity := NewDeviceIdentity(token.Device)
+	identity.DeviceToken = token
+	return identity
+}
+
+// NewBootstrapIdentity returns identity of the bootstrap token.
+func NewBootstrapIdentity(token *certificates.BootstrapToken) *Identity {
+	return &Identity{Username: token.Username(), Groups: token.Groups(), BootstrapToken: token}
+}
+
+// SetIdentity attaches authenticated identity to the request.
+func SetIdentity(req *restful.Request, identity *Identity) {
+	req.SetAttribute(identityAttribute, identity)
+}
+
+// GetIdentity returns authenticated identity of the request, nil for anonymous requests.
+func GetIdentity(req *restful.Request) *Identity {
+	if identity, ok := req.Attribute(identityAttribute).(*Identity); ok {
+		return identity
+	}
+	return nil
+}
+
+// GetRequestedDevice returns name of the device the request is about. Kubelets name their node in the path
+// or select their node or pods with a field selector.
+func GetRequestedDevice(req *restful.Request) string {
+	if node := req.PathParameter("node"); len(node) > 0 {
+		return node
+	}
+
+	selector, err := fields.ParseSelector(req.QueryParameter("fieldSelector"))
+	if err != nil {
+		return ""
+	}
+
+	for _, field := range []string{"metadata.name", "spec.nodeName"} {
+		if value, ok := selector.RequiresExactMatch(field); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// GetDevice returns name of the authenticated device sending the request, empty for anonymous requests and
+// bootstrap tokens. Names in the request are never trusted.
+func GetDevice(req *restful.Request) string {
+	if identity := GetIdentity(req); identity != nil {
+		return identity.Device
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/watch"
+
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+const certificatesAPIVersion = "certificates.k8s.io/v1beta1"
+
+type ICertificateController interface {
+	// TransformWatchEvent implements WatchEventController.
+	TransformWatchEvent(watch.Event) watch.Event
+
+	ToCertificateSigningRequestList(*v1.IotCertificateRequestList) *certificates.CertificateSigningRequestList
+	ToCertificateSigningRequest(*v1.IotCertificateRequest) *certificates.CertificateSigningRequest
+	ToIotCertificateRequest(*certificates.CertificateSigningRequest) *v1.IotCertificateRequest
+	ToUnstructured(*certificates.CertificateSigningRequest) (*unstructured.Unstructured, error)
+	FromUnstructured(*unstructured.Unstructured) (*v1.IotCertificateRequest, error)
+}
+
+type certificateController struct {
+	iotDomain string
+}
+
+// TransformWatchEvent converts an ADD/UPDATE/DELETE event for an IotCertificateRequest to
+// an ADD/UPDATE/DELETE event for a k8s CertificateSigningRequest
+func (this certificateController) TransformWatchEvent(event watch.Event) watch.Event {
+	if request, ok := event.Object.(*v1.IotCertificateRequest); ok {
+		event.Object = this.ToCertificateSigningRequest(request)
+	}
+	return event
+}
+
+// ToCertificateSigningRequestList converts a list of IotCertificateRequests to a list of
+// k8s CertificateSigningRequests
+func (this certificateController) ToCertificateSigningRequestList(
+	list *v1.IotCertificateRequestList) *certificates.CertificateSigningRequestList {
+	result := &certificates.CertificateSigningRequestList{}
+	result.TypeMeta = metav1.TypeMeta{APIVersion: certificatesAPIVersion, Kind: "CertificateSigningRequestList"}
+	result.Items = make([]certificates.CertificateSigningRequest, 0)
+
+	for _, request := range list.Items {
+		result.Items = append(result.Items, *this.ToCertificateSigningRequest(&request))
+	}
+
+	return result
+}
+
+// ToCertificateSigningRequest converts an IotCertificateRequest to a k8s CertificateSigningRequest. The
+// requests are cluster scoped, so namespace is dropped.
+func (this certificateController) ToCertificateSigningRequest(
+	request *v1.IotCertificateRequest) *certificates.CertificateSigningRequest {
+	csr := &certificates.CertificateSigningRequest{}
+
+	csr.TypeMeta = metav1.TypeMeta{APIVersion: certificatesAPIVersion, Kind: "CertificateSigningRequest"}
+	csr.ObjectMeta = request.Metadata
+	csr.ObjectMeta.Namespace = ""
+	csr.Spec = request.Spec
+	csr.Status = request.Status
+
+	return csr
+}
+
+// ToIotCertificateRequest converts a k8s CertificateSigningRequest to an IotCertificateRequest
+func (this certificateController) ToIotCertificateRequest(
+	csr *certificates.CertificateSigningRequest) *v1.IotCertificateRequest {
+	request := &v1.IotCertificateRequest{}
+
+	request.TypeMeta = metav1.TypeMeta{
+		APIVersion: this.iotDomain + "/" + v1.APIVersion,
+		Kind:       v1.IotCertificateRequestKind,
+	}
+	request.Metadata = csr.ObjectMeta
+	request.Spec = csr.Spec
+	request.Status = csr.Status
+
+	return request
+}
+
+// ToUnstructured converts certificate signing request to unstructured iot certificate request
+func (this certificateController) ToUnstructured(
+	csr *certificates.CertificateSigningRequest) (*unstructured.Unstructured, error) {
+	result := &unstructured.Unstructured{}
+
+	marshalled, err := json.Marshal(this.ToIotCertificateRequest(csr))
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.UnmarshalJSON(marshalled)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// FromUnstructured converts unstructured iot certificate request to its type
+func (this certificateController) FromUnstructured(
+	unstructured *unstructured.Unstructured) (*v1.IotCertificateRequest, error) {
+	marshalled, err := unstructured.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	request := &v1.IotCertificateRequest{}
+	err = json.Unmarshal(marshalled, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+func NewCertificateController(iotDomain string) ICertificateController {
+	return &certificateController{iotDomain: iotDomain}
+}
@@ -18,7 +18,7 @@ var (
 
 	iotTypeMeta = metav1.TypeMeta{
 		Kind:       string(v1.IotDeviceKind),
-		APIVersion: iotDomain,
+		APIVersion: iotDomain + "/" + v1.APIVersion,
 	}
 
 	typeMeta = metav1.TypeMeta{
@@ -30,7 +30,7 @@ var (
 func createTestNode(name string) *kubeapi.Node {
 	return &kubeapi.Node{
 		TypeMeta: typeMeta,
-		ObjectMeta: kubeapi.ObjectMeta{
+		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: "",
 		},
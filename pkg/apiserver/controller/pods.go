@@ -1,7 +1,10 @@
 package controller
 
 import (
+	"strings"
+
 	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/config"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -24,6 +27,7 @@ type IPodController interface {
 
 type podController struct {
 	iotDomain string
+	store     *config.ApiserverStore
 }
 
 // TransformWatchEvent converts an ADD/UPDATE/DELETE event for an IotPod to
@@ -59,6 +63,8 @@ func (this podController) ToPod(iotPod *v1.IotPod) *kubeapi.Pod {
 	pod.ObjectMeta = iotPod.Metadata
 	pod.Status = iotPod.Status
 
+	// IotPods are shared by the watch cache, containers are copied before required fields are set
+	pod.Spec.Containers = copyContainers(iotPod.Spec.Containers)
 	pod = this.setRequiredFields(pod)
 
 	return pod
@@ -132,8 +138,13 @@ func (this podController) getTypeMeta(kind v1.ResourceKind) metav1.TypeMeta {
 }
 
 func (this podController) setRequiredFields(pod *kubeapi.Pod) *kubeapi.Pod {
+	pullPolicy := this.store.Get().Pods.ImagePullPolicy
 	for i := range pod.Spec.Containers {
-		pod.Spec.Containers[i].ImagePullPolicy = kubeapi.PullAlways
+		if len(pullPolicy) > 0 {
+			pod.Spec.Containers[i].ImagePullPolicy = pullPolicy
+		} else if len(pod.Spec.Containers[i].ImagePullPolicy) == 0 {
+			pod.Spec.Containers[i].ImagePullPolicy = getDefaultPullPolicy(pod.Spec.Containers[i].Image)
+		}
 		pod.Spec.Containers[i].TerminationMessagePolicy = kubeapi.TerminationMessageReadFile
 		for j := range pod.Spec.Containers[i].Ports {
 			pod.Spec.Containers[i].Ports[j].Protocol = kubeapi.ProtocolTCP
@@ -149,6 +160,30 @@ func (this podController) setRequiredFields(pod *kubeapi.Pod) *kubeapi.Pod {
 	return pod
 }
 
-func NewPodController(iotDomain string) IPodController {
-	return &podController{iotDomain: iotDomain}
+func copyContainers(containers []kubeapi.Container) []kubeapi.Container {
+	if containers == nil {
+		return nil
+	}
+
+	result := make([]kubeapi.Container, len(containers))
+	for i, container := range containers {
+		result[i] = container
+		result[i].Ports = append([]kubeapi.ContainerPort(nil), container.Ports...)
+	}
+	return result
+}
+
+// getDefaultPullPolicy returns pull policy kubernetes defaults containers to, kubelets expect it to be set.
+func getDefaultPullPolicy(image string) kubeapi.PullPolicy {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if !strings.Contains(name, ":") || strings.HasSuffix(name, ":latest") {
+		return kubeapi.PullAlways
+	}
+	return kubeapi.PullIfNotPresent
+}
+
+// NewPodController creates controller transforming IotPods into Pods. Settings of transformed pods are read
+// from the store, so reloaded settings apply to the next transformation.
+func NewPodController(iotDomain string, store *config.ApiserverStore) IPodController {
+	return &podController{iotDomain: iotDomain, store: store}
 }
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"sort"
+
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+type IServiceController interface {
+	// TransformWatchEvent implements WatchEventController.
+	TransformWatchEvent(watch.Event) watch.Event
+
+	ToServiceList([]kubeapi.Service) *kubeapi.ServiceList
+	ToService(*kubeapi.Service) *kubeapi.Service
+}
+
+type serviceController struct{}
+
+// TransformWatchEvent sets type of Services sent by the watch cache
+func (this serviceController) TransformWatchEvent(event watch.Event) watch.Event {
+	if service, ok := event.Object.(*kubeapi.Service); ok {
+		event.Object = this.ToService(service)
+	}
+	return event
+}
+
+// ToServiceList returns list of Services served to devices
+func (this serviceController) ToServiceList(services []kubeapi.Service) *kubeapi.ServiceList {
+	list := &kubeapi.ServiceList{Items: make([]kubeapi.Service, 0, len(services))}
+	list.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceList"}
+
+	for _, service := range services {
+		list.Items = append(list.Items, *this.ToService(&service))
+	}
+	return list
+}
+
+// ToService returns copy of cached Service with its type set
+func (this serviceController) ToService(service *kubeapi.Service) *kubeapi.Service {
+	result := *service
+	result.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Service"}
+	return &result
+}
+
+func NewServiceController() IServiceController {
+	return &serviceController{}
+}
+
+type IEndpointsController interface {
+	// TransformWatchEvent implements WatchEventController.
+	TransformWatchEvent(watch.Event) watch.Event
+
+	ToEndpointsList([]kubeapi.Endpoints) *kubeapi.EndpointsList
+	ToEndpoints(*kubeapi.Endpoints) *kubeapi.Endpoints
+}
+
+type endpointsController struct {
+	services *watchcache.Cache
+	store    *config.ApiserverStore
+}
+
+// TransformWatchEvent rewrites Endpoints sent by the watch cache the way devices reach them
+func (this endpointsController) TransformWatchEvent(event watch.Event) watch.Event {
+	if endpoints, ok := event.Object.(*kubeapi.Endpoints); ok {
+		event.Object = this.ToEndpoints(endpoints)
+	}
+	return event
+}
+
+// ToEndpointsList returns list of Endpoints served to devices
+func (this endpointsController) ToEndpointsList(endpoints []kubeapi.Endpoints) *kubeapi.EndpointsList {
+	list := &kubeapi.EndpointsList{Items: make([]kubeapi.Endpoints, 0, len(endpoints))}
+	list.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "EndpointsList"}
+
+	for _, item := range endpoints {
+		list.Items = append(list.Items, *this.ToEndpoints(&item))
+	}
+	return list
+}
+
+// ToEndpoints returns copy of cached Endpoints as devices reach them. With the gateway, addresses of pods in
+// the cluster are replaced by the gateway address and ports by node ports of the service.
+func (this endpointsController) ToEndpoints(endpoints *kubeapi.Endpoints) *kubeapi.Endpoints {
+	result := *endpoints
+	result.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Endpoints"}
+
+	if cfg := this.store.Get().Services; cfg.Endpoints == config.EndpointsGateway {
+		result.Subsets = this.toGateway(endpoints, cfg.GatewayAddress)
+	}
+	return &result
+}
+
+// toGateway returns subsets of the endpoints at the gateway. Ports whose service port has no node port aren't
+// reachable through the gateway and are dropped. Ports are ready if any pod serving them is ready.
+func (this endpointsController) toGateway(endpoints *kubeapi.Endpoints,
+	gateway string) []kubeapi.EndpointSubset {
+	obj, err := this.services.Get(endpoints.Namespace, endpoints.Name)
+	if err != nil {
+		return []kubeapi.EndpointSubset{}
+	}
+
+	nodePorts := make(map[string]int32)
+	for _, port := range obj.(*kubeapi.Service).Spec.Ports {
+		if port.NodePort > 0 {
+			nodePorts[port.Name] = port.NodePort
+		}
+	}
+
+	ready := make(map[string]kubeapi.EndpointPort)
+	notReady := make(map[string]kubeapi.EndpointPort)
+	for _, subset := range endpoints.Subsets {
+		for _, port := range subset.Ports {
+			nodePort, ok := nodePorts[port.Name]
+			if !ok {
+				continue
+			}
+
+			port.Port = nodePort
+			if len(subset.Addresses) > 0 {
+				ready[port.Name] = port
+			} else if len(subset.NotReadyAddresses) > 0 {
+				notReady[port.Name] = port
+			}
+		}
+	}
+
+	subsets := make([]kubeapi.EndpointSubset, 0)
+	address := []kubeapi.EndpointAddress{{IP: gateway}}
+	if len(ready) > 0 {
+		subsets = append(subsets, kubeapi.EndpointSubset{Addresses: address, Ports: sortedPorts(ready, nil)})
+	}
+	if ports := sortedPorts(notReady, ready); len(ports) > 0 {
+		subsets = append(subsets, kubeapi.EndpointSubset{NotReadyAddresses: address, Ports: ports})
+	}
+	return subsets
+}
+
+// sortedPorts returns ports ordered by name, except those in excluded.
+func sortedPorts(ports, excluded map[string]kubeapi.EndpointPort) []kubeapi.EndpointPort {
+	result := make([]kubeapi.EndpointPort, 0, len(ports))
+	for name, port := range ports {
+		if _, ok := excluded[name]; !ok {
+			result = append(result, port)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// NewEndpointsController creates controller of Endpoints served to devices. Services are read from the
+// cache for their node ports.
+func NewEndpointsController(services *watchcache.Cache, store *config.ApiserverStore) IEndpointsController {
+	return &endpointsController{services: services, store: store}
+}
@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testGateway = "10.0.0.1"
+
+func newTestServices(t *testing.T, services ...kubeapi.Service) (*watchcache.Cache, chan struct{}) {
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &kubeapi.ServiceList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: services}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+
+	c := watchcache.NewCache("services", lw, &kubeapi.Service{}, func(runtime.Object) string { return "" }, 10, 10)
+	stopCh := make(chan struct{})
+	go c.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+	return c, stopCh
+}
+
+func newTestService(name string, ports ...kubeapi.ServicePort) kubeapi.Service {
+	return kubeapi.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       kubeapi.ServiceSpec{Ports: ports},
+	}
+}
+
+func newTestEndpoints(name string, subsets ...kubeapi.EndpointSubset) *kubeapi.Endpoints {
+	return &kubeapi.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Subsets:    subsets,
+	}
+}
+
+func TestToEndpointsGateway(t *testing.T) {
+	services, stopCh := newTestServices(t,
+		newTestService("web", kubeapi.ServicePort{Name: "http", Port: 80, NodePort: 30080},
+			kubeapi.ServicePort{Name: "https", Port: 443, NodePort: 30443},
+			kubeapi.ServicePort{Name: "metrics", Port: 9090}),
+	)
+	defer close(stopCh)
+
+	cfg := config.NewApiserverConfig()
+	cfg.Services = config.ServicesConfig{Endpoints: config.EndpointsGateway, GatewayAddress: testGateway}
+	ctrl := NewEndpointsController(services, config.NewApiserverStore(cfg))
+
+	pod := func(ip string) []kubeapi.EndpointAddress { return []kubeapi.EndpointAddress{{IP: ip}} }
+	gateway := pod(testGateway)
+	http := kubeapi.EndpointPort{Name: "http", Port: 8080, Protocol: kubeapi.ProtocolTCP}
+	https := kubeapi.EndpointPort{Name: "https", Port: 8443, Protocol: kubeapi.ProtocolTCP}
+	metrics := kubeapi.EndpointPort{Name: "metrics", Port: 9090, Protocol: kubeapi.ProtocolTCP}
+	atNodePort := func(port kubeapi.EndpointPort, nodePort int32) kubeapi.EndpointPort {
+		port.Port = nodePort
+		return port
+	}
+
+	cases := []struct {
+		name      string
+		endpoints *kubeapi.Endpoints
+		expected  []kubeapi.EndpointSubset
+	}{
+		{"ready", newTestEndpoints("web",
+			kubeapi.EndpointSubset{Addresses: pod("172.16.0.1"), Ports: []kubeapi.EndpointPort{https, http}}),
+			[]kubeapi.EndpointSubset{{Addresses: gateway,
+				Ports: []kubeapi.EndpointPort{atNodePort(http, 30080), atNodePort(https, 30443)}}},
+		},
+		{"not ready", newTestEndpoints("web",
+			kubeapi.EndpointSubset{NotReadyAddresses: pod("172.16.0.1"), Ports: []kubeapi.EndpointPort{http}}),
+			[]kubeapi.EndpointSubset{{NotReadyAddresses: gateway,
+				Ports: []kubeapi.EndpointPort{atNodePort(http, 30080)}}},
+		},
+		{"ready and not ready merged", newTestEndpoints("web",
+			kubeapi.EndpointSubset{Addresses: pod("172.16.0.1"), NotReadyAddresses: pod("172.16.0.2"),
+				Ports: []kubeapi.EndpointPort{http}},
+			kubeapi.EndpointSubset{NotReadyAddresses: pod("172.16.0.3"), Ports: []kubeapi.EndpointPort{http, https}},
+		), []kubeapi.EndpointSubset{
+			{Addresses: gateway, Ports: []kubeapi.EndpointPort{atNodePort(http, 30080)}},
+			{NotReadyAddresses: gateway, Ports: []kubeapi.EndpointPort{atNodePort(https, 30443)}},
+		}},
+		{"ports without node port dropped", newTestEndpoints("web",
+			kubeapi.EndpointSubset{Addresses: pod("172.16.0.1"), Ports: []kubeapi.EndpointPort{http, metrics}},
+			kubeapi.EndpointSubset{NotReadyAddresses: pod("172.16.0.2"), Ports: []kubeapi.EndpointPort{metrics}},
+		), []kubeapi.EndpointSubset{{Addresses: gateway, Ports: []kubeapi.EndpointPort{atNodePort(http, 30080)}}}},
+		{"no addresses", newTestEndpoints("web", kubeapi.EndpointSubset{Ports: []kubeapi.EndpointPort{http}}),
+			[]kubeapi.EndpointSubset{}},
+		{"no service", newTestEndpoints("db",
+			kubeapi.EndpointSubset{Addresses: pod("172.16.0.1"), Ports: []kubeapi.EndpointPort{http}}),
+			[]kubeapi.EndpointSubset{}},
+	}
+
+	for _, c := range cases {
+		result := ctrl.ToEndpoints(c.endpoints)
+		if result.Kind != "Endpoints" || result.APIVersion != "v1" {
+			t.Errorf("%s: expected v1 Endpoints, got %s %s", c.name, result.APIVersion, result.Kind)
+		}
+		if !reflect.DeepEqual(result.Subsets, c.expected) {
+			t.Errorf("%s: expected subsets %+v, got %+v", c.name, c.expected, result.Subsets)
+		}
+	}
+}
+
+func TestToEndpointsDirect(t *testing.T) {
+	services, stopCh := newTestServices(t)
+	defer close(stopCh)
+	ctrl := NewEndpointsController(services, config.NewApiserverStore(config.NewApiserverConfig()))
+
+	endpoints := newTestEndpoints("web", kubeapi.EndpointSubset{
+		Addresses: []kubeapi.EndpointAddress{{IP: "172.16.0.1"}},
+		Ports:     []kubeapi.EndpointPort{{Name: "http", Port: 8080}},
+	})
+	if result := ctrl.ToEndpoints(endpoints); !reflect.DeepEqual(result.Subsets, endpoints.Subsets) {
+		t.Errorf("expected subsets %+v, got %+v", endpoints.Subsets, result.Subsets)
+	}
+}
@@ -0,0 +1,137 @@
+package encoding
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+)
+
+const (
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+// Filter compresses responses with gzip if the client accepts it, watch streams included. Response bytes
+// before and after compression are recorded per route and content type, so savings can be measured.
+func Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	writer := &responseWriter{ResponseWriter: resp.ResponseWriter, compress: acceptsGzip(req.Request)}
+	resp.ResponseWriter = writer
+	defer func() {
+		writer.Close()
+		metrics.ObserveResponseBytes(req.SelectedRoutePath(), mediaType(writer.Header().Get("Content-Type")),
+			writer.encoding(), writer.uncompressed, writer.sent)
+	}()
+
+	chain.ProcessFilter(req, resp)
+}
+
+func acceptsGzip(req *http.Request) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+
+	for _, accepted := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0]) == encodingGzip {
+			return true
+		}
+	}
+	return false
+}
+
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "unknown"
+	}
+	return mediaType
+}
+
+// responseWriter compresses written body and counts bytes written before and after compression. It can be
+// flushed, so watch events reach devices right away.
+type responseWriter struct {
+	http.ResponseWriter
+
+	compress    bool
+	gzip        *gzip.Writer
+	wroteHeader bool
+
+	uncompressed int
+	sent         int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	// Responses without body and responses encoded by handlers are sent as they are
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified ||
+		len(w.Header().Get("Content-Encoding")) > 0 {
+		w.compress = false
+	}
+
+	if w.compress {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", encodingGzip)
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.gzip = gzip.NewWriter(countingWriter{w})
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.uncompressed += len(data)
+
+	if w.gzip != nil {
+		return w.gzip.Write(data)
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.sent += n
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (w *responseWriter) Flush() {
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier.
+func (w *responseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// Close writes the rest of the compressed body.
+func (w *responseWriter) Close() {
+	if w.gzip != nil {
+		w.gzip.Close()
+	}
+}
+
+func (w *responseWriter) encoding() string {
+	if w.gzip != nil {
+		return encodingGzip
+	}
+	return encodingIdentity
+}
+
+// countingWriter counts compressed bytes sent to the client.
+type countingWriter struct {
+	w *responseWriter
+}
+
+func (c countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.ResponseWriter.Write(data)
+	c.w.sent += n
+	return n, err
+}
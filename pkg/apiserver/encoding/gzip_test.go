@@ -0,0 +1,135 @@
+package encoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gunzip(t *testing.T, data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("cannot read gzip header: %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("cannot decompress body: %s", err.Error())
+	}
+	return string(body)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		method, acceptEncoding string
+		expected               bool
+	}{
+		{http.MethodGet, "gzip", true},
+		{http.MethodGet, "deflate, gzip;q=1.0", true},
+		{http.MethodGet, "identity", false},
+		{http.MethodGet, "", false},
+		{http.MethodGet, "gzipped", false},
+		{http.MethodHead, "gzip", false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/api/v1/pods", nil)
+		req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		if actual := acceptsGzip(req); actual != c.expected {
+			t.Errorf("%s with %q: expected %t, got %t", c.method, c.acceptEncoding, c.expected, actual)
+		}
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := &responseWriter{ResponseWriter: recorder, compress: true}
+
+	first := `{"type":"ADDED"}` + "\n"
+	writer.Write([]byte(first))
+	writer.Flush()
+
+	// Flushed event is readable before the stream ends
+	if !recorder.Flushed {
+		t.Errorf("expected underlying writer to be flushed")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("cannot read gzip header: %s", err.Error())
+	}
+	flushed := make([]byte, len(first))
+	if _, err := reader.Read(flushed); err != nil || string(flushed) != first {
+		t.Errorf("expected flushed event %q, got %q: %v", first, flushed, err)
+	}
+
+	second := `{"type":"DELETED"}` + "\n"
+	writer.Write([]byte(second))
+	writer.Close()
+
+	if body := gunzip(t, recorder.Body.Bytes()); body != first+second {
+		t.Errorf("expected body %q, got %q", first+second, body)
+	}
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != encodingGzip {
+		t.Errorf("expected gzip content encoding, got %q", encoding)
+	}
+	if writer.uncompressed != len(first+second) || writer.sent != recorder.Body.Len() {
+		t.Errorf("expected %d bytes before and %d after compression, got %d and %d", len(first+second),
+			recorder.Body.Len(), writer.uncompressed, writer.sent)
+	}
+}
+
+func TestResponseWriterSkip(t *testing.T) {
+	cases := []struct {
+		name     string
+		compress bool
+		code     int
+		// encoding is Content-Encoding set by the handler
+		encoding string
+	}{
+		{"not accepted", false, http.StatusOK, ""},
+		{"no content", true, http.StatusNoContent, ""},
+		{"not modified", true, http.StatusNotModified, ""},
+		{"encoded by handler", true, http.StatusOK, "deflate"},
+	}
+
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		writer := &responseWriter{ResponseWriter: recorder, compress: c.compress}
+		if len(c.encoding) > 0 {
+			writer.Header().Set("Content-Encoding", c.encoding)
+		}
+
+		writer.WriteHeader(c.code)
+		body := ""
+		if c.code == http.StatusOK {
+			body = "plain body"
+			writer.Write([]byte(body))
+		}
+		writer.Close()
+
+		if recorder.Code != c.code || recorder.Body.String() != body {
+			t.Errorf("%s: expected %d with body %q, got %d with %q", c.name, c.code, body, recorder.Code,
+				recorder.Body.String())
+		}
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != c.encoding {
+			t.Errorf("%s: expected content encoding %q, got %q", c.name, c.encoding, encoding)
+		}
+		if writer.encoding() != encodingIdentity || writer.sent != len(body) {
+			t.Errorf("%s: expected %d bytes sent uncompressed, got %d as %s", c.name, len(body), writer.sent,
+				writer.encoding())
+		}
+	}
+
+	// Headers are written once, the body keeps status of the first call
+	recorder := httptest.NewRecorder()
+	writer := &responseWriter{ResponseWriter: recorder, compress: true}
+	writer.WriteHeader(http.StatusCreated)
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("created"))
+	writer.Close()
+	if recorder.Code != http.StatusCreated || gunzip(t, recorder.Body.Bytes()) != "created" {
+		t.Errorf("expected compressed %d response, got %d", http.StatusCreated, recorder.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/vnd.kubernetes.protobuf"
+	// ContentTypeProtobufWatch is content type of watch streams of length-delimited protobuf events.
+	ContentTypeProtobufWatch = ContentTypeProtobuf + ";stream=watch"
+
+	// listMetaField and continueField are protobuf field numbers of ListMeta in lists and of continue in
+	// ListMeta, which the vendored API types lack.
+	listMetaField = 1
+	continueField = 3
+)
+
+var serializer = protobuf.NewSerializer(nil, nil, ContentTypeProtobuf)
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type unmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+// AcceptsProtobuf returns true if the client accepts protobuf responses. Kubelets do so when started with
+// --kube-api-content-type=application/vnd.kubernetes.protobuf.
+func AcceptsProtobuf(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == ContentTypeProtobuf {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProtobuf returns true if the request body is protobuf.
+func IsProtobuf(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == ContentTypeProtobuf
+}
+
+// DecodeBody decodes request body into the object. Protobuf bodies are decoded if the request says so,
+// others are decoded as JSON.
+func DecodeBody(req *http.Request, body []byte, into runtime.Object) error {
+	if !IsProtobuf(req) {
+		return json.Unmarshal(body, into)
+	}
+
+	target, ok := into.(unmarshaler)
+	if !ok {
+		return fmt.Errorf("%T can't be decoded from protobuf", into)
+	}
+
+	unknown := &runtime.Unknown{}
+	if _, _, err := serializer.Decode(body, nil, unknown); err != nil {
+		return err
+	}
+	return target.Unmarshal(unknown.Raw)
+}
+
+// EncodeProtobuf encodes the object as protobuf. Kind and API version are taken from its TypeMeta.
+func EncodeProtobuf(obj runtime.Object) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := serializer.Encode(obj, buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// EncodeProtobufList encodes the list as protobuf with continue token of the next page, if any.
+func EncodeProtobufList(list runtime.Object, continueToken string) ([]byte, error) {
+	if len(continueToken) == 0 {
+		return EncodeProtobuf(list)
+	}
+
+	message, ok := list.(marshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T can't be encoded as protobuf", list)
+	}
+	data, err := message.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// Repeated embedded messages are merged by decoders, so continue is set on top of the encoded ListMeta
+	listMeta := appendBytesField(nil, continueField, []byte(continueToken))
+	data = appendBytesField(data, listMetaField, listMeta)
+
+	kind := list.GetObjectKind().GroupVersionKind()
+	return EncodeProtobuf(&runtime.Unknown{
+		TypeMeta: runtime.TypeMeta{APIVersion: kind.GroupVersion().String(), Kind: kind.Kind},
+		Raw:      data,
+	})
+}
+
+// EncodeProtobufWatchEvent encodes the event as a frame of a protobuf watch stream.
+func EncodeProtobufWatchEvent(event watch.Event) ([]byte, error) {
+	object, err := EncodeProtobuf(event.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	watchEvent := &metav1.WatchEvent{Type: string(event.Type), Object: runtime.RawExtension{Raw: object}}
+	data, err := watchEvent.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	return append(frame, data...), nil
+}
+
+func appendBytesField(data []byte, field int, value []byte) []byte {
+	data = appendVarint(data, uint64(field<<3|2))
+	data = appendVarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendVarint(data []byte, value uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return append(data, buffer[:binary.PutUvarint(buffer, value)]...)
+}
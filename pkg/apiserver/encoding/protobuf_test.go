@@ -0,0 +1,122 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func newTestPodList() *kubeapi.PodList {
+	list := &kubeapi.PodList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "42", SelfLink: "/api/v1/pods"},
+	}
+	for _, name := range []string{"pod-a", "pod-b"} {
+		pod := kubeapi.Pod{}
+		pod.Name = name
+		pod.Namespace = "default"
+		pod.Spec.NodeName = "raspi-1"
+		list.Items = append(list.Items, pod)
+	}
+	return list
+}
+
+// decodeTestList decodes protobuf list encoded by EncodeProtobufList and returns the raw message too.
+func decodeTestList(t *testing.T, data []byte) (*kubeapi.PodList, *runtime.Unknown) {
+	unknown := &runtime.Unknown{}
+	if _, _, err := serializer.Decode(data, nil, unknown); err != nil {
+		t.Fatalf("cannot decode envelope: %s", err.Error())
+	}
+
+	list := &kubeapi.PodList{}
+	if err := list.Unmarshal(unknown.Raw); err != nil {
+		t.Fatalf("cannot decode list: %s", err.Error())
+	}
+	return list, unknown
+}
+
+// readBytesFields returns values of all length-delimited fields with given number, in order.
+func readBytesFields(t *testing.T, data []byte, field int) [][]byte {
+	values := make([][]byte, 0)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("invalid field key")
+		}
+		data = data[n:]
+
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatal("invalid length")
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if int(key>>3) == field {
+				values = append(values, value)
+			}
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return values
+}
+
+func TestEncodeProtobufList(t *testing.T) {
+	for _, continueToken := range []string{"", "eyJydiI6NDIsInN0YXJ0IjoiZGVmYXVsdC9wb2QtYiJ9"} {
+		data, err := EncodeProtobufList(newTestPodList(), continueToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, unknown := decodeTestList(t, data)
+		if unknown.APIVersion != "v1" || unknown.Kind != "PodList" {
+			t.Errorf("expected v1 PodList, got %s %s", unknown.APIVersion, unknown.Kind)
+		}
+		// Fields of the encoded ListMeta survive merging with the appended one
+		if list.ResourceVersion != "42" || list.SelfLink != "/api/v1/pods" {
+			t.Errorf("expected list meta to be kept, got %+v", list.ListMeta)
+		}
+		if len(list.Items) != 2 || list.Items[0].Name != "pod-a" || list.Items[1].Spec.NodeName != "raspi-1" {
+			t.Errorf("expected both pods to be decoded, got %+v", list.Items)
+		}
+
+		// Vendored ListMeta lacks continue, so it's read from the last ListMeta field of the message
+		var decoded string
+		listMetas := readBytesFields(t, unknown.Raw, listMetaField)
+		if len(listMetas) > 0 {
+			for _, value := range readBytesFields(t, listMetas[len(listMetas)-1], continueField) {
+				decoded = string(value)
+			}
+		}
+		if decoded != continueToken {
+			t.Errorf("expected continue token %q, got %q", continueToken, decoded)
+		}
+	}
+}
+
+// plainList is a list without protobuf encoding.
+type plainList struct {
+	Items []string
+}
+
+func (l *plainList) GetObjectKind() schema.ObjectKind {
+	return schema.EmptyObjectKind
+}
+
+func TestEncodeProtobufListUnsupported(t *testing.T) {
+	if _, err := EncodeProtobufList(&plainList{}, "token"); err == nil {
+		t.Errorf("expected error for object without protobuf encoding")
+	}
+}
@@ -0,0 +1,346 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watchcache"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/golang/groupcache/lru"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// maxRecords is number of aggregated events kept in memory. Least recently seen events are forgotten first.
+const maxRecords = 10000
+
+const (
+	resultCreated    = "created"
+	resultAggregated = "aggregated"
+	resultDropped    = "dropped"
+)
+
+// record is an event aggregated in memory together with its repeated occurrences.
+type record struct {
+	key       string
+	device    string
+	namespace string
+	name      string
+	event     *apiv1.Event
+	// created is false until the event is written upstream. Events over the rate cap are written with
+	// their count once the device is allowed to write again.
+	created bool
+	seen    time.Time
+
+	// writing serializes writes of the event upstream, so occurrences don't patch it before it's created.
+	writing sync.Mutex
+}
+
+// limiter caps events written upstream by a device. It's replaced when the cap is reloaded.
+type limiter struct {
+	qps     float32
+	burst   int
+	limiter flowcontrol.RateLimiter
+}
+
+// Aggregator writes events of devices to the kubernetes apiserver. Events are rewritten to reference
+// IotDevices and IotPods in the namespace of the device, repeated events are counted into a single event
+// and events written by a device are capped by the events config.
+type Aggregator struct {
+	client    corev1.EventsGetter
+	devices   *watchcache.Cache
+	iotDomain string
+	store     *config.ApiserverStore
+
+	mu       sync.Mutex
+	records  *lru.Cache
+	names    map[string]*record
+	limiters map[string]*limiter
+}
+
+// NewAggregator creates aggregator of device events. Devices cache is used to reference IotDevices by UID.
+func NewAggregator(client corev1.EventsGetter, devices *watchcache.Cache, iotDomain string,
+	store *config.ApiserverStore) *Aggregator {
+	a := &Aggregator{
+		client:    client,
+		devices:   devices,
+		iotDomain: iotDomain,
+		store:     store,
+		records:   lru.New(maxRecords),
+		names:     make(map[string]*record),
+		limiters:  make(map[string]*limiter),
+	}
+	a.records.OnEvicted = func(_ lru.Key, value interface{}) {
+		rec := value.(*record)
+		if current := a.names[rec.namespace+"/"+rec.name]; current == rec {
+			delete(a.names, rec.namespace+"/"+rec.name)
+		}
+	}
+	return a
+}
+
+// Create records event sent by the device. Returned event has name of the aggregated event and the involved
+// object of the device, so kubelets update it on repeated occurrences.
+func (a *Aggregator) Create(device, namespace string, event *apiv1.Event) (*apiv1.Event, error) {
+	involvedObject := event.InvolvedObject
+	a.rewrite(device, namespace, event)
+	if event.LastTimestamp.IsZero() {
+		event.LastTimestamp = metav1.Now()
+	}
+	if event.FirstTimestamp.IsZero() {
+		event.FirstTimestamp = event.LastTimestamp
+	}
+	key := aggregateKey(device, event)
+
+	a.mu.Lock()
+	value, ok := a.records.Get(key)
+	rec, _ := value.(*record)
+	if !ok || time.Since(rec.seen) > a.store.Get().Events.AggregationWindow.Duration {
+		rec = &record{key: key, device: device, namespace: namespace, name: event.Name, event: event}
+		if len(rec.name) == 0 {
+			rec.name = fmt.Sprintf("%s.%x", event.InvolvedObject.Name, time.Now().UnixNano())
+		}
+		rec.event.Name = rec.name
+		if rec.event.Count == 0 {
+			rec.event.Count = 1
+		}
+		a.add(rec)
+	} else {
+		rec.event.Count++
+		rec.event.LastTimestamp = event.LastTimestamp
+	}
+	rec.seen = time.Now()
+	a.mu.Unlock()
+
+	result, err := a.write(device, rec)
+	if err != nil {
+		return nil, err
+	}
+	return withInvolvedObject(result, involvedObject), nil
+}
+
+// Update records repeated occurrence of event with given name, sent by the device as patch. Unknown events
+// of the device are patched upstream, kubelets create them again if they don't exist. Events of other devices
+// are not found.
+func (a *Aggregator) Update(device, namespace, name string, patch []byte) (*apiv1.Event, error) {
+	occurrence := &apiv1.Event{}
+	if err := json.Unmarshal(patch, occurrence); err != nil {
+		return nil, errors.NewBadRequest(err.Error())
+	}
+
+	a.mu.Lock()
+	rec, ok := a.names[namespace+"/"+name]
+	if ok && rec.device != device {
+		a.mu.Unlock()
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "events"}, name)
+	}
+	if !ok {
+		a.mu.Unlock()
+		return a.patchUnknown(device, namespace, name, occurrence)
+	}
+
+	a.records.Get(rec.key)
+	rec.event.Count++
+	if !occurrence.LastTimestamp.IsZero() {
+		rec.event.LastTimestamp = occurrence.LastTimestamp
+	}
+	if len(occurrence.Message) > 0 {
+		rec.event.Message = occurrence.Message
+	}
+	rec.seen = time.Now()
+	involvedObject := rec.event.InvolvedObject
+	a.mu.Unlock()
+
+	result, err := a.write(device, rec)
+	if err != nil {
+		return nil, err
+	}
+	return withInvolvedObject(result, involvedObject), nil
+}
+
+// write creates or patches the aggregated event upstream if the device is under its rate cap. Otherwise the
+// event keeps being counted in memory and the occurrence is reported as dropped.
+func (a *Aggregator) write(device string, rec *record) (*apiv1.Event, error) {
+	rec.writing.Lock()
+	defer rec.writing.Unlock()
+
+	a.mu.Lock()
+	event := *rec.event
+	created := rec.created
+	allowed := a.allow(device)
+	a.mu.Unlock()
+
+	if !allowed {
+		metrics.DeviceEventRecorded(resultDropped)
+		return &event, nil
+	}
+
+	if !created {
+		result, err := a.client.Events(rec.namespace).Create(&event)
+		if err != nil {
+			a.forget(rec)
+			return nil, err
+		}
+		a.mu.Lock()
+		rec.created = true
+		a.mu.Unlock()
+		metrics.DeviceEventRecorded(resultCreated)
+		return result, nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"count":         event.Count,
+		"lastTimestamp": event.LastTimestamp,
+		"message":       event.Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := a.client.Events(rec.namespace).Patch(rec.name, types.MergePatchType, patch)
+	if errors.IsNotFound(err) {
+		// Event was deleted upstream, e.g. by its TTL, so the next occurrence starts a new one
+		a.forget(rec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.DeviceEventRecorded(resultAggregated)
+	return result, nil
+}
+
+// patchUnknown patches event which isn't aggregated in memory, e.g. after restart, with the occurrence. Events
+// of other devices, told apart by their device selector label, are reported as not found.
+func (a *Aggregator) patchUnknown(device, namespace, name string, occurrence *apiv1.Event) (*apiv1.Event, error) {
+	current, err := a.client.Events(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if current.Labels[v1.DeviceSelector] != device {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "events"}, name)
+	}
+
+	// Only the occurrence is patched, so devices can't relabel the event. Resource version makes the patch
+	// fail if the event changed since it was checked.
+	fields := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": current.ResourceVersion},
+		"count":    current.Count + 1,
+	}
+	if occurrence.Count > 0 {
+		fields["count"] = occurrence.Count
+	}
+	if !occurrence.LastTimestamp.IsZero() {
+		fields["lastTimestamp"] = occurrence.LastTimestamp
+	}
+	if len(occurrence.Message) > 0 {
+		fields["message"] = occurrence.Message
+	}
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := a.client.Events(namespace).Patch(name, types.MergePatchType, patch)
+	if err != nil {
+		return nil, err
+	}
+	metrics.DeviceEventRecorded(resultAggregated)
+	return result, nil
+}
+
+// rewrite makes the event reference IotDevice or IotPod of the device in its namespace instead of Node or
+// Pod, which don't exist, and tags it with the device.
+func (a *Aggregator) rewrite(device, namespace string, event *apiv1.Event) {
+	ref := &event.InvolvedObject
+	switch ref.Kind {
+	case string(v1.NodeKind):
+		ref.Kind = v1.IotDeviceKind
+		ref.UID = ""
+		if obj, err := a.devices.Get(namespace, ref.Name); err == nil {
+			ref.UID = obj.(*v1.IotDevice).Metadata.UID
+		}
+	case v1.PodKind:
+		ref.Kind = v1.IotPodKind
+	}
+	if ref.Kind == v1.IotDeviceKind || ref.Kind == v1.IotPodKind {
+		ref.APIVersion = a.iotDomain + "/" + v1.APIVersion
+		ref.Namespace = namespace
+		ref.ResourceVersion = ""
+	}
+
+	event.Namespace = namespace
+	event.ResourceVersion = ""
+	event.Source.Host = device
+	if event.Labels == nil {
+		event.Labels = make(map[string]string)
+	}
+	event.Labels[v1.DeviceSelector] = device
+}
+
+// allow returns true if the device may write an event upstream. Caller must hold the lock.
+func (a *Aggregator) allow(device string) bool {
+	cfg := a.store.Get().Events
+	current, ok := a.limiters[device]
+	if !ok || current.qps != cfg.QPS || current.burst != cfg.Burst {
+		current = &limiter{qps: cfg.QPS, burst: cfg.Burst,
+			limiter: flowcontrol.NewTokenBucketRateLimiter(cfg.QPS, cfg.Burst)}
+		a.limiters[device] = current
+	}
+	return current.limiter.TryAccept()
+}
+
+// add stores new record in place of expired record of the same event or record with the same name. Caller
+// must hold the lock.
+func (a *Aggregator) add(rec *record) {
+	a.records.Remove(rec.key)
+	if previous, ok := a.names[rec.namespace+"/"+rec.name]; ok {
+		a.records.Remove(previous.key)
+	}
+	a.records.Add(rec.key, rec)
+	a.names[rec.namespace+"/"+rec.name] = rec
+}
+
+func (a *Aggregator) forget(rec *record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if current, ok := a.names[rec.namespace+"/"+rec.name]; ok && current == rec {
+		a.records.Remove(rec.key)
+	}
+}
+
+// withInvolvedObject returns copy of the event referencing given object. Events returned by the client are
+// never changed.
+func withInvolvedObject(event *apiv1.Event, involvedObject apiv1.ObjectReference) *apiv1.Event {
+	out := *event
+	out.InvolvedObject = involvedObject
+	return &out
+}
+
+// aggregateKey identifies repeated events of the device. Events differing only in timestamps and count are
+// the same event.
+func aggregateKey(device string, event *apiv1.Event) string {
+	ref := event.InvolvedObject
+	return strings.Join([]string{
+		device,
+		event.Source.Component,
+		ref.Kind,
+		ref.Namespace,
+		ref.Name,
+		string(ref.UID),
+		ref.FieldPath,
+		event.Type,
+		event.Reason,
+		event.Message,
+	}, "\x00")
+}
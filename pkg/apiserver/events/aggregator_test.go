@@ -0,0 +1,180 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const testNamespace = "devices"
+
+// fakeEvents stores events of a single namespace. Create waits for creating to be closed, if it's set.
+type fakeEvents struct {
+	corev1.EventInterface
+
+	mu       sync.Mutex
+	events   map[string]*apiv1.Event
+	patches  []string
+	creating chan struct{}
+	started  chan struct{}
+}
+
+func newFakeEvents() *fakeEvents {
+	return &fakeEvents{events: make(map[string]*apiv1.Event), started: make(chan struct{}, 1)}
+}
+
+func (f *fakeEvents) Events(namespace string) corev1.EventInterface {
+	return f
+}
+
+func (f *fakeEvents) Create(event *apiv1.Event) (*apiv1.Event, error) {
+	f.started <- struct{}{}
+	if f.creating != nil {
+		<-f.creating
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created := *event
+	f.events[event.Name] = &created
+	result := created
+	return &result, nil
+}
+
+func (f *fakeEvents) Get(name string, options metav1.GetOptions) (*apiv1.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event, ok := f.events[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "events"}, name)
+	}
+	result := *event
+	return &result, nil
+}
+
+func (f *fakeEvents) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*apiv1.Event,
+	error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event, ok := f.events[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "events"}, name)
+	}
+	f.patches = append(f.patches, string(data))
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	result := *event
+	return &result, nil
+}
+
+func newTestAggregator(client *fakeEvents) *Aggregator {
+	return NewAggregator(client, nil, "fujitsu.com", config.NewApiserverStore(config.NewApiserverConfig()))
+}
+
+func newTestEvent(name string) *apiv1.Event {
+	event := &apiv1.Event{Reason: "Pulled", Message: "Container image pulled"}
+	event.Name = name
+	event.InvolvedObject = apiv1.ObjectReference{Kind: v1.PodKind, Name: "nginx"}
+	return event
+}
+
+func TestAggregatorUpdateWhileCreating(t *testing.T) {
+	client := newFakeEvents()
+	client.creating = make(chan struct{})
+	aggregator := newTestAggregator(client)
+
+	created := make(chan error)
+	go func() {
+		_, err := aggregator.Create("raspi-1", testNamespace, newTestEvent("nginx.1"))
+		created <- err
+	}()
+	<-client.started
+
+	updated := make(chan error)
+	go func() {
+		_, err := aggregator.Update("raspi-1", testNamespace, "nginx.1", []byte(`{"count":2}`))
+		updated <- err
+	}()
+
+	close(client.creating)
+	if err := <-created; err != nil {
+		t.Fatalf("unexpected create error %s", err.Error())
+	}
+	// Occurrence waits for the event to be created instead of failing to patch it
+	if err := <-updated; err != nil {
+		t.Fatalf("unexpected update error %s", err.Error())
+	}
+	if event, _ := client.Get("nginx.1", metav1.GetOptions{}); event.Count != 2 {
+		t.Errorf("expected count 2, got %d", event.Count)
+	}
+}
+
+func TestAggregatorUpdateUnknown(t *testing.T) {
+	cases := []struct {
+		name   string
+		labels map[string]string
+		found  bool
+	}{
+		{"own event", map[string]string{v1.DeviceSelector: "raspi-1"}, true},
+		{"event of other device", map[string]string{v1.DeviceSelector: "raspi-2"}, false},
+		{"unlabeled event", nil, false},
+	}
+
+	for _, c := range cases {
+		client := newFakeEvents()
+		event := newTestEvent("nginx.1")
+		event.Labels = c.labels
+		event.Count = 3
+		client.events[event.Name] = event
+		aggregator := newTestAggregator(client)
+
+		patch := `{"count":4,"message":"Pulled again","metadata":{"labels":{"deviceSelector":"raspi-1"}}}`
+		result, err := aggregator.Update("raspi-1", testNamespace, "nginx.1", []byte(patch))
+		if !c.found {
+			if !errors.IsNotFound(err) || len(client.patches) > 0 {
+				t.Errorf("%s: expected not found without patch, got %v and patches %v", c.name, err, client.patches)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		if result.Count != 4 || result.Message != "Pulled again" {
+			t.Errorf("%s: expected occurrence to be patched, got %+v", c.name, result)
+		}
+		// Only the occurrence is patched
+		if len(client.patches) != 1 || strings.Contains(client.patches[0], "labels") {
+			t.Errorf("%s: expected single patch without labels, got %v", c.name, client.patches)
+		}
+	}
+}
+
+func TestAggregatorUpdateOtherDevice(t *testing.T) {
+	client := newFakeEvents()
+	aggregator := newTestAggregator(client)
+	if _, err := aggregator.Create("raspi-1", testNamespace, newTestEvent("nginx.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, device := range []string{"raspi-2", ""} {
+		if _, err := aggregator.Update(device, testNamespace, "nginx.1", []byte(`{"count":2}`)); !errors.IsNotFound(err) {
+			t.Errorf("%q: expected not found, got %v", device, err)
+		}
+	}
+	if len(client.patches) > 0 {
+		t.Errorf("expected no patches, got %v", client.patches)
+	}
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "iot_apiserver"
+
+var (
+	requestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of handled requests per route, method and status code.",
+		},
+		[]string{"route", "method", "code"},
+	)
+
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Request latencies per route and method. Watches are observed when they are closed.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+		},
+		[]string{"route", "method"},
+	)
+
+	activeWatches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_watches",
+			Help:      "Number of open watch connections per resource and notifier.",
+		},
+		[]string{"resource", "notifier"},
+	)
+
+	streamedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watch_sent_bytes_total",
+			Help:      "Number of bytes streamed to devices over watch connections per resource.",
+		},
+		[]string{"resource"},
+	)
+
+	responseBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_bytes_total",
+			Help:      "Number of response body bytes sent per route, content type and content encoding.",
+		},
+		[]string{"route", "content_type", "encoding"},
+	)
+
+	uncompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_uncompressed_bytes_total",
+			Help:      "Number of response body bytes before compression per route and content type.",
+		},
+		[]string{"route", "content_type"},
+	)
+
+	upstreamLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Latencies of requests to the kubernetes apiserver per proxy and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"proxy", "method"},
+	)
+
+	terminatedWatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "watch_cache_terminated_watches_total",
+			Help:      "Number of watches served from the watch cache closed for falling behind, per resource.",
+		},
+		[]string{"resource"},
+	)
+
+	deviceEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "device_events_total",
+			Help:      "Number of events sent by devices per result: created, aggregated into an event or dropped.",
+		},
+		[]string{"result"},
+	)
+
+	throttledRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "throttled_requests_total",
+			Help:      "Number of requests rejected by rate limits per scope, address, device, client or tenant, and verb.",
+		},
+		[]string{"scope", "verb"},
+	)
+
+	upstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_errors_total",
+			Help:      "Number of failed requests to the kubernetes apiserver per proxy and method.",
+		},
+		[]string{"proxy", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestCount, requestLatency, activeWatches, streamedBytes, upstreamLatency,
+		upstreamErrors, terminatedWatches, responseBytes, uncompressedBytes, deviceEvents, throttledRequests)
+}
+
+// RouteFilter records count and latency of every request served by the web service. Routes are reported
+// with their path templates, e.g. /api/v1/namespaces/{namespace}/pods, so the number of series is bounded.
+func RouteFilter(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
+	start := time.Now()
+	chain.ProcessFilter(req, res)
+
+	route := req.SelectedRoutePath()
+	method := req.Request.Method
+
+	requestCount.WithLabelValues(route, method, strconv.Itoa(res.StatusCode())).Inc()
+	requestLatency.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+}
+
+// WatchStarted increments number of open watch connections. Returned function has to be called when the
+// connection is closed.
+func WatchStarted(resource, notifier string) func() {
+	gauge := activeWatches.WithLabelValues(resource, notifier)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// AddStreamedBytes records bytes written to a watch connection of resource.
+func AddStreamedBytes(resource string, n int) {
+	streamedBytes.WithLabelValues(resource).Add(float64(n))
+}
+
+// ObserveResponseBytes records size of a response body before and after compression. Watches are observed
+// when they are closed.
+func ObserveResponseBytes(route, contentType, encoding string, uncompressed, sent int) {
+	responseBytes.WithLabelValues(route, contentType, encoding).Add(float64(sent))
+	uncompressedBytes.WithLabelValues(route, contentType).Add(float64(uncompressed))
+}
+
+// WatchTerminated counts a watch of resource closed by the watch cache for falling behind.
+func WatchTerminated(resource string) {
+	terminatedWatches.WithLabelValues(resource).Inc()
+}
+
+// DeviceEventRecorded counts an event sent by a device with given result.
+func DeviceEventRecorded(result string) {
+	deviceEvents.WithLabelValues(result).Inc()
+}
+
+// RequestThrottled counts a request rejected by rate limit of given scope and verb.
+func RequestThrottled(scope, verb string) {
+	throttledRequests.WithLabelValues(scope, verb).Inc()
+}
+
+// ObserveUpstream records latency of an upstream request started at given time and counts it as failed
+// if err is not nil.
+func ObserveUpstream(proxy, method string, start time.Time, err error) {
+	upstreamLatency.WithLabelValues(proxy, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamErrors.WithLabelValues(proxy, method).Inc()
+	}
+}
@@ -0,0 +1,215 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// operation is an operation of JSON patch (RFC 6902).
+type operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies operations to the document in order. The patch fails as a whole if any of them
+// fails.
+func applyJSONPatch(document interface{}, operations []operation) (interface{}, error) {
+	for _, op := range operations {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+			if len(op.Value) == 0 {
+				return nil, fmt.Errorf("%s operation on %q has no value", op.Op, op.Path)
+			}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			document, err = add(document, path, value)
+		case "remove":
+			document, err = remove(document, path)
+		case "replace":
+			if len(path) == 0 {
+				document = value
+			} else if document, err = remove(document, path); err == nil {
+				document, err = add(document, path, value)
+			}
+		case "move", "copy":
+			var from []string
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+			if value, err = get(document, from); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				document, err = remove(document, from)
+			} else {
+				value, err = deepCopy(value)
+			}
+			if err == nil {
+				document, err = add(document, path, value)
+			}
+		case "test":
+			var current interface{}
+			if current, err = get(document, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = fmt.Errorf("test of %q failed", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return document, nil
+}
+
+// parsePointer splits JSON pointer (RFC 6901) into unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q doesn't start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func get(document interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("field %q doesn't exist", token)
+			}
+			document = value
+		case []interface{}:
+			i, err := index(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			document = container[i]
+		default:
+			return nil, fmt.Errorf("%q can't be referenced in a value", token)
+		}
+	}
+	return document, nil
+}
+
+func add(document interface{}, path []string, value interface{}) (interface{}, error) {
+	return update(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			if token == "-" {
+				return append(container, value), nil
+			}
+			i, err := index(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("%q can't be added to a value", token)
+		}
+	}, value)
+}
+
+func remove(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("document can't be removed")
+	}
+
+	return update(document, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, fmt.Errorf("field %q doesn't exist", token)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			i, err := index(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:i], container[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("%q can't be removed from a value", token)
+		}
+	}, nil)
+}
+
+// update calls fn with parent of the last token and replaces the parent by its result. Empty path replaces
+// the whole document with the value.
+func update(document interface{}, path []string, fn func(interface{}, string) (interface{}, error),
+	value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	if len(path) == 1 {
+		return fn(document, path[0])
+	}
+
+	child, err := get(document, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = update(child, path[1:], fn, value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		container[path[0]] = child
+	case []interface{}:
+		i, _ := index(path[0], len(container)-1)
+		container[i] = child
+	}
+	return document, nil
+}
+
+// index parses array index not greater than max.
+func index(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func deepCopy(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied interface{}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
@@ -0,0 +1,109 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reasonUnsupportedMediaType is reason of patches of unknown type, which the vendored API types lack.
+const reasonUnsupportedMediaType metav1.StatusReason = "UnsupportedMediaType"
+
+// GetType returns patch type of the request content type.
+func GetType(req *http.Request) (types.PatchType, error) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return "", newUnsupportedMediaType(req.Header.Get("Content-Type"))
+	}
+
+	switch patchType := types.PatchType(mediaType); patchType {
+	case types.JSONPatchType, types.MergePatchType, types.StrategicMergePatchType:
+		return patchType, nil
+	default:
+		return "", newUnsupportedMediaType(mediaType)
+	}
+}
+
+// Apply applies the patch to the JSON document. Strategic merge patches merge lists by patch merge keys set
+// on fields of dataStruct, the Go type the document is decoded into.
+func Apply(original []byte, patchType types.PatchType, patch []byte, dataStruct interface{}) ([]byte, error) {
+	var document interface{}
+	if err := json.Unmarshal(original, &document); err != nil {
+		return nil, err
+	}
+
+	var patched interface{}
+	var err error
+	switch patchType {
+	case types.JSONPatchType:
+		operations := []operation{}
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			return nil, newInvalidPatch(err)
+		}
+		patched, err = applyJSONPatch(document, operations)
+	case types.MergePatchType, types.StrategicMergePatchType:
+		patchDocument := map[string]interface{}{}
+		if err := json.Unmarshal(patch, &patchDocument); err != nil {
+			return nil, newInvalidPatch(err)
+		}
+
+		documentMap, ok := document.(map[string]interface{})
+		if !ok {
+			return nil, newInvalidPatch(fmt.Errorf("document is not an object"))
+		}
+
+		if patchType == types.MergePatchType {
+			patched = mergePatch(documentMap, patchDocument)
+		} else {
+			patched, err = strategicMerge(documentMap, patchDocument, typeOf(dataStruct))
+		}
+	default:
+		return nil, newUnsupportedMediaType(string(patchType))
+	}
+	if err != nil {
+		return nil, newInvalidPatch(err)
+	}
+	return json.Marshal(patched)
+}
+
+// mergePatch applies JSON merge patch (RFC 7386). Null values remove fields, objects are merged and other
+// values replaced.
+func mergePatch(original, patch map[string]interface{}) map[string]interface{} {
+	if original == nil {
+		original = make(map[string]interface{})
+	}
+
+	for key, value := range patch {
+		if value == nil {
+			delete(original, key)
+			continue
+		}
+
+		patchObject, isPatchObject := value.(map[string]interface{})
+		if !isPatchObject {
+			original[key] = value
+			continue
+		}
+		originalObject, _ := original[key].(map[string]interface{})
+		original[key] = mergePatch(originalObject, patchObject)
+	}
+	return original
+}
+
+func newInvalidPatch(err error) *errors.StatusError {
+	return errors.NewBadRequest(fmt.Sprintf("invalid patch: %s", err))
+}
+
+func newUnsupportedMediaType(mediaType string) *errors.StatusError {
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusUnsupportedMediaType,
+		Reason:  reasonUnsupportedMediaType,
+		Message: fmt.Sprintf("patch type %q is not supported", mediaType),
+	}}
+}
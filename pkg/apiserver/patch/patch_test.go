@@ -0,0 +1,150 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+type patchTestCase struct {
+	name     string
+	original string
+	patch    string
+	// expected is the patched document, or substring of the error if it's prefixed with "error:"
+	expected string
+}
+
+func runPatchTests(t *testing.T, patchType types.PatchType, dataStruct interface{}, cases []patchTestCase) {
+	for _, c := range cases {
+		patched, err := Apply([]byte(c.original), patchType, []byte(c.patch), dataStruct)
+		if strings.HasPrefix(c.expected, "error:") {
+			message := strings.TrimSpace(strings.TrimPrefix(c.expected, "error:"))
+			if err == nil || !strings.Contains(err.Error(), message) {
+				t.Errorf("%s: expected error %q, got %v", c.name, message, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+
+		var actual, expected interface{}
+		json.Unmarshal(patched, &actual)
+		json.Unmarshal([]byte(c.expected), &expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, patched)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	original := `{"a":{"b":"c"},"list":[1,2,3]}`
+	runPatchTests(t, types.JSONPatchType, nil, []patchTestCase{
+		{"add", original, `[{"op":"add","path":"/a/d","value":"e"},{"op":"add","path":"/list/-","value":4}]`,
+			`{"a":{"b":"c","d":"e"},"list":[1,2,3,4]}`},
+		{"replace", original, `[{"op":"replace","path":"/list/0","value":0}]`, `{"a":{"b":"c"},"list":[0,2,3]}`},
+		{"move", original, `[{"op":"move","from":"/a/b","path":"/b"}]`, `{"a":{},"b":"c","list":[1,2,3]}`},
+		{"copy", original, `[{"op":"copy","from":"/a","path":"/d"}]`,
+			`{"a":{"b":"c"},"d":{"b":"c"},"list":[1,2,3]}`},
+		{"test", original, `[{"op":"test","path":"/a/b","value":"c"},{"op":"remove","path":"/list/1"}]`,
+			`{"a":{"b":"c"},"list":[1,3]}`},
+		{"escaped path", `{"a/b":{"c~d":1}}`, `[{"op":"remove","path":"/a~1b/c~0d"}]`, `{"a/b":{}}`},
+		{"failed test", original, `[{"op":"remove","path":"/list/0"},{"op":"test","path":"/a/b","value":"d"}]`,
+			`error: test of "/a/b" failed`},
+		{"test of missing field", original, `[{"op":"test","path":"/d","value":"c"}]`,
+			`error: field "d" doesn't exist`},
+		{"move of missing field", original, `[{"op":"move","from":"/d","path":"/e"}]`,
+			`error: field "d" doesn't exist`},
+		{"move into missing object", original, `[{"op":"move","from":"/a/b","path":"/d/e"}]`,
+			`error: field "d" doesn't exist`},
+		{"remove of missing field", original, `[{"op":"remove","path":"/a/d"}]`, `error: field "d" doesn't exist`},
+		{"remove out of range", original, `[{"op":"remove","path":"/list/3"}]`, `error: invalid array index "3"`},
+		{"remove of document", original, `[{"op":"remove","path":""}]`, `error: document can't be removed`},
+		{"add without value", original, `[{"op":"add","path":"/d"}]`, `error: has no value`},
+		{"unknown operation", original, `[{"op":"merge","path":"/a"}]`, `error: unknown operation "merge"`},
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	original := `{"a":{"b":"c","d":"e"},"list":[1,2],"f":"g"}`
+	runPatchTests(t, types.MergePatchType, nil, []patchTestCase{
+		{"null deletes field", original, `{"f":null}`, `{"a":{"b":"c","d":"e"},"list":[1,2]}`},
+		{"null deletes nested field", original, `{"a":{"d":null}}`, `{"a":{"b":"c"},"list":[1,2],"f":"g"}`},
+		{"null of missing field", original, `{"h":null}`, `{"a":{"b":"c","d":"e"},"list":[1,2],"f":"g"}`},
+		{"null in new object", original, `{"h":{"i":null,"j":1}}`,
+			`{"a":{"b":"c","d":"e"},"list":[1,2],"f":"g","h":{"j":1}}`},
+		{"list replaced", original, `{"list":[3]}`, `{"a":{"b":"c","d":"e"},"list":[3],"f":"g"}`},
+		{"object replaced by value", original, `{"a":"b"}`, `{"a":"b","list":[1,2],"f":"g"}`},
+		{"not an object", `[1]`, `{"a":"b"}`, `error: document is not an object`},
+	})
+}
+
+func TestStrategicMergePatch(t *testing.T) {
+	status := `{"phase":"Pending","conditions":[` +
+		`{"type":"Initialized","status":"True"},` +
+		`{"type":"Ready","status":"False","reason":"ContainersNotReady"},` +
+		`{"type":"PodScheduled","status":"True"}]}`
+	runPatchTests(t, types.StrategicMergePatchType, &kubeapi.PodStatus{}, []patchTestCase{
+		{"conditions merged by type", status,
+			`{"phase":"Running","conditions":[{"type":"Ready","status":"True","reason":null}]}`,
+			`{"phase":"Running","conditions":[{"type":"Initialized","status":"True"},` +
+				`{"type":"Ready","status":"True"},{"type":"PodScheduled","status":"True"}]}`},
+		{"condition added", status, `{"conditions":[{"type":"Unschedulable","status":"False"}]}`,
+			`{"phase":"Pending","conditions":[{"type":"Initialized","status":"True"},` +
+				`{"type":"Ready","status":"False","reason":"ContainersNotReady"},` +
+				`{"type":"PodScheduled","status":"True"},{"type":"Unschedulable","status":"False"}]}`},
+		{"directives of new condition stripped", status,
+			`{"conditions":[{"type":"Unschedulable","status":"False","$patch":"merge",` +
+				`"$retainKeys":["type","status"]}]}`,
+			`{"phase":"Pending","conditions":[{"type":"Initialized","status":"True"},` +
+				`{"type":"Ready","status":"False","reason":"ContainersNotReady"},` +
+				`{"type":"PodScheduled","status":"True"},{"type":"Unschedulable","status":"False"}]}`},
+		{"set element order", status,
+			`{"$setElementOrder/conditions":[{"type":"PodScheduled"},{"type":"Ready"},{"type":"Initialized"}],` +
+				`"conditions":[{"type":"Ready","status":"True"}]}`,
+			`{"phase":"Pending","conditions":[{"type":"PodScheduled","status":"True"},` +
+				`{"type":"Ready","status":"True","reason":"ContainersNotReady"},{"type":"Initialized","status":"True"}]}`},
+		{"deleted condition", status, `{"conditions":[{"type":"Ready","$patch":"delete"}]}`,
+			`{"phase":"Pending","conditions":[{"type":"Initialized","status":"True"},` +
+				`{"type":"PodScheduled","status":"True"}]}`},
+		{"replaced conditions", status,
+			`{"conditions":[{"type":"Ready","status":"True"},{"$patch":"replace"}]}`,
+			`{"phase":"Pending","conditions":[{"type":"Ready","status":"True"}]}`},
+		{"replaced object", `{"phase":"Pending","hostIP":"10.0.0.1"}`, `{"$patch":"replace","phase":"Running"}`,
+			`{"phase":"Running"}`},
+		{"deleted object", `{"phase":"Pending","conditions":[]}`, `{"$patch":"delete"}`, `null`},
+		{"retained keys", `{"phase":"Pending","hostIP":"10.0.0.1","podIP":"10.1.0.1"}`,
+			`{"$retainKeys":["phase","podIP"],"podIP":"10.1.0.2"}`, `{"phase":"Pending","podIP":"10.1.0.2"}`},
+		{"unknown directive", status, `{"$patch":"append"}`, `error: unknown patch directive append`},
+		{"condition without merge key", status, `{"conditions":[{"status":"True"}]}`,
+			`error: item has no merge key type`},
+	})
+}
+
+func TestStrategicMergePatchNested(t *testing.T) {
+	pod := `{"metadata":{"name":"nginx","finalizers":["a","b"]},` +
+		`"spec":{"containers":[{"name":"nginx","image":"nginx:1.12","env":[{"name":"A","value":"1"}]}]}}`
+	runPatchTests(t, types.StrategicMergePatchType, &kubeapi.Pod{}, []patchTestCase{
+		{"nested lists merged by name", pod,
+			`{"spec":{"containers":[{"name":"nginx","env":[{"name":"B","value":"2"}]}]}}`,
+			`{"metadata":{"name":"nginx","finalizers":["a","b"]},"spec":{"containers":[{"name":"nginx",` +
+				`"image":"nginx:1.12","env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}]}}`},
+		{"directives of new nested items stripped", pod,
+			`{"spec":{"containers":[{"name":"sidecar","image":"busybox",` +
+				`"env":[{"name":"A","value":"1"},{"name":"B","$patch":"delete"}]}]}}`,
+			`{"metadata":{"name":"nginx","finalizers":["a","b"]},"spec":{"containers":[{"name":"nginx",` +
+				`"image":"nginx:1.12","env":[{"name":"A","value":"1"}]},` +
+				`{"name":"sidecar","image":"busybox","env":[{"name":"A","value":"1"}]}]}}`},
+		{"primitive list merged as set", pod, `{"metadata":{"finalizers":["b","c"]}}`,
+			`{"metadata":{"name":"nginx","finalizers":["a","b","c"]},"spec":{"containers":[{"name":"nginx",` +
+				`"image":"nginx:1.12","env":[{"name":"A","value":"1"}]}]}}`},
+		{"deleted from primitive list", pod, `{"metadata":{"$deleteFromPrimitiveList/finalizers":["a"]}}`,
+			`{"metadata":{"name":"nginx","finalizers":["b"]},"spec":{"containers":[{"name":"nginx",` +
+				`"image":"nginx:1.12","env":[{"name":"A","value":"1"}]}]}}`},
+	})
+}
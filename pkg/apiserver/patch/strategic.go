@@ -0,0 +1,299 @@
+package patch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Directives of strategic merge patches.
+const (
+	directiveMarker         = "$patch"
+	directiveReplace        = "replace"
+	directiveDelete         = "delete"
+	directiveMerge          = "merge"
+	retainKeysDirective     = "$retainKeys"
+	setElementOrderPrefix   = "$setElementOrder/"
+	deleteFromPrimitiveList = "$deleteFromPrimitiveList/"
+)
+
+// field is a struct field as seen by strategic merge patches.
+type field struct {
+	typ      reflect.Type
+	strategy string
+	mergeKey string
+}
+
+// strategicMerge applies strategic merge patch as kubelets send it. Lists of fields with merge strategy are
+// merged by their merge key, other fields are merged like JSON merge patch. Patch directives $patch,
+// $retainKeys, $setElementOrder and $deleteFromPrimitiveList are supported.
+func strategicMerge(original, patch map[string]interface{}, typ reflect.Type) (map[string]interface{}, error) {
+	if original == nil {
+		original = make(map[string]interface{})
+	}
+
+	switch directive := patch[directiveMarker]; directive {
+	case nil, directiveMerge:
+	case directiveReplace:
+		replaced := make(map[string]interface{})
+		for key, value := range patch {
+			if key != directiveMarker {
+				replaced[key] = value
+			}
+		}
+		return replaced, nil
+	case directiveDelete:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown patch directive %v", directive)
+	}
+
+	if retainKeys, ok := patch[retainKeysDirective].([]interface{}); ok {
+		retained := make(map[string]bool)
+		for _, key := range retainKeys {
+			retained[fmt.Sprint(key)] = true
+		}
+		for key := range original {
+			if !retained[key] {
+				delete(original, key)
+			}
+		}
+	}
+
+	for key, value := range patch {
+		if key == directiveMarker || key == retainKeysDirective || strings.HasPrefix(key, setElementOrderPrefix) {
+			continue
+		}
+
+		if strings.HasPrefix(key, deleteFromPrimitiveList) {
+			name := strings.TrimPrefix(key, deleteFromPrimitiveList)
+			original[name] = deleteValues(original[name], value)
+			continue
+		}
+
+		if value == nil {
+			delete(original, key)
+			continue
+		}
+
+		fieldInfo := lookupField(typ, key)
+		switch patchValue := value.(type) {
+		case map[string]interface{}:
+			originalObject, _ := original[key].(map[string]interface{})
+			merged, err := strategicMerge(originalObject, patchValue, elemType(fieldInfo.typ))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+			if merged == nil {
+				delete(original, key)
+			} else {
+				original[key] = merged
+			}
+		case []interface{}:
+			if !strings.Contains(fieldInfo.strategy, "merge") {
+				original[key] = patchValue
+				continue
+			}
+
+			originalList, _ := original[key].([]interface{})
+			merged, err := mergeList(originalList, patchValue, fieldInfo.mergeKey, elemType(fieldInfo.typ))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", key, err)
+			}
+			original[key] = merged
+		default:
+			original[key] = value
+		}
+	}
+
+	for key, value := range patch {
+		if strings.HasPrefix(key, setElementOrderPrefix) {
+			name := strings.TrimPrefix(key, setElementOrderPrefix)
+			if list, ok := original[name].([]interface{}); ok {
+				original[name] = orderList(list, value, lookupField(typ, name).mergeKey)
+			}
+		}
+	}
+	return original, nil
+}
+
+// mergeList merges items of the patch into items of the original list with the same merge key. Lists of
+// primitives are merged as sets.
+func mergeList(original, patch []interface{}, mergeKey string, typ reflect.Type) ([]interface{}, error) {
+	merged := append([]interface{}{}, original...)
+	for _, item := range patch {
+		patchItem, ok := item.(map[string]interface{})
+		if !ok {
+			if indexOf(merged, item, "") < 0 {
+				merged = append(merged, item)
+			}
+			continue
+		}
+
+		if patchItem[directiveMarker] == directiveReplace {
+			return removeDirectives(patch), nil
+		}
+		if len(mergeKey) == 0 {
+			return nil, fmt.Errorf("list of objects without merge key can't be merged")
+		}
+		if _, ok := patchItem[mergeKey]; !ok {
+			return nil, fmt.Errorf("item has no merge key %s", mergeKey)
+		}
+
+		i := indexOf(merged, patchItem, mergeKey)
+		if patchItem[directiveMarker] == directiveDelete {
+			if i >= 0 {
+				merged = append(merged[:i], merged[i+1:]...)
+			}
+			continue
+		}
+
+		// New items are merged into nothing too, so their directives are stripped
+		var originalItem map[string]interface{}
+		if i >= 0 {
+			originalItem, _ = merged[i].(map[string]interface{})
+		}
+		mergedItem, err := strategicMerge(originalItem, patchItem, typ)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			merged = append(merged, mergedItem)
+		} else {
+			merged[i] = mergedItem
+		}
+	}
+	return merged, nil
+}
+
+// orderList sorts the list by the order of items in $setElementOrder. Items missing in the order keep their
+// relative order at the end.
+func orderList(list []interface{}, order interface{}, mergeKey string) []interface{} {
+	orderItems, ok := order.([]interface{})
+	if !ok {
+		return list
+	}
+
+	ordered := make([]interface{}, 0, len(list))
+	used := make([]bool, len(list))
+	for _, orderItem := range orderItems {
+		for i, item := range list {
+			if !used[i] && sameItem(item, orderItem, mergeKey) {
+				ordered = append(ordered, item)
+				used[i] = true
+				break
+			}
+		}
+	}
+	for i, item := range list {
+		if !used[i] {
+			ordered = append(ordered, item)
+		}
+	}
+	return ordered
+}
+
+func deleteValues(list interface{}, values interface{}) interface{} {
+	originalList, ok := list.([]interface{})
+	deleted, isList := values.([]interface{})
+	if !ok || !isList {
+		return list
+	}
+
+	kept := make([]interface{}, 0, len(originalList))
+	for _, item := range originalList {
+		if indexOf(deleted, item, "") < 0 {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func removeDirectives(list []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		if object, ok := item.(map[string]interface{}); ok && object[directiveMarker] != nil {
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+func indexOf(list []interface{}, item interface{}, mergeKey string) int {
+	for i, current := range list {
+		if sameItem(current, item, mergeKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameItem compares objects by merge key and primitives by value.
+func sameItem(a, b interface{}, mergeKey string) bool {
+	if len(mergeKey) == 0 {
+		return reflect.DeepEqual(a, b)
+	}
+
+	objectA, okA := a.(map[string]interface{})
+	objectB, okB := b.(map[string]interface{})
+	return okA && okB && reflect.DeepEqual(objectA[mergeKey], objectB[mergeKey])
+}
+
+// lookupField returns struct field with given JSON name, fields of inlined structs included. Unknown fields
+// have no type and are merged like JSON merge patch.
+func lookupField(typ reflect.Type, name string) field {
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return field{}
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		tag := strings.Split(structField.Tag.Get("json"), ",")
+		if (structField.Anonymous && len(tag[0]) == 0) || (len(tag) > 1 && tag[1] == "inline") {
+			if inlined := lookupField(derefType(structField.Type), name); inlined.typ != nil {
+				return inlined
+			}
+			continue
+		}
+
+		jsonName := tag[0]
+		if len(jsonName) == 0 {
+			jsonName = structField.Name
+		}
+		if jsonName == name {
+			return field{
+				typ:      structField.Type,
+				strategy: structField.Tag.Get("patchStrategy"),
+				mergeKey: structField.Tag.Get("patchMergeKey"),
+			}
+		}
+	}
+	return field{}
+}
+
+// elemType returns type of nested objects of the field: the struct itself, or values of maps and slices.
+func elemType(typ reflect.Type) reflect.Type {
+	typ = derefType(typ)
+	if typ == nil {
+		return nil
+	}
+	if typ.Kind() == reflect.Map || typ.Kind() == reflect.Slice {
+		return derefType(typ.Elem())
+	}
+	return typ
+}
+
+func derefType(typ reflect.Type) reflect.Type {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+func typeOf(dataStruct interface{}) reflect.Type {
+	if dataStruct == nil {
+		return nil
+	}
+	return derefType(reflect.TypeOf(dataStruct))
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubewatch "k8s.io/apimachinery/pkg/watch"
+)
+
+// InstrumentedServerProxy records latency and errors of every IServerProxy method.
+type InstrumentedServerProxy struct {
+	proxy IServerProxy
+}
+
+func NewInstrumentedServerProxy(proxy IServerProxy) IServerProxy {
+	return &InstrumentedServerProxy{proxy: proxy}
+}
+
+func (this InstrumentedServerProxy) Create(resource *metav1.APIResource, namespace string,
+	obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	start := time.Now()
+	result, err := this.proxy.Create(resource, namespace, obj)
+	metrics.ObserveUpstream("server", "create", start, err)
+	return result, err
+}
+
+func (this InstrumentedServerProxy) Delete(resource *metav1.APIResource, namespace, name string,
+	deleteOptions *metav1.DeleteOptions) error {
+	start := time.Now()
+	err := this.proxy.Delete(resource, namespace, name, deleteOptions)
+	metrics.ObserveUpstream("server", "delete", start, err)
+	return err
+}
+
+func (this InstrumentedServerProxy) Patch(resource *metav1.APIResource, namespace, name string,
+	pt types.PatchType, body []byte) (*unstructured.Unstructured, error) {
+	start := time.Now()
+	result, err := this.proxy.Patch(resource, namespace, name, pt, body)
+	metrics.ObserveUpstream("server", "patch", start, err)
+	return result, err
+}
+
+func (this InstrumentedServerProxy) Update(resource *metav1.APIResource, namespace string,
+	obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	start := time.Now()
+	result, err := this.proxy.Update(resource, namespace, obj)
+	metrics.ObserveUpstream("server", "update", start, err)
+	return result, err
+}
+
+func (this InstrumentedServerProxy) Get(resource *metav1.APIResource, namespace, name string) (
+	*unstructured.Unstructured, error) {
+	start := time.Now()
+	result, err := this.proxy.Get(resource, namespace, name)
+	metrics.ObserveUpstream("server", "get", start, err)
+	return result, err
+}
+
+func (this InstrumentedServerProxy) List(resource *metav1.APIResource, namespace string,
+	listOptions *metav1.ListOptions) (runtime.Object, error) {
+	start := time.Now()
+	result, err := this.proxy.List(resource, namespace, listOptions)
+	metrics.ObserveUpstream("server", "list", start, err)
+	return result, err
+}
+
+// Watch records the time needed to establish the watch, not its whole duration.
+func (this InstrumentedServerProxy) Watch(resource *metav1.APIResource, namespace string,
+	listOptions *metav1.ListOptions) (kubewatch.Interface, error) {
+	start := time.Now()
+	result, err := this.proxy.Watch(resource, namespace, listOptions)
+	metrics.ObserveUpstream("server", "watch", start, err)
+	return result, err
+}
+
+// InstrumentedRawProxy records latency and errors of every IRawProxy method.
+type InstrumentedRawProxy struct {
+	proxy IRawProxy
+}
+
+func NewInstrumentedRawProxy(proxy IRawProxy) IRawProxy {
+	return &InstrumentedRawProxy{proxy: proxy}
+}
+
+func (this InstrumentedRawProxy) Put(req *restful.Request) ([]byte, error) {
+	start := time.Now()
+	result, err := this.proxy.Put(req)
+	metrics.ObserveUpstream("raw", "put", start, err)
+	return result, err
+}
+
+func (this InstrumentedRawProxy) Get(req *restful.Request) ([]byte, error) {
+	start := time.Now()
+	result, err := this.proxy.Get(req)
+	metrics.ObserveUpstream("raw", "get", start, err)
+	return result, err
+}
+
+func (this InstrumentedRawProxy) Post(req *restful.Request) ([]byte, error) {
+	start := time.Now()
+	result, err := this.proxy.Post(req)
+	metrics.ObserveUpstream("raw", "post", start, err)
+	return result, err
+}
+
+func (this InstrumentedRawProxy) Patch(req *restful.Request) ([]byte, error) {
+	start := time.Now()
+	result, err := this.proxy.Patch(req)
+	metrics.ObserveUpstream("raw", "patch", start, err)
+	return result, err
+}
+
+// Watch is not instrumented. Raw watches connect asynchronously and their errors end the notifier.
+func (this InstrumentedRawProxy) Watch(req *restful.Request) watch.Watcher {
+	return this.proxy.Watch(req)
+}
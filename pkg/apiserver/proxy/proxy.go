@@ -1,12 +1,26 @@
 package proxy
 
-import "k8s.io/client-go/dynamic"
+import (
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
 
 type Proxy struct {
 	ServerProxy IServerProxy
 	RawProxy    IRawProxy
 }
 
-func NewProxy(tprClient *dynamic.Client, serverAddress string) *Proxy {
-	return &Proxy{ServerProxy: NewServerProxy(tprClient), RawProxy: NewRawProxy(serverAddress)}
+// NewProxy creates proxies to the kubernetes apiserver. Both use credentials and TLS settings of the client
+// config.
+func NewProxy(tprClient *dynamic.Client, clientConfig *rest.Config, store *config.ApiserverStore) *Proxy {
+	rawProxy, err := NewRawProxy(clientConfig, store)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return &Proxy{
+		ServerProxy: NewInstrumentedServerProxy(NewServerProxy(tprClient)),
+		RawProxy:    NewInstrumentedRawProxy(rawProxy),
+	}
 }
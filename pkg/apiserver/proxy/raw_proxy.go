@@ -2,14 +2,20 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
 
 	"github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful/log"
 	"github.com/fest-research/iot-addon/pkg/apiserver/watch"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/rest"
 )
 
 type IRawProxy interface {
@@ -20,76 +26,85 @@ type IRawProxy interface {
 	Watch(*restful.Request) watch.Watcher
 }
 
+// RawProxy passes requests through to the kubernetes apiserver as they are, query included. Requests are
+// sent with TLS settings and credentials of the client config, over connections pooled by its transport.
 type RawProxy struct {
-	serverAddress string
+	baseURL *url.URL
+	client  *http.Client
+	store   *config.ApiserverStore
 }
 
-func NewRawProxy(serverAddress string) IRawProxy {
-	return &RawProxy{serverAddress: serverAddress}
-}
-
-func (this RawProxy) Get(req *restful.Request) ([]byte, error) {
-	requestPath := this.serverAddress + this.removePathParams(req.Request.URL)
-	log.Printf("[Raw proxy] GET Request (%s)", requestPath)
-
-	r, err := http.Get(requestPath)
+// NewRawProxy creates proxy to the kubernetes apiserver of the client config.
+func NewRawProxy(clientConfig *rest.Config, store *config.ApiserverStore) (IRawProxy, error) {
+	transport, err := rest.TransportFor(clientConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
+	baseURL, _, err := rest.DefaultServerURL(clientConfig.Host, "", schema.GroupVersion{},
+		rest.IsConfigTransportTLS(*clientConfig))
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("[Raw proxy] GET Response (%s): %s", requestPath, string(body))
-	return body, nil
+	return &RawProxy{baseURL: baseURL, client: &http.Client{Transport: transport}, store: store}, nil
 }
 
-func (this RawProxy) Put(req *restful.Request) ([]byte, error) {
-	requestPath := this.serverAddress + this.removePathParams(req.Request.URL)
-
-	defer req.Request.Body.Close()
-	reqBody, err := ioutil.ReadAll(req.Request.Body)
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("[Raw proxy] PUT Request (%s): %s", requestPath, string(reqBody))
+func (this RawProxy) Get(req *restful.Request) ([]byte, error) {
+	return this.do(req, http.MethodGet, "")
+}
 
-	client := &http.Client{}
-	newReq, err := http.NewRequest("PUT", requestPath, bytes.NewReader(reqBody))
-	if err != nil {
-		return nil, err
-	}
-	r, err := client.Do(newReq)
-	if err != nil {
-		return nil, err
-	}
+func (this RawProxy) Put(req *restful.Request) ([]byte, error) {
+	return this.do(req, http.MethodPut, contentType(req, "application/json"))
+}
 
-	defer r.Body.Close()
+func (this RawProxy) Post(req *restful.Request) ([]byte, error) {
+	return this.do(req, http.MethodPost, contentType(req, "application/json"))
+}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
+func (this RawProxy) Patch(req *restful.Request) ([]byte, error) {
+	return this.do(req, http.MethodPatch, contentType(req, "application/strategic-merge-patch+json"))
+}
 
-	log.Printf("[Raw proxy] PUT Response (%s): %s", requestPath, string(body))
-	return body, nil
+func (this RawProxy) Watch(req *restful.Request) watch.Watcher {
+	watcher := watch.NewRawWatcher(this.client)
+	go watcher.Watch(this.requestURL(req.Request.URL))
+	return watcher
 }
 
-func (this RawProxy) Post(req *restful.Request) ([]byte, error) {
-	requestPath := this.serverAddress + this.removePathParams(req.Request.URL)
+// do sends the request upstream, with its body unless it is a GET. Error statuses of the kubernetes
+// apiserver are returned as errors, so they reach the client with their code.
+func (this RawProxy) do(req *restful.Request, method, contentType string) ([]byte, error) {
+	requestURL := this.requestURL(req.Request.URL)
+	logger := logging.RequestLogger(req)
+
+	var reqBody []byte
+	if method == http.MethodGet {
+		logger.Debugf("[Raw proxy] GET Request (%s)", requestURL)
+	} else {
+		defer req.Request.Body.Close()
+		body, err := ioutil.ReadAll(req.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = body
+		logRequest(logger, method, requestURL, reqBody)
+	}
 
-	defer req.Request.Body.Close()
-	reqBody, err := ioutil.ReadAll(req.Request.Body)
+	upstreamReq, err := http.NewRequest(method, requestURL, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("[Raw proxy] POST Request (%s): %s", requestPath, string(reqBody))
+	ctx, cancel := context.WithTimeout(req.Request.Context(), this.store.Get().Timeouts.Upstream.Duration)
+	defer cancel()
+	upstreamReq = upstreamReq.WithContext(ctx)
+
+	upstreamReq.Header.Set("Accept", "application/json")
+	if len(contentType) > 0 {
+		upstreamReq.Header.Set("Content-Type", contentType)
+	}
 
-	r, err := http.Post(requestPath, "application/json", bytes.NewReader(reqBody))
+	r, err := this.client.Do(upstreamReq)
 	if err != nil {
 		return nil, err
 	}
@@ -101,56 +116,51 @@ func (this RawProxy) Post(req *restful.Request) ([]byte, error) {
 		return nil, err
 	}
 
-	log.Printf("[Raw proxy] POST Response (%s): %s", requestPath, string(body))
+	logResponse(logger, method, requestURL, body)
+	if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusMultipleChoices {
+		return nil, newUpstreamError(r.StatusCode, method, body)
+	}
 	return body, nil
 }
 
-func (this RawProxy) Patch(req *restful.Request) ([]byte, error) {
-	requestPath := this.serverAddress + this.removePathParams(req.Request.URL)
-
-	defer req.Request.Body.Close()
-	reqBody, err := ioutil.ReadAll(req.Request.Body)
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("[Raw proxy] PATCH Request (%s): %s", requestPath, string(reqBody))
+// requestURL returns URL of the request on the kubernetes apiserver. Path prefix of the server, if any, is
+// kept.
+func (this RawProxy) requestURL(requestURL *url.URL) string {
+	upstreamURL := *this.baseURL
+	upstreamURL.Path = upstreamURL.Path + requestURL.Path
+	upstreamURL.RawQuery = requestURL.RawQuery
+	return upstreamURL.String()
+}
 
-	client := &http.Client{}
-	newReq, err := http.NewRequest("PATCH", requestPath, bytes.NewReader(reqBody))
-	if err != nil {
-		return nil, err
+// logRequest dumps redacted request body at debug level.
+func logRequest(logger *logging.Logger, method, requestPath string, body []byte) {
+	if logging.DebugEnabled() {
+		logger.Debugf("[Raw proxy] %s Request (%s): %s", method, requestPath, logging.RedactBody(body))
 	}
-	newReq.Header.Add("Content-Type", "application/strategic-merge-patch+json")
-	r, err := client.Do(newReq)
-	if err != nil {
-		return nil, err
-	}
-
-	defer r.Body.Close()
+}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
+// logResponse dumps redacted response body at debug level.
+func logResponse(logger *logging.Logger, method, requestPath string, body []byte) {
+	if logging.DebugEnabled() {
+		logger.Debugf("[Raw proxy] %s Response (%s): %s", method, requestPath, logging.RedactBody(body))
 	}
-
-	log.Printf("[Raw proxy] PATCH Response (%s): %s", requestPath, string(body))
-	return body, nil
 }
 
-func (this RawProxy) Watch(req *restful.Request) watch.Watcher {
-	watcher := watch.NewRawWatcher()
-	// TODO map request path to third party resource watch path
-	requestPath := this.serverAddress + this.removePathParams(req.Request.URL)
-
-	go watcher.Watch(requestPath)
-	return watcher
+// newUpstreamError returns Status sent by the kubernetes apiserver as error, or a generic error of the code if
+// the body is no Status.
+func newUpstreamError(code int, method string, body []byte) error {
+	status := metav1.Status{}
+	if err := json.Unmarshal(body, &status); err == nil && status.Kind == "Status" {
+		return &errors.StatusError{ErrStatus: status}
+	}
+	return errors.NewGenericServerResponse(code, method, schema.GroupResource{}, "", string(body), 0, true)
 }
 
-// Remove everything after '?' in url path (FOR TESTS ONLY!)
-func (this RawProxy) removePathParams(url *url.URL) string {
-	path := url.String()
-	if strings.Contains(path, "?") {
-		path = path[:strings.Index(path, "?")]
+// contentType returns content type of the request body, so protobuf bodies sent by kubelets reach the server
+// as they are.
+func contentType(req *restful.Request, defaultType string) string {
+	if contentType := req.Request.Header.Get("Content-Type"); len(contentType) > 0 {
+		return contentType
 	}
-	return path
+	return defaultType
 }
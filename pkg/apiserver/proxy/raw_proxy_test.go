@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// upstreamRequest is a request received by the test server.
+type upstreamRequest struct {
+	method      string
+	path        string
+	query       string
+	contentType string
+	body        string
+}
+
+func newTestRawProxy(t *testing.T, prefix string, code int, body string) (IRawProxy, *upstreamRequest,
+	*httptest.Server) {
+	received := &upstreamRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqBody, _ := ioutil.ReadAll(req.Body)
+		*received = upstreamRequest{
+			method:      req.Method,
+			path:        req.URL.Path,
+			query:       req.URL.RawQuery,
+			contentType: req.Header.Get("Content-Type"),
+			body:        string(reqBody),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+
+	proxy, err := NewRawProxy(&rest.Config{Host: server.URL + prefix},
+		config.NewApiserverStore(config.NewApiserverConfig()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy, received, server
+}
+
+func newTestRequest(t *testing.T, method, target, body string) *restful.Request {
+	req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restful.NewRequest(req)
+}
+
+func TestRawProxyRequestURL(t *testing.T) {
+	cases := []struct {
+		name     string
+		prefix   string
+		target   string
+		expected upstreamRequest
+	}{
+		{"no prefix", "", "/api/v1/namespaces/default/pods/nginx",
+			upstreamRequest{method: http.MethodGet, path: "/api/v1/namespaces/default/pods/nginx"}},
+		{"prefix", "/k8s", "/api/v1/namespaces/default/pods/nginx",
+			upstreamRequest{method: http.MethodGet, path: "/k8s/api/v1/namespaces/default/pods/nginx"}},
+		{"query", "/k8s", "/api/v1/namespaces/default/pods?labelSelector=app%3Dnginx&limit=10",
+			upstreamRequest{method: http.MethodGet, path: "/k8s/api/v1/namespaces/default/pods",
+				query: "labelSelector=app%3Dnginx&limit=10"}},
+	}
+
+	for _, c := range cases {
+		proxy, received, server := newTestRawProxy(t, c.prefix, http.StatusOK, `{}`)
+		if _, err := proxy.Get(newTestRequest(t, http.MethodGet, "http://localhost"+c.target, "")); err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if *received != c.expected {
+			t.Errorf("%s: expected upstream request %+v, got %+v", c.name, c.expected, *received)
+		}
+		server.Close()
+	}
+}
+
+func TestRawProxyBody(t *testing.T) {
+	proxy, received, server := newTestRawProxy(t, "/k8s", http.StatusCreated, `{"kind":"Pod"}`)
+	defer server.Close()
+
+	req := newTestRequest(t, http.MethodPatch, "http://localhost/api/v1/namespaces/default/pods/nginx/status",
+		`{"status":{}}`)
+	req.Request.Header.Set("Content-Type", "application/merge-patch+json")
+	body, err := proxy.Patch(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"kind":"Pod"}` {
+		t.Errorf("expected upstream body, got %s", body)
+	}
+
+	expected := upstreamRequest{method: http.MethodPatch, path: "/k8s/api/v1/namespaces/default/pods/nginx/status",
+		contentType: "application/merge-patch+json", body: `{"status":{}}`}
+	if *received != expected {
+		t.Errorf("expected upstream request %+v, got %+v", expected, *received)
+	}
+}
+
+func TestRawProxyUpstreamError(t *testing.T) {
+	cases := []struct {
+		name    string
+		code    int
+		body    string
+		reason  metav1.StatusReason
+		message string
+	}{
+		{"status", http.StatusConflict, `{"kind":"Status","apiVersion":"v1","status":"Failure",` +
+			`"message":"pods \"nginx\" already exists","reason":"AlreadyExists","code":409}`,
+			metav1.StatusReasonAlreadyExists, `pods "nginx" already exists`},
+		{"not found status", http.StatusNotFound, `{"kind":"Status","apiVersion":"v1","status":"Failure",` +
+			`"message":"pods \"nginx\" not found","reason":"NotFound","code":404}`,
+			metav1.StatusReasonNotFound, `pods "nginx" not found`},
+		{"no status", http.StatusForbidden, `forbidden by the proxy`, metav1.StatusReasonForbidden, ""},
+	}
+
+	for _, c := range cases {
+		proxy, _, server := newTestRawProxy(t, "", c.code, c.body)
+		_, err := proxy.Post(newTestRequest(t, http.MethodPost, "http://localhost/api/v1/namespaces/default/pods",
+			`{}`))
+		server.Close()
+
+		status, ok := err.(errors.APIStatus)
+		if !ok {
+			t.Errorf("%s: expected status error, got %v", c.name, err)
+			continue
+		}
+		if code := status.Status().Code; int(code) != c.code {
+			t.Errorf("%s: expected code %d, got %d", c.name, c.code, code)
+		}
+		if reason := status.Status().Reason; reason != c.reason {
+			t.Errorf("%s: expected reason %s, got %s", c.name, c.reason, reason)
+		}
+		if len(c.message) > 0 && status.Status().Message != c.message {
+			t.Errorf("%s: expected message %q, got %q", c.name, c.message, status.Status().Message)
+		}
+	}
+}
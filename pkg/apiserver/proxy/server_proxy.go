@@ -1,7 +1,7 @@
 package proxy
 
 import (
-	"github.com/emicklei/go-restful/log"
+	"github.com/fest-research/iot-addon/pkg/logging"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -31,47 +31,48 @@ func NewServerProxy(tprClient *dynamic.Client) IServerProxy {
 
 func (this ServerProxy) Get(resource *metav1.APIResource, namespace, name string) (
 	*unstructured.Unstructured, error) {
-	log.Printf("[Server proxy] GET resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] GET resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 
 	return this.tprClient.Resource(resource, namespace).Get(name)
 }
 
 func (this ServerProxy) Create(resource *metav1.APIResource, namespace string, obj *unstructured.Unstructured) (
 	*unstructured.Unstructured, error) {
-	log.Printf("[Server proxy] CREATE resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] CREATE resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 
 	return this.tprClient.Resource(resource, namespace).Create(obj)
 }
 
 func (this ServerProxy) Delete(resource *metav1.APIResource, namespace, name string,
 	deleteOptions *metav1.DeleteOptions) error {
-	log.Printf("[Server proxy] DELETE resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] DELETE resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 
 	return this.tprClient.Resource(resource, namespace).Delete(name, deleteOptions)
 }
 
 func (this ServerProxy) Update(resource *metav1.APIResource, namespace string,
 	obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
-	log.Printf("[Server proxy] UPDATE resource: %v", obj)
+	logging.Debugf("[Server proxy] UPDATE resource: %s, namespaced: %t, name: %s", resource.Name,
+		resource.Namespaced, obj.GetName())
 
 	return this.tprClient.Resource(resource, namespace).Update(obj)
 }
 
 func (this ServerProxy) Patch(resource *metav1.APIResource, namespace, name string,
 	pt types.PatchType, body []byte) (*unstructured.Unstructured, error) {
-	log.Printf("[Server proxy] PATCH resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] PATCH resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 	return this.tprClient.Resource(resource, namespace).Patch(name, pt, body)
 }
 
 func (this ServerProxy) List(resource *metav1.APIResource, namespace string, listOptions *metav1.ListOptions) (
 	runtime.Object, error) {
-	log.Printf("[Server proxy] LIST resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] LIST resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 	return this.tprClient.Resource(resource, namespace).List(listOptions)
 }
 
 func (this ServerProxy) Watch(resource *metav1.APIResource, namespace string, listOptions *metav1.ListOptions) (
 	watch.Interface, error) {
-	log.Printf("[Server proxy] WATCH resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
+	logging.Debugf("[Server proxy] WATCH resource: %s, namespaced: %t", resource.Name, resource.Namespaced)
 
 	watcher, err := this.tprClient.
 		Resource(resource, namespace).
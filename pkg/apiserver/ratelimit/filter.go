@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"github.com/golang/groupcache/lru"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	VerbWatch = "watch"
+	VerbList  = "list"
+	VerbWrite = "write"
+
+	scopeAddress = "address"
+	scopeDevice  = "device"
+	scopeClient  = "client"
+	scopeTenant  = "tenant"
+)
+
+// maxBuckets is number of token buckets kept in memory. Least recently used buckets are forgotten first, they
+// are full again once recreated.
+const maxBuckets = 10000
+
+// reasonTooManyRequests is reason of rejected requests, which the vendored API types lack.
+const reasonTooManyRequests metav1.StatusReason = "TooManyRequests"
+
+// bucket is token bucket of an address, device, client or tenant and verb. It's replaced when its limit is reloaded.
+type bucket struct {
+	limit   config.RateLimit
+	limiter flowcontrol.RateLimiter
+}
+
+// Limiter rejects requests of addresses, devices and tenants over their rate limits with 429 Too Many
+// Requests.
+type Limiter struct {
+	store *config.ApiserverStore
+
+	mu      sync.Mutex
+	buckets *lru.Cache
+}
+
+func NewLimiter(store *config.ApiserverStore) *Limiter {
+	return &Limiter{store: store, buckets: lru.New(maxBuckets)}
+}
+
+// AddressFilter takes a token of the address the request is sent from. It runs ahead of authentication, so
+// floods of requests failing to authenticate don't reach the kubernetes apiserver either.
+func (l *Limiter) AddressFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	verb := GetVerb(req)
+	address := getClientAddress(req)
+
+	limit := limitOf(l.store.Get().RateLimits.Client, verb)
+	if !l.allow(scopeAddress+"/"+address+"/"+verb, limit) {
+		reject(req, resp, scopeAddress, address, verb, limit)
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// Filter runs after authentication and takes a token of the device sending the request and a token of its tenant. Clients not authenticated
+// as a device, anonymous ones and users of bootstrap tokens, are limited by their address like devices.
+func (l *Limiter) Filter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	cfg := l.store.Get()
+	verb := GetVerb(req)
+	device := auth.GetDevice(req)
+	tenant := cfg.Tenancy.NamespaceOf(device)
+
+	scope, name := scopeDevice, device
+	if len(device) == 0 {
+		scope, name = scopeClient, getClientAddress(req)
+	}
+	limit := limitOf(cfg.RateLimits.Device, verb)
+	if !l.allow(scope+"/"+name+"/"+verb, limit) {
+		reject(req, resp, scope, name, verb, limit)
+		return
+	}
+
+	limit = limitOf(cfg.RateLimits.TenantLimits(tenant), verb)
+	if !l.allow(scopeTenant+"/"+tenant+"/"+verb, limit) {
+		reject(req, resp, scopeTenant, tenant, verb, limit)
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// allow takes a token from the bucket with given key. Limits with zero QPS are unlimited.
+func (l *Limiter) allow(key string, limit config.RateLimit) bool {
+	if limit.QPS <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, ok := l.buckets.Get(key)
+	current, _ := value.(*bucket)
+	if !ok || current.limit != limit {
+		current = &bucket{limit: limit, limiter: flowcontrol.NewTokenBucketRateLimiter(limit.QPS, limit.Burst)}
+		l.buckets.Add(key, current)
+	}
+	return current.limiter.TryAccept()
+}
+
+// GetVerb returns verb class of the request limits are set for. Reads other than watches are lists.
+func GetVerb(req *restful.Request) string {
+	switch {
+	case req.Request.Method != http.MethodGet && req.Request.Method != http.MethodHead:
+		return VerbWrite
+	case strings.Contains(req.SelectedRoutePath(), "/watch/") || req.QueryParameter("watch") == "true":
+		return VerbWatch
+	default:
+		return VerbList
+	}
+}
+
+// getClientAddress returns host the request is sent from.
+func getClientAddress(req *restful.Request) string {
+	host, _, err := net.SplitHostPort(req.Request.RemoteAddr)
+	if err != nil {
+		return req.Request.RemoteAddr
+	}
+	return host
+}
+
+func limitOf(limits config.RequestLimits, verb string) config.RateLimit {
+	switch verb {
+	case VerbWatch:
+		return limits.Watch
+	case VerbWrite:
+		return limits.Write
+	default:
+		return limits.List
+	}
+}
+
+// reject writes 429 status asking the client to retry once the bucket has a token again.
+func reject(req *restful.Request, resp *restful.Response, scope, name, verb string, limit config.RateLimit) {
+	metrics.RequestThrottled(scope, verb)
+	logging.RequestLogger(req).Warningf("[Rate limiter] %s %s exceeded %s rate limit", scope, name, verb)
+
+	retryAfter := int(math.Ceil(1 / float64(limit.QPS)))
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Code:     errors.StatusTooManyRequests,
+		Reason:   reasonTooManyRequests,
+		Message:  fmt.Sprintf("too many %s requests of %s %s, try again later", verb, scope, name),
+		Details:  &metav1.StatusDetails{RetryAfterSeconds: int32(retryAfter)},
+	}
+
+	resp.AddHeader("Retry-After", strconv.Itoa(retryAfter))
+	resp.WriteHeaderAndJson(errors.StatusTooManyRequests, status, restful.MIME_JSON)
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/auth"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+)
+
+func newTestLimiter() *Limiter {
+	cfg := config.NewApiserverConfig()
+	cfg.RateLimits.Device.List = config.RateLimit{QPS: 0.001, Burst: 1}
+	cfg.RateLimits.Tenant.List = config.RateLimit{}
+	return NewLimiter(config.NewApiserverStore(cfg))
+}
+
+// filterTestRequest sends list request from the address with the identity and returns its status.
+func filterTestRequest(l *Limiter, remoteAddr string, identity *auth.Identity) int {
+	httpReq := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	httpReq.RemoteAddr = remoteAddr
+	req := restful.NewRequest(httpReq)
+	if identity != nil {
+		auth.SetIdentity(req, identity)
+	}
+
+	recorder := httptest.NewRecorder()
+	chain := &restful.FilterChain{Target: func(req *restful.Request, resp *restful.Response) {
+		resp.WriteHeader(http.StatusOK)
+	}}
+	l.Filter(req, restful.NewResponse(recorder), chain)
+	return recorder.Code
+}
+
+func TestLimiterScopes(t *testing.T) {
+	bootstrap := func() *auth.Identity {
+		return auth.NewBootstrapIdentity(&certificates.BootstrapToken{ID: "abcdef"})
+	}
+	impostor := auth.NewDeviceIdentity("raspi-1")
+	impostor.Device = ""
+
+	cases := []struct {
+		name string
+		// first and second requests, the second one is throttled if it shares the bucket of the first one
+		first, second func(*Limiter) int
+		throttled     bool
+	}{
+		{"same device", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", auth.NewDeviceIdentity("raspi-1"))
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.2:5000", auth.NewDeviceIdentity("raspi-1"))
+		}, true},
+		{"other device", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", auth.NewDeviceIdentity("raspi-1"))
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", auth.NewDeviceIdentity("raspi-2"))
+		}, false},
+		{"anonymous of same address", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", nil)
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:6000", nil)
+		}, true},
+		{"anonymous of other address", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", nil)
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.2:5000", nil)
+		}, false},
+		{"bootstrap token of other address", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", bootstrap())
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.2:5000", bootstrap())
+		}, false},
+		{"username without device", func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.1:5000", auth.NewDeviceIdentity("raspi-1"))
+		}, func(l *Limiter) int {
+			return filterTestRequest(l, "10.0.0.2:5000", impostor)
+		}, false},
+	}
+
+	for _, c := range cases {
+		l := newTestLimiter()
+		if code := c.first(l); code != http.StatusOK {
+			t.Errorf("%s: expected first request to pass, got %d", c.name, code)
+		}
+
+		expected := http.StatusOK
+		if c.throttled {
+			expected = http.StatusTooManyRequests
+		}
+		if code := c.second(l); code != expected {
+			t.Errorf("%s: expected %d, got %d", c.name, expected, code)
+		}
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	l := newTestLimiter()
+	for i := 0; i < maxBuckets+100; i++ {
+		filterTestRequest(l, fmt.Sprintf("10.%d.%d.%d:5000", i>>16, (i>>8)&255, i&255), nil)
+	}
+	if l.buckets.Len() != maxBuckets {
+		t.Errorf("expected %d buckets, got %d", maxBuckets, l.buckets.Len())
+	}
+
+	// Recently used bucket is kept
+	recent := fmt.Sprintf("10.0.%d.%d:5000", (maxBuckets>>8)&255, maxBuckets&255)
+	if code := filterTestRequest(l, recent, nil); code != http.StatusTooManyRequests {
+		t.Errorf("expected recently used bucket to be kept, got %d", code)
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	cfg := config.NewApiserverConfig()
+	cfg.RateLimits.Client.List = config.RateLimit{QPS: 0.001, Burst: 3}
+	l := NewLimiter(config.NewApiserverStore(cfg))
+
+	// Authentication runs after the filter and rejects every request
+	send := func(remoteAddr string) int {
+		httpReq := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		httpReq.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		chain := &restful.FilterChain{Target: func(req *restful.Request, resp *restful.Response) {
+			resp.WriteHeader(http.StatusUnauthorized)
+		}}
+		l.AddressFilter(restful.NewRequest(httpReq), restful.NewResponse(recorder), chain)
+		return recorder.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send(fmt.Sprintf("10.0.0.1:%d", 5000+i)); code != http.StatusUnauthorized {
+			t.Errorf("expected request %d to reach authentication, got %d", i, code)
+		}
+	}
+	if code := send("10.0.0.1:6000"); code != http.StatusTooManyRequests {
+		t.Errorf("expected unauthenticated requests over the burst to be throttled, got %d", code)
+	}
+	if code := send("10.0.0.2:5000"); code != http.StatusUnauthorized {
+		t.Errorf("expected request of other address to reach authentication, got %d", code)
+	}
+}
@@ -0,0 +1,142 @@
+package watch
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// DeltaParameter is query parameter of watches opting in to delta encoded events.
+	DeltaParameter = "delta"
+
+	// DeltaResyncParameter is query parameter of delta watches of clients whose copies diverged from the
+	// stream. Such watches start with the full state of every object, whatever resource version they resume from.
+	DeltaResyncParameter = "deltaResync"
+
+	// deltaSnapshotInterval is number of patches of an object sent before its full state is sent again.
+	deltaSnapshotInterval = 10
+)
+
+// deltaEvent is a watch event of delta encoded streams. Object of MODIFIED events with base resource version
+// is a JSON merge patch against the object with that resource version last sent on the stream. Clients whose
+// copy has different resource version resync by watching again with DeltaResyncParameter.
+type deltaEvent struct {
+	Type                watch.EventType `json:"type"`
+	Object              json.RawMessage `json:"object"`
+	BaseResourceVersion string          `json:"baseResourceVersion,omitempty"`
+}
+
+// sentObject is the last state of an object sent on the stream.
+type sentObject struct {
+	data            []byte
+	resourceVersion string
+	patches         int
+}
+
+// deltaEventEncoder sends patches of modified objects instead of their full state. It keeps objects sent on
+// the stream, so every stream needs its own encoder.
+type deltaEventEncoder struct {
+	sent map[string]*sentObject
+}
+
+func newDeltaEventEncoder() *deltaEventEncoder {
+	return &deltaEventEncoder{sent: make(map[string]*sentObject)}
+}
+
+// WatchResourceVersion returns resource version the watch of the request starts from, none for delta watches
+// resyncing, so they start with the full state of every object.
+func WatchResourceVersion(request *restful.Request) string {
+	if request.QueryParameter(DeltaParameter) == "true" && request.QueryParameter(DeltaResyncParameter) == "true" {
+		return ""
+	}
+	return request.QueryParameter("resourceVersion")
+}
+
+func (e *deltaEventEncoder) ContentType() string {
+	return jsonEventEncoder{}.ContentType()
+}
+
+// Encode implements eventEncoder.
+func (e *deltaEventEncoder) Encode(event watch.Event) ([]byte, error) {
+	data, err := json.Marshal(event.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors are not objects of the stream
+	accessor, err := meta.Accessor(event.Object)
+	if err != nil {
+		return json.Marshal(&deltaEvent{Type: event.Type, Object: data})
+	}
+	key := accessor.GetNamespace() + "/" + accessor.GetName()
+
+	if event.Type == watch.Deleted {
+		delete(e.sent, key)
+		return json.Marshal(&deltaEvent{Type: event.Type, Object: data})
+	}
+
+	last, ok := e.sent[key]
+	current := &sentObject{data: data, resourceVersion: accessor.GetResourceVersion()}
+	e.sent[key] = current
+	if event.Type != watch.Modified || !ok || last.patches >= deltaSnapshotInterval {
+		return json.Marshal(&deltaEvent{Type: event.Type, Object: data})
+	}
+
+	patch, err := createMergePatch(last.data, data)
+	if err != nil {
+		return nil, err
+	}
+	current.patches = last.patches + 1
+	return json.Marshal(&deltaEvent{Type: event.Type, Object: patch, BaseResourceVersion: last.resourceVersion})
+}
+
+// createMergePatch creates JSON merge patch (RFC 7386) turning the original document into the modified one.
+func createMergePatch(original, modified []byte) ([]byte, error) {
+	originalMap := map[string]interface{}{}
+	if err := json.Unmarshal(original, &originalMap); err != nil {
+		return nil, err
+	}
+
+	modifiedMap := map[string]interface{}{}
+	if err := json.Unmarshal(modified, &modifiedMap); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(diffMaps(originalMap, modifiedMap))
+}
+
+// diffMaps returns changed fields of nested objects and null for removed ones. Lists are replaced as a whole.
+func diffMaps(original, modified map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range modified {
+		originalValue, ok := original[key]
+		if !ok {
+			patch[key] = value
+			continue
+		}
+
+		originalObject, isOriginalObject := originalValue.(map[string]interface{})
+		modifiedObject, isModifiedObject := value.(map[string]interface{})
+		if isOriginalObject && isModifiedObject {
+			if nested := diffMaps(originalObject, modifiedObject); len(nested) > 0 {
+				patch[key] = nested
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(originalValue, value) {
+			patch[key] = value
+		}
+	}
+
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
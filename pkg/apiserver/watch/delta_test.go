@@ -0,0 +1,134 @@
+package watch
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+	"k8s.io/apimachinery/pkg/watch"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDiffMaps(t *testing.T) {
+	cases := []struct {
+		name               string
+		original, modified string
+		expected           string
+	}{
+		{"unchanged", `{"a":1,"b":{"c":"d"}}`, `{"a":1,"b":{"c":"d"}}`, `{}`},
+		{"changed", `{"a":1,"b":"c"}`, `{"a":2,"b":"c"}`, `{"a":2}`},
+		{"added", `{"a":1}`, `{"a":1,"b":{"c":"d"}}`, `{"b":{"c":"d"}}`},
+		{"removed", `{"a":1,"b":{"c":"d"}}`, `{"a":1}`, `{"b":null}`},
+		{"nested", `{"a":{"b":1,"c":2,"d":{"e":3}}}`, `{"a":{"b":1,"c":3,"d":{}}}`,
+			`{"a":{"c":3,"d":{"e":null}}}`},
+		{"list replaced", `{"a":[1,2,3]}`, `{"a":[1,3]}`, `{"a":[1,3]}`},
+		{"object replaced by value", `{"a":{"b":1}}`, `{"a":"b"}`, `{"a":"b"}`},
+		{"value replaced by object", `{"a":"b"}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+
+	for _, c := range cases {
+		patch, err := createMergePatch([]byte(c.original), []byte(c.modified))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+
+		var actual, expected interface{}
+		json.Unmarshal(patch, &actual)
+		json.Unmarshal([]byte(c.expected), &expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected patch %s, got %s", c.name, c.expected, patch)
+		}
+	}
+}
+
+func newTestNode(resourceVersion int) *kubeapi.Node {
+	node := &kubeapi.Node{}
+	node.Name = "raspi-1"
+	node.ResourceVersion = strconv.Itoa(resourceVersion)
+	node.Labels = map[string]string{"heartbeat": strconv.Itoa(resourceVersion)}
+	return node
+}
+
+func decodeDeltaEvent(t *testing.T, data []byte) *deltaEvent {
+	event := &deltaEvent{}
+	if err := json.Unmarshal(data, event); err != nil {
+		t.Fatalf("cannot decode event: %s", err.Error())
+	}
+	return event
+}
+
+func TestDeltaEventEncoderSnapshotInterval(t *testing.T) {
+	encoder := newDeltaEventEncoder()
+	if _, err := encoder.Encode(watch.Event{Type: watch.Added, Object: newTestNode(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for rv := 2; rv <= 3*(deltaSnapshotInterval+1); rv++ {
+		data, err := encoder.Encode(watch.Event{Type: watch.Modified, Object: newTestNode(rv)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := decodeDeltaEvent(t, data)
+
+		// Every event after deltaSnapshotInterval patches carries the full object
+		full := (rv-1)%(deltaSnapshotInterval+1) == 0
+		node := &kubeapi.Node{}
+		json.Unmarshal(event.Object, node)
+		if full {
+			if len(event.BaseResourceVersion) > 0 || node.Name != "raspi-1" {
+				t.Errorf("%d: expected full object, got %s based on %q", rv, event.Object, event.BaseResourceVersion)
+			}
+			continue
+		}
+
+		if event.BaseResourceVersion != strconv.Itoa(rv-1) {
+			t.Errorf("%d: expected patch based on %d, got %q", rv, rv-1, event.BaseResourceVersion)
+		}
+		if len(node.Name) > 0 || node.ResourceVersion != strconv.Itoa(rv) || node.Labels["heartbeat"] != strconv.Itoa(rv) {
+			t.Errorf("%d: expected patch of resource version and label, got %s", rv, event.Object)
+		}
+	}
+}
+
+func TestDeltaEventEncoderDeleted(t *testing.T) {
+	encoder := newDeltaEventEncoder()
+	encoder.Encode(watch.Event{Type: watch.Added, Object: newTestNode(1)})
+	encoder.Encode(watch.Event{Type: watch.Deleted, Object: newTestNode(2)})
+
+	// Objects added again after deletion are sent in full
+	encoder.Encode(watch.Event{Type: watch.Added, Object: newTestNode(3)})
+	data, _ := encoder.Encode(watch.Event{Type: watch.Modified, Object: newTestNode(4)})
+	if event := decodeDeltaEvent(t, data); event.BaseResourceVersion != "3" {
+		t.Errorf("expected patch based on 3, got %q", event.BaseResourceVersion)
+	}
+
+	encoder.Encode(watch.Event{Type: watch.Deleted, Object: newTestNode(5)})
+	data, _ = encoder.Encode(watch.Event{Type: watch.Modified, Object: newTestNode(6)})
+	if event := decodeDeltaEvent(t, data); len(event.BaseResourceVersion) > 0 {
+		t.Errorf("expected full object after deletion, got patch based on %q", event.BaseResourceVersion)
+	}
+}
+
+func TestWatchResourceVersion(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"resourceVersion=42", "42"},
+		{"resourceVersion=42&delta=true", "42"},
+		{"resourceVersion=42&deltaResync=true", "42"},
+		{"resourceVersion=42&delta=true&deltaResync=true", ""},
+		{"delta=true&deltaResync=true", ""},
+	}
+
+	for _, c := range cases {
+		request := restful.NewRequest(httptest.NewRequest("GET", "/api/v1/watch/pods?"+c.query, nil))
+		if actual := WatchResourceVersion(request); actual != c.expected {
+			t.Errorf("%s: expected resource version %q, got %q", c.query, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package watch
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var (
+	drainCh   = make(chan struct{})
+	drainOnce sync.Once
+)
+
+// Drain closes watch streams of all running and future notifiers. Each stream ends with an error event,
+// so kubelets reconnect right away instead of waiting for the watch timeout.
+func Drain() {
+	drainOnce.Do(func() {
+		logging.Infof("[Notifier] Draining watch streams")
+		close(drainCh)
+	})
+}
+
+// writeShutdownEvent sends the last event of a drained watch stream.
+func writeShutdownEvent(resource string, encoder eventEncoder, response *restful.Response,
+	flusher http.Flusher) error {
+	encodedEvent, err := encoder.Encode(watch.Event{
+		Type: watch.Error,
+		Object: &metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Code:     http.StatusServiceUnavailable,
+			Reason:   metav1.StatusReasonServiceUnavailable,
+			Message:  "apiserver is shutting down",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	n, err := response.Write(encodedEvent)
+	metrics.AddStreamedBytes(resource, n)
+	if err != nil {
+		return err
+	}
+
+	flusher.Flush()
+	return nil
+}
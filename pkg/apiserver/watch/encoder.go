@@ -0,0 +1,49 @@
+package watch
+
+import (
+	"github.com/emicklei/go-restful"
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/encoding"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// eventEncoder encodes events written to a watch stream.
+type eventEncoder interface {
+	ContentType() string
+	Encode(watch.Event) ([]byte, error)
+}
+
+type jsonEventEncoder struct{}
+
+func (jsonEventEncoder) ContentType() string {
+	return encoding.ContentTypeJSON
+}
+
+// Encode implements eventEncoder. Our event has correct json annotations for watch event.
+func (jsonEventEncoder) Encode(event watch.Event) ([]byte, error) {
+	return json.Marshal(&v1.Event{Type: event.Type, Object: event.Object})
+}
+
+type protobufEventEncoder struct{}
+
+func (protobufEventEncoder) ContentType() string {
+	return encoding.ContentTypeProtobufWatch
+}
+
+// Encode implements eventEncoder.
+func (protobufEventEncoder) Encode(event watch.Event) ([]byte, error) {
+	return encoding.EncodeProtobufWatchEvent(event)
+}
+
+// newEventEncoder returns delta or protobuf encoder if it's enabled and requested by the client, delta
+// encoding taking precedence.
+func newEventEncoder(request *restful.Request, protobuf, delta bool) eventEncoder {
+	if delta && request.QueryParameter(DeltaParameter) == "true" {
+		return newDeltaEventEncoder()
+	}
+	if protobuf && encoding.AcceptsProtobuf(request.Request) {
+		return protobufEventEncoder{}
+	}
+	return jsonEventEncoder{}
+}
@@ -6,19 +6,23 @@ import (
 	"time"
 
 	"github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful/log"
-	"github.com/fest-research/iot-addon/pkg/api/v1"
 	ctrl "github.com/fest-research/iot-addon/pkg/apiserver/controller"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/logging"
 
-	"k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
-var defaultTimeout = 10 * time.Minute
+// EventFilter returns false for events the watch client must not see.
+type EventFilter func(watch.Event) bool
 
 type Notifier struct {
+	resource    string
 	controllers []ctrl.WatchEventController
 	timeout     time.Duration
+	filter      EventFilter
+	protobuf    bool
+	delta       bool
 }
 
 // Controllers are executed in registration order
@@ -30,11 +34,29 @@ func (this *Notifier) SetTimeout(timeout time.Duration) {
 	this.timeout = timeout
 }
 
+// SetFilter sets filter of events. Events are filtered before controllers transform them.
+func (this *Notifier) SetFilter(filter EventFilter) {
+	this.filter = filter
+}
+
+// EnableProtobuf streams protobuf events to clients accepting them. Controllers must transform events to
+// objects of kubernetes API types.
+func (this *Notifier) EnableProtobuf() {
+	this.protobuf = true
+}
+
+// EnableDelta sends JSON merge patches of modified objects to clients watching with delta parameter set to
+// true. Full objects are sent again after every 10 patches of an object.
+func (this *Notifier) EnableDelta() {
+	this.delta = true
+}
+
 // Start starts the notifier, which will "notify" every time the watcher produces an Event by
 // writing a transformation of the produced Event to the response. The transformation of the
 // Event is done by the registered controllers, in the order they were registered.
-func (this *Notifier) Start(watcher watch.Interface, response *restful.Response) error {
-	log.Printf("[Notifier] Starting watch client notifier.")
+func (this *Notifier) Start(watcher watch.Interface, request *restful.Request, response *restful.Response) error {
+	logger := logging.RequestLogger(request)
+	logger.Debugf("[Notifier] Starting watch client notifier.")
 	cn, ok := response.ResponseWriter.(http.CloseNotifier)
 	if !ok {
 		return fmt.Errorf("Unable to start watch - can't get http.CloseNotifier: %#v", response.ResponseWriter)
@@ -50,7 +72,10 @@ func (this *Notifier) Start(watcher watch.Interface, response *restful.Response)
 	timeoutCh, cleanup := timeoutFactory.TimeoutCh()
 	defer cleanup()
 
-	response.Header().Set("Content-Type", "application/json")
+	defer metrics.WatchStarted(this.resource, "notifier")()
+
+	encoder := newEventEncoder(request, this.protobuf, this.delta)
+	response.Header().Set("Content-Type", encoder.ContentType())
 	response.Header().Set("Transfer-Encoding", "chunked")
 	response.WriteHeader(http.StatusOK)
 	flusher.Flush()
@@ -63,21 +88,34 @@ func (this *Notifier) Start(watcher watch.Interface, response *restful.Response)
 			return nil
 		case <-timeoutCh:
 			return nil
-		case event := <-resultChan:
+		case <-drainCh:
+			return writeShutdownEvent(this.resource, encoder, response, flusher)
+		case event, ok := <-resultChan:
+			// Watch ended upstream or fell behind, the client has to watch again
+			if !ok {
+				return nil
+			}
+
+			if this.filter != nil && !this.filter(event) {
+				continue
+			}
+
 			// Transform data if there are any controllers registered
 			for _, controller := range this.controllers {
 				event = controller.TransformWatchEvent(event)
 			}
 
-			// Our event has correct json annotations for watch event.
-			iotEvent := this.toEvent(event)
-			encodedEvent, err := json.Marshal(&iotEvent)
+			encodedEvent, err := encoder.Encode(event)
 			if err != nil {
 				return err
 			}
 
-			log.Printf("[Notifier] Sending response to watch client: %s", encodedEvent)
-			_, err = response.Write(encodedEvent)
+			if logging.DebugEnabled() {
+				logger.Debugf("[Notifier] Sending %s event to watch client: %s", event.Type,
+					logging.RedactBody(encodedEvent))
+			}
+			n, err := response.Write(encodedEvent)
+			metrics.AddStreamedBytes(this.resource, n)
 			if err != nil {
 				return err
 			}
@@ -89,13 +127,8 @@ func (this *Notifier) Start(watcher watch.Interface, response *restful.Response)
 	}
 }
 
-func (this Notifier) toEvent(event watch.Event) v1.Event {
-	return v1.Event{
-		Type:   event.Type,
-		Object: event.Object,
-	}
-}
-
-func NewNotifier() *Notifier {
-	return &Notifier{controllers: make([]ctrl.WatchEventController, 0), timeout: defaultTimeout}
+// NewNotifier creates notifier of watch events of given resource, closing the stream after timeout.
+// Resource name is used to label metrics.
+func NewNotifier(resource string, timeout time.Duration) *Notifier {
+	return &Notifier{resource: resource, controllers: make([]ctrl.WatchEventController, 0), timeout: timeout}
 }
@@ -1,24 +1,42 @@
 package watch
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/emicklei/go-restful"
-	"github.com/emicklei/go-restful/log"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 type RawNotifier struct {
-	timeout time.Duration
+	resource  string
+	timeout   time.Duration
+	newObject func() runtime.Object
 }
 
 func (this *RawNotifier) SetTimeout(timeout time.Duration) {
 	this.timeout = timeout
 }
 
-func (this *RawNotifier) Start(watcher Watcher, response *restful.Response) error {
-	log.Printf("[Notifier] Starting watch client notifier.")
+// EnableProtobuf streams protobuf events to clients accepting them. Raw JSON events are decoded into objects
+// created by newObject, which must be of a kubernetes API type.
+func (this *RawNotifier) EnableProtobuf(newObject func() runtime.Object) {
+	this.newObject = newObject
+}
+
+// Start streams events of the watcher to the response until the client leaves, the stream times out or the
+// watch ends upstream. The watcher is stopped when Start returns.
+func (this *RawNotifier) Start(watcher Watcher, request *restful.Request, response *restful.Response) error {
+	defer watcher.Stop()
+
+	logger := logging.RequestLogger(request)
+	logger.Debugf("[Raw Notifier] Starting watch client notifier.")
 	cn, ok := response.ResponseWriter.(http.CloseNotifier)
 	if !ok {
 		return fmt.Errorf("Unable to start watch - can't get http.CloseNotifier: %#v", response.ResponseWriter)
@@ -34,7 +52,10 @@ func (this *RawNotifier) Start(watcher Watcher, response *restful.Response) erro
 	timeoutCh, cleanup := timeoutFactory.TimeoutCh()
 	defer cleanup()
 
-	response.Header().Set("Content-Type", "application/json")
+	defer metrics.WatchStarted(this.resource, "raw_notifier")()
+
+	encoder := newEventEncoder(request, this.newObject != nil, false)
+	response.Header().Set("Content-Type", encoder.ContentType())
 	response.Header().Set("Transfer-Encoding", "chunked")
 	response.WriteHeader(http.StatusOK)
 	flusher.Flush()
@@ -48,11 +69,21 @@ func (this *RawNotifier) Start(watcher Watcher, response *restful.Response) erro
 			return nil
 		case <-timeoutCh:
 			return nil
+		case <-drainCh:
+			return writeShutdownEvent(this.resource, encoder, response, flusher)
 		case err := <-errorChan:
 			return err
 		case msg := <-resultChan:
-			log.Printf("[Raw Notifier] Sending response to watch client: %s", msg)
-			_, err := response.Write([]byte(msg))
+			if logging.DebugEnabled() {
+				logger.Debugf("[Raw Notifier] Sending response to watch client: %s", logging.RedactBody([]byte(msg)))
+			}
+			encodedEvent, err := this.encode(encoder, msg)
+			if err != nil {
+				return err
+			}
+
+			n, err := response.Write(encodedEvent)
+			metrics.AddStreamedBytes(this.resource, n)
 			if err != nil {
 				return err
 			}
@@ -64,6 +95,32 @@ func (this *RawNotifier) Start(watcher Watcher, response *restful.Response) erro
 	}
 }
 
-func NewRawNotifier() *RawNotifier {
-	return &RawNotifier{timeout: defaultTimeout}
+// encode passes JSON events through, other encodings get the decoded event.
+func (this *RawNotifier) encode(encoder eventEncoder, msg string) ([]byte, error) {
+	if _, ok := encoder.(jsonEventEncoder); ok {
+		return []byte(msg), nil
+	}
+
+	rawEvent := &struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}{}
+	if err := json.Unmarshal([]byte(msg), rawEvent); err != nil {
+		return nil, err
+	}
+
+	var object runtime.Object = this.newObject()
+	if rawEvent.Type == watch.Error {
+		object = &metav1.Status{}
+	}
+	if err := json.Unmarshal(rawEvent.Object, object); err != nil {
+		return nil, err
+	}
+	return encoder.Encode(watch.Event{Type: rawEvent.Type, Object: object})
+}
+
+// NewRawNotifier creates notifier of raw watch events of given resource, closing the stream after timeout.
+// Resource name is used to label metrics.
+func NewRawNotifier(resource string, timeout time.Duration) *RawNotifier {
+	return &RawNotifier{resource: resource, timeout: timeout}
 }
@@ -3,48 +3,93 @@ package watch
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"sync"
 
-	"github.com/emicklei/go-restful/log"
+	"github.com/fest-research/iot-addon/pkg/logging"
 )
 
 // Interface can be implemented by anything that knows how to watch and report changes.
 type Watcher interface {
 	Watch(string)
+	// Stop ends the watch and closes its upstream connection.
+	Stop()
 
 	ResultChan() chan string
 	ErrorChan() chan error
 }
 
 type RawWatcher struct {
+	client *http.Client
 	result chan string
 	err    chan error
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // This is supposed to be called as go routine and synced using channels
 func (this *RawWatcher) Watch(watchPath string) {
-	log.Printf("[Watcher] Creating watch on %s", watchPath)
-	resp, err := http.Get(watchPath)
+	logging.Debugf("[Watcher] Creating watch on %s", watchPath)
+
+	req, err := http.NewRequest(http.MethodGet, watchPath, nil)
+	if err != nil {
+		this.sendError(err)
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-this.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := this.client.Do(req.WithContext(ctx))
 	if err != nil {
-		this.err <- err
+		this.sendError(err)
 		return
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		this.sendError(fmt.Errorf("watch on %s failed with status %d: %s", watchPath, resp.StatusCode,
+			logging.RedactBody(body)))
+		return
+	}
+
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			this.err <- err
+			this.sendError(err)
 			return
 		}
 
-		log.Printf("[Watcher] Server response: %s", string(line))
-		this.result <- bytes.NewBuffer(line).String()
+		if logging.DebugEnabled() {
+			logging.Debugf("[Watcher] Server response: %s", logging.RedactBody(line))
+		}
+		select {
+		case this.result <- bytes.NewBuffer(line).String():
+		case <-this.stop:
+			return
+		}
 	}
 }
 
+func (this *RawWatcher) Stop() {
+	this.stopOnce.Do(func() { close(this.stop) })
+}
+
 func (this *RawWatcher) ResultChan() chan string {
 	return this.result
 }
@@ -53,6 +98,17 @@ func (this *RawWatcher) ErrorChan() chan error {
 	return this.err
 }
 
-func NewRawWatcher() Watcher {
-	return &RawWatcher{result: make(chan string), err: make(chan error)}
+// sendError reports error ending the watch unless the watch was stopped.
+func (this *RawWatcher) sendError(err error) {
+	select {
+	case this.err <- err:
+	case <-this.stop:
+	}
+}
+
+// NewRawWatcher creates watcher reading watch streams with the client, which carries credentials of the
+// kubernetes apiserver.
+func NewRawWatcher(client *http.Client) Watcher {
+	return &RawWatcher{client: client, result: make(chan string), err: make(chan error),
+		stop: make(chan struct{})}
 }
@@ -0,0 +1,513 @@
+package watchcache
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// KeyIndex indexes cached objects by "namespace/key", key being returned by the KeyFunc of the cache.
+const KeyIndex = "key"
+
+// KeyFunc returns key watches of an object are selected by, e.g. name of the device an IotPod is scheduled on.
+type KeyFunc func(obj runtime.Object) string
+
+// FilterFunc returns true for objects a watch selects. Watches see objects starting to match as added and
+// objects no longer matching as deleted.
+type FilterFunc func(obj runtime.Object) bool
+
+// Cache holds objects of one IoT resource from all namespaces, kept up to date by a single upstream watch.
+// Lists are served from memory and watch events are fanned out to watches of the matching namespace and key.
+type Cache struct {
+	resource string
+	keyFunc  KeyFunc
+	buffer   int
+
+	indexer    cache.Indexer
+	controller cache.Controller
+	// changed is called with objects added, updated or deleted upstream
+	changed func(obj runtime.Object)
+
+	mu     sync.Mutex
+	synced bool
+	// watchers by "namespace/key", watchers of whole namespaces are registered under "namespace/"
+	watchers map[string]map[*cacheWatcher]struct{}
+	history  *history
+	// lastRV is resource version of the newest dispatched event
+	lastRV uint64
+	// ahead is set when lastRV is newer than the upstream version of the event, so the next events need newer
+	// versions than their own to be told apart
+	ahead bool
+}
+
+// NewCache creates cache of objects listed and watched by lw. Up to historySize recent events are kept, so
+// watches can resume from resource versions returned by earlier lists. Every watch buffers up to buffer
+// events, watches falling further behind are closed and their clients have to list again.
+func NewCache(resource string, lw cache.ListerWatcher, objType runtime.Object, keyFunc KeyFunc,
+	historySize, buffer int) *Cache {
+	c := &Cache{
+		resource: resource,
+		keyFunc:  keyFunc,
+		buffer:   buffer,
+		watchers: make(map[string]map[*cacheWatcher]struct{}),
+		history:  newHistory(historySize),
+	}
+
+	c.indexer, c.controller = cache.NewIndexerInformer(lw, objType, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.onAdd,
+		UpdateFunc: c.onUpdate,
+		DeleteFunc: c.onDelete,
+	}, cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		KeyIndex:             c.keyIndexFunc,
+	})
+	return c
+}
+
+// Run starts the upstream watch. It blocks until stop channel is closed.
+func (c *Cache) Run(stopCh <-chan struct{}) {
+	logging.Infof("[Watch cache] Starting cache of %s", c.resource)
+	go c.waitForSync(stopCh)
+	c.controller.Run(stopCh)
+}
+
+func (c *Cache) waitForSync(stopCh <-chan struct{}) {
+	if !cache.WaitForCacheSync(stopCh, c.controller.HasSynced) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Objects of the initial list are not replayed, watches from older versions have to list again
+	c.history.clear(c.lastRV)
+	c.synced = true
+	logging.Infof("[Watch cache] Cache of %s synced", c.resource)
+}
+
+// OnChange sets handler called with every object added, updated or deleted upstream, after watches were sent
+// the event. It must be set before the cache is run.
+func (c *Cache) OnChange(handler func(obj runtime.Object)) {
+	c.changed = handler
+}
+
+// Resync sends the cached object with given namespace and name to its watches again as modified, e.g. when
+// objects it is served with changed. It does nothing if there is no such object.
+func (c *Cache) Resync(namespace, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, exists, err := c.indexer.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return
+	}
+
+	// Unchanged object needs a version newer than the last event, so watches resumed from it see the resync
+	object := obj.(runtime.Object)
+	c.lastRV++
+	c.ahead = true
+	c.record(c.lastRV, entry{
+		event:     watch.Event{Type: watch.Modified, Object: object},
+		old:       object,
+		namespace: namespace,
+		key:       c.keyFunc(object),
+		exact:     true,
+		all:       true,
+	})
+}
+
+// HasSynced returns true once the initial list is cached.
+func (c *Cache) HasSynced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.synced
+}
+
+// CheckSynced returns error until the initial list is cached. It is meant for readiness checks.
+func (c *Cache) CheckSynced() error {
+	if !c.HasSynced() {
+		return fmt.Errorf("cache of %s is not synced", c.resource)
+	}
+	return nil
+}
+
+// Get returns cached object with given namespace and name. Returned object is shared and must not be
+// modified.
+func (c *Cache) Get(namespace, name string) (runtime.Object, error) {
+	if err := c.checkReady(); err != nil {
+		return nil, err
+	}
+
+	obj, exists, err := c.indexer.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+	if !exists {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: c.resource}, name)
+	}
+	return obj.(runtime.Object), nil
+}
+
+// ListOptions selects a page of a list.
+type ListOptions struct {
+	// Limit is maximum number of returned objects, all of them are returned if it is 0
+	Limit int64
+	// Continue is token returned with the previous page
+	Continue string
+}
+
+// ListResult is a page of a list.
+type ListResult struct {
+	// Objects are shared and must not be modified
+	Objects         []runtime.Object
+	ResourceVersion string
+	// Continue is token of the next page, empty on the last page
+	Continue string
+}
+
+// List returns cached objects of the namespace with given key, all objects of the namespace if key is empty.
+// Objects are further selected by filter, if set, and returned in pages ordered by namespace and name.
+// Watches started from returned resource version don't miss any later event. Continue tokens older than the
+// kept history expire.
+func (c *Cache) List(namespace, key string, filter FilterFunc, options ListOptions) (*ListResult, error) {
+	if err := c.checkReady(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rv := c.lastRV
+	start := ""
+	if len(options.Continue) > 0 {
+		token, err := decodeContinue(options.Continue)
+		if err != nil {
+			return nil, err
+		}
+		if token.ResourceVersion < c.history.evictedRV {
+			return nil, newExpired(fmt.Sprintf("The provided continue parameter is too old, list of %s "+
+				"has to be restarted without it", c.resource))
+		}
+		rv = token.ResourceVersion
+		start = token.Start
+	}
+
+	objs, err := c.list(namespace, key)
+	if err != nil {
+		return nil, errors.NewInternalError(err)
+	}
+
+	keys := make(map[runtime.Object]string, len(objs))
+	for _, obj := range objs {
+		keys[obj], _ = cache.MetaNamespaceKeyFunc(obj)
+	}
+	sort.Slice(objs, func(i, j int) bool { return keys[objs[i]] < keys[objs[j]] })
+
+	result := &ListResult{Objects: make([]runtime.Object, 0), ResourceVersion: strconv.FormatUint(rv, 10)}
+	for _, obj := range objs {
+		if keys[obj] <= start || (filter != nil && !filter(obj)) {
+			continue
+		}
+
+		// Page is full and there is a next one
+		if options.Limit > 0 && int64(len(result.Objects)) == options.Limit {
+			last := result.Objects[len(result.Objects)-1]
+			result.Continue, err = encodeContinue(rv, keys[last])
+			if err != nil {
+				return nil, errors.NewInternalError(err)
+			}
+			break
+		}
+		result.Objects = append(result.Objects, obj)
+	}
+	return result, nil
+}
+
+// Watch returns watch of objects of the namespace with given key, all objects of the namespace if key is
+// empty. Objects are further selected by filter, if set. Watches without resource version start with ADDED
+// events of all matching objects, others replay events newer than the resource version. Resource versions
+// older than the kept history are rejected as gone, so clients list again.
+func (c *Cache) Watch(namespace, key, resourceVersion string, filter FilterFunc) (watch.Interface, error) {
+	if err := c.checkReady(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := newCacheWatcher(c.buffer, filter, c.forget)
+	w.id = watcherID(namespace, key)
+
+	var initial []watch.Event
+	if len(resourceVersion) == 0 || resourceVersion == "0" {
+		objs, err := c.list(namespace, key)
+		if err != nil {
+			return nil, errors.NewInternalError(err)
+		}
+		for _, obj := range objs {
+			if filter == nil || filter(obj) {
+				initial = append(initial, watch.Event{Type: watch.Added, Object: obj})
+			}
+		}
+	} else {
+		rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+		if err != nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid resource version %q", resourceVersion))
+		}
+		if rv < c.history.evictedRV {
+			return nil, errors.NewGone(fmt.Sprintf("too old resource version: %d (%d)", rv, c.history.evictedRV))
+		}
+		for _, e := range c.history.since(rv, namespace, key) {
+			if event, ok := w.filterEvent(e); ok {
+				initial = append(initial, event)
+			}
+		}
+	}
+
+	if c.watchers[w.id] == nil {
+		c.watchers[w.id] = make(map[*cacheWatcher]struct{})
+	}
+	c.watchers[w.id][w] = struct{}{}
+	go w.process(initial)
+
+	return w, nil
+}
+
+func (c *Cache) checkReady() error {
+	if !c.HasSynced() {
+		return errors.NewServiceUnavailable(fmt.Sprintf("cache of %s is not synced yet", c.resource))
+	}
+	return nil
+}
+
+func (c *Cache) list(namespace, key string) ([]runtime.Object, error) {
+	var items []interface{}
+	var err error
+	if len(key) == 0 {
+		items, err = c.indexer.ByIndex(cache.NamespaceIndex, namespace)
+	} else {
+		items, err = c.indexer.ByIndex(KeyIndex, namespace+"/"+key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		objs = append(objs, item.(runtime.Object))
+	}
+	return objs, nil
+}
+
+func (c *Cache) keyIndexFunc(obj interface{}) ([]string, error) {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.keyFunc(obj.(runtime.Object))
+	if len(key) == 0 {
+		return []string{}, nil
+	}
+	return []string{object.GetNamespace() + "/" + key}, nil
+}
+
+func (c *Cache) onAdd(obj interface{}) {
+	object := obj.(runtime.Object)
+	c.dispatch(false, entry{
+		event:     watch.Event{Type: watch.Added, Object: object},
+		namespace: namespaceOf(object),
+		key:       c.keyFunc(object),
+		exact:     true,
+		all:       true,
+	})
+	c.notify(object)
+}
+
+func (c *Cache) onUpdate(oldObj, newObj interface{}) {
+	old := oldObj.(runtime.Object)
+	cur := newObj.(runtime.Object)
+	// Relists report unchanged objects as updated
+	if resourceVersionOf(old) == resourceVersionOf(cur) {
+		return
+	}
+
+	defer c.notify(cur)
+
+	namespace := namespaceOf(cur)
+	oldKey := c.keyFunc(old)
+	curKey := c.keyFunc(cur)
+	if oldKey == curKey {
+		c.dispatch(false, entry{
+			event:     watch.Event{Type: watch.Modified, Object: cur},
+			old:       old,
+			namespace: namespace,
+			key:       curKey,
+			exact:     true,
+			all:       true,
+		})
+		return
+	}
+
+	// Object moved to another key, e.g. IotPod rescheduled on another device. Watches of the old key see it
+	// deleted, watches of the new key see it added.
+	c.dispatch(false, entry{
+		event:     watch.Event{Type: watch.Deleted, Object: cur},
+		old:       old,
+		namespace: namespace,
+		key:       oldKey,
+		exact:     true,
+	}, entry{
+		event:     watch.Event{Type: watch.Added, Object: cur},
+		namespace: namespace,
+		key:       curKey,
+		exact:     true,
+	}, entry{
+		event:     watch.Event{Type: watch.Modified, Object: cur},
+		old:       old,
+		namespace: namespace,
+		key:       curKey,
+		all:       true,
+	})
+}
+
+func (c *Cache) onDelete(obj interface{}) {
+	// Objects deleted while the upstream watch was down are found missing by the relist
+	tombstone, missed := obj.(cache.DeletedFinalStateUnknown)
+	if missed {
+		obj = tombstone.Obj
+	}
+	object, ok := obj.(runtime.Object)
+	if !ok {
+		logging.Warningf("[Watch cache] Unexpected deleted object of %s: %#v", c.resource, obj)
+		return
+	}
+
+	c.dispatch(missed, entry{
+		event:     watch.Event{Type: watch.Deleted, Object: object},
+		namespace: namespaceOf(object),
+		key:       c.keyFunc(object),
+		exact:     true,
+		all:       true,
+	})
+	c.notify(object)
+}
+
+func (c *Cache) notify(obj runtime.Object) {
+	if c.changed != nil {
+		c.changed(obj)
+	}
+}
+
+// dispatch records entries of one upstream event and sends them to matching watches. Watches that can't keep
+// up are closed. Missed deletions evict the history, see nextResourceVersion.
+func (c *Cache) dispatch(missed bool, entries ...entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rv := c.nextResourceVersion(resourceVersionOf(entries[0].event.Object), missed)
+	c.record(rv, entries...)
+
+	if missed {
+		c.history.clear(c.lastRV)
+		logging.Infof("[Watch cache] Deletion of %s missed by the watch, watches older than %d have to list "+
+			"again", c.resource, c.lastRV)
+	}
+}
+
+// record adds entries with given resource version to the history and sends them to matching watches. Caller
+// must hold the lock.
+func (c *Cache) record(rv uint64, entries ...entry) {
+	for _, e := range entries {
+		e.rv = rv
+		c.history.add(e)
+
+		if e.exact && len(e.key) > 0 {
+			c.send(watcherID(e.namespace, e.key), e)
+		}
+		if e.all {
+			c.send(watcherID(e.namespace, ""), e)
+		}
+	}
+}
+
+// nextResourceVersion returns version of the next dispatched event. Objects relisted after the upstream watch
+// was down may be older than the last event, they get its version. Deletions found by the relist carry the
+// last known version of the object, so they get a version newer than the last event, and the history is
+// evicted as at sync: watches from older versions can't tell whether they have seen the object and have to
+// list again. Later events then get newer versions than the last one too, until upstream versions catch up.
+func (c *Cache) nextResourceVersion(rv uint64, missed bool) uint64 {
+	switch {
+	case rv > c.lastRV:
+		c.ahead = false
+	case missed || c.ahead:
+		rv = c.lastRV + 1
+		c.ahead = true
+	default:
+		rv = c.lastRV
+	}
+	c.lastRV = rv
+	return rv
+}
+
+func (c *Cache) send(id string, e entry) {
+	for w := range c.watchers[id] {
+		event, ok := w.filterEvent(e)
+		if !ok {
+			continue
+		}
+		if !w.send(event) {
+			logging.Warningf("[Watch cache] Closing watch of %s %s, it is too slow", c.resource, id)
+			metrics.WatchTerminated(c.resource)
+			c.remove(w)
+			close(w.input)
+		}
+	}
+}
+
+// forget removes stopped watcher from the cache.
+func (c *Cache) forget(w *cacheWatcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(w)
+}
+
+func (c *Cache) remove(w *cacheWatcher) {
+	watchers := c.watchers[w.id]
+	delete(watchers, w)
+	if len(watchers) == 0 {
+		delete(c.watchers, w.id)
+	}
+}
+
+func watcherID(namespace, key string) string {
+	return namespace + "/" + key
+}
+
+func namespaceOf(obj runtime.Object) string {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return object.GetNamespace()
+}
+
+// resourceVersionOf returns resource version of the object. Versions of kubernetes objects are numeric.
+func resourceVersionOf(obj runtime.Object) uint64 {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return 0
+	}
+	rv, _ := strconv.ParseUint(object.GetResourceVersion(), 10, 64)
+	return rv
+}
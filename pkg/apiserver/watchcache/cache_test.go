@@ -0,0 +1,345 @@
+package watchcache
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testNamespace = "default"
+
+func newTestPod(name, device string, rv int) *v1.IotPod {
+	return &v1.IotPod{Metadata: metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       testNamespace,
+		ResourceVersion: strconv.Itoa(rv),
+		Labels:          map[string]string{v1.DeviceSelector: device},
+	}}
+}
+
+func newTestCache(t *testing.T, historySize int, initial ...v1.IotPod) (*Cache, *watch.FakeWatcher, chan struct{}) {
+	upstream := watch.NewFake()
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.IotPodList{Metadata: metav1.ListMeta{ResourceVersion: "1"}, Items: initial}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return upstream, nil
+		},
+	}
+
+	c := NewCache(v1.IotPodType, lw, &v1.IotPod{}, podKeyFunc, historySize, 10)
+	stopCh := make(chan struct{})
+	go c.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+	return c, upstream, stopCh
+}
+
+// waitForResourceVersion waits until the cache dispatched event with given resource version.
+func waitForResourceVersion(t *testing.T, c *Cache, rv uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		lastRV := c.lastRV
+		c.mu.Unlock()
+
+		if lastRV >= rv {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for resource version %d, cache is at %d", rv, lastRV)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, w watch.Interface) watch.Event {
+	select {
+	case event := <-w.ResultChan():
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return watch.Event{}
+	}
+}
+
+func TestWatchFanOut(t *testing.T) {
+	c, upstream, stopCh := newTestCache(t, 100)
+	defer close(stopCh)
+
+	const devices = 10000
+	watchers := make([]watch.Interface, devices)
+	for i := range watchers {
+		w, err := c.Watch(testNamespace, fmt.Sprintf("device-%d", i), "0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		watchers[i] = w
+	}
+
+	go func() {
+		for i := 0; i < devices; i++ {
+			upstream.Add(newTestPod(fmt.Sprintf("pod-%d", i), fmt.Sprintf("device-%d", i), i+2))
+		}
+	}()
+
+	for i, w := range watchers {
+		event := receive(t, w)
+		pod := event.Object.(*v1.IotPod)
+		if event.Type != watch.Added || pod.Metadata.Name != fmt.Sprintf("pod-%d", i) {
+			t.Fatalf("watch of device-%d got %s of %s", i, event.Type, pod.Metadata.Name)
+		}
+	}
+}
+
+func TestWatchFromResourceVersion(t *testing.T) {
+	c, upstream, stopCh := newTestCache(t, 4, *newTestPod("pod-a", "device-a", 1))
+	defer close(stopCh)
+
+	page, err := c.List(testNamespace, "device-a", nil, ListOptions{})
+	if err != nil || len(page.Objects) != 1 {
+		t.Fatalf("expected one cached pod, got %v: %v", page, err)
+	}
+	rv := page.ResourceVersion
+
+	// Pod moves to another device, it is deleted for the old device
+	upstream.Modify(newTestPod("pod-a", "device-b", 2))
+	upstream.Add(newTestPod("pod-c", "device-a", 3))
+	waitForResourceVersion(t, c, 3)
+
+	w, err := c.Watch(testNamespace, "device-a", rv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if event := receive(t, w); event.Type != watch.Deleted {
+		t.Errorf("expected %s, got %s", watch.Deleted, event.Type)
+	}
+	if event := receive(t, w); event.Type != watch.Added || event.Object.(*v1.IotPod).Metadata.Name != "pod-c" {
+		t.Errorf("expected pod-c to be added, got %s", event.Type)
+	}
+
+	// Moved pod took three events, history keeps four, so the first one is gone
+	upstream.Add(newTestPod("pod-d", "device-a", 4))
+	waitForResourceVersion(t, c, 4)
+	_, err = c.Watch(testNamespace, "device-a", rv, nil)
+	if status, ok := err.(errors.APIStatus); !ok || status.Status().Reason != metav1.StatusReasonGone {
+		t.Errorf("expected gone error, got %v", err)
+	}
+}
+
+func TestWatchFilter(t *testing.T) {
+	c, upstream, stopCh := newTestCache(t, 10)
+	defer close(stopCh)
+
+	w, err := c.Watch(testNamespace, "", "0", func(obj runtime.Object) bool {
+		return obj.(*v1.IotPod).Metadata.Labels["app"] == "demo"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	pod := newTestPod("pod-a", "device-a", 2)
+	upstream.Add(pod)
+
+	pod = newTestPod("pod-a", "device-a", 3)
+	pod.Metadata.Labels["app"] = "demo"
+	upstream.Modify(pod)
+
+	pod = newTestPod("pod-a", "device-a", 4)
+	upstream.Modify(pod)
+
+	for _, expected := range []watch.EventType{watch.Added, watch.Deleted} {
+		if event := receive(t, w); event.Type != expected {
+			t.Errorf("expected %s, got %s", expected, event.Type)
+		}
+	}
+}
+
+func TestListPages(t *testing.T) {
+	var pods []v1.IotPod
+	for i := 0; i < 5; i++ {
+		pods = append(pods, *newTestPod(fmt.Sprintf("pod-%d", i), "device-a", 1))
+	}
+	c, upstream, stopCh := newTestCache(t, 1, pods...)
+	defer close(stopCh)
+
+	names := make([]string, 0)
+	options := ListOptions{Limit: 2}
+	for {
+		page, err := c.List(testNamespace, "", nil, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range page.Objects {
+			names = append(names, obj.(*v1.IotPod).Metadata.Name)
+		}
+		if len(page.Continue) == 0 {
+			break
+		}
+		options.Continue = page.Continue
+	}
+	if fmt.Sprint(names) != "[pod-0 pod-1 pod-2 pod-3 pod-4]" {
+		t.Errorf("unexpected pages %v", names)
+	}
+
+	// Continue tokens expire with the history
+	page, err := c.List(testNamespace, "", nil, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Add(newTestPod("pod-5", "device-a", 2))
+	upstream.Add(newTestPod("pod-6", "device-a", 3))
+	waitForResourceVersion(t, c, 3)
+
+	_, err = c.List(testNamespace, "", nil, ListOptions{Limit: 2, Continue: page.Continue})
+	if status, ok := err.(errors.APIStatus); !ok || status.Status().Code != 410 {
+		t.Errorf("expected expired continue token, got %v", err)
+	}
+}
+
+func TestMissedDeletion(t *testing.T) {
+	var mu sync.Mutex
+	items := []v1.IotPod{*newTestPod("pod-a", "device-a", 2), *newTestPod("pod-b", "device-a", 3)}
+	upstream := watch.NewFake()
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return &v1.IotPodList{Metadata: metav1.ListMeta{ResourceVersion: "3"}, Items: items}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return upstream, nil
+		},
+	}
+
+	c := NewCache(v1.IotPodType, lw, &v1.IotPod{}, podKeyFunc, 10, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+
+	page, err := c.List(testNamespace, "device-a", nil, ListOptions{})
+	if err != nil || len(page.Objects) != 2 {
+		t.Fatalf("expected two cached pods, got %v: %v", page, err)
+	}
+	live, err := c.Watch(testNamespace, "device-a", page.ResourceVersion, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Stop()
+
+	// pod-b is deleted while the upstream watch is down, the relist doesn't return it any more
+	mu.Lock()
+	items = items[:1]
+	stopped := upstream
+	upstream = watch.NewFake()
+	mu.Unlock()
+	stopped.Stop()
+
+	event := receive(t, live)
+	if event.Type != watch.Deleted || event.Object.(*v1.IotPod).Metadata.Name != "pod-b" {
+		t.Fatalf("expected pod-b to be deleted, got %s", event.Type)
+	}
+
+	// Watches from before the deletion can't resume, it's no longer in the history
+	_, err = c.Watch(testNamespace, "device-a", page.ResourceVersion, nil)
+	if status, ok := err.(errors.APIStatus); !ok || status.Status().Reason != metav1.StatusReasonGone {
+		t.Errorf("expected gone error, got %v", err)
+	}
+
+	// Lists after the deletion have a newer version, an upstream event of that version isn't missed
+	page, err = c.List(testNamespace, "device-a", nil, ListOptions{})
+	if err != nil || len(page.Objects) != 1 || page.ResourceVersion != "4" {
+		t.Fatalf("expected pod-a at version 4, got %v: %v", page, err)
+	}
+	w, err := c.Watch(testNamespace, "device-a", page.ResourceVersion, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	mu.Lock()
+	upstream.Add(newTestPod("pod-c", "device-a", 4))
+	mu.Unlock()
+	if event := receive(t, w); event.Type != watch.Added || event.Object.(*v1.IotPod).Metadata.Name != "pod-c" {
+		t.Errorf("expected pod-c to be added, got %s", event.Type)
+	}
+}
+
+func TestResync(t *testing.T) {
+	c, upstream, stopCh := newTestCache(t, 10, *newTestPod("pod-a", "device-a", 1))
+	defer close(stopCh)
+
+	// Changes of pods of the other cache resync pods of the same name
+	otherUpstream := watch.NewFake()
+	other := NewCache(v1.IotPodType, &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.IotPodList{Metadata: metav1.ListMeta{ResourceVersion: "1"}}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return otherUpstream, nil
+		},
+	}, &v1.IotPod{}, podKeyFunc, 10, 10)
+	other.OnChange(func(obj runtime.Object) {
+		pod := obj.(*v1.IotPod)
+		c.Resync(pod.Metadata.Namespace, pod.Metadata.Name)
+	})
+	go other.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, other.HasSynced) {
+		t.Fatal("cache not synced")
+	}
+
+	page, err := c.List(testNamespace, "device-a", nil, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pod missing in the cache isn't resynced
+	otherUpstream.Add(newTestPod("pod-b", "device-b", 2))
+	otherUpstream.Add(newTestPod("pod-a", "device-b", 3))
+	waitForResourceVersion(t, c, 2)
+
+	w, err := c.Watch(testNamespace, "device-a", page.ResourceVersion, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	event := receive(t, w)
+	pod := event.Object.(*v1.IotPod)
+	if event.Type != watch.Modified || pod.Metadata.Name != "pod-a" || pod.Metadata.ResourceVersion != "1" {
+		t.Errorf("expected pod-a at version 1 to be modified, got %s of %s at version %s", event.Type,
+			pod.Metadata.Name, pod.Metadata.ResourceVersion)
+	}
+
+	// Upstream event of the resynced version gets a newer one
+	upstream.Add(newTestPod("pod-c", "device-a", 2))
+	waitForResourceVersion(t, c, 3)
+	if event := receive(t, w); event.Type != watch.Added || event.Object.(*v1.IotPod).Metadata.Name != "pod-c" {
+		t.Errorf("expected pod-c to be added, got %s", event.Type)
+	}
+
+	page, err = c.List(testNamespace, "device-a", nil, ListOptions{})
+	if err != nil || len(page.Objects) != 2 || page.ResourceVersion != "3" {
+		t.Errorf("expected two pods at version 3, got %v: %v", page, err)
+	}
+}
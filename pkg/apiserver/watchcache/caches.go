@@ -0,0 +1,142 @@
+package watchcache
+
+import (
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/apiserver/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Caches holds watch caches of IoT resources served to devices.
+type Caches struct {
+	// Devices are keyed by their name
+	Devices *Cache
+	// Pods are keyed by the deviceSelector label of the device they are scheduled on
+	Pods *Cache
+	// CertificateRequests are keyed by their requester
+	CertificateRequests *Cache
+	// Services and Endpoints are only watched by namespace
+	Services  *Cache
+	Endpoints *Cache
+}
+
+// NewCaches creates caches of IotDevices, IotPods, IotCertificateRequests, Services and Endpoints from all
+// namespaces. Endpoints are sent to their watches again when their Service changes, as they are served with
+// its node ports.
+func NewCaches(tprClient *dynamic.Client, client corev1.CoreV1Interface, historySize, buffer int) *Caches {
+	caches := &Caches{
+		Devices: NewCache(v1.IotDeviceType, newListWatch(tprClient, v1.IotDeviceType), &v1.IotDevice{},
+			deviceKeyFunc, historySize, buffer),
+		Pods: NewCache(v1.IotPodType, newListWatch(tprClient, v1.IotPodType), &v1.IotPod{},
+			podKeyFunc, historySize, buffer),
+		CertificateRequests: NewCache(v1.IotCertificateRequestType,
+			newListWatch(tprClient, v1.IotCertificateRequestType), &v1.IotCertificateRequest{},
+			certificateRequestKeyFunc, historySize, buffer),
+		Services: NewCache("services", newServiceListWatch(client), &kubeapi.Service{}, namespaceKeyFunc,
+			historySize, buffer),
+		Endpoints: NewCache("endpoints", newEndpointsListWatch(client), &kubeapi.Endpoints{}, namespaceKeyFunc,
+			historySize, buffer),
+	}
+
+	caches.Services.OnChange(func(obj runtime.Object) {
+		service := obj.(*kubeapi.Service)
+		caches.Endpoints.Resync(service.Namespace, service.Name)
+	})
+	return caches
+}
+
+// Run starts all caches. It doesn't block.
+func (this *Caches) Run(stopCh <-chan struct{}) {
+	go this.Devices.Run(stopCh)
+	go this.Pods.Run(stopCh)
+	go this.CertificateRequests.Run(stopCh)
+	go this.Services.Run(stopCh)
+	go this.Endpoints.Run(stopCh)
+}
+
+// CheckSynced returns error until all caches are synced.
+func (this *Caches) CheckSynced() error {
+	for _, c := range []*Cache{this.Devices, this.Pods, this.CertificateRequests, this.Services,
+		this.Endpoints} {
+		if err := c.CheckSynced(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deviceKeyFunc(obj runtime.Object) string {
+	return obj.(*v1.IotDevice).Metadata.Name
+}
+
+func podKeyFunc(obj runtime.Object) string {
+	return obj.(*v1.IotPod).Metadata.Labels[v1.DeviceSelector]
+}
+
+func certificateRequestKeyFunc(obj runtime.Object) string {
+	return obj.(*v1.IotCertificateRequest).Spec.Username
+}
+
+// namespaceKeyFunc keys no object, so objects are only listed and watched by their namespace.
+func namespaceKeyFunc(runtime.Object) string {
+	return ""
+}
+
+func newListWatch(tprClient *dynamic.Client, resource string) *cache.ListWatch {
+	apiResource := &metav1.APIResource{Name: resource, Namespaced: true}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			start := time.Now()
+			list, err := tprClient.Resource(apiResource, metav1.NamespaceAll).List(&options)
+			metrics.ObserveUpstream("cache", "list", start, err)
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			start := time.Now()
+			watcher, err := tprClient.Resource(apiResource, metav1.NamespaceAll).Watch(&options)
+			metrics.ObserveUpstream("cache", "watch", start, err)
+			return watcher, err
+		},
+	}
+}
+
+func newServiceListWatch(client corev1.CoreV1Interface) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			start := time.Now()
+			list, err := client.Services(metav1.NamespaceAll).List(options)
+			metrics.ObserveUpstream("cache", "list", start, err)
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			start := time.Now()
+			watcher, err := client.Services(metav1.NamespaceAll).Watch(options)
+			metrics.ObserveUpstream("cache", "watch", start, err)
+			return watcher, err
+		},
+	}
+}
+
+func newEndpointsListWatch(client corev1.CoreV1Interface) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			start := time.Now()
+			list, err := client.Endpoints(metav1.NamespaceAll).List(options)
+			metrics.ObserveUpstream("cache", "list", start, err)
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			start := time.Now()
+			watcher, err := client.Endpoints(metav1.NamespaceAll).Watch(options)
+			metrics.ObserveUpstream("cache", "watch", start, err)
+			return watcher, err
+		},
+	}
+}
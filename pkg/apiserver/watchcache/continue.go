@@ -0,0 +1,56 @@
+package watchcache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const continueVersion = "iot.continue/v1"
+
+// continueToken points after the last object of a page. Pages of a list share resource version of its first
+// page, so watches started from it don't miss changes made while the pages were read.
+type continueToken struct {
+	Version         string `json:"v"`
+	ResourceVersion uint64 `json:"rv"`
+	Start           string `json:"start"`
+}
+
+func encodeContinue(rv uint64, start string) (string, error) {
+	out, err := json.Marshal(&continueToken{Version: continueVersion, ResourceVersion: rv, Start: start})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+func decodeContinue(token string) (*continueToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.NewBadRequest(fmt.Sprintf("continue key is not valid: %s", err))
+	}
+
+	decoded := &continueToken{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		return nil, errors.NewBadRequest(fmt.Sprintf("continue key is not valid: %s", err))
+	}
+	if decoded.Version != continueVersion {
+		return nil, errors.NewBadRequest(fmt.Sprintf("continue key is not valid: version %q is not supported",
+			decoded.Version))
+	}
+	return decoded, nil
+}
+
+// newExpired returns error of continue tokens older than the kept history. Clients have to list again.
+func newExpired(message string) *errors.StatusError {
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusGone,
+		Reason:  metav1.StatusReasonExpired,
+		Message: message,
+	}}
+}
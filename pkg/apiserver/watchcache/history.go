@@ -0,0 +1,79 @@
+package watchcache
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// entry is a dispatched event. Exact entries are sent to watches of the key, other entries to watches of
+// the whole namespace. Modified entries and objects moved to another key keep the previous object.
+type entry struct {
+	event     watch.Event
+	old       runtime.Object
+	rv        uint64
+	namespace string
+	key       string
+	exact     bool
+	all       bool
+}
+
+func (e entry) matches(namespace, key string) bool {
+	if e.namespace != namespace {
+		return false
+	}
+	if len(key) == 0 {
+		return e.all
+	}
+	return e.exact && e.key == key
+}
+
+// history is a ring buffer of recent events.
+type history struct {
+	entries []entry
+	start   int
+	size    int
+	// evictedRV is resource version of the newest event no longer kept
+	evictedRV uint64
+}
+
+func newHistory(capacity int) *history {
+	return &history{entries: make([]entry, capacity)}
+}
+
+func (h *history) add(e entry) {
+	if len(h.entries) == 0 {
+		h.evictedRV = e.rv
+		return
+	}
+
+	if h.size == len(h.entries) {
+		h.evictedRV = h.entries[h.start].rv
+		h.entries[h.start] = entry{}
+		h.start = (h.start + 1) % len(h.entries)
+		h.size--
+	}
+	h.entries[(h.start+h.size)%len(h.entries)] = e
+	h.size++
+}
+
+// clear drops all events, watches from versions up to rv have to list again.
+func (h *history) clear(rv uint64) {
+	for i := range h.entries {
+		h.entries[i] = entry{}
+	}
+	h.start = 0
+	h.size = 0
+	h.evictedRV = rv
+}
+
+// since returns entries newer than given resource version matching namespace and key, oldest first.
+func (h *history) since(rv uint64, namespace, key string) []entry {
+	entries := make([]entry, 0)
+	for i := 0; i < h.size; i++ {
+		e := h.entries[(h.start+i)%len(h.entries)]
+		if e.rv > rv && e.matches(namespace, key) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
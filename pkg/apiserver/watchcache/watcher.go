@@ -0,0 +1,110 @@
+package watchcache
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// cacheWatcher is a watch served from the cache. Events are buffered, so a slow client never blocks
+// dispatching to the others.
+type cacheWatcher struct {
+	id     string
+	input  chan watch.Event
+	result chan watch.Event
+	done   chan struct{}
+	filter FilterFunc
+
+	stopOnce sync.Once
+	forget   func(*cacheWatcher)
+}
+
+func newCacheWatcher(buffer int, filter FilterFunc, forget func(*cacheWatcher)) *cacheWatcher {
+	return &cacheWatcher{
+		input:  make(chan watch.Event, buffer),
+		result: make(chan watch.Event),
+		done:   make(chan struct{}),
+		filter: filter,
+		forget: forget,
+	}
+}
+
+// ResultChan implements watch.Interface. The channel is closed when the watch is stopped or falls behind.
+func (w *cacheWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// Stop implements watch.Interface.
+func (w *cacheWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		w.forget(w)
+		close(w.done)
+	})
+}
+
+// filterEvent returns event of the entry as seen by the watch. It returns false if the watch doesn't select
+// the object before nor after the event.
+func (w *cacheWatcher) filterEvent(e entry) (watch.Event, bool) {
+	if w.filter == nil {
+		return e.event, true
+	}
+
+	switch e.event.Type {
+	case watch.Modified:
+		matched := e.old != nil && w.filter(e.old)
+		matches := w.filter(e.event.Object)
+		switch {
+		case matched && matches:
+			return e.event, true
+		case matches:
+			return watch.Event{Type: watch.Added, Object: e.event.Object}, true
+		case matched:
+			return watch.Event{Type: watch.Deleted, Object: e.event.Object}, true
+		}
+		return watch.Event{}, false
+	case watch.Deleted:
+		if e.old != nil {
+			return e.event, w.filter(e.old)
+		}
+	}
+	return e.event, w.filter(e.event.Object)
+}
+
+// send buffers the event. It returns false if the buffer is full.
+func (w *cacheWatcher) send(event watch.Event) bool {
+	select {
+	case w.input <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// process sends initial events followed by dispatched ones to the result channel.
+func (w *cacheWatcher) process(initial []watch.Event) {
+	defer close(w.result)
+
+	for _, event := range initial {
+		select {
+		case w.result <- event:
+		case <-w.done:
+			return
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-w.input:
+			if !ok {
+				return
+			}
+			select {
+			case w.result <- event:
+			case <-w.done:
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
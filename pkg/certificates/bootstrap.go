@@ -0,0 +1,197 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"regexp"
+	"time"
+
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+)
+
+// Bootstrap tokens are Secrets in the same format as kubernetes bootstrap tokens, with their own usage key,
+// so tokens for devices can't join the cluster as nodes and the other way round.
+const (
+	BootstrapTokenSecretType   = kubeapi.SecretType("bootstrap.kubernetes.io/token")
+	BootstrapTokenSecretPrefix = "bootstrap-token-"
+
+	BootstrapTokenIDKey         = "token-id"
+	BootstrapTokenSecretKey     = "token-secret"
+	BootstrapTokenExpirationKey = "expiration"
+	// BootstrapTokenUsageKey has to be "true" for the token to request device certificates.
+	BootstrapTokenUsageKey = "usage-iot-bootstrap"
+	// DeviceTokenUsageKey has to be "true" for the token to authenticate as its device, for devices that
+	// don't use client certificates.
+	DeviceTokenUsageKey = "usage-iot-authentication"
+	// BootstrapTokenDeviceKey binds the token to its device. Bootstrap tokens may then only request certificate
+	// of the device, device tokens require it.
+	BootstrapTokenDeviceKey = "iot-device-name"
+	// DeviceTokenReplacedByKey is set by rotation on the old device token to ID of the token replacing it.
+	DeviceTokenReplacedByKey = "iot-replaced-by"
+	// DeviceTokenReplacesKey is set by rotation on the new device token to ID of the token it replaces. The
+	// old token is deleted once the device authenticates with the new one.
+	DeviceTokenReplacesKey = "iot-replaces"
+
+	// BootstrapUserPrefix prefixes user names of bootstrap tokens, followed by the token ID.
+	BootstrapUserPrefix = "system:bootstrap:"
+	// BootstrapGroup is group of all bootstrap tokens.
+	BootstrapGroup = "system:bootstrappers"
+	// BoundBootstrapGroup is group of bootstrap tokens bound to the device they requested certificate for.
+	BoundBootstrapGroup = "system:bootstrappers:iot-addon:device-bound"
+)
+
+const bootstrapTokenChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+var bootstrapTokenPattern = regexp.MustCompile(`^([a-z0-9]{6})\.([a-z0-9]{16})$`)
+
+// BootstrapToken is validated bootstrap or device token.
+type BootstrapToken struct {
+	ID string
+	// Device is name of the device the token is bound to, empty if it may request certificate for any device.
+	Device string
+	// Bootstrap is set for tokens that may request device certificates.
+	Bootstrap bool
+	// Authentication is set for device tokens, they authenticate as their device.
+	Authentication bool
+	// Expiration is zero for tokens that never expire.
+	Expiration time.Time
+	// Replaces is ID of the device token replaced by this one, ReplacedBy ID of the token replacing this one.
+	Replaces   string
+	ReplacedBy string
+}
+
+// Username returns user name of the token.
+func (this BootstrapToken) Username() string {
+	return BootstrapUserPrefix + this.ID
+}
+
+// Groups returns groups of the token.
+func (this BootstrapToken) Groups() []string {
+	if len(this.Device) > 0 {
+		return []string{BootstrapGroup, BoundBootstrapGroup}
+	}
+	return []string{BootstrapGroup}
+}
+
+// ParseBootstrapToken splits token in "<id>.<secret>" format.
+func ParseBootstrapToken(token string) (id string, secret string, err error) {
+	parts := bootstrapTokenPattern.FindStringSubmatch(token)
+	if parts == nil {
+		return "", "", fmt.Errorf("bootstrap token has to match %s", bootstrapTokenPattern.String())
+	}
+	return parts[1], parts[2], nil
+}
+
+// GenerateBootstrapToken returns ID and secret of a new random token.
+func GenerateBootstrapToken() (id string, secret string, err error) {
+	if id, err = randomString(6); err != nil {
+		return "", "", err
+	}
+	if secret, err = randomString(16); err != nil {
+		return "", "", err
+	}
+	return id, secret, nil
+}
+
+func randomString(length int) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(bootstrapTokenChars)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = bootstrapTokenChars[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// BootstrapTokenSecretName returns name of the Secret of token with given ID.
+func BootstrapTokenSecretName(id string) string {
+	return BootstrapTokenSecretPrefix + id
+}
+
+// ParseBootstrapTokenSecret returns token stored in the Secret. Tokens without IoT usage and device tokens
+// not bound to a device are rejected.
+func ParseBootstrapTokenSecret(secret *kubeapi.Secret) (*BootstrapToken, error) {
+	if secret.Type != BootstrapTokenSecretType {
+		return nil, fmt.Errorf("secret %s is not a bootstrap token", secret.Name)
+	}
+
+	token := &BootstrapToken{
+		ID:             string(secret.Data[BootstrapTokenIDKey]),
+		Device:         string(secret.Data[BootstrapTokenDeviceKey]),
+		Bootstrap:      string(secret.Data[BootstrapTokenUsageKey]) == "true",
+		Authentication: string(secret.Data[DeviceTokenUsageKey]) == "true",
+		Replaces:       string(secret.Data[DeviceTokenReplacesKey]),
+		ReplacedBy:     string(secret.Data[DeviceTokenReplacedByKey]),
+	}
+	if !token.Bootstrap && !token.Authentication {
+		return nil, fmt.Errorf("token %s is not allowed to authenticate devices", token.ID)
+	}
+	if token.Authentication && len(token.Device) == 0 {
+		return nil, fmt.Errorf("device token %s is not bound to a device", token.ID)
+	}
+
+	if expiration, ok := secret.Data[BootstrapTokenExpirationKey]; ok {
+		expiresAt, err := time.Parse(time.RFC3339, string(expiration))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration of token %s: %s", token.ID, err.Error())
+		}
+		token.Expiration = expiresAt
+	}
+	return token, nil
+}
+
+// ValidateBootstrapToken checks token secret against the Secret. Tokens without IoT usage or past their
+// expiration are rejected.
+func ValidateBootstrapToken(secret *kubeapi.Secret, id, tokenSecret string, now time.Time) (*BootstrapToken, error) {
+	if string(secret.Data[BootstrapTokenIDKey]) != id ||
+		subtle.ConstantTimeCompare(secret.Data[BootstrapTokenSecretKey], []byte(tokenSecret)) != 1 {
+		return nil, fmt.Errorf("invalid bootstrap token %s", id)
+	}
+
+	token, err := ParseBootstrapTokenSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Expiration.IsZero() && now.After(token.Expiration) {
+		return nil, fmt.Errorf("token %s expired", id)
+	}
+	return token, nil
+}
+
+// NewDeviceTokenSecret returns Secret of a new device token, valid until expiration.
+func NewDeviceTokenSecret(namespace, device, id, tokenSecret string, expiration time.Time) *kubeapi.Secret {
+	secret := &kubeapi.Secret{
+		Type: BootstrapTokenSecretType,
+		Data: map[string][]byte{
+			BootstrapTokenIDKey:         []byte(id),
+			BootstrapTokenSecretKey:     []byte(tokenSecret),
+			BootstrapTokenExpirationKey: []byte(expiration.UTC().Format(time.RFC3339)),
+			DeviceTokenUsageKey:         []byte("true"),
+			BootstrapTokenDeviceKey:     []byte(device),
+		},
+	}
+	secret.Name = BootstrapTokenSecretName(id)
+	secret.Namespace = namespace
+	return secret
+}
+
+// IsAutoApprovable returns true for requests of bootstrap tokens bound to the requested device and for
+// renewals, where the device requests certificate for itself.
+func IsAutoApprovable(spec certificates.CertificateSigningRequestSpec, device string) bool {
+	if spec.Username == DeviceUsername(device) {
+		return true
+	}
+
+	for _, group := range spec.Groups {
+		if group == BoundBootstrapGroup {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package certificates
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+func newTestTokenSecret(data map[string]string) *kubeapi.Secret {
+	secret := &kubeapi.Secret{Type: BootstrapTokenSecretType, Data: make(map[string][]byte)}
+	secret.Name = BootstrapTokenSecretName("abcdef")
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
+
+func TestValidateBootstrapToken(t *testing.T) {
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	valid := map[string]string{
+		BootstrapTokenIDKey:         "abcdef",
+		BootstrapTokenSecretKey:     "0123456789abcdef",
+		BootstrapTokenExpirationKey: "2017-07-01T00:00:00Z",
+		BootstrapTokenUsageKey:      "true",
+		BootstrapTokenDeviceKey:     "raspi-1",
+	}
+	with := func(key, value string) map[string]string {
+		data := make(map[string]string)
+		for k, v := range valid {
+			data[k] = v
+		}
+		if len(value) == 0 {
+			delete(data, key)
+		} else {
+			data[key] = value
+		}
+		return data
+	}
+
+	cases := []struct {
+		name       string
+		secret     *kubeapi.Secret
+		id, token  string
+		err        string
+		expiration time.Time
+	}{
+		{"valid", newTestTokenSecret(valid), "abcdef", "0123456789abcdef", "",
+			time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"never expires", newTestTokenSecret(with(BootstrapTokenExpirationKey, "")), "abcdef",
+			"0123456789abcdef", "", time.Time{}},
+		{"wrong secret type", func() *kubeapi.Secret {
+			secret := newTestTokenSecret(valid)
+			secret.Type = kubeapi.SecretTypeOpaque
+			return secret
+		}(), "abcdef", "0123456789abcdef", "is not a bootstrap token", time.Time{}},
+		{"id mismatch", newTestTokenSecret(with(BootstrapTokenIDKey, "ghijkl")), "abcdef", "0123456789abcdef",
+			"invalid bootstrap token", time.Time{}},
+		{"wrong secret", newTestTokenSecret(valid), "abcdef", "fedcba9876543210", "invalid bootstrap token",
+			time.Time{}},
+		{"expired", newTestTokenSecret(with(BootstrapTokenExpirationKey, "2017-05-01T00:00:00Z")), "abcdef",
+			"0123456789abcdef", "expired", time.Time{}},
+		{"invalid expiration", newTestTokenSecret(with(BootstrapTokenExpirationKey, "tomorrow")), "abcdef",
+			"0123456789abcdef", "invalid expiration", time.Time{}},
+		{"missing usage", newTestTokenSecret(with(BootstrapTokenUsageKey, "")), "abcdef", "0123456789abcdef",
+			"not allowed to authenticate devices", time.Time{}},
+		{"unbound device token", newTestTokenSecret(with(BootstrapTokenDeviceKey, "")), "abcdef",
+			"0123456789abcdef", "", time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"device token without device", func() *kubeapi.Secret {
+			data := with(BootstrapTokenDeviceKey, "")
+			data[DeviceTokenUsageKey] = "true"
+			return newTestTokenSecret(data)
+		}(), "abcdef", "0123456789abcdef", "not bound to a device", time.Time{}},
+	}
+
+	for _, c := range cases {
+		token, err := ValidateBootstrapToken(c.secret, c.id, c.token, now)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		if token.ID != c.id || !token.Expiration.Equal(c.expiration) {
+			t.Errorf("%s: expected token %s expiring %s, got %+v", c.name, c.id, c.expiration, token)
+		}
+	}
+}
+
+func TestParseBootstrapToken(t *testing.T) {
+	cases := []struct {
+		token      string
+		id, secret string
+		valid      bool
+	}{
+		{"abcdef.0123456789abcdef", "abcdef", "0123456789abcdef", true},
+		{"ABCDEF.0123456789abcdef", "", "", false},
+		{"abcdef.0123456789", "", "", false},
+		{"abcdef0123456789abcdef", "", "", false},
+	}
+
+	for _, c := range cases {
+		id, secret, err := ParseBootstrapToken(c.token)
+		if (err == nil) != c.valid || id != c.id || secret != c.secret {
+			t.Errorf("%s: expected %q, %q and valid %t, got %q, %q and %v", c.token, c.id, c.secret, c.valid,
+				id, secret, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	certificates "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+	"k8s.io/client-go/util/cert"
+)
+
+const (
+	// DeviceUserPrefix prefixes common name of device certificates. Devices run kubelets, so their
+	// certificates look the same as certificates of nodes.
+	DeviceUserPrefix = "system:node:"
+	// DeviceGroup is the only organization of device certificates.
+	DeviceGroup = "system:nodes"
+
+	// clockSkew backdates issued certificates, so devices with clocks slightly behind can use them at once.
+	clockSkew = 5 * time.Minute
+)
+
+// DeviceUsername returns user name of the device with given name.
+func DeviceUsername(device string) string {
+	return DeviceUserPrefix + device
+}
+
+// GetDeviceName returns name of the device identified by the certificate subject.
+func GetDeviceName(subject pkix.Name) (string, bool) {
+	if !strings.HasPrefix(subject.CommonName, DeviceUserPrefix) || len(subject.Organization) != 1 ||
+		subject.Organization[0] != DeviceGroup {
+		return "", false
+	}
+
+	device := strings.TrimPrefix(subject.CommonName, DeviceUserPrefix)
+	return device, len(validation.IsDNS1123Subdomain(device)) == 0
+}
+
+// ParseDeviceRequest parses PEM encoded certificate signing request of a device and returns name of the
+// device. Requests have to be signed by the requested key and may only ask for a device identity, alternative
+// names are rejected.
+func ParseDeviceRequest(request []byte) (*x509.CertificateRequest, string, error) {
+	block, _ := pem.Decode(request)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, "", fmt.Errorf("PEM block of type CERTIFICATE REQUEST expected")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, "", err
+	}
+
+	device, ok := GetDeviceName(csr.Subject)
+	if !ok {
+		return nil, "", fmt.Errorf("subject has to be CN=%s<device name>, O=%s", DeviceUserPrefix, DeviceGroup)
+	}
+	if len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 {
+		return nil, "", fmt.Errorf("alternative names are not allowed in device certificates")
+	}
+	return csr, device, nil
+}
+
+// GetConditions returns true for each of Approved and Denied conditions set in the status.
+func GetConditions(status certificates.CertificateSigningRequestStatus) (approved bool, denied bool) {
+	for _, condition := range status.Conditions {
+		switch condition.Type {
+		case certificates.CertificateApproved:
+			approved = true
+		case certificates.CertificateDenied:
+			denied = true
+		}
+	}
+	return approved, denied
+}
+
+// Signer issues device client certificates signed by the IoT CA. The IoT apiserver trusts the CA as its
+// client CA.
+type Signer struct {
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+}
+
+// NewSigner loads PEM encoded CA certificate and key.
+func NewSigner(certFile, keyFile string) (*Signer, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := cert.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA certificate %s: %s", certFile, err.Error())
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cert.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA key %s: %s", keyFile, err.Error())
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key %s can't sign certificates", keyFile)
+	}
+	return &Signer{caCert: certs[0], caKey: signer}, nil
+}
+
+// Sign issues client certificate for the device certificate signing request. Certificates never outlive
+// the CA.
+func (this *Signer) Sign(request []byte, duration time.Duration) ([]byte, error) {
+	csr, _, err := ParseDeviceRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(duration)
+	if notAfter.After(this.caCert.NotAfter) {
+		notAfter = this.caCert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, this.caCert, csr.PublicKey, this.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// GetCertificateExpiry returns expiry of the first certificate in PEM encoded data.
+func GetCertificateExpiry(certificate []byte) (time.Time, error) {
+	certs, err := cert.ParseCertsPEM(certificate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return certs[0].NotAfter, nil
+}
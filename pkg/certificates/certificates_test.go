@@ -0,0 +1,155 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestRequest(t *testing.T, template *x509.CertificateRequest) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func newTestSigner(t *testing.T, notAfter time.Time) *Signer {
+	key := newTestKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iot-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signer{caCert: caCert, caKey: key}
+}
+
+var deviceSubject = pkix.Name{CommonName: DeviceUsername("raspi-1"), Organization: []string{DeviceGroup}}
+
+func TestParseDeviceRequest(t *testing.T) {
+	// tampered request has its signature changed, so it doesn't match the key any more
+	tampered, _ := pem.Decode(newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject}))
+	tampered.Bytes[len(tampered.Bytes)-1] ^= 0xff
+
+	cases := []struct {
+		name    string
+		request []byte
+		err     string
+	}{
+		{"valid", newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject}), ""},
+		{"not a request", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{}}),
+			"CERTIFICATE REQUEST expected"},
+		{"signature mismatch", pem.EncodeToMemory(tampered), "verification failure"},
+		{"other user", newTestRequest(t, &x509.CertificateRequest{Subject: pkix.Name{
+			CommonName: "admin", Organization: []string{DeviceGroup}}}), "subject has to be"},
+		{"other group", newTestRequest(t, &x509.CertificateRequest{Subject: pkix.Name{
+			CommonName: DeviceUsername("raspi-1"), Organization: []string{"system:masters"}}}),
+			"subject has to be"},
+		{"additional group", newTestRequest(t, &x509.CertificateRequest{Subject: pkix.Name{
+			CommonName:   DeviceUsername("raspi-1"),
+			Organization: []string{DeviceGroup, "system:masters"}}}), "subject has to be"},
+		{"invalid device name", newTestRequest(t, &x509.CertificateRequest{Subject: pkix.Name{
+			CommonName: DeviceUsername("Raspi_1"), Organization: []string{DeviceGroup}}}), "subject has to be"},
+		{"dns name", newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject,
+			DNSNames: []string{"kubernetes.default"}}), "alternative names"},
+		{"ip address", newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject,
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}), "alternative names"},
+		{"email address", newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject,
+			EmailAddresses: []string{"admin@example.com"}}), "alternative names"},
+	}
+
+	for _, c := range cases {
+		_, device, err := ParseDeviceRequest(c.request)
+		switch {
+		case c.name == "valid":
+			if err != nil || device != "raspi-1" {
+				t.Errorf("%s: expected device raspi-1, got %q and %v", c.name, device, err)
+			}
+		case err == nil:
+			t.Errorf("%s: expected error, got device %q", c.name, device)
+		case !strings.Contains(err.Error(), c.err):
+			t.Errorf("%s: expected error containing %q, got %s", c.name, c.err, err.Error())
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	caExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	signer := newTestSigner(t, caExpiry)
+	request := newTestRequest(t, &x509.CertificateRequest{Subject: deviceSubject})
+
+	cases := []struct {
+		name     string
+		duration time.Duration
+		// clamped is set if the certificate expires with the CA
+		clamped bool
+	}{
+		{"within ca validity", time.Hour, false},
+		{"beyond ca validity", 365 * 24 * time.Hour, true},
+	}
+
+	for _, c := range cases {
+		start := time.Now()
+		certificate, err := signer.Sign(request, c.duration)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+
+		block, _ := pem.Decode(certificate)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Errorf("%s: cannot parse certificate: %s", c.name, err.Error())
+			continue
+		}
+
+		if c.clamped && !cert.NotAfter.Equal(caExpiry) {
+			t.Errorf("%s: expected expiry %s of the CA, got %s", c.name, caExpiry, cert.NotAfter)
+		}
+		if !c.clamped && (cert.NotAfter.Before(start.Add(c.duration).Truncate(time.Second)) ||
+			cert.NotAfter.After(time.Now().Add(c.duration))) {
+			t.Errorf("%s: expected expiry in %s, got %s", c.name, c.duration, cert.NotAfter)
+		}
+		if cert.Subject.CommonName != deviceSubject.CommonName ||
+			len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+			t.Errorf("%s: expected client certificate of %s, got %+v", c.name, deviceSubject.CommonName, cert)
+		}
+		if err := cert.CheckSignatureFrom(signer.caCert); err != nil {
+			t.Errorf("%s: certificate is not signed by the CA: %s", c.name, err.Error())
+		}
+	}
+
+	tampered, _ := pem.Decode(request)
+	tampered.Bytes[len(tampered.Bytes)-1] ^= 0xff
+	if _, err := signer.Sign(pem.EncodeToMemory(tampered), time.Hour); err == nil {
+		t.Errorf("expected request with signature mismatch to be rejected")
+	}
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+// ApiserverKind is kind of the IoT apiserver config file.
+const ApiserverKind = "ApiserverConfig"
+
+// ApiserverConfig is configuration of the IoT apiserver. Kubernetes, listen, watch cache and bootstrap token
+// namespace settings require restart, other fields are reloaded without restart.
+type ApiserverConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Kubernetes KubernetesConfig       `json:"kubernetes"`
+	Listen     ListenConfig           `json:"listen"`
+	Tenancy    TenancyConfig          `json:"tenancy"`
+	Timeouts   ApiserverTimeoutConfig `json:"timeouts"`
+	Pods       PodConfig              `json:"pods"`
+	Logging    LoggingConfig          `json:"logging"`
+
+	Authentication AuthenticationConfig `json:"authentication"`
+	Admission      AdmissionConfig      `json:"admission"`
+	WatchCache     WatchCacheConfig     `json:"watchCache"`
+	Events         EventsConfig         `json:"events"`
+	RateLimits     RateLimitConfig      `json:"rateLimits"`
+	Services       ServicesConfig       `json:"services"`
+}
+
+// TenancyConfig maps devices to namespaces their IotDevices and IotPods live in. First rule matching
+// the device name wins, devices matching no rule belong to the default namespace.
+type TenancyConfig struct {
+	DefaultNamespace string        `json:"defaultNamespace"`
+	Rules            []TenancyRule `json:"rules"`
+}
+
+type TenancyRule struct {
+	DevicePrefix string `json:"devicePrefix"`
+	Namespace    string `json:"namespace"`
+}
+
+// NamespaceOf returns namespace of the device with given name. Requests without device identity are
+// served from the default namespace.
+func (this TenancyConfig) NamespaceOf(device string) string {
+	if len(device) == 0 {
+		return this.DefaultNamespace
+	}
+
+	for _, rule := range this.Rules {
+		if strings.HasPrefix(device, rule.DevicePrefix) {
+			return rule.Namespace
+		}
+	}
+	return this.DefaultNamespace
+}
+
+type ApiserverTimeoutConfig struct {
+	// Watch is how long watch streams stay open before kubelets have to reconnect.
+	Watch metav1.Duration `json:"watch"`
+	// Shutdown is how long in-flight requests may take after SIGTERM before the server exits anyway.
+	Shutdown metav1.Duration `json:"shutdown"`
+	// Upstream is how long requests passed through to the kubernetes apiserver may take. Watches aren't
+	// limited by it.
+	Upstream metav1.Duration `json:"upstream"`
+}
+
+// PodConfig sets fields of pods served to kubelets.
+type PodConfig struct {
+	// ImagePullPolicy overrides pull policy of all containers. Policy of IotPod is kept when it's empty.
+	ImagePullPolicy kubeapi.PullPolicy `json:"imagePullPolicy"`
+}
+
+// AuthenticationConfig sets how devices authenticate. Devices present client certificates issued by the IoT
+// CA, new devices use bootstrap tokens to request their certificates.
+type AuthenticationConfig struct {
+	// AllowAnonymous lets requests without credentials through, so devices set up before bootstrapping was
+	// available keep working while they are migrated. Anonymous requests are served from the default
+	// namespace and aren't restricted to a device, so it's disabled by default.
+	AllowAnonymous bool `json:"allowAnonymous"`
+	// BootstrapTokenNamespace is namespace of bootstrap token Secrets. Changes require restart.
+	BootstrapTokenNamespace string `json:"bootstrapTokenNamespace"`
+	// CertificateRequestNamespace is namespace IotCertificateRequests of devices are created in.
+	CertificateRequestNamespace string `json:"certificateRequestNamespace"`
+}
+
+const (
+	// AdmissionOpen registers devices as approved.
+	AdmissionOpen = "Open"
+	// AdmissionApproval registers devices matching no allow-list rule as pending.
+	AdmissionApproval = "Approval"
+)
+
+// AdmissionConfig sets how devices registering themselves join the fleet. Pre-registered IotDevices are
+// never changed.
+type AdmissionConfig struct {
+	Mode      string          `json:"mode"`
+	AllowList []AdmissionRule `json:"allowList"`
+}
+
+// AdmissionRule approves devices matching all of its fields. Serial numbers of devices are reported by
+// kubelets as machine ID or system UUID.
+type AdmissionRule struct {
+	Name       string `json:"name"`
+	MachineID  string `json:"machineID"`
+	SystemUUID string `json:"systemUUID"`
+}
+
+// Matches returns true if the device with given name and node info matches all set fields of the rule.
+func (this AdmissionRule) Matches(name string, info kubeapi.NodeSystemInfo) bool {
+	return (len(this.Name) == 0 || this.Name == name) &&
+		(len(this.MachineID) == 0 || this.MachineID == info.MachineID) &&
+		(len(this.SystemUUID) == 0 || this.SystemUUID == info.SystemUUID)
+}
+
+// IsAllowed returns true if the device matches any allow-list rule.
+func (this AdmissionConfig) IsAllowed(name string, info kubeapi.NodeSystemInfo) bool {
+	for _, rule := range this.AllowList {
+		if rule.Matches(name, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchCacheConfig sizes the in-memory caches devices are served lists and watches from.
+type WatchCacheConfig struct {
+	// HistorySize is number of recent events kept per resource. Watches resuming from older resource versions
+	// have to list again.
+	HistorySize int `json:"historySize"`
+	// Buffer is number of events buffered per watch. Watches falling further behind are closed.
+	Buffer int `json:"buffer"`
+}
+
+// EventsConfig sets how events sent by devices are written to the kubernetes apiserver.
+type EventsConfig struct {
+	// AggregationWindow is how long after its last occurrence a repeated event is counted into the same event.
+	AggregationWindow metav1.Duration `json:"aggregationWindow"`
+	// QPS and Burst cap events written per device. Occurrences over the cap are only counted in memory and
+	// written with the next allowed occurrence.
+	QPS   float32 `json:"qps"`
+	Burst int     `json:"burst"`
+}
+
+// RateLimitConfig caps requests per client address, per device and per tenant namespace. Tenant limits apply
+// to all devices of the tenant together.
+type RateLimitConfig struct {
+	// Client limits requests per address before they are authenticated, so clients failing to authenticate
+	// are throttled too. Devices behind a NAT share the limits of its address.
+	Client RequestLimits `json:"client"`
+	Device RequestLimits `json:"device"`
+	Tenant RequestLimits `json:"tenant"`
+	// Tenants overrides tenant limits per namespace.
+	Tenants map[string]RequestLimits `json:"tenants"`
+}
+
+// TenantLimits returns limits of tenant with given namespace.
+func (this RateLimitConfig) TenantLimits(namespace string) RequestLimits {
+	if limits, ok := this.Tenants[namespace]; ok {
+		return limits
+	}
+	return this.Tenant
+}
+
+// RequestLimits sets limits per verb. Reads other than watches are limited as lists.
+type RequestLimits struct {
+	Watch RateLimit `json:"watch"`
+	List  RateLimit `json:"list"`
+	Write RateLimit `json:"write"`
+}
+
+// RateLimit is a token bucket filled with QPS tokens per second up to Burst. Zero QPS disables the limit.
+type RateLimit struct {
+	QPS   float32 `json:"qps"`
+	Burst int     `json:"burst"`
+}
+
+const (
+	// EndpointsDirect serves endpoints as they are, for devices reaching the cluster network through a tunnel.
+	EndpointsDirect = "Direct"
+	// EndpointsGateway serves endpoints at the gateway address and node ports of their services.
+	EndpointsGateway = "Gateway"
+)
+
+// ServicesConfig sets how Services and Endpoints of the device namespace are served to devices.
+type ServicesConfig struct {
+	// Endpoints is how edge pods reach in-cluster backends, Direct or Gateway.
+	Endpoints string `json:"endpoints"`
+	// GatewayAddress is IP address devices reach node ports of the cluster at, e.g. of a load balancer. Ports
+	// of services without node port aren't reachable through the gateway.
+	GatewayAddress string `json:"gatewayAddress"`
+}
+
+// NewApiserverConfig returns configuration with defaults of all fields.
+func NewApiserverConfig() *ApiserverConfig {
+	return &ApiserverConfig{
+		TypeMeta:   metav1.TypeMeta{APIVersion: Version, Kind: ApiserverKind},
+		Kubernetes: KubernetesConfig{Domain: DefaultDomain},
+		Listen:     ListenConfig{Address: ":8083"},
+		Tenancy:    TenancyConfig{DefaultNamespace: "default"},
+		Timeouts: ApiserverTimeoutConfig{
+			Watch:    metav1.Duration{Duration: 10 * time.Minute},
+			Shutdown: metav1.Duration{Duration: 30 * time.Second},
+			Upstream: metav1.Duration{Duration: 30 * time.Second},
+		},
+		Pods:    PodConfig{ImagePullPolicy: kubeapi.PullAlways},
+		Logging: newLoggingConfig(),
+		Authentication: AuthenticationConfig{
+			AllowAnonymous:              false,
+			BootstrapTokenNamespace:     "kube-system",
+			CertificateRequestNamespace: "kube-system",
+		},
+		Admission:  AdmissionConfig{Mode: AdmissionOpen},
+		WatchCache: WatchCacheConfig{HistorySize: 10000, Buffer: 100},
+		Events: EventsConfig{
+			AggregationWindow: metav1.Duration{Duration: 10 * time.Minute},
+			QPS:               1,
+			Burst:             10,
+		},
+		RateLimits: RateLimitConfig{
+			Client: RequestLimits{
+				Watch: RateLimit{QPS: 5, Burst: 100},
+				List:  RateLimit{QPS: 10, Burst: 200},
+				Write: RateLimit{QPS: 50, Burst: 200},
+			},
+			Device: RequestLimits{
+				Watch: RateLimit{QPS: 0.5, Burst: 10},
+				List:  RateLimit{QPS: 1, Burst: 20},
+				Write: RateLimit{QPS: 5, Burst: 20},
+			},
+		},
+		Services: ServicesConfig{Endpoints: EndpointsDirect},
+	}
+}
+
+// LoadApiserverConfig reads config file on top of defaults. Result has to be validated once command line
+// flags are applied.
+func LoadApiserverConfig(path string) (*ApiserverConfig, error) {
+	config := NewApiserverConfig()
+	if err := load(path, ApiserverKind, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// AddFlags binds command line flags to fields of the config. Flags take precedence over the config file.
+func (this *ApiserverConfig) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&this.Kubernetes.Apiserver, "apiserver", this.Kubernetes.Apiserver,
+		"Kubernetes api server address")
+	flags.StringVar(&this.Kubernetes.Kubeconfig, "kubeconfig", this.Kubernetes.Kubeconfig,
+		"Absolute path to the kubeconfig file")
+	flags.StringVar(&this.Kubernetes.Domain, "domain", this.Kubernetes.Domain, "custom domain name")
+	flags.Var(newPortValue(&this.Listen.Address), "port", "Port to listen on")
+	flags.DurationVar(&this.Timeouts.Shutdown.Duration, "shutdown-timeout", this.Timeouts.Shutdown.Duration,
+		"How long in-flight requests may take after SIGTERM before the server exits anyway")
+	flags.BoolVar(&this.Authentication.AllowAnonymous, "allow-anonymous", this.Authentication.AllowAnonymous,
+		"Serve requests without credentials while devices are migrated to client certificates")
+	addLoggingFlags(flags, &this.Logging)
+}
+
+// Validate returns error listing all invalid fields.
+func (this *ApiserverConfig) Validate() error {
+	errs := validateKubernetes(this.Kubernetes, field.NewPath("kubernetes"))
+	errs = append(errs, validateListen(this.Listen, field.NewPath("listen"))...)
+	errs = append(errs, validateTenancy(this.Tenancy, field.NewPath("tenancy"))...)
+
+	timeoutsPath := field.NewPath("timeouts")
+	errs = append(errs, validatePositive(this.Timeouts.Watch, timeoutsPath.Child("watch"))...)
+	errs = append(errs, validateNonNegative(this.Timeouts.Shutdown, timeoutsPath.Child("shutdown"))...)
+	errs = append(errs, validatePositive(this.Timeouts.Upstream, timeoutsPath.Child("upstream"))...)
+
+	switch this.Pods.ImagePullPolicy {
+	case "", kubeapi.PullAlways, kubeapi.PullIfNotPresent, kubeapi.PullNever:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("pods", "imagePullPolicy"),
+			this.Pods.ImagePullPolicy, []string{
+				string(kubeapi.PullAlways), string(kubeapi.PullIfNotPresent), string(kubeapi.PullNever),
+			}))
+	}
+
+	errs = append(errs, validateLogging(this.Logging, field.NewPath("logging"))...)
+
+	authPath := field.NewPath("authentication")
+	errs = append(errs, validateNamespace(this.Authentication.BootstrapTokenNamespace,
+		authPath.Child("bootstrapTokenNamespace"))...)
+	errs = append(errs, validateNamespace(this.Authentication.CertificateRequestNamespace,
+		authPath.Child("certificateRequestNamespace"))...)
+
+	errs = append(errs, validateAdmission(this.Admission, field.NewPath("admission"))...)
+
+	watchCachePath := field.NewPath("watchCache")
+	if this.WatchCache.HistorySize < 0 {
+		errs = append(errs, field.Invalid(watchCachePath.Child("historySize"), this.WatchCache.HistorySize,
+			"must not be negative"))
+	}
+	if this.WatchCache.Buffer <= 0 {
+		errs = append(errs, field.Invalid(watchCachePath.Child("buffer"), this.WatchCache.Buffer,
+			"must be positive"))
+	}
+
+	eventsPath := field.NewPath("events")
+	errs = append(errs, validatePositive(this.Events.AggregationWindow, eventsPath.Child("aggregationWindow"))...)
+	if this.Events.QPS <= 0 {
+		errs = append(errs, field.Invalid(eventsPath.Child("qps"), this.Events.QPS, "must be positive"))
+	}
+	if this.Events.Burst <= 0 {
+		errs = append(errs, field.Invalid(eventsPath.Child("burst"), this.Events.Burst, "must be positive"))
+	}
+
+	errs = append(errs, validateRateLimits(this.RateLimits, field.NewPath("rateLimits"))...)
+	errs = append(errs, validateServices(this.Services, field.NewPath("services"))...)
+	return toError(ApiserverKind, errs)
+}
+
+// Reload returns updated config with fields that require restart kept from this config. Names of kept
+// fields that changed are returned, so they can be reported.
+func (this *ApiserverConfig) Reload(updated *ApiserverConfig) (*ApiserverConfig, []string) {
+	reloaded := *updated
+	ignored := make([]string, 0)
+
+	if !reflect.DeepEqual(this.Kubernetes, updated.Kubernetes) {
+		reloaded.Kubernetes = this.Kubernetes
+		ignored = append(ignored, "kubernetes")
+	}
+	if !reflect.DeepEqual(this.Listen, updated.Listen) {
+		reloaded.Listen = this.Listen
+		ignored = append(ignored, "listen")
+	}
+	if !reflect.DeepEqual(this.WatchCache, updated.WatchCache) {
+		reloaded.WatchCache = this.WatchCache
+		ignored = append(ignored, "watchCache")
+	}
+	if this.Authentication.BootstrapTokenNamespace != updated.Authentication.BootstrapTokenNamespace {
+		reloaded.Authentication.BootstrapTokenNamespace = this.Authentication.BootstrapTokenNamespace
+		ignored = append(ignored, "authentication.bootstrapTokenNamespace")
+	}
+	return &reloaded, ignored
+}
+
+func validateTenancy(config TenancyConfig, path *field.Path) field.ErrorList {
+	errs := validateNamespace(config.DefaultNamespace, path.Child("defaultNamespace"))
+
+	for i, rule := range config.Rules {
+		rulePath := path.Child("rules").Index(i)
+		if len(rule.DevicePrefix) == 0 {
+			errs = append(errs, field.Required(rulePath.Child("devicePrefix"), ""))
+		}
+		errs = append(errs, validateNamespace(rule.Namespace, rulePath.Child("namespace"))...)
+	}
+	return errs
+}
+
+func validateAdmission(config AdmissionConfig, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if config.Mode != AdmissionOpen && config.Mode != AdmissionApproval {
+		errs = append(errs, field.NotSupported(path.Child("mode"), config.Mode,
+			[]string{AdmissionOpen, AdmissionApproval}))
+	}
+
+	for i, rule := range config.AllowList {
+		if rule == (AdmissionRule{}) {
+			errs = append(errs, field.Required(path.Child("allowList").Index(i),
+				"one of name, machineID or systemUUID is required"))
+		}
+	}
+	return errs
+}
+
+func validateRateLimits(config RateLimitConfig, path *field.Path) field.ErrorList {
+	errs := validateRequestLimits(config.Client, path.Child("client"))
+	errs = append(errs, validateRequestLimits(config.Device, path.Child("device"))...)
+	errs = append(errs, validateRequestLimits(config.Tenant, path.Child("tenant"))...)
+	for namespace, limits := range config.Tenants {
+		tenantPath := path.Child("tenants").Key(namespace)
+		errs = append(errs, validateNamespace(namespace, tenantPath)...)
+		errs = append(errs, validateRequestLimits(limits, tenantPath)...)
+	}
+	return errs
+}
+
+func validateRequestLimits(limits RequestLimits, path *field.Path) field.ErrorList {
+	errs := validateRateLimit(limits.Watch, path.Child("watch"))
+	errs = append(errs, validateRateLimit(limits.List, path.Child("list"))...)
+	return append(errs, validateRateLimit(limits.Write, path.Child("write"))...)
+}
+
+func validateRateLimit(limit RateLimit, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if limit.QPS < 0 {
+		errs = append(errs, field.Invalid(path.Child("qps"), limit.QPS, "must not be negative"))
+	}
+	if limit.QPS > 0 && limit.Burst <= 0 {
+		errs = append(errs, field.Invalid(path.Child("burst"), limit.Burst, "must be positive if qps is set"))
+	}
+	return errs
+}
+
+func validateServices(config ServicesConfig, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	switch config.Endpoints {
+	case EndpointsDirect:
+	case EndpointsGateway:
+		if net.ParseIP(config.GatewayAddress) == nil {
+			errs = append(errs, field.Invalid(path.Child("gatewayAddress"), config.GatewayAddress,
+				"must be an IP address if endpoints are served at the gateway"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(path.Child("endpoints"), config.Endpoints,
+			[]string{EndpointsDirect, EndpointsGateway}))
+	}
+	return errs
+}
+
+// ApiserverStore holds current configuration of the IoT apiserver. Handlers read it on every request, so
+// reloaded fields apply to new requests right away.
+type ApiserverStore struct {
+	value atomic.Value
+}
+
+func NewApiserverStore(config *ApiserverConfig) *ApiserverStore {
+	store := &ApiserverStore{}
+	store.Set(config)
+	return store
+}
+
+// Get returns current configuration. It must not be modified.
+func (this *ApiserverStore) Get() *ApiserverConfig {
+	return this.value.Load().(*ApiserverConfig)
+}
+
+func (this *ApiserverStore) Set(config *ApiserverConfig) {
+	this.value.Store(config)
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Version is apiVersion of supported config files. Files of other versions are rejected, so incompatible
+// changes of the format never get applied silently.
+const Version = "iot-addon/v1alpha1"
+
+// DefaultDomain is the default group of IoT custom types.
+const DefaultDomain = "fujitsu.com"
+
+// KubernetesConfig selects the kubernetes cluster and the group of IoT custom types. Changes require restart.
+type KubernetesConfig struct {
+	// Apiserver is address of kubernetes apiserver in http://host:port format.
+	Apiserver string `json:"apiserver"`
+	// Kubeconfig is absolute path to the kubeconfig file. In-cluster config is used if both are empty.
+	Kubeconfig string `json:"kubeconfig"`
+	// Domain is the group of IoT custom types.
+	Domain string `json:"domain"`
+}
+
+// ListenConfig is address the server listens on. Changes require restart.
+type ListenConfig struct {
+	Address string    `json:"address"`
+	TLS     TLSConfig `json:"tls"`
+}
+
+// TLSConfig enables HTTPS when certificate and key are set. Certificates presented by clients are verified
+// against the client CA when it is set.
+type TLSConfig struct {
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"`
+}
+
+// Enabled returns true if server certificate is configured.
+func (this TLSConfig) Enabled() bool {
+	return len(this.CertFile) > 0
+}
+
+// ServerConfig returns TLS config of the server. Certificate and key are loaded by the server itself.
+func (this TLSConfig) ServerConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(this.ClientCAFile) == 0 {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(this.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", this.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// LoggingConfig sets verbosity and format of logs. Changes are applied without restart.
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+func newLoggingConfig() LoggingConfig {
+	return LoggingConfig{Level: logging.InfoLevel.String(), Format: logging.TextFormat}
+}
+
+// load reads YAML config file of given kind into config prefilled with defaults. Unknown fields are
+// rejected, so typos don't fall back to defaults unnoticed.
+func load(path, kind string, config interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %s", err.Error())
+	}
+
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return fmt.Errorf("config file %s is not valid YAML: %s", path, err.Error())
+	}
+
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err.Error())
+	}
+	if typeMeta.APIVersion != Version || typeMeta.Kind != kind {
+		return fmt.Errorf("config file %s: unsupported apiVersion %q and kind %q, expected %q and %q", path,
+			typeMeta.APIVersion, typeMeta.Kind, Version, kind)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("config file %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+func validateKubernetes(config KubernetesConfig, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Subdomain(config.Domain) {
+		errs = append(errs, field.Invalid(path.Child("domain"), config.Domain, msg))
+	}
+	return errs
+}
+
+func validateListen(config ListenConfig, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		errs = append(errs, field.Invalid(path.Child("address"), config.Address, err.Error()))
+	}
+
+	tlsPath := path.Child("tls")
+	if len(config.TLS.CertFile) > 0 != (len(config.TLS.KeyFile) > 0) {
+		errs = append(errs, field.Required(tlsPath, "certFile and keyFile have to be set together"))
+	}
+	if len(config.TLS.ClientCAFile) > 0 && !config.TLS.Enabled() {
+		errs = append(errs, field.Required(tlsPath.Child("certFile"), "client CA requires server certificate"))
+	}
+
+	errs = append(errs, validateFile(config.TLS.CertFile, tlsPath.Child("certFile"))...)
+	errs = append(errs, validateFile(config.TLS.KeyFile, tlsPath.Child("keyFile"))...)
+	errs = append(errs, validateFile(config.TLS.ClientCAFile, tlsPath.Child("clientCAFile"))...)
+	return errs
+}
+
+// validateFile checks that file, if set, exists.
+func validateFile(file string, path *field.Path) field.ErrorList {
+	if len(file) == 0 {
+		return field.ErrorList{}
+	}
+	if _, err := os.Stat(file); err != nil {
+		return field.ErrorList{field.Invalid(path, file, err.Error())}
+	}
+	return field.ErrorList{}
+}
+
+func validateNamespace(namespace string, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Label(namespace) {
+		errs = append(errs, field.Invalid(path, namespace, msg))
+	}
+	return errs
+}
+
+func validateLogging(config LoggingConfig, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if _, err := logging.ParseLevel(config.Level); err != nil {
+		errs = append(errs, field.NotSupported(path.Child("level"), config.Level, []string{
+			logging.ErrorLevel.String(), logging.WarningLevel.String(), logging.InfoLevel.String(),
+			logging.DebugLevel.String(),
+		}))
+	}
+	if config.Format != logging.TextFormat && config.Format != logging.JSONFormat {
+		errs = append(errs, field.NotSupported(path.Child("format"), config.Format, []string{
+			logging.TextFormat, logging.JSONFormat,
+		}))
+	}
+	return errs
+}
+
+func validatePositive(duration metav1.Duration, path *field.Path) field.ErrorList {
+	if duration.Duration <= 0 {
+		return field.ErrorList{field.Invalid(path, duration.Duration.String(), "must be greater than zero")}
+	}
+	return field.ErrorList{}
+}
+
+func validateNonNegative(duration metav1.Duration, path *field.Path) field.ErrorList {
+	if duration.Duration < 0 {
+		return field.ErrorList{field.Invalid(path, duration.Duration.String(), "must not be negative")}
+	}
+	return field.ErrorList{}
+}
+
+// toError joins validation errors into one error listing every invalid field.
+func toError(kind string, errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("invalid %s: %s", kind, strings.Join(messages, "; "))
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestControllerConfigValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*ControllerConfig)
+		// fields are paths of invalid fields expected in the error, none if the config is valid
+		fields []string
+	}{
+		{"defaults", func(*ControllerConfig) {}, nil},
+		{"domain", func(c *ControllerConfig) { c.Kubernetes.Domain = "Invalid_Domain" },
+			[]string{"kubernetes.domain"}},
+		{"address", func(c *ControllerConfig) { c.Listen.Address = "8084" }, []string{"listen.address"}},
+		{"tls key without cert", func(c *ControllerConfig) { c.Listen.TLS.KeyFile = "tls.key" },
+			[]string{"listen.tls"}},
+		{"workers", func(c *ControllerConfig) { c.Workers = WorkerConfig{} },
+			[]string{"workers.daemonSets", "workers.devices"}},
+		{"negative resync", func(c *ControllerConfig) { c.Timeouts.ResyncPeriod.Duration = -time.Second },
+			[]string{"timeouts.resyncPeriod"}},
+		{"disabled resync", func(c *ControllerConfig) { c.Timeouts.ResyncPeriod.Duration = 0 }, nil},
+		{"watch max age", func(c *ControllerConfig) { c.Timeouts.WatchMaxAge.Duration = 0 },
+			[]string{"timeouts.watchMaxAge"}},
+		{"negative heartbeat", func(c *ControllerConfig) { c.Heartbeat.GracePeriod.Duration = -time.Second },
+			[]string{"heartbeat.gracePeriod"}},
+		{"disabled heartbeat", func(c *ControllerConfig) { c.Heartbeat.GracePeriod.Duration = 0 }, nil},
+		{"renew deadline", func(c *ControllerConfig) {
+			c.LeaderElection.RenewDeadline = c.LeaderElection.RetryPeriod
+		}, []string{"leaderElection.renewDeadline"}},
+		{"disabled leader election", func(c *ControllerConfig) {
+			c.LeaderElection = LeaderElectionConfig{Enabled: false}
+		}, nil},
+		{"logging", func(c *ControllerConfig) { c.Logging = LoggingConfig{Level: "trace", Format: "xml"} },
+			[]string{"logging.level", "logging.format"}},
+		{"certificates namespace", func(c *ControllerConfig) { c.Certificates.Namespace = "" },
+			[]string{"certificates.namespace"}},
+		{"ca key without cert", func(c *ControllerConfig) { c.Certificates.CAKeyFile = "/nonexistent/ca.key" },
+			[]string{"certificates:", "certificates.caKeyFile"}},
+		{"token ttl", func(c *ControllerConfig) { c.Rotation.TokenTTL = c.Rotation.RenewBefore },
+			[]string{"rotation.tokenTTL"}},
+		{"rotation interval", func(c *ControllerConfig) { c.Rotation.CheckInterval.Duration = 0 },
+			[]string{"rotation.checkInterval"}},
+	}
+
+	for _, c := range cases {
+		config := NewControllerConfig()
+		c.modify(config)
+		checkValidationError(t, c.name, config.Validate(), c.fields)
+	}
+}
+
+func TestApiserverConfigValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(*ApiserverConfig)
+		fields []string
+	}{
+		{"defaults", func(*ApiserverConfig) {}, nil},
+		{"client ca without tls", func(c *ApiserverConfig) { c.Listen.TLS.ClientCAFile = "/nonexistent/ca.crt" },
+			[]string{"listen.tls.certFile", "listen.tls.clientCAFile"}},
+		{"default namespace", func(c *ApiserverConfig) { c.Tenancy.DefaultNamespace = "Default" },
+			[]string{"tenancy.defaultNamespace"}},
+		{"timeouts", func(c *ApiserverConfig) {
+			c.Timeouts.Watch.Duration = 0
+			c.Timeouts.Upstream.Duration = 0
+		}, []string{"timeouts.watch", "timeouts.upstream"}},
+		{"image pull policy", func(c *ApiserverConfig) { c.Pods.ImagePullPolicy = "Sometimes" },
+			[]string{"pods.imagePullPolicy"}},
+		{"bootstrap token namespace", func(c *ApiserverConfig) {
+			c.Authentication.BootstrapTokenNamespace = ""
+		}, []string{"authentication.bootstrapTokenNamespace"}},
+		{"watch cache", func(c *ApiserverConfig) {
+			c.WatchCache.HistorySize = -1
+			c.WatchCache.Buffer = 0
+		}, []string{"watchCache.historySize", "watchCache.buffer"}},
+		{"events", func(c *ApiserverConfig) {
+			c.Events.AggregationWindow = metav1.Duration{}
+			c.Events.QPS = 0
+			c.Events.Burst = 0
+		}, []string{"events.aggregationWindow", "events.qps", "events.burst"}},
+		{"rate limits", func(c *ApiserverConfig) {
+			c.RateLimits.Client.Watch = RateLimit{QPS: -1}
+			c.RateLimits.Device.List = RateLimit{QPS: 1}
+		}, []string{"rateLimits.client.watch.qps", "rateLimits.device.list.burst"}},
+		{"services gateway", func(c *ApiserverConfig) { c.Services.Endpoints = EndpointsGateway },
+			[]string{"services.gatewayAddress"}},
+	}
+
+	for _, c := range cases {
+		config := NewApiserverConfig()
+		c.modify(config)
+		checkValidationError(t, c.name, config.Validate(), c.fields)
+	}
+}
+
+func TestControllerConfigReload(t *testing.T) {
+	current := NewControllerConfig()
+
+	updated := NewControllerConfig()
+	updated.Kubernetes.Domain = "example.com"
+	updated.Listen.Address = ":9000"
+	updated.Workers.Devices = 8
+	updated.Timeouts.ResyncPeriod.Duration = time.Minute
+	updated.Timeouts.Shutdown.Duration = time.Minute
+	updated.Heartbeat.GracePeriod.Duration = time.Minute
+	updated.LeaderElection.Enabled = false
+	updated.Logging.Level = "debug"
+	updated.Certificates.CACertFile = "ca.crt"
+	updated.Certificates.AutoApprove = false
+	updated.Rotation.CheckInterval.Duration = time.Minute
+
+	reloaded, ignored := current.Reload(updated)
+
+	expectedIgnored := []string{"kubernetes", "listen", "workers", "timeouts.resyncPeriod", "leaderElection",
+		"certificates.caCertFile", "certificates.caKeyFile"}
+	if !reflect.DeepEqual(ignored, expectedIgnored) {
+		t.Errorf("expected ignored fields %v, got %v", expectedIgnored, ignored)
+	}
+
+	expected := *updated
+	expected.Kubernetes = current.Kubernetes
+	expected.Listen = current.Listen
+	expected.Workers = current.Workers
+	expected.Timeouts.ResyncPeriod = current.Timeouts.ResyncPeriod
+	expected.LeaderElection = current.LeaderElection
+	expected.Certificates.CACertFile = current.Certificates.CACertFile
+	if !reflect.DeepEqual(*reloaded, expected) {
+		t.Errorf("expected reloaded config %+v, got %+v", expected, *reloaded)
+	}
+
+	if _, ignored := current.Reload(NewControllerConfig()); len(ignored) > 0 {
+		t.Errorf("expected no ignored fields for unchanged config, got %v", ignored)
+	}
+}
+
+func TestApiserverConfigReload(t *testing.T) {
+	current := NewApiserverConfig()
+
+	updated := NewApiserverConfig()
+	updated.Listen.TLS.ClientCAFile = "ca.crt"
+	updated.WatchCache.Buffer = 1
+	updated.Tenancy.DefaultNamespace = "devices"
+	updated.Timeouts.Upstream.Duration = time.Minute
+	updated.Authentication.AllowAnonymous = !current.Authentication.AllowAnonymous
+	updated.Authentication.BootstrapTokenNamespace = "tokens"
+
+	reloaded, ignored := current.Reload(updated)
+
+	expectedIgnored := []string{"listen", "watchCache", "authentication.bootstrapTokenNamespace"}
+	if !reflect.DeepEqual(ignored, expectedIgnored) {
+		t.Errorf("expected ignored fields %v, got %v", expectedIgnored, ignored)
+	}
+
+	expected := *updated
+	expected.Listen = current.Listen
+	expected.WatchCache = current.WatchCache
+	expected.Authentication.BootstrapTokenNamespace = current.Authentication.BootstrapTokenNamespace
+	if !reflect.DeepEqual(*reloaded, expected) {
+		t.Errorf("expected reloaded config %+v, got %+v", expected, *reloaded)
+	}
+}
+
+// checkValidationError checks that err names all expected fields, or that there is no error if none are
+// expected.
+func checkValidationError(t *testing.T, name string, err error, fields []string) {
+	if len(fields) == 0 {
+		if err != nil {
+			t.Errorf("%s: expected valid config, got %s", name, err.Error())
+		}
+		return
+	}
+
+	if err == nil {
+		t.Errorf("%s: expected error of fields %v, got none", name, fields)
+		return
+	}
+	for _, field := range fields {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("%s: expected error of field %s, got %s", name, field, err.Error())
+		}
+	}
+}
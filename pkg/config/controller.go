@@ -0,0 +1,288 @@
+package config
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ControllerKind is kind of the IoT controller config file.
+const ControllerKind = "ControllerConfig"
+
+// ControllerConfig is configuration of the IoT controller. Logging, heartbeat, shutdown timeout, certificate
+// approval and credential rotation are reloaded without restart, other fields require restart.
+type ControllerConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Kubernetes     KubernetesConfig        `json:"kubernetes"`
+	Listen         ListenConfig            `json:"listen"`
+	Workers        WorkerConfig            `json:"workers"`
+	Timeouts       ControllerTimeoutConfig `json:"timeouts"`
+	Heartbeat      HeartbeatConfig         `json:"heartbeat"`
+	LeaderElection LeaderElectionConfig    `json:"leaderElection"`
+	Logging        LoggingConfig           `json:"logging"`
+	Certificates   CertificatesConfig      `json:"certificates"`
+	Rotation       RotationConfig          `json:"rotation"`
+}
+
+// WorkerConfig is number of objects of each kind synced concurrently.
+type WorkerConfig struct {
+	DaemonSets int `json:"daemonSets"`
+	Devices    int `json:"devices"`
+}
+
+type ControllerTimeoutConfig struct {
+	// ResyncPeriod is how often all IoT resources are reconciled, 0 disables periodic reconciliation.
+	ResyncPeriod metav1.Duration `json:"resyncPeriod"`
+	// WatchMaxAge is how long watches may stay without activity before the controller is reported unhealthy.
+	WatchMaxAge metav1.Duration `json:"watchMaxAge"`
+	// Shutdown is how long in-flight syncs may take after SIGTERM before the controller exits anyway.
+	Shutdown metav1.Duration `json:"shutdown"`
+}
+
+// HeartbeatConfig sets when IotDevices that stopped posting status are no longer reported as ready.
+type HeartbeatConfig struct {
+	// GracePeriod is how long since the last heartbeat a device stays ready, 0 disables the check.
+	GracePeriod metav1.Duration `json:"gracePeriod"`
+}
+
+type LeaderElectionConfig struct {
+	Enabled       bool            `json:"enabled"`
+	Identity      string          `json:"identity"`
+	Namespace     string          `json:"namespace"`
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod"`
+}
+
+// CertificatesConfig sets how certificate requests of devices are approved and signed.
+type CertificatesConfig struct {
+	// Namespace is namespace of IotCertificateRequests, requests from other namespaces are ignored.
+	Namespace string `json:"namespace"`
+	// CACertFile and CAKeyFile are the IoT CA signing device certificates, signing is disabled if they
+	// are empty. Changes require restart.
+	CACertFile string `json:"caCertFile"`
+	CAKeyFile  string `json:"caKeyFile"`
+	// Duration is how long issued certificates are valid.
+	Duration metav1.Duration `json:"duration"`
+	// AutoApprove approves requests of bootstrap tokens bound to the requested device and renewals of
+	// devices themselves. Other requests wait for manual approval.
+	AutoApprove bool `json:"autoApprove"`
+}
+
+// RotationConfig sets when device credentials are rotated. Kubelets rotate their certificates themselves,
+// device tokens are rotated by the controller.
+type RotationConfig struct {
+	// RenewBefore is how long before expiry credentials are due for rotation.
+	RenewBefore metav1.Duration `json:"renewBefore"`
+	// TokenNamespace is namespace of device token Secrets.
+	TokenNamespace string `json:"tokenNamespace"`
+	// TokenTTL is how long device tokens issued by rotation are valid.
+	TokenTTL metav1.Duration `json:"tokenTTL"`
+	// CheckInterval is how often credentials of all devices are checked.
+	CheckInterval metav1.Duration `json:"checkInterval"`
+}
+
+// NewControllerConfig returns configuration with defaults of all fields.
+func NewControllerConfig() *ControllerConfig {
+	return &ControllerConfig{
+		TypeMeta:   metav1.TypeMeta{APIVersion: Version, Kind: ControllerKind},
+		Kubernetes: KubernetesConfig{Domain: DefaultDomain},
+		Listen:     ListenConfig{Address: ":8084"},
+		Workers:    WorkerConfig{DaemonSets: 2, Devices: 2},
+		Timeouts: ControllerTimeoutConfig{
+			ResyncPeriod: metav1.Duration{Duration: 5 * time.Minute},
+			WatchMaxAge:  metav1.Duration{Duration: 15 * time.Minute},
+			Shutdown:     metav1.Duration{Duration: 30 * time.Second},
+		},
+		Heartbeat: HeartbeatConfig{GracePeriod: metav1.Duration{Duration: 5 * time.Minute}},
+		LeaderElection: LeaderElectionConfig{
+			Enabled:       true,
+			Namespace:     "kube-system",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Logging: newLoggingConfig(),
+		Certificates: CertificatesConfig{
+			Namespace:   "kube-system",
+			Duration:    metav1.Duration{Duration: 365 * 24 * time.Hour},
+			AutoApprove: true,
+		},
+		Rotation: RotationConfig{
+			RenewBefore:    metav1.Duration{Duration: 30 * 24 * time.Hour},
+			TokenNamespace: "kube-system",
+			TokenTTL:       metav1.Duration{Duration: 90 * 24 * time.Hour},
+			CheckInterval:  metav1.Duration{Duration: 10 * time.Minute},
+		},
+	}
+}
+
+// LoadControllerConfig reads config file on top of defaults. Result has to be validated once command line
+// flags are applied.
+func LoadControllerConfig(path string) (*ControllerConfig, error) {
+	config := NewControllerConfig()
+	if err := load(path, ControllerKind, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// AddFlags binds command line flags to fields of the config. Flags take precedence over the config file.
+func (this *ControllerConfig) AddFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&this.Kubernetes.Apiserver, "apiserver", this.Kubernetes.Apiserver,
+		"apiserver adress in http://host:port format")
+	flags.StringVar(&this.Kubernetes.Kubeconfig, "kubeconfig", this.Kubernetes.Kubeconfig,
+		"absolute path to the kubeconfig file")
+	flags.StringVar(&this.Kubernetes.Domain, "domain", this.Kubernetes.Domain, "custom domain name")
+	flags.IntVar(&this.Workers.DaemonSets, "daemonset-workers", this.Workers.DaemonSets,
+		"number of IotDaemonSets synced concurrently")
+	flags.IntVar(&this.Workers.Devices, "device-workers", this.Workers.Devices,
+		"number of IotDevices synced concurrently")
+	flags.DurationVar(&this.Timeouts.ResyncPeriod.Duration, "resync-period", this.Timeouts.ResyncPeriod.Duration,
+		"how often all IoT resources are reconciled, 0 disables periodic reconciliation")
+	flags.Var(newPortValue(&this.Listen.Address), "metrics-port",
+		"port serving prometheus metrics on /metrics and health probes on /healthz and /readyz")
+	flags.DurationVar(&this.Timeouts.WatchMaxAge.Duration, "watch-max-age", this.Timeouts.WatchMaxAge.Duration,
+		"how long watches may stay without activity before the controller is reported unhealthy")
+	flags.DurationVar(&this.Timeouts.Shutdown.Duration, "shutdown-timeout", this.Timeouts.Shutdown.Duration,
+		"how long in-flight syncs may take after SIGTERM before the controller exits anyway")
+
+	flags.BoolVar(&this.LeaderElection.Enabled, "leader-elect", this.LeaderElection.Enabled,
+		"run leader election, so only one replica reconciles at a time")
+	flags.StringVar(&this.LeaderElection.Identity, "leader-elect-identity", this.LeaderElection.Identity,
+		"leader election identity, hostname if empty")
+	flags.StringVar(&this.LeaderElection.Namespace, "leader-elect-namespace", this.LeaderElection.Namespace,
+		"namespace of the leader election lock")
+	flags.DurationVar(&this.LeaderElection.LeaseDuration.Duration, "leader-elect-lease-duration",
+		this.LeaderElection.LeaseDuration.Duration,
+		"how long standbys wait since the last renewal before they take over leadership")
+	flags.DurationVar(&this.LeaderElection.RenewDeadline.Duration, "leader-elect-renew-deadline",
+		this.LeaderElection.RenewDeadline.Duration,
+		"how long the leader retries renewing the lease before it gives up leadership")
+	flags.DurationVar(&this.LeaderElection.RetryPeriod.Duration, "leader-elect-retry-period",
+		this.LeaderElection.RetryPeriod.Duration,
+		"how long candidates wait between attempts to acquire or renew the lease")
+
+	addLoggingFlags(flags, &this.Logging)
+}
+
+// Validate returns error listing all invalid fields.
+func (this *ControllerConfig) Validate() error {
+	errs := validateKubernetes(this.Kubernetes, field.NewPath("kubernetes"))
+	errs = append(errs, validateListen(this.Listen, field.NewPath("listen"))...)
+
+	workersPath := field.NewPath("workers")
+	if this.Workers.DaemonSets < 1 {
+		errs = append(errs, field.Invalid(workersPath.Child("daemonSets"), this.Workers.DaemonSets,
+			"must be at least 1"))
+	}
+	if this.Workers.Devices < 1 {
+		errs = append(errs, field.Invalid(workersPath.Child("devices"), this.Workers.Devices, "must be at least 1"))
+	}
+
+	timeoutsPath := field.NewPath("timeouts")
+	errs = append(errs, validateNonNegative(this.Timeouts.ResyncPeriod, timeoutsPath.Child("resyncPeriod"))...)
+	errs = append(errs, validatePositive(this.Timeouts.WatchMaxAge, timeoutsPath.Child("watchMaxAge"))...)
+	errs = append(errs, validateNonNegative(this.Timeouts.Shutdown, timeoutsPath.Child("shutdown"))...)
+	errs = append(errs, validateNonNegative(this.Heartbeat.GracePeriod,
+		field.NewPath("heartbeat", "gracePeriod"))...)
+
+	if this.LeaderElection.Enabled {
+		lePath := field.NewPath("leaderElection")
+		errs = append(errs, validatePositive(this.LeaderElection.RetryPeriod, lePath.Child("retryPeriod"))...)
+		if this.LeaderElection.RenewDeadline.Duration <= this.LeaderElection.RetryPeriod.Duration {
+			errs = append(errs, field.Invalid(lePath.Child("renewDeadline"),
+				this.LeaderElection.RenewDeadline.Duration.String(), "must be greater than retryPeriod"))
+		}
+		if this.LeaderElection.LeaseDuration.Duration <= this.LeaderElection.RenewDeadline.Duration {
+			errs = append(errs, field.Invalid(lePath.Child("leaseDuration"),
+				this.LeaderElection.LeaseDuration.Duration.String(), "must be greater than renewDeadline"))
+		}
+	}
+
+	errs = append(errs, validateLogging(this.Logging, field.NewPath("logging"))...)
+
+	certificatesPath := field.NewPath("certificates")
+	errs = append(errs, validateNamespace(this.Certificates.Namespace, certificatesPath.Child("namespace"))...)
+	errs = append(errs, validatePositive(this.Certificates.Duration, certificatesPath.Child("duration"))...)
+	if len(this.Certificates.CACertFile) > 0 != (len(this.Certificates.CAKeyFile) > 0) {
+		errs = append(errs, field.Required(certificatesPath, "caCertFile and caKeyFile have to be set together"))
+	}
+	errs = append(errs, validateFile(this.Certificates.CACertFile, certificatesPath.Child("caCertFile"))...)
+	errs = append(errs, validateFile(this.Certificates.CAKeyFile, certificatesPath.Child("caKeyFile"))...)
+
+	rotationPath := field.NewPath("rotation")
+	errs = append(errs, validatePositive(this.Rotation.RenewBefore, rotationPath.Child("renewBefore"))...)
+	errs = append(errs, validateNamespace(this.Rotation.TokenNamespace, rotationPath.Child("tokenNamespace"))...)
+	errs = append(errs, validatePositive(this.Rotation.CheckInterval, rotationPath.Child("checkInterval"))...)
+	if this.Rotation.TokenTTL.Duration <= this.Rotation.RenewBefore.Duration {
+		errs = append(errs, field.Invalid(rotationPath.Child("tokenTTL"), this.Rotation.TokenTTL.Duration.String(),
+			"must be greater than renewBefore"))
+	}
+	return toError(ControllerKind, errs)
+}
+
+// Reload returns updated config with fields that require restart kept from this config. Names of kept
+// fields that changed are returned, so they can be reported.
+func (this *ControllerConfig) Reload(updated *ControllerConfig) (*ControllerConfig, []string) {
+	reloaded := *updated
+	ignored := make([]string, 0)
+
+	if !reflect.DeepEqual(this.Kubernetes, updated.Kubernetes) {
+		reloaded.Kubernetes = this.Kubernetes
+		ignored = append(ignored, "kubernetes")
+	}
+	if !reflect.DeepEqual(this.Listen, updated.Listen) {
+		reloaded.Listen = this.Listen
+		ignored = append(ignored, "listen")
+	}
+	if this.Workers != updated.Workers {
+		reloaded.Workers = this.Workers
+		ignored = append(ignored, "workers")
+	}
+	if this.Timeouts.ResyncPeriod != updated.Timeouts.ResyncPeriod {
+		reloaded.Timeouts.ResyncPeriod = this.Timeouts.ResyncPeriod
+		ignored = append(ignored, "timeouts.resyncPeriod")
+	}
+	if this.Timeouts.WatchMaxAge != updated.Timeouts.WatchMaxAge {
+		reloaded.Timeouts.WatchMaxAge = this.Timeouts.WatchMaxAge
+		ignored = append(ignored, "timeouts.watchMaxAge")
+	}
+	if this.LeaderElection != updated.LeaderElection {
+		reloaded.LeaderElection = this.LeaderElection
+		ignored = append(ignored, "leaderElection")
+	}
+	if this.Certificates.CACertFile != updated.Certificates.CACertFile ||
+		this.Certificates.CAKeyFile != updated.Certificates.CAKeyFile {
+		reloaded.Certificates.CACertFile = this.Certificates.CACertFile
+		reloaded.Certificates.CAKeyFile = this.Certificates.CAKeyFile
+		ignored = append(ignored, "certificates.caCertFile", "certificates.caKeyFile")
+	}
+	return &reloaded, ignored
+}
+
+// ControllerStore holds current configuration of the IoT controller, so reloaded fields are picked up by
+// running components.
+type ControllerStore struct {
+	value atomic.Value
+}
+
+func NewControllerStore(config *ControllerConfig) *ControllerStore {
+	store := &ControllerStore{}
+	store.Set(config)
+	return store
+}
+
+// Get returns current configuration. It must not be modified.
+func (this *ControllerStore) Get() *ControllerConfig {
+	return this.value.Load().(*ControllerConfig)
+}
+
+func (this *ControllerStore) Set(config *ControllerConfig) {
+	this.value.Store(config)
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+func addLoggingFlags(flags *pflag.FlagSet, config *LoggingConfig) {
+	flags.StringVar(&config.Level, "log-level", config.Level, "log verbosity: error, warning, info or debug")
+	flags.StringVar(&config.Format, "log-format", config.Format, "log output format: text or json")
+}
+
+// portValue is port flag setting port of listen address, so flags from before listen addresses were
+// configurable keep working.
+type portValue struct {
+	address *string
+}
+
+func newPortValue(address *string) *portValue {
+	return &portValue{address: address}
+}
+
+func (this *portValue) String() string {
+	_, port, err := net.SplitHostPort(*this.address)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+func (this *portValue) Set(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", value)
+	}
+
+	host, _, err := net.SplitHostPort(*this.address)
+	if err != nil {
+		host = ""
+	}
+	*this.address = net.JoinHostPort(host, value)
+	return nil
+}
+
+func (this *portValue) Type() string {
+	return "int"
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ReloadInterval is how often config files are checked for changes. Mounted ConfigMaps are updated by
+// swapping symlinks, so file contents are compared instead of relying on file events.
+const ReloadInterval = 10 * time.Second
+
+// WatchFile calls onChange every time content of the file changes. It blocks until stop channel is closed.
+func WatchFile(path string, interval time.Duration, onChange func(), stopCh <-chan struct{}) {
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.Warningf("Cannot read config file %s: %s", path, err.Error())
+	}
+
+	wait.Until(func() {
+		current, err := ioutil.ReadFile(path)
+		if err != nil {
+			logging.Warningf("Cannot read config file %s: %s", path, err.Error())
+			return
+		}
+
+		if bytes.Equal(current, last) {
+			return
+		}
+		last = current
+		onChange()
+	}, interval, stopCh)
+}
@@ -0,0 +1,291 @@
+package leaderelection
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// LeaderElectionRecordAnnotationKey is the annotation of the lock Endpoints object holding the lease.
+const LeaderElectionRecordAnnotationKey = "control-plane.alpha.kubernetes.io/leader"
+
+// LeaderElectionRecord is the lease stored in the lock object. Its format is compatible with the one used
+// by kubernetes components, so "kubectl describe" shows the current leader the same way.
+type LeaderElectionRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+// Config describes the lease and the callbacks run when leadership changes.
+type Config struct {
+	Client    *kubernetes.Clientset
+	Namespace string
+	Name      string
+	Identity  string
+
+	// LeaseDuration is how long standbys wait since the last observed renewal before taking over.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader retries renewing before it gives up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is how long candidates wait between attempts to acquire or renew the lease.
+	RetryPeriod time.Duration
+
+	// OnStartedLeading is run in a goroutine once the lease is acquired. Stop channel is closed when
+	// leadership is lost.
+	OnStartedLeading func(stop <-chan struct{})
+	// OnStoppedLeading is run when leadership is lost.
+	OnStoppedLeading func()
+}
+
+// LeaderElector acquires and renews the lease stored as an annotation of an Endpoints object. Only one
+// candidate holds the lease at a time, others stand by and take over once it expires.
+type LeaderElector struct {
+	config Config
+
+	observedRecord LeaderElectionRecord
+	observedTime   time.Time
+}
+
+// NewLeaderElector validates the config and creates a leader elector.
+func NewLeaderElector(config Config) (*LeaderElector, error) {
+	if config.LeaseDuration <= config.RenewDeadline {
+		return nil, fmt.Errorf("lease duration must be greater than renew deadline")
+	}
+	if config.RenewDeadline <= config.RetryPeriod {
+		return nil, fmt.Errorf("renew deadline must be greater than retry period")
+	}
+	if len(config.Identity) == 0 {
+		return nil, fmt.Errorf("leader election identity must not be empty")
+	}
+	if config.OnStartedLeading == nil || config.OnStoppedLeading == nil {
+		return nil, fmt.Errorf("OnStartedLeading and OnStoppedLeading callbacks are required")
+	}
+
+	return &LeaderElector{config: config}, nil
+}
+
+// Run blocks until the lease is acquired, starts OnStartedLeading and keeps renewing the lease. When
+// renewal fails for longer than renew deadline or stop channel is closed, stop channel of OnStartedLeading
+// is closed and OnStoppedLeading is called once OnStartedLeading returned. When stopped by stop channel,
+// the lease is released so standbys don't wait for it to expire. Run returns right away when stop channel
+// is closed before the lease is acquired.
+func (le *LeaderElector) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	if !le.acquire(stopCh) {
+		return
+	}
+	defer le.config.OnStoppedLeading()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		le.config.OnStartedLeading(stop)
+	}()
+
+	stopped := le.renew(stopCh)
+	close(stop)
+	<-done
+
+	if stopped {
+		le.release()
+	}
+}
+
+// IsLeader returns true if the last observed lease is held by this candidate.
+func (le *LeaderElector) IsLeader() bool {
+	return le.observedRecord.HolderIdentity == le.config.Identity
+}
+
+func (le *LeaderElector) acquire(stopCh <-chan struct{}) bool {
+	logging.Infof("[Leader election] %s is trying to acquire lease %s/%s", le.config.Identity,
+		le.config.Namespace, le.config.Name)
+
+	for {
+		if le.tryAcquireOrRenew() {
+			logging.Infof("[Leader election] %s acquired lease %s/%s", le.config.Identity, le.config.Namespace,
+				le.config.Name)
+			return true
+		}
+
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(le.config.RetryPeriod):
+		}
+	}
+}
+
+// renew keeps renewing the lease, it returns true when stopped by stop channel and false when renewal failed.
+func (le *LeaderElector) renew(stopCh <-chan struct{}) bool {
+	for {
+		err := wait.Poll(le.config.RetryPeriod, le.config.RenewDeadline, func() (bool, error) {
+			return le.tryAcquireOrRenew(), nil
+		})
+
+		if err != nil {
+			logging.Errorf("[Leader election] %s failed to renew lease %s/%s: %s", le.config.Identity,
+				le.config.Namespace, le.config.Name, err.Error())
+			return false
+		}
+
+		select {
+		case <-stopCh:
+			logging.Infof("[Leader election] %s stopped renewing lease %s/%s", le.config.Identity,
+				le.config.Namespace, le.config.Name)
+			return true
+		case <-time.After(le.config.RetryPeriod):
+		}
+	}
+}
+
+// release clears the holder of the lease if it is still held by this candidate, so that standbys acquire it
+// right away.
+func (le *LeaderElector) release() {
+	endpoints, err := le.config.Client.CoreV1().Endpoints(le.config.Namespace).Get(le.config.Name,
+		metav1.GetOptions{})
+	if err != nil {
+		logging.Warningf("[Leader election] Cannot get lease %s/%s: %s", le.config.Namespace, le.config.Name,
+			err.Error())
+		return
+	}
+
+	record := LeaderElectionRecord{}
+	if err := json.Unmarshal([]byte(endpoints.Annotations[LeaderElectionRecordAnnotationKey]), &record); err != nil {
+		logging.Warningf("[Leader election] Cannot decode lease %s/%s: %s", le.config.Namespace, le.config.Name,
+			err.Error())
+		return
+	}
+	if record.HolderIdentity != le.config.Identity {
+		return
+	}
+
+	now := metav1.Now()
+	record = LeaderElectionRecord{
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+		LeaderTransitions:    record.LeaderTransitions,
+	}
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	endpoints.Annotations[LeaderElectionRecordAnnotationKey] = string(encodedRecord)
+
+	if _, err := le.config.Client.CoreV1().Endpoints(le.config.Namespace).Update(endpoints); err != nil {
+		logging.Warningf("[Leader election] Cannot release lease %s/%s: %s", le.config.Namespace, le.config.Name,
+			err.Error())
+		return
+	}
+
+	le.observedRecord = record
+	le.observedTime = time.Now()
+	logging.Infof("[Leader election] %s released lease %s/%s", le.config.Identity, le.config.Namespace,
+		le.config.Name)
+}
+
+// tryAcquireOrRenew creates the lease or updates it if it is held by this candidate or expired. Conflicting
+// updates of concurrent candidates are rejected by the resource version check of the apiserver. Released
+// lease without a holder is acquired right away.
+func (le *LeaderElector) tryAcquireOrRenew() bool {
+	now := metav1.Now()
+	record := LeaderElectionRecord{
+		HolderIdentity:       le.config.Identity,
+		LeaseDurationSeconds: int(le.config.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	endpoints, err := le.config.Client.CoreV1().Endpoints(le.config.Namespace).Get(le.config.Name,
+		metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			logging.Warningf("[Leader election] Cannot get lease %s/%s: %s", le.config.Namespace, le.config.Name,
+				err.Error())
+			return false
+		}
+
+		encodedRecord, err := json.Marshal(record)
+		if err != nil {
+			return false
+		}
+
+		_, err = le.config.Client.CoreV1().Endpoints(le.config.Namespace).Create(&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        le.config.Name,
+				Namespace:   le.config.Namespace,
+				Annotations: map[string]string{LeaderElectionRecordAnnotationKey: string(encodedRecord)},
+			},
+		})
+		if err != nil {
+			logging.Warningf("[Leader election] Cannot create lease %s/%s: %s", le.config.Namespace, le.config.Name,
+				err.Error())
+			return false
+		}
+
+		le.observedRecord = record
+		le.observedTime = time.Now()
+		return true
+	}
+
+	if endpoints.Annotations == nil {
+		endpoints.Annotations = make(map[string]string)
+	}
+
+	oldRecord := LeaderElectionRecord{}
+	if encodedOldRecord, ok := endpoints.Annotations[LeaderElectionRecordAnnotationKey]; ok {
+		if err := json.Unmarshal([]byte(encodedOldRecord), &oldRecord); err != nil {
+			logging.Warningf("[Leader election] Cannot decode lease %s/%s: %s", le.config.Namespace, le.config.Name,
+				err.Error())
+			return false
+		}
+
+		if !reflect.DeepEqual(le.observedRecord, oldRecord) {
+			le.observedRecord = oldRecord
+			le.observedTime = time.Now()
+		}
+
+		if len(oldRecord.HolderIdentity) > 0 && le.observedTime.Add(le.config.LeaseDuration).After(now.Time) &&
+			!le.IsLeader() {
+			return false
+		}
+	}
+
+	// Acquire time and transitions are preserved when the lease is renewed by its holder.
+	if oldRecord.HolderIdentity == le.config.Identity {
+		record.AcquireTime = oldRecord.AcquireTime
+		record.LeaderTransitions = oldRecord.LeaderTransitions
+	} else {
+		record.LeaderTransitions = oldRecord.LeaderTransitions + 1
+	}
+
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		return false
+	}
+	endpoints.Annotations[LeaderElectionRecordAnnotationKey] = string(encodedRecord)
+
+	if _, err := le.config.Client.CoreV1().Endpoints(le.config.Namespace).Update(endpoints); err != nil {
+		logging.Warningf("[Leader election] Cannot update lease %s/%s: %s", le.config.Namespace, le.config.Name,
+			err.Error())
+		return false
+	}
+
+	le.observedRecord = record
+	le.observedTime = time.Now()
+	return true
+}
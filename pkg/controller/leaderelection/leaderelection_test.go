@@ -0,0 +1,222 @@
+package leaderelection
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+const testLockPath = "/api/v1/namespaces/kube-system/endpoints"
+
+// fakeApiserver stores the lock Endpoints object and counts the writes of it.
+type fakeApiserver struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	lock   []byte
+	writes int
+}
+
+func newFakeApiserver() *fakeApiserver {
+	f := &fakeApiserver{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeApiserver) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == testLockPath && f.lock == nil,
+		req.Method == http.MethodPut && req.URL.Path == testLockPath+"/iot-controller" && f.lock != nil:
+		f.lock, _ = ioutil.ReadAll(req.Body)
+		f.writes++
+		w.Write(f.lock)
+	case req.Method == http.MethodGet && req.URL.Path == testLockPath+"/iot-controller" && f.lock != nil:
+		w.Write(f.lock)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+	}
+}
+
+func (f *fakeApiserver) setRecord(t *testing.T, record LeaderElectionRecord) {
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := json.Marshal(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{
+		Name:        "iot-controller",
+		Namespace:   "kube-system",
+		Annotations: map[string]string{LeaderElectionRecordAnnotationKey: string(encodedRecord)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lock = lock
+}
+
+func (f *fakeApiserver) getRecord(t *testing.T) LeaderElectionRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	endpoints := v1.Endpoints{}
+	if err := json.Unmarshal(f.lock, &endpoints); err != nil {
+		t.Fatal(err)
+	}
+	record := LeaderElectionRecord{}
+	if err := json.Unmarshal([]byte(endpoints.Annotations[LeaderElectionRecordAnnotationKey]), &record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func (f *fakeApiserver) getWrites() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+func newTestElector(t *testing.T, f *fakeApiserver, started chan<- struct{}) *LeaderElector {
+	le, err := NewLeaderElector(Config{
+		Client:        kubernetes.NewClientset(&rest.Config{Host: f.server.URL}),
+		Namespace:     "kube-system",
+		Name:          "iot-controller",
+		Identity:      "controller-1",
+		LeaseDuration: time.Minute,
+		RenewDeadline: 100 * time.Millisecond,
+		RetryPeriod:   10 * time.Millisecond,
+		OnStartedLeading: func(stop <-chan struct{}) {
+			close(started)
+			<-stop
+		},
+		OnStoppedLeading: func() {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return le
+}
+
+func TestTryAcquireOrRenew(t *testing.T) {
+	acquired := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	cases := []struct {
+		name string
+		// record is the current lease, none if nil
+		record *LeaderElectionRecord
+		// observedAge is how long ago the current lease was observed, it's not observed yet if zero
+		observedAge time.Duration
+
+		acquired    bool
+		transitions int
+		// acquireTime is the expected acquire time, it's the time of the update if nil
+		acquireTime *metav1.Time
+	}{
+		{"free", nil, 0, true, 0, nil},
+		{"renewed", &LeaderElectionRecord{HolderIdentity: "controller-1", AcquireTime: acquired,
+			RenewTime: acquired, LeaderTransitions: 2}, 0, true, 2, &acquired},
+		{"held", &LeaderElectionRecord{HolderIdentity: "controller-2", AcquireTime: acquired,
+			RenewTime: acquired, LeaderTransitions: 2}, 0, false, 2, &acquired},
+		{"held and observed", &LeaderElectionRecord{HolderIdentity: "controller-2", AcquireTime: acquired,
+			RenewTime: acquired, LeaderTransitions: 2}, 30 * time.Second, false, 2, &acquired},
+		{"expired", &LeaderElectionRecord{HolderIdentity: "controller-2", AcquireTime: acquired,
+			RenewTime: acquired, LeaderTransitions: 2}, 2 * time.Minute, true, 3, nil},
+		{"released", &LeaderElectionRecord{AcquireTime: acquired, RenewTime: acquired, LeaderTransitions: 2},
+			0, true, 3, nil},
+	}
+
+	for _, c := range cases {
+		f := newFakeApiserver()
+		le := newTestElector(t, f, make(chan struct{}))
+		if c.record != nil {
+			f.setRecord(t, *c.record)
+			if c.observedAge > 0 {
+				le.observedRecord = *c.record
+				le.observedTime = time.Now().Add(-c.observedAge)
+			}
+		}
+
+		start := time.Now().Truncate(time.Second)
+		if acquired := le.tryAcquireOrRenew(); acquired != c.acquired {
+			t.Errorf("%s: expected acquired %t, got %t", c.name, c.acquired, acquired)
+		}
+		if le.IsLeader() != c.acquired {
+			t.Errorf("%s: expected leader %t, got %t", c.name, c.acquired, le.IsLeader())
+		}
+
+		record := f.getRecord(t)
+		if expected := c.acquired || c.record == nil; (f.getWrites() > 0) != expected {
+			t.Errorf("%s: expected lease written %t, got %d writes", c.name, expected, f.getWrites())
+		}
+		if c.acquired && record.HolderIdentity != "controller-1" {
+			t.Errorf("%s: expected holder controller-1, got %q", c.name, record.HolderIdentity)
+		}
+		if c.acquired && record.RenewTime.Time.Before(start) {
+			t.Errorf("%s: expected lease renewed after %s, got %s", c.name, start, record.RenewTime)
+		}
+		if record.LeaderTransitions != c.transitions {
+			t.Errorf("%s: expected %d transitions, got %d", c.name, c.transitions, record.LeaderTransitions)
+		}
+		if c.acquireTime != nil && !record.AcquireTime.Equal(*c.acquireTime) {
+			t.Errorf("%s: expected acquire time %s, got %s", c.name, c.acquireTime, record.AcquireTime)
+		} else if c.acquireTime == nil && record.AcquireTime.Time.Before(start) {
+			t.Errorf("%s: expected acquired after %s, got %s", c.name, start, record.AcquireTime)
+		}
+		f.server.Close()
+	}
+}
+
+func TestRunReleasesLease(t *testing.T) {
+	f := newFakeApiserver()
+	defer f.server.Close()
+
+	started := make(chan struct{})
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	le := newTestElector(t, f, started)
+	go func() {
+		defer close(done)
+		le.Run(stopCh)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lease to be acquired")
+	}
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected run to return")
+	}
+
+	record := f.getRecord(t)
+	if len(record.HolderIdentity) > 0 {
+		t.Errorf("expected lease to be released, got holder %q", record.HolderIdentity)
+	}
+
+	// Standby acquires the released lease without waiting for it to expire.
+	standby := newTestElector(t, f, make(chan struct{}))
+	standby.config.Identity = "controller-2"
+	if !standby.tryAcquireOrRenew() {
+		t.Errorf("expected released lease to be acquired")
+	}
+	if record := f.getRecord(t); record.LeaderTransitions != 1 {
+		t.Errorf("expected 1 transition, got %d", record.LeaderTransitions)
+	}
+}
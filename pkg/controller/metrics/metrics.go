@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Namespace prefixes names of all IoT controller metrics.
+const Namespace = "iot_controller"
+
+// Results of syncs and IotPod operations.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// Operations done with IotPods.
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+var (
+	syncCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "syncs_total",
+			Help:      "Number of reconciliations per kind and result.",
+		},
+		[]string{"kind", "result"},
+	)
+
+	syncLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "sync_duration_seconds",
+			Help:      "Reconciliation latencies per kind.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"kind"},
+	)
+
+	watchRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "watch_restarts_total",
+			Help:      "Number of watches restarted after they were closed by timeout or error per resource.",
+		},
+		[]string{"resource"},
+	)
+
+	podOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "pod_operations_total",
+			Help:      "Number of IotPods created, updated and deleted by the controller per result.",
+		},
+		[]string{"operation", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(syncCount, syncLatency, watchRestarts, podOperations)
+}
+
+// ObserveSync records result and latency of reconciliation of kind started at given time.
+func ObserveSync(kind string, start time.Time, err error) {
+	syncLatency.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	syncCount.WithLabelValues(kind, result(err)).Inc()
+}
+
+// WatchRestarted counts restarted watch of resource.
+func WatchRestarted(resource string) {
+	watchRestarts.WithLabelValues(resource).Inc()
+}
+
+// ObservePodOperation counts IotPod operation with its result.
+func ObservePodOperation(operation string, err error) {
+	podOperations.WithLabelValues(operation, result(err)).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultSuccess
+}
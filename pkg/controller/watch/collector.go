@@ -0,0 +1,193 @@
+package watch
+
+import (
+	"time"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/controller/metrics"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	devicesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "devices"),
+		"Number of IotDevices by Ready condition and unschedulable state.",
+		[]string{"ready", "unschedulable"}, nil,
+	)
+
+	deviceCredentialsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "device", "credentials"),
+		"Number of IotDevices by credential type and rotation state.",
+		[]string{"type", "state"}, nil,
+	)
+
+	desiredPodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "daemonset", "desired_pods"),
+		"Number of schedulable IotDevices selected by IotDaemonSet.",
+		[]string{"namespace", "daemonset"}, nil,
+	)
+
+	readyPodsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "daemonset", "ready_pods"),
+		"Number of ready IotPods controlled by IotDaemonSet.",
+		[]string{"namespace", "daemonset"}, nil,
+	)
+)
+
+// FleetCollector computes gauges of IotDevices and IotDaemonSets from informer caches on every scrape, so
+// they never drift from the state the watchers act on.
+type FleetCollector struct {
+	informers *IotInformers
+	store     *config.ControllerStore
+}
+
+func NewFleetCollector(informers *IotInformers, store *config.ControllerStore) *FleetCollector {
+	return &FleetCollector{informers: informers, store: store}
+}
+
+// Describe implements prometheus.Collector.
+func (c *FleetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+	ch <- deviceCredentialsDesc
+	ch <- desiredPodsDesc
+	ch <- readyPodsDesc
+}
+
+// Collect implements prometheus.Collector. Nothing is reported until informer caches are synced.
+func (c *FleetCollector) Collect(ch chan<- prometheus.Metric) {
+	if !c.informers.HasSynced() {
+		return
+	}
+
+	c.collectDevices(ch)
+	c.collectCredentials(ch)
+	c.collectDaemonSets(ch)
+}
+
+func (c *FleetCollector) collectDevices(ch chan<- prometheus.Metric) {
+	type deviceState struct {
+		ready         string
+		unschedulable bool
+	}
+
+	gracePeriod := c.store.Get().Heartbeat.GracePeriod.Duration
+	now := metav1.Now()
+	counts := make(map[deviceState]int)
+	for _, obj := range c.informers.Devices.GetIndexer().List() {
+		device := obj.(*types.IotDevice)
+		counts[deviceState{
+			ready:         getDeviceReadyStatus(*device, gracePeriod, now),
+			unschedulable: kubernetes.GetUnschedulableLabelFromDevice(*device),
+		}]++
+	}
+
+	for state, count := range counts {
+		unschedulable := "false"
+		if state.unschedulable {
+			unschedulable = "true"
+		}
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(count), state.ready,
+			unschedulable)
+	}
+}
+
+// collectCredentials counts IotDevices by credential annotations set by CredentialMonitor.
+func (c *FleetCollector) collectCredentials(ch chan<- prometheus.Metric) {
+	type credentialState struct {
+		credentialType string
+		state          string
+	}
+
+	counts := make(map[credentialState]int)
+	for _, obj := range c.informers.Devices.GetIndexer().List() {
+		device := obj.(*types.IotDevice)
+		state, ok := device.Metadata.Annotations[types.AnnotationCredentialState]
+		if !ok {
+			continue
+		}
+		counts[credentialState{
+			credentialType: device.Metadata.Annotations[types.AnnotationCredentialType],
+			state:          state,
+		}]++
+	}
+
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(deviceCredentialsDesc, prometheus.GaugeValue, float64(count),
+			state.credentialType, state.state)
+	}
+}
+
+func (c *FleetCollector) collectDaemonSets(ch chan<- prometheus.Metric) {
+	for _, obj := range c.informers.DaemonSets.GetIndexer().List() {
+		ds := obj.(*types.IotDaemonSet)
+
+		devices, err := c.informers.GetDaemonSetDevices(*ds)
+		if err != nil {
+			logging.Warningf("Cannot collect metrics of %s %s: %s", types.IotDaemonSetKind, ds.Metadata.Name,
+				err.Error())
+			continue
+		}
+
+		pods, err := c.informers.GetControlledPods(ds.Metadata.Namespace, ds.Metadata.Name)
+		if err != nil {
+			logging.Warningf("Cannot collect metrics of %s %s: %s", types.IotDaemonSetKind, ds.Metadata.Name,
+				err.Error())
+			continue
+		}
+
+		desired := 0
+		for _, device := range devices {
+			if device.Metadata.DeletionTimestamp == nil && kubernetes.IsDeviceSchedulable(device) {
+				desired++
+			}
+		}
+
+		ready := 0
+		for _, pod := range pods {
+			ref := kubernetes.GetControllerOf(pod)
+			if ref != nil && ref.UID == ds.Metadata.UID && isPodReady(pod) {
+				ready++
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(desiredPodsDesc, prometheus.GaugeValue, float64(desired),
+			ds.Metadata.Namespace, ds.Metadata.Name)
+		ch <- prometheus.MustNewConstMetric(readyPodsDesc, prometheus.GaugeValue, float64(ready),
+			ds.Metadata.Namespace, ds.Metadata.Name)
+	}
+}
+
+// getDeviceReadyStatus returns status of the Ready condition of IotDevice as "true", "false" or "unknown".
+// Status of devices that stopped posting it for longer than the grace period is unknown, unless it's 0.
+func getDeviceReadyStatus(device types.IotDevice, gracePeriod time.Duration, now metav1.Time) string {
+	for _, condition := range device.Status.Conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+		if gracePeriod > 0 && now.Sub(condition.LastHeartbeatTime.Time) > gracePeriod {
+			return "unknown"
+		}
+
+		switch condition.Status {
+		case v1.ConditionTrue:
+			return "true"
+		case v1.ConditionFalse:
+			return "false"
+		}
+	}
+	return "unknown"
+}
+
+func isPodReady(pod types.IotPod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
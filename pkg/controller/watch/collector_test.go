@@ -0,0 +1,43 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestGetDeviceReadyStatus(t *testing.T) {
+	now := metav1.Now()
+	cases := []struct {
+		name        string
+		status      v1.ConditionStatus
+		heartbeat   time.Duration
+		gracePeriod time.Duration
+		expected    string
+	}{
+		{"ready", v1.ConditionTrue, time.Minute, 5 * time.Minute, "true"},
+		{"not ready", v1.ConditionFalse, time.Minute, 5 * time.Minute, "false"},
+		{"unknown", v1.ConditionUnknown, time.Minute, 5 * time.Minute, "unknown"},
+		{"stale ready", v1.ConditionTrue, 10 * time.Minute, 5 * time.Minute, "unknown"},
+		{"stale not ready", v1.ConditionFalse, 10 * time.Minute, 5 * time.Minute, "unknown"},
+		{"disabled check", v1.ConditionTrue, 10 * time.Minute, 0, "true"},
+	}
+
+	for _, c := range cases {
+		device := types.IotDevice{}
+		device.Status.Conditions = []v1.NodeCondition{
+			{Type: v1.NodeOutOfDisk, Status: v1.ConditionFalse},
+			{Type: v1.NodeReady, Status: c.status, LastHeartbeatTime: metav1.NewTime(now.Add(-c.heartbeat))},
+		}
+		if actual := getDeviceReadyStatus(device, c.gracePeriod, now); actual != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, actual)
+		}
+	}
+
+	if actual := getDeviceReadyStatus(types.IotDevice{}, time.Minute, now); actual != "unknown" {
+		t.Errorf("expected device without Ready condition to be unknown, got %s", actual)
+	}
+}
@@ -0,0 +1,324 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// CredentialMonitor reports expiry and rotation state of device credentials on IotDevices and rotates device
+// tokens before they expire. Kubelets rotate their certificates themselves, so certificates are only
+// reported. Devices fetch rotated tokens from the IoT apiserver, which deletes the old token once the device
+// uses the new one.
+type CredentialMonitor struct {
+	restClient *rest.RESTClient
+	clientset  *kubeclient.Clientset
+	informers  *IotInformers
+	recorder   record.EventRecorder
+	store      *config.ControllerStore
+}
+
+// credentialStatus is expiry and rotation state of credentials the device currently uses.
+type credentialStatus struct {
+	credentialType string
+	state          string
+	message        string
+	// expiry is zero for credentials that never expire.
+	expiry time.Time
+}
+
+// deviceToken is device token with its Secret.
+type deviceToken struct {
+	*certificates.BootstrapToken
+	secret *v1.Secret
+}
+
+func NewCredentialMonitor(restClient *rest.RESTClient, clientset *kubeclient.Clientset, informers *IotInformers,
+	recorder record.EventRecorder, store *config.ControllerStore) *CredentialMonitor {
+	return &CredentialMonitor{restClient: restClient, clientset: clientset, informers: informers,
+		recorder: recorder, store: store}
+}
+
+// Run waits for informer caches to sync and checks credentials of all IotDevices. Rotation settings are read
+// before every check, so reloaded settings apply without restart. It blocks until stop channel is closed.
+func (m *CredentialMonitor) Run(stopCh <-chan struct{}) {
+	runPeriodically(m.informers, func() time.Duration {
+		settings := m.store.Get().Rotation
+		m.check(settings)
+		return settings.CheckInterval.Duration
+	}, stopCh)
+}
+
+func (m *CredentialMonitor) check(settings config.RotationConfig) {
+	tokens, err := m.listDeviceTokens(settings.TokenNamespace)
+	if err != nil {
+		logging.Warningf("Cannot list device tokens: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, obj := range m.informers.Devices.GetIndexer().List() {
+		device := *obj.(*types.IotDevice)
+		if device.Metadata.DeletionTimestamp != nil {
+			continue
+		}
+
+		var status *credentialStatus
+		if deviceTokens, ok := tokens[device.Metadata.Name]; ok {
+			status = m.checkTokens(device, deviceTokens, settings, now)
+		} else {
+			requests, err := m.informers.GetDeviceCertificateRequests(device.Metadata.Name)
+			if err != nil {
+				logging.Warningf("Cannot get certificate requests of %s %s: %s", types.IotDeviceKind,
+					device.Metadata.Name, err.Error())
+				continue
+			}
+			status = getCertificateStatus(requests, settings.RenewBefore.Duration, now)
+		}
+
+		if status != nil {
+			m.updateStatus(device, *status)
+		}
+	}
+}
+
+// listDeviceTokens returns device tokens by name of their device, oldest expiration first.
+func (m *CredentialMonitor) listDeviceTokens(namespace string) (map[string][]deviceToken, error) {
+	secrets, err := m.clientset.CoreV1().Secrets(namespace).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("type", string(certificates.BootstrapTokenSecretType)).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string][]deviceToken)
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		token, err := certificates.ParseBootstrapTokenSecret(secret)
+		if err != nil || !token.Authentication {
+			continue
+		}
+		tokens[token.Device] = append(tokens[token.Device], deviceToken{BootstrapToken: token, secret: secret})
+	}
+
+	for _, deviceTokens := range tokens {
+		sort.Slice(deviceTokens, func(i, j int) bool {
+			return expiresBefore(deviceTokens[i].Expiration, deviceTokens[j].Expiration)
+		})
+	}
+	return tokens, nil
+}
+
+// checkTokens rotates the newest device token when it's close to expiry and returns state of the rotation.
+// Replaced tokens that still exist mean the device has not switched to the new token yet.
+func (m *CredentialMonitor) checkTokens(device types.IotDevice, tokens []deviceToken,
+	settings config.RotationConfig, now time.Time) *credentialStatus {
+	newest := tokens[len(tokens)-1]
+	status := &credentialStatus{credentialType: types.CredentialTypeToken, expiry: newest.Expiration}
+
+	if newest.Expiration.IsZero() {
+		status.state = types.CredentialStateCurrent
+		return status
+	}
+	if now.After(newest.Expiration) {
+		status.state = types.CredentialStateExpired
+		status.message = fmt.Sprintf("token %s expired", newest.ID)
+		return status
+	}
+
+	if newest.Expiration.Sub(now) < settings.RenewBefore.Duration {
+		if err := m.rotateToken(device, newest, settings, now); err != nil {
+			logging.WithFields(logging.Fields{"device": device.Metadata.Name}).Warningf(
+				"Cannot rotate device token %s: %s", newest.ID, err.Error())
+			status.state = types.CredentialStateFailed
+			status.message = fmt.Sprintf("cannot rotate token %s: %s", newest.ID, err.Error())
+			return status
+		}
+		status.state = types.CredentialStateRotating
+		status.message = fmt.Sprintf("token %s is rotated", newest.ID)
+		return status
+	}
+
+	for _, token := range tokens[:len(tokens)-1] {
+		if token.ReplacedBy != newest.ID {
+			continue
+		}
+
+		status.expiry = token.Expiration
+		if !token.Expiration.IsZero() && now.After(token.Expiration) {
+			status.state = types.CredentialStateFailed
+			status.message = fmt.Sprintf("device did not switch to token %s before token %s expired", newest.ID,
+				token.ID)
+			return status
+		}
+		status.state = types.CredentialStateRotating
+		status.message = fmt.Sprintf("waiting for device to switch from token %s to token %s", token.ID, newest.ID)
+		return status
+	}
+
+	status.state = types.CredentialStateCurrent
+	return status
+}
+
+// rotateToken issues token replacing the old one. The old token is marked first, so the token is issued
+// again by the next check when creating it fails.
+func (m *CredentialMonitor) rotateToken(device types.IotDevice, old deviceToken, settings config.RotationConfig,
+	now time.Time) error {
+	id, tokenSecret, err := certificates.GenerateBootstrapToken()
+	if err != nil {
+		return err
+	}
+
+	secrets := m.clientset.CoreV1().Secrets(old.secret.Namespace)
+	old.secret.Data[certificates.DeviceTokenReplacedByKey] = []byte(id)
+	if _, err := secrets.Update(old.secret); err != nil {
+		return err
+	}
+
+	expiration := now.Add(settings.TokenTTL.Duration)
+	secret := certificates.NewDeviceTokenSecret(old.secret.Namespace, device.Metadata.Name, id, tokenSecret,
+		expiration)
+	secret.Data[certificates.DeviceTokenReplacesKey] = []byte(old.ID)
+	if _, err := secrets.Create(secret); err != nil {
+		return err
+	}
+
+	logging.WithFields(logging.Fields{"device": device.Metadata.Name}).Infof(
+		"Issued device token %s replacing token %s", id, old.ID)
+	m.recorder.Eventf(&device, v1.EventTypeNormal, RotatedCredentialsReason,
+		"Issued token %s replacing token %s, valid until %s", id, old.ID, expiration.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// getCertificateStatus returns state of the newest certificate issued to the device, nil if the device never
+// got one and has no denied request.
+func getCertificateStatus(requests []types.IotCertificateRequest, renewBefore time.Duration,
+	now time.Time) *credentialStatus {
+	var issued, newest *types.IotCertificateRequest
+	var expiry time.Time
+	for i := range requests {
+		request := &requests[i]
+		if newest == nil || newest.Metadata.CreationTimestamp.Before(request.Metadata.CreationTimestamp) {
+			newest = request
+		}
+
+		if len(request.Status.Certificate) == 0 {
+			continue
+		}
+		notAfter, err := certificates.GetCertificateExpiry(request.Status.Certificate)
+		if err != nil {
+			continue
+		}
+		if issued == nil || notAfter.After(expiry) {
+			issued, expiry = request, notAfter
+		}
+	}
+
+	if newest == nil {
+		return nil
+	}
+
+	status := &credentialStatus{credentialType: types.CredentialTypeCertificate, expiry: expiry}
+	if newest != issued && len(newest.Status.Certificate) == 0 {
+		if _, denied := certificates.GetConditions(newest.Status); denied {
+			status.state = types.CredentialStateFailed
+			status.message = fmt.Sprintf("certificate request %s was denied", newest.Metadata.Name)
+			return status
+		}
+		if issued != nil {
+			status.state = types.CredentialStateRotating
+			status.message = fmt.Sprintf("certificate request %s waits for approval", newest.Metadata.Name)
+			return status
+		}
+	}
+
+	switch {
+	case issued == nil:
+		return nil
+	case now.After(expiry):
+		status.state = types.CredentialStateExpired
+		status.message = "certificate expired"
+	case expiry.Sub(now) < renewBefore:
+		status.state = types.CredentialStateRotationDue
+		status.message = "kubelet has not requested new certificate"
+	default:
+		status.state = types.CredentialStateCurrent
+	}
+	return status
+}
+
+// updateStatus sets credential annotations of IotDevice and records event when the device needs attention.
+func (m *CredentialMonitor) updateStatus(device types.IotDevice, status credentialStatus) {
+	expiry := ""
+	if !status.expiry.IsZero() {
+		expiry = status.expiry.UTC().Format(time.RFC3339)
+	}
+
+	annotations := device.Metadata.Annotations
+	if annotations[types.AnnotationCredentialType] == status.credentialType &&
+		annotations[types.AnnotationCredentialState] == status.state &&
+		annotations[types.AnnotationCredentialExpiry] == expiry &&
+		annotations[types.AnnotationCredentialMessage] == status.message {
+		return
+	}
+
+	// Annotations are copied, objects from the cache must not be modified.
+	updated := make(map[string]string, len(annotations)+4)
+	for key, value := range annotations {
+		updated[key] = value
+	}
+	setAnnotation(updated, types.AnnotationCredentialType, status.credentialType)
+	setAnnotation(updated, types.AnnotationCredentialState, status.state)
+	setAnnotation(updated, types.AnnotationCredentialExpiry, expiry)
+	setAnnotation(updated, types.AnnotationCredentialMessage, status.message)
+	device.Metadata.Annotations = updated
+
+	if err := kubernetes.UpdateDevice(m.restClient, device); err != nil {
+		// Next check retries
+		logging.Warningf("Cannot update %s %s: %s", types.IotDeviceKind, device.Metadata.Name, err.Error())
+		return
+	}
+
+	if annotations[types.AnnotationCredentialState] == status.state {
+		return
+	}
+	switch status.state {
+	case types.CredentialStateRotationDue:
+		m.recorder.Eventf(&device, v1.EventTypeWarning, CredentialsExpiringReason, "Credentials expire at %s",
+			expiry)
+	case types.CredentialStateExpired:
+		m.recorder.Eventf(&device, v1.EventTypeWarning, CredentialsExpiredReason, "Credentials expired: %s",
+			status.message)
+	case types.CredentialStateFailed:
+		m.recorder.Eventf(&device, v1.EventTypeWarning, FailedRotateReason, "Credential rotation failed: %s",
+			status.message)
+	}
+}
+
+func setAnnotation(annotations map[string]string, key, value string) {
+	if len(value) == 0 {
+		delete(annotations, key)
+		return
+	}
+	annotations[key] = value
+}
+
+// expiresBefore orders expirations, zero expiration never expires.
+func expiresBefore(a, b time.Time) bool {
+	if a.IsZero() {
+		return false
+	}
+	return b.IsZero() || a.Before(b)
+}
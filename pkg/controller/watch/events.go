@@ -0,0 +1,32 @@
+package watch
+
+// Reasons of events recorded by the watchers. Names follow the ones used by kubernetes controllers, so
+// IoT workloads can be filtered the same way as regular ones.
+const (
+	SuccessfulCreateReason  = "SuccessfulCreate"
+	FailedCreateReason      = "FailedCreate"
+	SuccessfulUpdateReason  = "SuccessfulUpdate"
+	FailedUpdateReason      = "FailedUpdate"
+	SuccessfulDeleteReason  = "SuccessfulDelete"
+	FailedDeleteReason      = "FailedDelete"
+	SuccessfulAdoptReason   = "SuccessfulAdopt"
+	SuccessfulReleaseReason = "SuccessfulRelease"
+
+	DeviceUnschedulableReason = "DeviceUnschedulable"
+	DevicePendingReason       = "DevicePending"
+	DeviceDeletedReason       = "DeviceDeleted"
+	PodEvictedReason          = "PodEvicted"
+	FailedEvictReason         = "FailedEvict"
+
+	AutoApprovedReason       = "AutoApproved"
+	CertificateIssuedReason  = "CertificateIssued"
+	CertificateInvalidReason = "CertificateInvalid"
+	DeviceNotFoundReason     = "DeviceNotFound"
+	FailedSignReason         = "FailedSign"
+
+	RotatedCredentialsReason  = "RotatedCredentials"
+	CredentialsExpiringReason = "CredentialsExpiring"
+	CredentialsExpiredReason  = "CredentialsExpired"
+	FailedRotateReason        = "FailedRotate"
+	FailedRevokeReason        = "FailedRevoke"
+)
@@ -0,0 +1,71 @@
+package watch
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// expectationsTimeout is the time after which unobserved creation is considered lost. In that case
+// IotPod will be created again during next IotDaemonSet sync.
+const expectationsTimeout = 5 * time.Minute
+
+// podExpectations tracks IotPods created by IotDaemonSet workers that are not visible in the informer
+// cache yet. Without it a sync running before the cache catches up would create duplicated IotPods.
+type podExpectations struct {
+	lock    sync.Mutex
+	pending map[string]time.Time
+}
+
+func newPodExpectations() *podExpectations {
+	return &podExpectations{pending: make(map[string]time.Time)}
+}
+
+// Expect records that IotPod for IotDaemonSet with given key is being created on a device.
+func (this *podExpectations) Expect(dsKey, device string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.pending[this.key(dsKey, device)] = time.Now()
+}
+
+// Observe removes expectation for IotPod created for IotDaemonSet on a device.
+func (this *podExpectations) Observe(dsKey, device string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.pending, this.key(dsKey, device))
+}
+
+// IsPending checks if IotPod for IotDaemonSet on a device was created but not observed yet.
+func (this *podExpectations) IsPending(dsKey, device string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := this.key(dsKey, device)
+	timestamp, ok := this.pending[key]
+	if !ok {
+		return false
+	}
+
+	if time.Since(timestamp) > expectationsTimeout {
+		delete(this.pending, key)
+		return false
+	}
+	return true
+}
+
+// Forget removes all expectations of IotDaemonSet with given key.
+func (this *podExpectations) Forget(dsKey string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	prefix := dsKey + "|"
+	for key := range this.pending {
+		if strings.HasPrefix(key, prefix) {
+			delete(this.pending, key)
+		}
+	}
+}
+
+func (this *podExpectations) key(dsKey, device string) string {
+	return dsKey + "|" + device
+}
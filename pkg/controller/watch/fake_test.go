@@ -0,0 +1,202 @@
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testNamespace = "default"
+	testIotPrefix = "/apis/fujitsu.com/v1/namespaces/" + testNamespace + "/"
+)
+
+// fakeApiserver stores objects by their path and records changing requests as "METHOD path". Requests of
+// paths in failures fail with internal error.
+type fakeApiserver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests []string
+	failures map[string]bool
+}
+
+func newFakeApiserver(t *testing.T) *fakeApiserver {
+	f := &fakeApiserver{objects: make(map[string][]byte), failures: make(map[string]bool)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeApiserver) Close() {
+	f.server.Close()
+}
+
+// add stores object at given path.
+func (f *fakeApiserver) add(t *testing.T, path string, obj interface{}) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = data
+}
+
+// get decodes object stored at given path into obj, it returns false if there's none.
+func (f *fakeApiserver) get(t *testing.T, path string, obj interface{}) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[path]
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, obj); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func (f *fakeApiserver) getRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func (f *fakeApiserver) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := req.URL.Path
+	if req.Method != http.MethodGet {
+		f.requests = append(f.requests, req.Method+" "+path)
+	}
+	if f.failures[path] {
+		writeFakeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		if data, ok := f.objects[path]; ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+		if strings.HasSuffix(path, "/secrets") {
+			f.serveList(w, path, "SecretList")
+			return
+		}
+	case http.MethodPut:
+		if _, ok := f.objects[path]; ok {
+			body, _ := ioutil.ReadAll(req.Body)
+			f.objects[path] = body
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+	case http.MethodDelete:
+		if _, ok := f.objects[path]; ok {
+			delete(f.objects, path)
+			writeFakeStatus(w, http.StatusOK, "")
+			return
+		}
+	}
+	writeFakeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+}
+
+// serveList writes all objects stored under the path as a list. Caller must hold the lock.
+func (f *fakeApiserver) serveList(w http.ResponseWriter, path, kind string) {
+	paths := make([]string, 0)
+	for objPath := range f.objects {
+		if strings.HasPrefix(objPath, path+"/") {
+			paths = append(paths, objPath)
+		}
+	}
+	sort.Strings(paths)
+
+	items := make([]json.RawMessage, 0, len(paths))
+	for _, objPath := range paths {
+		items = append(items, f.objects[objPath])
+	}
+	data, _ := json.Marshal(map[string]interface{}{"kind": kind, "apiVersion": "v1", "items": items})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func writeFakeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+		Code:     int32(code),
+		Reason:   reason,
+	}
+	if code >= http.StatusBadRequest {
+		status.Status = metav1.StatusFailure
+		status.Message = fmt.Sprintf("fake apiserver: %s", reason)
+	}
+	data, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (f *fakeApiserver) restClient() *rest.RESTClient {
+	return kubernetes.NewRESTClient(kubernetes.NewClientConfig(f.server.URL, "", "fujitsu.com"))
+}
+
+func (f *fakeApiserver) clientset() *kubeclient.Clientset {
+	return kubernetes.NewClientset(&rest.Config{Host: f.server.URL})
+}
+
+// newTestInformers creates informers which are never run, tests fill their caches with given objects.
+func newTestInformers(f *fakeApiserver, objs ...interface{}) *IotInformers {
+	informers := NewIotInformers(f.restClient(), 0)
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *types.IotDevice:
+			informers.Devices.GetIndexer().Add(obj)
+		case *types.IotDaemonSet:
+			informers.DaemonSets.GetIndexer().Add(obj)
+		case *types.IotPod:
+			informers.Pods.GetIndexer().Add(obj)
+		case *types.IotCertificateRequest:
+			informers.CertificateRequests.GetIndexer().Add(obj)
+		}
+	}
+	return informers
+}
+
+func newTestStore() *config.ControllerStore {
+	return config.NewControllerStore(config.NewControllerConfig())
+}
+
+func newTestRecorder() *record.FakeRecorder {
+	return record.NewFakeRecorder(100)
+}
+
+// newTestPod returns IotPod on the device, created by the daemon set unless it's empty.
+func newTestPod(name, device, daemonSet string) *types.IotPod {
+	pod := &types.IotPod{}
+	pod.Metadata.Name = name
+	pod.Metadata.Namespace = testNamespace
+	pod.Metadata.Labels = map[string]string{types.DeviceSelector: device}
+	if len(daemonSet) > 0 {
+		pod.Metadata.Labels[types.CreatedBy] = types.IotDaemonSetType + "." + daemonSet
+	}
+	return pod
+}
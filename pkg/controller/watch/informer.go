@@ -0,0 +1,409 @@
+package watch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/controller/metrics"
+	"github.com/fest-research/iot-addon/pkg/healthz"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// CreatedByIndex indexes IotPods by the IotDaemonSet that created them.
+	CreatedByIndex = "createdBy"
+
+	// ControllerIndex indexes IotPods by "namespace/name" of the IotDaemonSet set as their controller.
+	ControllerIndex = "controller"
+
+	// DeviceIndex indexes IotPods by the IotDevice they are scheduled on and IotDaemonSets by the
+	// IotDevice they select. Values have "namespace/deviceSelector" format. IotCertificateRequests are
+	// indexed by name of the requested device, they don't know namespace of the device.
+	DeviceIndex = "device"
+
+	// NameIndex indexes IotDevices by name, so devices can be found without knowing their namespace.
+	NameIndex = "name"
+)
+
+// IotInformers holds shared informers for all IoT resources. Watchers read from their local caches
+// instead of querying the kubernetes apiserver for every event.
+type IotInformers struct {
+	Devices    cache.SharedIndexInformer
+	DaemonSets cache.SharedIndexInformer
+	Pods       cache.SharedIndexInformer
+
+	CertificateRequests cache.SharedIndexInformer
+
+	activity map[string]*watchActivity
+}
+
+// watchActivity holds time of the last successful list, watch or watch event of a resource.
+type watchActivity struct {
+	mu   sync.RWMutex
+	last time.Time
+}
+
+func (this *watchActivity) touch() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.last = time.Now()
+}
+
+func (this *watchActivity) age() time.Duration {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return time.Since(this.last)
+}
+
+// NewIotInformers creates shared informers for IotDevices, IotDaemonSets, IotPods and IotCertificateRequests
+// from all namespaces. Resync period of 0 disables periodic resync.
+func NewIotInformers(restClient *rest.RESTClient, resyncPeriod time.Duration) *IotInformers {
+	activity := map[string]*watchActivity{
+		types.IotDeviceType:    {},
+		types.IotDaemonSetType: {},
+		types.IotPodType:       {},
+
+		types.IotCertificateRequestType: {},
+	}
+
+	informers := &IotInformers{
+		activity: activity,
+		Devices: cache.NewSharedIndexInformer(
+			newListWatch(restClient, types.IotDeviceType, activity[types.IotDeviceType]),
+			&types.IotDevice{},
+			resyncPeriod,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+				NameIndex:            deviceNameIndexFunc,
+			},
+		),
+		DaemonSets: cache.NewSharedIndexInformer(
+			newListWatch(restClient, types.IotDaemonSetType, activity[types.IotDaemonSetType]),
+			&types.IotDaemonSet{},
+			resyncPeriod,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+				DeviceIndex:          daemonSetDeviceIndexFunc,
+			},
+		),
+		Pods: cache.NewSharedIndexInformer(
+			newListWatch(restClient, types.IotPodType, activity[types.IotPodType]),
+			&types.IotPod{},
+			resyncPeriod,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+				CreatedByIndex:       podCreatedByIndexFunc,
+				ControllerIndex:      podControllerIndexFunc,
+				DeviceIndex:          podDeviceIndexFunc,
+			},
+		),
+		CertificateRequests: cache.NewSharedIndexInformer(
+			newListWatch(restClient, types.IotCertificateRequestType, activity[types.IotCertificateRequestType]),
+			&types.IotCertificateRequest{},
+			resyncPeriod,
+			cache.Indexers{
+				cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+				DeviceIndex:          certificateRequestDeviceIndexFunc,
+			},
+		),
+	}
+
+	informers.trackEvents(informers.Devices, activity[types.IotDeviceType])
+	informers.trackEvents(informers.DaemonSets, activity[types.IotDaemonSetType])
+	informers.trackEvents(informers.Pods, activity[types.IotPodType])
+	informers.trackEvents(informers.CertificateRequests, activity[types.IotCertificateRequestType])
+	return informers
+}
+
+func (this *IotInformers) trackEvents(informer cache.SharedIndexInformer, activity *watchActivity) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { activity.touch() },
+		UpdateFunc: func(interface{}, interface{}) { activity.touch() },
+		DeleteFunc: func(interface{}) { activity.touch() },
+	})
+}
+
+// Run starts all informers. It blocks until stop channel is closed.
+func (this *IotInformers) Run(stopCh <-chan struct{}) {
+	go this.Devices.Run(stopCh)
+	go this.DaemonSets.Run(stopCh)
+	go this.Pods.Run(stopCh)
+	go this.CertificateRequests.Run(stopCh)
+	<-stopCh
+}
+
+// HasSynced returns true once all informers have completed their initial list.
+func (this *IotInformers) HasSynced() bool {
+	return this.Devices.HasSynced() && this.DaemonSets.HasSynced() && this.Pods.HasSynced() &&
+		this.CertificateRequests.HasSynced()
+}
+
+// SyncedCheck reports informers that have not completed their initial list yet.
+func (this *IotInformers) SyncedCheck() healthz.Checker {
+	return healthz.NamedCheck("informers-synced", func() error {
+		if !this.HasSynced() {
+			return fmt.Errorf("informer caches are not synced")
+		}
+		return nil
+	})
+}
+
+// WatchChecks returns one check per resource failing when there was no successful list, watch or watch
+// event for longer than maxAge. Reflectors restart idle watches every 5 to 10 minutes, so maxAge has to
+// be longer than that.
+func (this *IotInformers) WatchChecks(maxAge time.Duration) []healthz.Checker {
+	checks := make([]healthz.Checker, 0, len(this.activity))
+	for _, resource := range []string{types.IotDeviceType, types.IotDaemonSetType, types.IotPodType,
+		types.IotCertificateRequestType} {
+		activity := this.activity[resource]
+		checks = append(checks, healthz.NamedCheck("watch-"+resource, func() error {
+			if age := activity.age(); age > maxAge {
+				return fmt.Errorf("last watch activity %s ago", age.String())
+			}
+			return nil
+		}))
+	}
+	return checks
+}
+
+// GetDevice returns IotDevice with given name and namespace from the cache.
+func (this *IotInformers) GetDevice(namespace, name string) (*types.IotDevice, bool, error) {
+	obj, exists, err := this.Devices.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+	return obj.(*types.IotDevice), true, nil
+}
+
+// GetDevicesByName returns cached IotDevices with given name from all namespaces.
+func (this *IotInformers) GetDevicesByName(name string) ([]types.IotDevice, error) {
+	objs, err := this.Devices.GetIndexer().ByIndex(NameIndex, name)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]types.IotDevice, 0, len(objs))
+	for _, obj := range objs {
+		devices = append(devices, *obj.(*types.IotDevice))
+	}
+	return devices, nil
+}
+
+// GetDeviceCertificateRequests returns cached IotCertificateRequests for the device with given name.
+func (this *IotInformers) GetDeviceCertificateRequests(name string) ([]types.IotCertificateRequest, error) {
+	objs, err := this.CertificateRequests.GetIndexer().ByIndex(DeviceIndex, name)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]types.IotCertificateRequest, 0, len(objs))
+	for _, obj := range objs {
+		requests = append(requests, *obj.(*types.IotCertificateRequest))
+	}
+	return requests, nil
+}
+
+// GetDaemonSet returns IotDaemonSet with given name and namespace from the cache.
+func (this *IotInformers) GetDaemonSet(namespace, name string) (*types.IotDaemonSet, bool, error) {
+	obj, exists, err := this.DaemonSets.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil, exists, err
+	}
+	return obj.(*types.IotDaemonSet), true, nil
+}
+
+// ListDevices returns all cached IotDevices from given namespace.
+func (this *IotInformers) ListDevices(namespace string) ([]types.IotDevice, error) {
+	objs, err := this.Devices.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]types.IotDevice, 0, len(objs))
+	for _, obj := range objs {
+		devices = append(devices, *obj.(*types.IotDevice))
+	}
+	return devices, nil
+}
+
+// GetDaemonSetDevices returns cached IotDevices selected by IotDaemonSet deviceSelector label
+// (IotDevice name or 'all').
+func (this *IotInformers) GetDaemonSetDevices(ds types.IotDaemonSet) ([]types.IotDevice, error) {
+	deviceSelector := ds.Metadata.Labels[types.DeviceSelector]
+	if deviceSelector == types.DevicesAll {
+		return this.ListDevices(ds.Metadata.Namespace)
+	}
+
+	device, exists, err := this.GetDevice(ds.Metadata.Namespace, deviceSelector)
+	if err != nil || !exists {
+		return []types.IotDevice{}, err
+	}
+	return []types.IotDevice{*device}, nil
+}
+
+// GetDaemonSetPods returns cached IotPods created by IotDaemonSet.
+func (this *IotInformers) GetDaemonSetPods(ds types.IotDaemonSet) ([]types.IotPod, error) {
+	return this.listPodsByIndex(CreatedByIndex,
+		ds.Metadata.Namespace+"/"+types.IotDaemonSetType+"."+ds.Metadata.Name)
+}
+
+// GetControlledPods returns cached IotPods controlled by IotDaemonSet with given name. Pods controlled by
+// deleted IotDaemonSets with the same name are returned too, so callers have to compare UIDs.
+func (this *IotInformers) GetControlledPods(namespace, name string) ([]types.IotPod, error) {
+	return this.listPodsByIndex(ControllerIndex, namespace+"/"+name)
+}
+
+// GetDevicePods returns cached IotPods scheduled on IotDevice.
+func (this *IotInformers) GetDevicePods(device types.IotDevice) ([]types.IotPod, error) {
+	return this.listPodsByIndex(DeviceIndex, device.Metadata.Namespace+"/"+device.Metadata.Name)
+}
+
+// GetDeviceDaemonSets returns cached IotDaemonSets that select IotDevice either by its name or with 'all'.
+func (this *IotInformers) GetDeviceDaemonSets(device types.IotDevice) ([]types.IotDaemonSet, error) {
+	result := make([]types.IotDaemonSet, 0)
+	for _, selector := range []string{device.Metadata.Name, types.DevicesAll} {
+		objs, err := this.DaemonSets.GetIndexer().ByIndex(DeviceIndex, device.Metadata.Namespace+"/"+selector)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			result = append(result, *obj.(*types.IotDaemonSet))
+		}
+	}
+	return result, nil
+}
+
+func (this *IotInformers) listPodsByIndex(indexName, indexKey string) ([]types.IotPod, error) {
+	objs, err := this.Pods.GetIndexer().ByIndex(indexName, indexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make([]types.IotPod, 0, len(objs))
+	for _, obj := range objs {
+		pods = append(pods, *obj.(*types.IotPod))
+	}
+	return pods, nil
+}
+
+// newListWatch creates list and watch functions for IoT resource from all namespaces. Default
+// metav1.ParameterCodec does not know IoT group version, so api.ParameterCodec is used instead. Every
+// watch except the first one is counted as restarted, reflectors only rewatch when the previous watch ended.
+func newListWatch(restClient *rest.RESTClient, resource string, activity *watchActivity) *cache.ListWatch {
+	started := false
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list, err := restClient.Get().
+				Namespace(api.NamespaceAll).
+				Resource(resource).
+				VersionedParams(&options, api.ParameterCodec).
+				Do().
+				Get()
+			if err == nil {
+				activity.touch()
+			}
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			if started {
+				metrics.WatchRestarted(resource)
+			}
+			started = true
+
+			watcher, err := restClient.Get().
+				Prefix("watch").
+				Namespace(api.NamespaceAll).
+				Resource(resource).
+				VersionedParams(&options, api.ParameterCodec).
+				Watch()
+			if err == nil {
+				activity.touch()
+			}
+			return watcher, err
+		},
+	}
+}
+
+func deviceNameIndexFunc(obj interface{}) ([]string, error) {
+	device, ok := obj.(*types.IotDevice)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotDeviceKind, obj)
+	}
+	return []string{device.Metadata.Name}, nil
+}
+
+func certificateRequestDeviceIndexFunc(obj interface{}) ([]string, error) {
+	request, ok := obj.(*types.IotCertificateRequest)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotCertificateRequestKind, obj)
+	}
+
+	// Invalid requests are denied by the watcher, they don't belong to any device
+	_, device, err := certificates.ParseDeviceRequest(request.Spec.Request)
+	if err != nil {
+		return []string{}, nil
+	}
+	return []string{device}, nil
+}
+
+func podCreatedByIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*types.IotPod)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotPodKind, obj)
+	}
+
+	createdBy, ok := pod.Metadata.Labels[types.CreatedBy]
+	if !ok {
+		return []string{}, nil
+	}
+	return []string{pod.Metadata.Namespace + "/" + createdBy}, nil
+}
+
+func podControllerIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*types.IotPod)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotPodKind, obj)
+	}
+
+	ref := kubernetes.GetControllerOf(*pod)
+	if ref == nil || ref.Kind != types.IotDaemonSetKind {
+		return []string{}, nil
+	}
+	return []string{pod.Metadata.Namespace + "/" + ref.Name}, nil
+}
+
+func podDeviceIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*types.IotPod)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotPodKind, obj)
+	}
+
+	deviceSelector, ok := pod.Metadata.Labels[types.DeviceSelector]
+	if !ok {
+		return []string{}, nil
+	}
+	return []string{pod.Metadata.Namespace + "/" + deviceSelector}, nil
+}
+
+func daemonSetDeviceIndexFunc(obj interface{}) ([]string, error) {
+	ds, ok := obj.(*types.IotDaemonSet)
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %T", types.IotDaemonSetKind, obj)
+	}
+
+	deviceSelector, ok := ds.Metadata.Labels[types.DeviceSelector]
+	if !ok {
+		return []string{}, nil
+	}
+	return []string{ds.Metadata.Namespace + "/" + deviceSelector}, nil
+}
@@ -0,0 +1,193 @@
+package watch
+
+import (
+	"fmt"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	certificatesapi "k8s.io/client-go/pkg/apis/certificates/v1beta1"
+	"k8s.io/client-go/pkg/util/workqueue"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// IotCertificateRequestWatcher approves certificate requests of devices by policy and signs approved ones
+// with the IoT CA. Only requests for pre-created IotDevices are approved, requests for unknown devices are
+// denied and requests for devices waiting for approval are never approved automatically. Requests that don't match the policy wait for an administrator to add Approved condition.
+type IotCertificateRequestWatcher struct {
+	restClient *rest.RESTClient
+	informers  *IotInformers
+	signer     *certificates.Signer
+	recorder   record.EventRecorder
+	store      *config.ControllerStore
+	queue      workqueue.RateLimitingInterface
+}
+
+// NewIotCertificateRequestWatcher creates the watcher. Approved requests are not signed when signer is nil.
+func NewIotCertificateRequestWatcher(restClient *rest.RESTClient, informers *IotInformers,
+	signer *certificates.Signer, recorder record.EventRecorder,
+	store *config.ControllerStore) *IotCertificateRequestWatcher {
+	w := &IotCertificateRequestWatcher{
+		restClient: restClient,
+		informers:  informers,
+		signer:     signer,
+		recorder:   recorder,
+		store:      store,
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(),
+			types.IotCertificateRequestType),
+	}
+
+	informers.CertificateRequests.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			enqueue(w.queue, obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			enqueue(w.queue, cur)
+		},
+	})
+
+	return w
+}
+
+// Watch waits for informer caches to sync and starts a worker processing queued requests. It blocks until
+// stop channel is closed and the in-flight sync is finished.
+func (w *IotCertificateRequestWatcher) Watch(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer w.queue.ShutDown()
+
+	logging.Infof("Starting %s watcher", types.IotCertificateRequestType)
+	if w.signer == nil {
+		logging.Warningf("IoT CA is not configured, approved certificate requests are not signed")
+	}
+	if !cache.WaitForCacheSync(stopCh, w.informers.HasSynced) {
+		return
+	}
+
+	runWorkers(w.queue, 1, w.worker, stopCh)
+	logging.Infof("Shut down %s watcher", types.IotCertificateRequestType)
+}
+
+func (w *IotCertificateRequestWatcher) worker() {
+	for processNextWorkItem(w.queue, types.IotCertificateRequestKind, w.syncRequest) {
+	}
+}
+
+func (w *IotCertificateRequestWatcher) syncRequest(key string) error {
+	obj, exists, err := w.informers.CertificateRequests.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+
+	// Objects from the cache must not be modified, the request is copied with its conditions
+	request := *obj.(*types.IotCertificateRequest)
+	request.Status.Conditions = append([]certificatesapi.CertificateSigningRequestCondition{},
+		request.Status.Conditions...)
+
+	settings := w.store.Get().Certificates
+	if request.Metadata.Namespace != settings.Namespace || len(request.Status.Certificate) > 0 {
+		return nil
+	}
+
+	approved, denied := certificates.GetConditions(request.Status)
+	if denied {
+		return nil
+	}
+
+	_, device, err := certificates.ParseDeviceRequest(request.Spec.Request)
+	if err != nil {
+		return w.deny(request, CertificateInvalidReason, err.Error())
+	}
+
+	devices, err := w.informers.GetDevicesByName(device)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return w.deny(request, DeviceNotFoundReason, fmt.Sprintf("%s %s does not exist", types.IotDeviceKind,
+			device))
+	}
+
+	if !approved {
+		if !settings.AutoApprove || !certificates.IsAutoApprovable(request.Spec, device) || anyPending(devices) {
+			logging.WithFields(logging.Fields{"device": device}).Infof("%s %s of %s waits for approval",
+				types.IotCertificateRequestKind, request.Metadata.Name, request.Spec.Username)
+			return nil
+		}
+		return w.approve(request, device)
+	}
+
+	if w.signer == nil {
+		return nil
+	}
+	return w.sign(request, device, settings)
+}
+
+// anyPending returns true if any of the devices waits for approval, their requests are approved manually.
+func anyPending(devices []types.IotDevice) bool {
+	for _, device := range devices {
+		if kubernetes.IsDevicePending(device) {
+			return true
+		}
+	}
+	return false
+}
+
+// approve adds Approved condition, the update triggers signing.
+func (w *IotCertificateRequestWatcher) approve(request types.IotCertificateRequest, device string) error {
+	request.Status.Conditions = append(request.Status.Conditions, certificatesapi.CertificateSigningRequestCondition{
+		Type:           certificatesapi.CertificateApproved,
+		Reason:         AutoApprovedReason,
+		Message:        "Auto approved certificate of device " + device,
+		LastUpdateTime: metav1.Now(),
+	})
+	if err := kubernetes.UpdateCertificateRequest(w.restClient, request); err != nil {
+		return err
+	}
+
+	w.recorder.Eventf(&request, v1.EventTypeNormal, AutoApprovedReason, "Auto approved certificate of device %s",
+		device)
+	return nil
+}
+
+func (w *IotCertificateRequestWatcher) deny(request types.IotCertificateRequest, reason, message string) error {
+	request.Status.Conditions = append(request.Status.Conditions, certificatesapi.CertificateSigningRequestCondition{
+		Type:           certificatesapi.CertificateDenied,
+		Reason:         reason,
+		Message:        message,
+		LastUpdateTime: metav1.Now(),
+	})
+	if err := kubernetes.UpdateCertificateRequest(w.restClient, request); err != nil {
+		return err
+	}
+
+	w.recorder.Eventf(&request, v1.EventTypeWarning, reason, "Denied certificate request: %s", message)
+	return nil
+}
+
+func (w *IotCertificateRequestWatcher) sign(request types.IotCertificateRequest, device string,
+	settings config.CertificatesConfig) error {
+	certificate, err := w.signer.Sign(request.Spec.Request, settings.Duration.Duration)
+	if err != nil {
+		w.recorder.Eventf(&request, v1.EventTypeWarning, FailedSignReason, "Error signing certificate: %s",
+			err.Error())
+		return err
+	}
+
+	request.Status.Certificate = certificate
+	if err := kubernetes.UpdateCertificateRequest(w.restClient, request); err != nil {
+		return err
+	}
+
+	logging.WithFields(logging.Fields{"device": device}).Infof("Issued certificate for %s %s",
+		types.IotCertificateRequestKind, request.Metadata.Name)
+	w.recorder.Eventf(&request, v1.EventTypeNormal, CertificateIssuedReason, "Issued certificate of device %s",
+		device)
+	return nil
+}
@@ -1,141 +1,387 @@
 package watch
 
 import (
-	"fmt"
-	"log"
+	"strings"
 
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/controller/metrics"
 	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/dynamic"
-	client "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/workqueue"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
+// IotDaemonSetWatcher keeps IotPods of every IotDaemonSet in sync with its template and selected IotDevices.
+// It is the only watcher that creates IotPods, other watchers enqueue affected IotDaemonSets instead.
 type IotDaemonSetWatcher struct {
-	dynamicClient *dynamic.Client
-	restClient    *rest.RESTClient
-	clientset     *client.Clientset
-	iotDomain     string
+	restClient   *rest.RESTClient
+	informers    *IotInformers
+	recorder     record.EventRecorder
+	queue        workqueue.RateLimitingInterface
+	expectations *podExpectations
 }
 
-func NewIotDaemonSetWatcher(dynamicClient *dynamic.Client, restClient *rest.RESTClient, clientset *client.Clientset,
-	iotDomain string) IotDaemonSetWatcher {
-	return IotDaemonSetWatcher{
-		dynamicClient: dynamicClient,
-		restClient:    restClient,
-		clientset:     clientset,
-		iotDomain:     iotDomain,
+func NewIotDaemonSetWatcher(restClient *rest.RESTClient, informers *IotInformers,
+	recorder record.EventRecorder) *IotDaemonSetWatcher {
+	w := &IotDaemonSetWatcher{
+		restClient:   restClient,
+		informers:    informers,
+		recorder:     recorder,
+		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), types.IotDaemonSetType),
+		expectations: newPodExpectations(),
 	}
+
+	informers.DaemonSets.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			enqueue(w.queue, obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			enqueue(w.queue, cur)
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueue(w.queue, obj)
+		},
+	})
+
+	return w
 }
 
-// WatchIotDaemonSet watches for IotDaemonSet events and handles them.
-func (w IotDaemonSetWatcher) Watch() {
-	for {
-		err := w.start()
-		if err != nil {
-			log.Printf("An error occured: %s", err.Error())
-		}
+// Watch waits for informer caches to sync and starts workers processing queued IotDaemonSets. It blocks
+// until stop channel is closed and in-flight syncs are finished.
+func (w *IotDaemonSetWatcher) Watch(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer w.queue.ShutDown()
+
+	logging.Infof("Starting %s watcher", types.IotDaemonSetType)
+	if !cache.WaitForCacheSync(stopCh, w.informers.HasSynced) {
+		return
 	}
+
+	runWorkers(w.queue, workers, w.worker, stopCh)
+	logging.Infof("Shut down %s watcher", types.IotDaemonSetType)
 }
 
-func (w IotDaemonSetWatcher) start() error {
-	watcher, err := w.dynamicClient.Resource(&metav1.APIResource{
-		Name:       types.IotDaemonSetType,
-		Namespaced: true,
-	}, api.NamespaceAll).Watch(&metav1.ListOptions{})
+// EnqueueKey adds IotDaemonSet with "namespace/name" key to the queue.
+func (w *IotDaemonSetWatcher) EnqueueKey(key string) {
+	w.queue.Add(key)
+}
+
+// ObservePod marks creation of IotPod as observed, so next syncs of its IotDaemonSet will see it in the cache.
+func (w *IotDaemonSetWatcher) ObservePod(pod types.IotPod) {
+	if key, ok := getPodDaemonSetKey(pod); ok {
+		w.expectations.Observe(key, pod.Metadata.Labels[types.DeviceSelector])
+	}
+}
 
+func (w *IotDaemonSetWatcher) worker() {
+	for processNextWorkItem(w.queue, types.IotDaemonSetKind, w.syncDaemonSet) {
+	}
+}
+
+func (w *IotDaemonSetWatcher) syncDaemonSet(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	ds, exists, err := w.informers.GetDaemonSet(namespace, name)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Watcher for %s created \n", types.IotDaemonSetType)
+	if !exists {
+		return w.handleDaemonSetDeletion(key, types.IotDaemonSet{
+			Metadata: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		})
+	}
+
+	return w.handleDaemonSetSync(key, *ds)
+}
 
-	defer watcher.Stop()
+// handleDaemonSetSync reschedules IotPods of IotDaemonSet. It deletes IotPods from devices that are not
+// selected or schedulable anymore together with duplicated IotPods, updates specs of existing IotPods
+// and creates IotPods on selected devices that don't have them yet. Every correction is logged.
+func (w *IotDaemonSetWatcher) handleDaemonSetSync(key string, ds types.IotDaemonSet) error {
+	if ds.Metadata.DeletionTimestamp != nil {
+		return w.handleDaemonSetFinalization(key, ds)
+	}
 
-	for {
-		e, ok := <-watcher.ResultChan()
+	// Getting all existing IotPods controlled by IotDaemonSet.
+	existingPods, err := w.claimPods(key, ds)
+	if err != nil {
+		return err
+	}
 
-		if !ok {
-			return fmt.Errorf("%s watch ended due to a timeout", types.IotDaemonSetType)
+	// Getting list of IotDevices where IotDaemonSet should be deployed. IotDevices being deleted are
+	// skipped, their IotPods are removed by IotDeviceWatcher.
+	selectedDevices, err := w.informers.GetDaemonSetDevices(ds)
+	if err != nil {
+		return err
+	}
+
+	destinedDevices := make([]types.IotDevice, 0, len(selectedDevices))
+	for _, device := range selectedDevices {
+		if device.Metadata.DeletionTimestamp == nil {
+			destinedDevices = append(destinedDevices, device)
+		}
+	}
+
+	schedulableDevices := make(map[string]bool)
+	for _, device := range destinedDevices {
+		if kubernetes.IsDeviceSchedulable(device) {
+			schedulableDevices[device.Metadata.Name] = true
+		}
+	}
+
+	errs := make([]error, 0)
+	scheduledDevices := make(map[string]bool)
+
+	// Updating and deleting existing IotPods.
+	for _, existingPod := range existingPods {
+		device := existingPod.Metadata.Labels[types.DeviceSelector]
+
+		reason := ""
+		if !kubernetes.IsPodCorrectlyScheduled(ds, existingPod) || !schedulableDevices[device] {
+			reason = "device " + device + " is not selected or not schedulable"
+		} else if scheduledDevices[device] {
+			reason = "device " + device + " already runs another IotPod of the same " + types.IotDaemonSetKind
+		}
+
+		if len(reason) > 0 {
+			if err := w.deletePod(key, &ds, existingPod, reason); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		scheduledDevices[device] = true
+		if !kubernetes.IsPodUpToDate(ds, existingPod) {
+			logging.Infof("Updating %s %s of %s %s: pod template changed", types.IotPodKind,
+				existingPod.Metadata.Name, types.IotDaemonSetKind, key)
+			err := kubernetes.UpdatePod(w.restClient, existingPod, ds.Spec.Template)
+			metrics.ObservePodOperation(metrics.OperationUpdate, err)
+			if err != nil {
+				w.recorder.Eventf(&ds, v1.EventTypeWarning, FailedUpdateReason, "Error updating pod %s: %s",
+					existingPod.Metadata.Name, err.Error())
+				errs = append(errs, err)
+			} else {
+				w.recorder.Eventf(&ds, v1.EventTypeNormal, SuccessfulUpdateReason, "Updated pod: %s",
+					existingPod.Metadata.Name)
+			}
 		}
+	}
 
-		ds, _ := e.Object.(*types.IotDaemonSet)
+	// Add missing IotPods unless their creation is still on the way to the cache.
+	for _, device := range kubernetes.GetDevicesMissingPods(destinedDevices, existingPods) {
+		if w.expectations.IsPending(key, device.Metadata.Name) {
+			continue
+		}
 
-		if e.Type == watch.Added {
-			w.handleDaemonSetAddition(*ds)
-		} else if e.Type == watch.Modified {
-			w.handleDaemonSetModification(*ds)
-		} else if e.Type == watch.Deleted {
-			w.handleDaemonSetDeletion(*ds)
-		} else if e.Type == watch.Error {
-			return fmt.Errorf("%s watch ended due to an error", types.IotDaemonSetType)
+		logging.Infof("Creating %s of %s %s on device %s: pod is missing", types.IotPodKind, types.IotDaemonSetKind,
+			key, device.Metadata.Name)
+		w.expectations.Expect(key, device.Metadata.Name)
+		err := kubernetes.CreateDaemonSetPod(ds, device, w.restClient)
+		metrics.ObservePodOperation(metrics.OperationCreate, err)
+		if err != nil {
+			w.expectations.Observe(key, device.Metadata.Name)
+			w.recorder.Eventf(&ds, v1.EventTypeWarning, FailedCreateReason, "Error creating pod on device %s: %s",
+				device.Metadata.Name, err.Error())
+			errs = append(errs, err)
+		} else {
+			w.recorder.Eventf(&ds, v1.EventTypeNormal, SuccessfulCreateReason, "Created pod on device %s",
+				device.Metadata.Name)
 		}
 	}
+
+	return utilerrors.NewAggregate(errs)
 }
 
-// handleDaemonSetAddition handles new IotDaemonSet addition event. It creates IotPods for added IotDaemonSet if they
-// don't exist yet.
-func (w IotDaemonSetWatcher) handleDaemonSetAddition(ds types.IotDaemonSet) {
-	log.Printf("Added new %s %s", types.IotDaemonSetKind, ds.Metadata.SelfLink)
+// claimPods returns IotPods controlled by IotDaemonSet. IotPods matching its createdBy label without a
+// controller are adopted, controlled IotPods that don't match it anymore are released and IotPods left
+// behind by a deleted IotDaemonSet with the same name are deleted.
+func (w *IotDaemonSetWatcher) claimPods(key string, ds types.IotDaemonSet) ([]types.IotPod, error) {
+	labeledPods, err := w.informers.GetDaemonSetPods(ds)
+	if err != nil {
+		return nil, err
+	}
 
-	// Getting list of IotDaemonSet selected IotDevices.
-	devices, err := kubernetes.GetDaemonSetDevices(ds, w.dynamicClient, w.restClient)
+	controlledPods, err := w.informers.GetControlledPods(ds.Metadata.Namespace, ds.Metadata.Name)
 	if err != nil {
-		log.Printf("Cannot get %s %s devices", types.IotDaemonSetKind, ds.Metadata.SelfLink)
+		return nil, err
 	}
 
-	// Creating IotPods on selected IotDevices if they don't exist yet.
-	for _, device := range devices {
+	createdBy := types.IotDaemonSetType + "." + ds.Metadata.Name
+	seen := make(map[string]bool)
+	claimed := make([]types.IotPod, 0)
+	errs := make([]error, 0)
 
-		unschedulable := kubernetes.GetUnschedulableLabelFromDevice(device)
-		if !kubernetes.IsPodCreated(w.restClient, ds, device) && !unschedulable {
-			kubernetes.CreateDaemonSetPod(ds, device, w.restClient)
+	for _, pod := range append(labeledPods, controlledPods...) {
+		if seen[pod.Metadata.Name] {
+			continue
+		}
+		seen[pod.Metadata.Name] = true
+
+		matches := pod.Metadata.Labels[types.CreatedBy] == createdBy
+		ref := kubernetes.GetControllerOf(pod)
+
+		switch {
+		case ref == nil:
+			logging.Infof("Adopting %s %s by %s %s: pod has no controller", types.IotPodKind, pod.Metadata.Name,
+				types.IotDaemonSetKind, key)
+			if err := kubernetes.AdoptPod(w.restClient, pod, ds); err != nil {
+				if !errors.IsNotFound(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			w.recorder.Eventf(&ds, v1.EventTypeNormal, SuccessfulAdoptReason, "Adopted pod: %s", pod.Metadata.Name)
+			claimed = append(claimed, pod)
+		case ref.Kind != types.IotDaemonSetKind || ref.Name != ds.Metadata.Name:
+			// Controlled by another object, labels are not enough to take it over.
+		case ref.UID != ds.Metadata.UID:
+			if err := w.deletePod(key, &ds, pod, "owner with UID "+string(ref.UID)+" does not exist"); err != nil {
+				errs = append(errs, err)
+			}
+		case !matches:
+			logging.Infof("Releasing %s %s of %s %s: pod labels do not match", types.IotPodKind, pod.Metadata.Name,
+				types.IotDaemonSetKind, key)
+			if err := kubernetes.ReleasePod(w.restClient, pod, ds.Metadata.UID); err != nil {
+				if !errors.IsNotFound(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			w.recorder.Eventf(&ds, v1.EventTypeNormal, SuccessfulReleaseReason, "Released pod: %s",
+				pod.Metadata.Name)
+		default:
+			claimed = append(claimed, pod)
 		}
 	}
+
+	return claimed, utilerrors.NewAggregate(errs)
 }
 
-// handleDaemonSetModification handles IotDaemonSet modification event. It reschedules IotPods for modified IotDaemonSet
-// and updates their specs.
-func (w IotDaemonSetWatcher) handleDaemonSetModification(ds types.IotDaemonSet) {
-	log.Printf("Modified new %s %s", types.IotDaemonSetKind, ds.Metadata.SelfLink)
+// handleDaemonSetFinalization handles IotDaemonSet deleted with orphan or foreground propagation. Its
+// IotPods are released or deleted first and the finalizer is removed afterwards, so the apiserver can
+// remove the IotDaemonSet. Background deletion doesn't set any finalizer and is handled by
+// handleDaemonSetDeletion once the IotDaemonSet is gone.
+func (w *IotDaemonSetWatcher) handleDaemonSetFinalization(key string, ds types.IotDaemonSet) error {
+	w.expectations.Forget(key)
 
-	// Making sure, that IotDaemonSet is deployed on currently selected IotDevices.
-	// Getting all existing IotPods created by IotDaemonSet.
-	existingPods, err := kubernetes.GetDaemonSetPods(w.restClient, ds)
+	controlledPods, err := w.informers.GetControlledPods(ds.Metadata.Namespace, ds.Metadata.Name)
 	if err != nil {
-		log.Printf("Cannot get %s %s pods", types.IotDaemonSetKind, ds.Metadata.SelfLink)
-		return
+		return err
 	}
 
-	// Getting list of IotDevices where IotDaemonSet should be deployed.
-	destinedDevices, err := kubernetes.GetDaemonSetDevices(ds, w.dynamicClient, w.restClient)
+	pods := make([]types.IotPod, 0, len(controlledPods))
+	for _, pod := range controlledPods {
+		if ref := kubernetes.GetControllerOf(pod); ref != nil && ref.UID == ds.Metadata.UID {
+			pods = append(pods, pod)
+		}
+	}
 
-	// Updating and deleting existing IotPods.
-	for _, existingPod := range existingPods {
-		if !kubernetes.IsPodCorrectlyScheduled(ds, existingPod) {
-			kubernetes.DeletePod(w.restClient, existingPod)
-		} else {
-			err = kubernetes.UpdatePod(w.restClient, existingPod, ds.Spec.Template)
-			if err != nil {
-				log.Printf("Error. Can not update IotPod %s", existingPod.Metadata.Name)
+	if kubernetes.HasDaemonSetFinalizer(ds, types.FinalizerOrphan) {
+		errs := make([]error, 0)
+		for _, pod := range pods {
+			logging.Infof("Releasing %s %s of %s %s: daemon set is deleted with orphaned dependents",
+				types.IotPodKind, pod.Metadata.Name, types.IotDaemonSetKind, key)
+			if err := kubernetes.ReleasePod(w.restClient, pod, ds.Metadata.UID); err != nil &&
+				!errors.IsNotFound(err) {
+				errs = append(errs, err)
 			}
 		}
+		if len(errs) > 0 {
+			return utilerrors.NewAggregate(errs)
+		}
+
+		return kubernetes.RemoveDaemonSetFinalizer(w.restClient, ds, types.FinalizerOrphan)
 	}
 
-	// Add missing IotPods.
-	for _, devicesMissingPod := range kubernetes.GetDevicesMissingPods(destinedDevices, existingPods) {
-		kubernetes.CreateDaemonSetPod(ds, devicesMissingPod, w.restClient)
+	if kubernetes.HasDaemonSetFinalizer(ds, types.FinalizerDeleteDependents) {
+		if len(pods) == 0 {
+			return kubernetes.RemoveDaemonSetFinalizer(w.restClient, ds, types.FinalizerDeleteDependents)
+		}
+
+		// Finalizer is removed by the sync triggered by deletion of the last IotPod.
+		errs := make([]error, 0)
+		for _, pod := range pods {
+			if err := w.deletePod(key, &ds, pod, "daemon set is deleted in foreground"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return utilerrors.NewAggregate(errs)
 	}
+
+	return nil
+}
+
+// handleDaemonSetDeletion removes all IotPods controlled by deleted IotDaemonSet. Released IotPods don't
+// have a controller anymore, so they are kept.
+func (w *IotDaemonSetWatcher) handleDaemonSetDeletion(key string, ds types.IotDaemonSet) error {
+	w.expectations.Forget(key)
+
+	pods, err := w.informers.GetControlledPods(ds.Metadata.Namespace, ds.Metadata.Name)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, pod := range pods {
+		if err := w.deletePod(key, nil, pod, "daemon set does not exist"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// deletePod deletes IotPod of IotDaemonSet and records the result as an event of the IotDaemonSet. Deleted
+// IotDaemonSets can't be referenced by events, so only the log is written when ds is nil.
+func (w *IotDaemonSetWatcher) deletePod(key string, ds *types.IotDaemonSet, pod types.IotPod, reason string) error {
+	logging.Infof("Deleting %s %s of %s %s: %s", types.IotPodKind, pod.Metadata.Name, types.IotDaemonSetKind, key,
+		reason)
+
+	err := kubernetes.DeletePod(w.restClient, pod)
+	if err != nil && !errors.IsNotFound(err) {
+		metrics.ObservePodOperation(metrics.OperationDelete, err)
+		if ds != nil {
+			w.recorder.Eventf(ds, v1.EventTypeWarning, FailedDeleteReason, "Error deleting pod %s: %s",
+				pod.Metadata.Name, err.Error())
+		}
+		return err
+	}
+
+	metrics.ObservePodOperation(metrics.OperationDelete, nil)
+	if ds != nil {
+		w.recorder.Eventf(ds, v1.EventTypeNormal, SuccessfulDeleteReason, "Deleted pod %s: %s", pod.Metadata.Name,
+			reason)
+	}
+	return nil
+}
+
+// getPodControllerKey returns "namespace/name" key of IotDaemonSet set as controller of IotPod.
+func getPodControllerKey(pod types.IotPod) (string, bool) {
+	ref := kubernetes.GetControllerOf(pod)
+	if ref == nil || ref.Kind != types.IotDaemonSetKind {
+		return "", false
+	}
+
+	return pod.Metadata.Namespace + "/" + ref.Name, true
 }
 
-// handleDaemonSetModification handles IotDaemonSet deletion event. It removes all IotPods created by deleted
-// IotDaemonSet.
-func (w IotDaemonSetWatcher) handleDaemonSetDeletion(ds types.IotDaemonSet) {
-	log.Printf("Deleted %s %s", types.IotDaemonSetKind, ds.Metadata.SelfLink)
+// getPodDaemonSetKey returns "namespace/name" key of IotDaemonSet that created IotPod.
+func getPodDaemonSetKey(pod types.IotPod) (string, bool) {
+	createdBy, ok := pod.Metadata.Labels[types.CreatedBy]
+	if !ok || !strings.HasPrefix(createdBy, types.IotDaemonSetType+".") {
+		return "", false
+	}
 
-	// Deleting IotPods created by IotDaemonSet.
-	kubernetes.DeleteDaemonSetPods(w.restClient, ds)
+	return pod.Metadata.Namespace + "/" + strings.TrimPrefix(createdBy, types.IotDaemonSetType+"."), true
 }
@@ -0,0 +1,99 @@
+package watch
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+func newTestDaemonSet(name string, uid apitypes.UID) *types.IotDaemonSet {
+	ds := &types.IotDaemonSet{}
+	ds.APIVersion = "fujitsu.com/v1"
+	ds.Kind = types.IotDaemonSetKind
+	ds.Metadata.Name = name
+	ds.Metadata.Namespace = testNamespace
+	ds.Metadata.UID = uid
+	ds.Metadata.Labels = map[string]string{types.DeviceSelector: types.DevicesAll}
+	return ds
+}
+
+// controlledBy returns the pod with controller reference to the daemon set.
+func controlledBy(pod *types.IotPod, ds *types.IotDaemonSet) *types.IotPod {
+	pod.Metadata.OwnerReferences = []metav1.OwnerReference{kubernetes.NewDaemonSetOwnerReference(*ds)}
+	return pod
+}
+
+func TestClaimPods(t *testing.T) {
+	ds := newTestDaemonSet("nginx", "uid-1")
+	deleted := newTestDaemonSet("nginx", "uid-0")
+	other := newTestDaemonSet("apache", "uid-2")
+
+	pods := []*types.IotPod{
+		newTestPod("orphan", "raspi-1", "nginx"),
+		controlledBy(newTestPod("owned", "raspi-2", "nginx"), ds),
+		controlledBy(newTestPod("relabeled", "raspi-3", "apache"), ds),
+		controlledBy(newTestPod("stale", "raspi-4", "nginx"), deleted),
+		controlledBy(newTestPod("foreign", "raspi-5", "nginx"), other),
+	}
+
+	apiserver := newFakeApiserver(t)
+	defer apiserver.Close()
+	objs := []interface{}{ds}
+	for _, pod := range pods {
+		apiserver.add(t, testIotPrefix+"iotpods/"+pod.Metadata.Name, pod)
+		objs = append(objs, pod)
+	}
+	// Pods deleted meanwhile are neither adopted nor reported as errors
+	objs = append(objs, newTestPod("gone", "raspi-6", "nginx"))
+
+	recorder := newTestRecorder()
+	w := NewIotDaemonSetWatcher(apiserver.restClient(), newTestInformers(apiserver, objs...), recorder)
+
+	claimed, err := w.claimPods(testNamespace+"/nginx", *ds)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	names := make([]string, 0, len(claimed))
+	for _, pod := range claimed {
+		names = append(names, pod.Metadata.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"orphan", "owned"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected claimed pods %v, got %v", expected, names)
+	}
+
+	requests := apiserver.getRequests()
+	sort.Strings(requests)
+	expectedRequests := []string{
+		"DELETE " + testIotPrefix + "iotpods/stale",
+		"PUT " + testIotPrefix + "iotpods/gone",
+		"PUT " + testIotPrefix + "iotpods/orphan",
+		"PUT " + testIotPrefix + "iotpods/relabeled",
+	}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Errorf("expected requests %v, got %v", expectedRequests, requests)
+	}
+
+	adopted := &types.IotPod{}
+	apiserver.get(t, testIotPrefix+"iotpods/orphan", adopted)
+	if ref := kubernetes.GetControllerOf(*adopted); ref == nil || ref.UID != ds.Metadata.UID {
+		t.Errorf("expected orphan to be adopted, got owner references %v", adopted.Metadata.OwnerReferences)
+	}
+
+	released := &types.IotPod{}
+	apiserver.get(t, testIotPrefix+"iotpods/relabeled", released)
+	if len(released.Metadata.OwnerReferences) > 0 {
+		t.Errorf("expected relabeled pod to be released, got owner references %v",
+			released.Metadata.OwnerReferences)
+	}
+
+	if len(recorder.Events) != 3 {
+		t.Errorf("expected adopt, release and delete events, got %d", len(recorder.Events))
+	}
+}
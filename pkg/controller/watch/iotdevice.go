@@ -1,133 +1,268 @@
 package watch
 
 import (
-	"fmt"
-	"log"
-
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	"github.com/fest-research/iot-addon/pkg/config"
+	"github.com/fest-research/iot-addon/pkg/controller/metrics"
 	"github.com/fest-research/iot-addon/pkg/kubernetes"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/dynamic"
-	client "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api"
+	"k8s.io/apimachinery/pkg/fields"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/workqueue"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
+// IotDeviceWatcher removes IotPods from unschedulable or deleted IotDevices and asks IotDaemonSetWatcher to
+// create IotPods on new or schedulable again IotDevices. Every IotDevice gets a finalizer, so its deletion
+// waits until its IotPods are removed and its credentials revoked.
 type IotDeviceWatcher struct {
-	dynamicClient *dynamic.Client
-	restClient    *rest.RESTClient
-	clientset     *client.Clientset
-	iotDomain     string
+	restClient       *rest.RESTClient
+	clientset        *kubeclient.Clientset
+	informers        *IotInformers
+	daemonSetWatcher *IotDaemonSetWatcher
+	recorder         record.EventRecorder
+	store            *config.ControllerStore
+	queue            workqueue.RateLimitingInterface
 }
 
-func NewIotDeviceWatcher(dynamicClient *dynamic.Client, restClient *rest.RESTClient, clientset *client.Clientset,
-	iotDomain string) IotDeviceWatcher {
-	return IotDeviceWatcher{
-		dynamicClient: dynamicClient,
-		restClient:    restClient,
-		clientset:     clientset,
-		iotDomain:     iotDomain,
+func NewIotDeviceWatcher(restClient *rest.RESTClient, clientset *kubeclient.Clientset, informers *IotInformers,
+	daemonSetWatcher *IotDaemonSetWatcher, recorder record.EventRecorder,
+	store *config.ControllerStore) *IotDeviceWatcher {
+	w := &IotDeviceWatcher{
+		restClient:       restClient,
+		clientset:        clientset,
+		store:            store,
+		informers:        informers,
+		daemonSetWatcher: daemonSetWatcher,
+		recorder:         recorder,
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), types.IotDeviceType),
 	}
+
+	informers.Devices.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			enqueue(w.queue, obj)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			// Only deletion, missing finalizer and changes of the unschedulable or approval label affect IotPods.
+			oldDevice, curDevice := old.(*types.IotDevice), cur.(*types.IotDevice)
+			if curDevice.Metadata.DeletionTimestamp != nil ||
+				!kubernetes.HasDeviceFinalizer(*curDevice, types.FinalizerDeviceCleanup) ||
+				kubernetes.IsDeviceSchedulable(*oldDevice) != kubernetes.IsDeviceSchedulable(*curDevice) {
+				enqueue(w.queue, cur)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			enqueue(w.queue, obj)
+		},
+	})
+
+	return w
 }
 
-func (w IotDeviceWatcher) Watch() {
-	for {
-		err := w.start()
-		if err != nil {
-			log.Printf("An error occured: %s", err.Error())
-		}
+// Watch waits for informer caches to sync and starts workers processing queued IotDevices. It blocks
+// until stop channel is closed and in-flight syncs are finished.
+func (w *IotDeviceWatcher) Watch(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer w.queue.ShutDown()
+
+	logging.Infof("Starting %s watcher", types.IotDeviceType)
+	if !cache.WaitForCacheSync(stopCh, w.informers.HasSynced) {
+		return
 	}
+
+	runWorkers(w.queue, workers, w.worker, stopCh)
+	logging.Infof("Shut down %s watcher", types.IotDeviceType)
 }
 
-func (w IotDeviceWatcher) start() error {
-	watcher, err := w.dynamicClient.Resource(&metav1.APIResource{
-		Name:       types.IotDeviceType,
-		Namespaced: true,
-	}, api.NamespaceAll).Watch(&metav1.ListOptions{})
+// EnqueueKey adds IotDevice with "namespace/name" key to the queue.
+func (w *IotDeviceWatcher) EnqueueKey(key string) {
+	w.queue.Add(key)
+}
 
+func (w *IotDeviceWatcher) worker() {
+	for processNextWorkItem(w.queue, types.IotDeviceKind, w.syncDevice) {
+	}
+}
+
+func (w *IotDeviceWatcher) syncDevice(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Watcher for %s created \n", types.IotDeviceType)
+	iotDevice, exists, err := w.informers.GetDevice(namespace, name)
+	if err != nil {
+		return err
+	}
 
-	defer watcher.Stop()
+	if !exists {
+		// IotDevice was removed without the finalizer, e.g. before the controller started to set it.
+		return w.deleteDevicePods(types.IotDevice{
+			Metadata: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}, "", "device does not exist")
+	}
 
-	for {
-		e, ok := <-watcher.ResultChan()
+	if iotDevice.Metadata.DeletionTimestamp != nil {
+		return w.handleDeviceDeletion(*iotDevice)
+	}
 
-		if !ok {
-			return fmt.Errorf("%s watch ended due to a timeout", types.IotDeviceType)
+	if !kubernetes.HasDeviceFinalizer(*iotDevice, types.FinalizerDeviceCleanup) {
+		if err := kubernetes.AddDeviceFinalizer(w.restClient, *iotDevice, types.FinalizerDeviceCleanup); err != nil {
+			return err
 		}
+	}
 
-		modificationMap := map[string]bool{}
-		iotDevice, _ := e.Object.(*types.IotDevice)
+	if kubernetes.IsDevicePending(*iotDevice) {
+		return w.handlePendingDevice(*iotDevice)
+	}
 
-		if e.Type == watch.Added {
-			log.Printf("Device added %s\n", iotDevice.Metadata.Name)
-			unschedulable := kubernetes.GetUnschedulableLabelFromDevice(*iotDevice)
-			modificationMap[iotDevice.Metadata.Name] = unschedulable
-			err := w.addModifyDeviceHandler(*iotDevice)
-			if err != nil {
-				log.Printf("Error [addModifyDeviceHandler] %s", err.Error())
-			}
-		} else if e.Type == watch.Modified {
-			unschedulable := kubernetes.GetUnschedulableLabelFromDevice(*iotDevice)
-			prevUnschedulable := modificationMap[iotDevice.Metadata.Name]
-			if unschedulable != prevUnschedulable {
-				log.Printf("Device  modified %s\n", iotDevice.Metadata.Name)
-				err := w.addModifyDeviceHandler(*iotDevice)
-				if err != nil {
-					log.Printf("Error [addModifyDeviceHandler] %s", err.Error())
-				}
-				modificationMap[iotDevice.Metadata.Name] = unschedulable
-			}
+	if kubernetes.GetUnschedulableLabelFromDevice(*iotDevice) {
+		return w.handleUnschedulableDevice(*iotDevice)
+	}
 
-		} else if e.Type == watch.Error {
-			return fmt.Errorf("Error %s", types.IotDeviceType)
-		}
+	return w.handleSchedulableDevice(*iotDevice)
+}
+
+// handleUnschedulableDevice deletes all IotPods scheduled on IotDevice.
+func (w *IotDeviceWatcher) handleUnschedulableDevice(iotDevice types.IotDevice) error {
+	return w.deleteDevicePods(iotDevice, DeviceUnschedulableReason,
+		"device "+iotDevice.Metadata.Name+" is unschedulable")
+}
+
+// handlePendingDevice deletes all IotPods scheduled on IotDevice waiting for approval, e.g. IotPods created
+// before the device was set back to pending.
+func (w *IotDeviceWatcher) handlePendingDevice(iotDevice types.IotDevice) error {
+	return w.deleteDevicePods(iotDevice, DevicePendingReason,
+		"device "+iotDevice.Metadata.Name+" waits for approval")
+}
+
+// handleDeviceDeletion deletes all IotPods bound to deleted IotDevice, revokes its credentials and removes
+// its finalizer afterwards, so the apiserver can remove the IotDevice. IotDaemonSetWatcher skips IotDevices
+// being deleted, so the IotPods are not recreated meanwhile.
+func (w *IotDeviceWatcher) handleDeviceDeletion(iotDevice types.IotDevice) error {
+	if !kubernetes.HasDeviceFinalizer(iotDevice, types.FinalizerDeviceCleanup) {
+		return nil
+	}
+
+	if err := w.deleteDevicePods(iotDevice, DeviceDeletedReason,
+		"device "+iotDevice.Metadata.Name+" is deleted"); err != nil {
+		return err
+	}
+
+	if err := w.revokeDeviceCredentials(iotDevice); err != nil {
+		return err
 	}
+
+	return kubernetes.RemoveDeviceFinalizer(w.restClient, iotDevice, types.FinalizerDeviceCleanup)
 }
 
-func (w IotDeviceWatcher) addModifyDeviceHandler(iotDevice types.IotDevice) error {
+// deleteDevicePods evicts all IotPods bound to IotDevice and records PodEvicted events of the IotPods. Event
+// with deviceReason is recorded for the IotDevice when any IotPod was evicted, empty deviceReason skips it.
+func (w *IotDeviceWatcher) deleteDevicePods(iotDevice types.IotDevice, deviceReason, reason string) error {
+	pods, err := w.informers.GetDevicePods(iotDevice)
+	if err != nil || len(pods) == 0 {
+		return err
+	}
 
-	unschedulable := kubernetes.GetUnschedulableLabelFromDevice(iotDevice)
-	deviceName := iotDevice.Metadata.Name
+	if len(deviceReason) > 0 {
+		w.recorder.Eventf(&iotDevice, v1.EventTypeWarning, deviceReason, "Evicting %d pods: %s", len(pods),
+			reason)
+	}
 
-	if unschedulable {
-		log.Printf("[addModifyDeviceHandler] Delete pods for unschedulable device %s", deviceName)
-		pods, err := kubernetes.GetDevicePods(w.restClient, iotDevice)
-		if err != nil {
-			return err
+	errs := make([]error, 0)
+	for i := range pods {
+		pod := &pods[i]
+		logging.Infof("Deleting %s %s: %s", types.IotPodKind, pod.Metadata.Name, reason)
+		if err := kubernetes.DeletePod(w.restClient, *pod); err != nil && !errors.IsNotFound(err) {
+			metrics.ObservePodOperation(metrics.OperationDelete, err)
+			w.recorder.Eventf(pod, v1.EventTypeWarning, FailedEvictReason, "Error evicting pod: %s", err.Error())
+			errs = append(errs, err)
+			continue
 		}
+		metrics.ObservePodOperation(metrics.OperationDelete, nil)
+		w.recorder.Eventf(pod, v1.EventTypeNormal, PodEvictedReason, "Evicted pod: %s", reason)
+	}
 
-		for _, pod := range pods {
-			err := kubernetes.DeletePod(w.restClient, pod)
-			if err != nil {
-				return err
-			}
+	return utilerrors.NewAggregate(errs)
+}
+
+// revokeDeviceCredentials deletes device tokens and bootstrap tokens bound to deleted IotDevice and its
+// IotCertificateRequests, so it can't get new credentials. Client certificates already issued are rejected
+// by the IoT apiserver once the IotDevice is gone. Tokens and requests only know the device name, so they are
+// kept while another IotDevice of the name exists.
+func (w *IotDeviceWatcher) revokeDeviceCredentials(iotDevice types.IotDevice) error {
+	name := iotDevice.Metadata.Name
+	devices, err := w.informers.GetDevicesByName(name)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.Metadata.Namespace != iotDevice.Metadata.Namespace && device.Metadata.DeletionTimestamp == nil {
+			logging.Infof("Keeping credentials of deleted %s %s/%s, %s/%s has the same name", types.IotDeviceKind,
+				iotDevice.Metadata.Namespace, name, device.Metadata.Namespace, name)
+			return nil
+		}
+	}
+
+	errs := make([]error, 0)
+	namespace := w.store.Get().Rotation.TokenNamespace
+	secrets := w.clientset.CoreV1().Secrets(namespace)
+	tokenSecrets, err := secrets.List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("type", string(certificates.BootstrapTokenSecretType)).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, secret := range tokenSecrets.Items {
+		token, err := certificates.ParseBootstrapTokenSecret(&secret)
+		if err != nil || token.Device != name {
+			continue
 		}
 
-	} else {
-		daemonSets, _ := kubernetes.GetDeviceDaemonSets(w.restClient, iotDevice)
-		for _, ds := range daemonSets {
+		logging.Infof("Deleting token %s of deleted %s %s", token.ID, types.IotDeviceKind, name)
+		if err := secrets.Delete(secret.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
 
-			if !kubernetes.IsPodCreated(w.restClient, ds, iotDevice) {
-				log.Printf("[addModifyDeviceHandler] Create new pod %s ", ds.Metadata.Name)
-				err := kubernetes.CreateDaemonSetPod(ds, iotDevice, w.restClient)
-				if err != nil {
-					return err
-				}
-			}
+	requests, err := w.informers.GetDeviceCertificateRequests(name)
+	if err != nil {
+		return err
+	}
+	for _, request := range requests {
+		logging.Infof("Deleting %s %s of deleted %s %s", types.IotCertificateRequestKind, request.Metadata.Name,
+			types.IotDeviceKind, name)
+		if err := kubernetes.DeleteCertificateRequest(w.restClient, request); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
 		}
 	}
+
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		w.recorder.Eventf(&iotDevice, v1.EventTypeWarning, FailedRevokeReason, "Error revoking credentials: %s",
+			err.Error())
+		return err
+	}
 	return nil
 }
 
-func createTypeMeta(apiVersion string) metav1.TypeMeta {
-	return metav1.TypeMeta{
-		Kind:       types.IotPodKind,
-		APIVersion: apiVersion,
+// handleSchedulableDevice enqueues all IotDaemonSets selecting IotDevice, so the missing IotPods get created.
+func (w *IotDeviceWatcher) handleSchedulableDevice(iotDevice types.IotDevice) error {
+	daemonSets, err := w.informers.GetDeviceDaemonSets(iotDevice)
+	if err != nil {
+		return err
+	}
+
+	for _, ds := range daemonSets {
+		w.daemonSetWatcher.EnqueueKey(ds.Metadata.Namespace + "/" + ds.Metadata.Name)
 	}
+
+	return nil
 }
@@ -0,0 +1,138 @@
+package watch
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/certificates"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
+)
+
+const testSecretPrefix = "/api/v1/namespaces/kube-system/secrets/"
+
+func newTestDevice(namespace, name string) *types.IotDevice {
+	device := &types.IotDevice{}
+	device.Metadata.Name = name
+	device.Metadata.Namespace = namespace
+	device.Metadata.Finalizers = []string{types.FinalizerDeviceCleanup}
+	return device
+}
+
+func deleting(device *types.IotDevice) *types.IotDevice {
+	now := metav1.Now()
+	device.Metadata.DeletionTimestamp = &now
+	return device
+}
+
+func newTestDeviceToken(id, device string) *kubeapi.Secret {
+	secret := &kubeapi.Secret{Type: certificates.BootstrapTokenSecretType, Data: map[string][]byte{
+		certificates.BootstrapTokenIDKey:     []byte(id),
+		certificates.BootstrapTokenSecretKey: []byte("0123456789abcdef"),
+		certificates.BootstrapTokenUsageKey:  []byte("true"),
+		certificates.BootstrapTokenDeviceKey: []byte(device),
+	}}
+	secret.Name = certificates.BootstrapTokenSecretName(id)
+	secret.Namespace = "kube-system"
+	return secret
+}
+
+func TestDeviceRemoval(t *testing.T) {
+	cases := []struct {
+		name string
+		// others are other devices of the same name
+		others []*types.IotDevice
+		// failed are paths failing with internal error
+		failed []string
+		// requests are expected requests, the finalizer is removed if the last one updates the device
+		requests []string
+	}{
+		{"removed", nil, nil, []string{
+			"DELETE " + testIotPrefix + "iotpods/nginx-1",
+			"DELETE " + testIotPrefix + "iotpods/nginx-2",
+			"DELETE " + testSecretPrefix + certificates.BootstrapTokenSecretName("abcdef"),
+			"PUT " + testIotPrefix + "iotdevices/raspi-1",
+		}},
+		{"same name in other namespace", []*types.IotDevice{newTestDevice("tenant-a", "raspi-1")}, nil,
+			[]string{
+				"DELETE " + testIotPrefix + "iotpods/nginx-1",
+				"DELETE " + testIotPrefix + "iotpods/nginx-2",
+				"PUT " + testIotPrefix + "iotdevices/raspi-1",
+			}},
+		{"same name being deleted", []*types.IotDevice{deleting(newTestDevice("tenant-a", "raspi-1"))}, nil,
+			[]string{
+				"DELETE " + testIotPrefix + "iotpods/nginx-1",
+				"DELETE " + testIotPrefix + "iotpods/nginx-2",
+				"DELETE " + testSecretPrefix + certificates.BootstrapTokenSecretName("abcdef"),
+				"PUT " + testIotPrefix + "iotdevices/raspi-1",
+			}},
+		{"failed pod deletion", nil, []string{testIotPrefix + "iotpods/nginx-1"}, []string{
+			"DELETE " + testIotPrefix + "iotpods/nginx-1",
+			"DELETE " + testIotPrefix + "iotpods/nginx-2",
+		}},
+		{"failed revocation", nil, []string{testSecretPrefix + certificates.BootstrapTokenSecretName("abcdef")},
+			[]string{
+				"DELETE " + testIotPrefix + "iotpods/nginx-1",
+				"DELETE " + testIotPrefix + "iotpods/nginx-2",
+				"DELETE " + testSecretPrefix + certificates.BootstrapTokenSecretName("abcdef"),
+			}},
+	}
+
+	for _, c := range cases {
+		apiserver := newFakeApiserver(t)
+		device := deleting(newTestDevice(testNamespace, "raspi-1"))
+		pods := []*types.IotPod{
+			newTestPod("nginx-1", "raspi-1", "nginx"),
+			newTestPod("nginx-2", "raspi-1", ""),
+			newTestPod("nginx-3", "raspi-2", "nginx"),
+		}
+
+		apiserver.add(t, testIotPrefix+"iotdevices/raspi-1", device)
+		objs := []interface{}{device}
+		for _, pod := range pods {
+			apiserver.add(t, testIotPrefix+"iotpods/"+pod.Metadata.Name, pod)
+			objs = append(objs, pod)
+		}
+		for _, other := range c.others {
+			objs = append(objs, other)
+		}
+		apiserver.add(t, testSecretPrefix+certificates.BootstrapTokenSecretName("abcdef"),
+			newTestDeviceToken("abcdef", "raspi-1"))
+		apiserver.add(t, testSecretPrefix+certificates.BootstrapTokenSecretName("ghijkl"),
+			newTestDeviceToken("ghijkl", "raspi-2"))
+		for _, path := range c.failed {
+			apiserver.failures[path] = true
+		}
+
+		informers := newTestInformers(apiserver, objs...)
+		recorder := newTestRecorder()
+		daemonSetWatcher := NewIotDaemonSetWatcher(apiserver.restClient(), informers, recorder)
+		w := NewIotDeviceWatcher(apiserver.restClient(), apiserver.clientset(), informers, daemonSetWatcher,
+			recorder, newTestStore())
+
+		err := w.syncDevice(testNamespace + "/raspi-1")
+		if (err != nil) != (len(c.failed) > 0) {
+			t.Errorf("%s: expected error %t, got %v", c.name, len(c.failed) > 0, err)
+		}
+
+		requests := apiserver.getRequests()
+		sort.Strings(requests[:2])
+		if !reflect.DeepEqual(requests, c.requests) {
+			t.Errorf("%s: expected requests %v, got %v", c.name, c.requests, requests)
+		}
+
+		updated := &types.IotDevice{}
+		apiserver.get(t, testIotPrefix+"iotdevices/raspi-1", updated)
+		removed := len(updated.Metadata.Finalizers) == 0
+		if expected := len(c.failed) == 0; removed != expected {
+			t.Errorf("%s: expected finalizer removed %t, got finalizers %v", c.name, expected,
+				updated.Metadata.Finalizers)
+		}
+		if !apiserver.get(t, testIotPrefix+"iotpods/nginx-3", &types.IotPod{}) {
+			t.Errorf("%s: expected pod of other device to be kept", c.name)
+		}
+		apiserver.Close()
+	}
+}
@@ -1,72 +1,57 @@
 package watch
 
 import (
-	"fmt"
-	"log"
-
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
-	"k8s.io/client-go/dynamic"
-	client "k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api"
-	"k8s.io/client-go/rest"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/client-go/tools/cache"
 )
 
+// IotPodWatcher has no queue of its own. It forwards IotPod events to IotDaemonSetWatcher, so creations
+// are observed and deleted IotPods of existing IotDaemonSets are recreated.
 type IotPodWatcher struct {
-	dynamicClient *dynamic.Client
-	restClient    *rest.RESTClient
-	clientset     *client.Clientset
-	iotDomain     string
+	daemonSetWatcher *IotDaemonSetWatcher
 }
 
-func NewIotPodWatcher(dynamicClient *dynamic.Client, restClient *rest.RESTClient, clientset *client.Clientset,
-	iotDomain string) IotPodWatcher {
-	return IotPodWatcher{
-		dynamicClient: dynamicClient,
-		restClient:    restClient,
-		clientset:     clientset,
-		iotDomain:     iotDomain,
-	}
-}
+func NewIotPodWatcher(informers *IotInformers, daemonSetWatcher *IotDaemonSetWatcher) *IotPodWatcher {
+	w := &IotPodWatcher{daemonSetWatcher: daemonSetWatcher}
 
-func (w IotPodWatcher) Watch() {
-	for {
-		err := w.start()
-		if err != nil {
-			log.Printf("An error occured: %s", err.Error())
-		}
-	}
-}
+	informers.Pods.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.handlePodAddition,
+		DeleteFunc: w.handlePodDeletion,
+	})
 
-func (w IotPodWatcher) start() error {
-	watcher, err := w.dynamicClient.Resource(&metav1.APIResource{
-		Name:       types.IotPodType,
-		Namespaced: true,
-	}, api.NamespaceAll).Watch(&metav1.ListOptions{})
+	return w
+}
 
-	if err != nil {
-		return err
+func (w *IotPodWatcher) handlePodAddition(obj interface{}) {
+	iotPod, ok := obj.(*types.IotPod)
+	if !ok {
+		return
 	}
 
-	log.Printf("Watcher for %s created \n", types.IotPodType)
-
-	defer watcher.Stop()
-
-	for {
-		e, ok := <-watcher.ResultChan()
+	w.daemonSetWatcher.ObservePod(*iotPod)
+}
 
+func (w *IotPodWatcher) handlePodDeletion(obj interface{}) {
+	iotPod, ok := obj.(*types.IotPod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 		if !ok {
-			return fmt.Errorf("%s watch ended due to a timeout", types.IotPodType)
+			return
 		}
 
-		iotPod, _ := e.Object.(*types.IotPod)
+		iotPod, ok = tombstone.Obj.(*types.IotPod)
+		if !ok {
+			return
+		}
+	}
 
-		if e.Type == watch.Deleted {
-			log.Printf("Pod deleted %s\n", iotPod.Metadata.Name)
+	logging.Debugf("%s %s deleted", types.IotPodKind, iotPod.Metadata.Name)
 
-		} else if e.Type == watch.Error {
-			return fmt.Errorf("Error %s", types.IotPodType)
-		}
+	// Controller is preferred, so foreground deletion of its IotDaemonSet notices the last removed IotPod.
+	if key, ok := getPodControllerKey(*iotPod); ok {
+		w.daemonSetWatcher.EnqueueKey(key)
+	} else if key, ok := getPodDaemonSetKey(*iotPod); ok {
+		w.daemonSetWatcher.EnqueueKey(key)
 	}
 }
@@ -0,0 +1,29 @@
+package watch
+
+import (
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// runPeriodically waits for informer caches to sync and calls check until stop channel is closed. check
+// returns how long to wait before it's called again, so monitors read their interval from the config store
+// on every call and reloaded intervals apply without restart.
+func runPeriodically(informers *IotInformers, check func() time.Duration, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	if !cache.WaitForCacheSync(stopCh, informers.HasSynced) {
+		return
+	}
+
+	for {
+		interval := check()
+
+		select {
+		case <-time.After(interval):
+		case <-stopCh:
+			return
+		}
+	}
+}
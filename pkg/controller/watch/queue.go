@@ -0,0 +1,75 @@
+package watch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/controller/metrics"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/util/workqueue"
+	"k8s.io/client-go/tools/cache"
+)
+
+// maxRetries is the number of times a key is retried before it is dropped out of the queue. With
+// default rate limiter it gives roughly 80 seconds of exponential backoff.
+const maxRetries = 15
+
+// syncHandler reconciles the object with given "namespace/name" key.
+type syncHandler func(key string) error
+
+// processNextWorkItem takes next key from the queue and syncs it. Keys that failed to sync are
+// requeued with rate limited backoff. It returns false when the queue is shutting down.
+func processNextWorkItem(queue workqueue.RateLimitingInterface, kind string, sync syncHandler) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	start := time.Now()
+	err := sync(key.(string))
+	metrics.ObserveSync(kind, start, err)
+	if err == nil {
+		queue.Forget(key)
+		return true
+	}
+
+	logger := logging.WithFields(logging.Fields{"kind": kind, "key": key})
+	if queue.NumRequeues(key) < maxRetries {
+		logger.Warningf("Error syncing, retrying: %s", err.Error())
+		queue.AddRateLimited(key)
+		return true
+	}
+
+	logger.Errorf("Dropping out of the queue: %s", err.Error())
+	queue.Forget(key)
+	return true
+}
+
+// runWorkers starts workers processing the queue and blocks until stop channel is closed. Then it shuts the
+// queue down and waits for in-flight syncs, so no sync is interrupted in the middle.
+func runWorkers(queue workqueue.RateLimitingInterface, workers int, worker func(), stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(worker, time.Second, stopCh)
+		}()
+	}
+
+	<-stopCh
+	queue.ShutDown()
+	wg.Wait()
+}
+
+// enqueue adds key of the object to the queue. Tombstones of deleted objects are handled too.
+func enqueue(queue workqueue.RateLimitingInterface, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		logging.Errorf("Cannot get key for object %+v: %s", obj, err.Error())
+		return
+	}
+	queue.Add(key)
+}
@@ -0,0 +1,99 @@
+package watch
+
+import (
+	"time"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/logging"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Reconciler periodically enqueues every IotDaemonSet and IotDevice together with IotDaemonSets and
+// IotDevices that left orphaned IotPods behind. Syncs are level based, so state diverged because of a missed event or a
+// failed sync converges within one period. Corrections are reported by the watchers doing them.
+type Reconciler struct {
+	informers        *IotInformers
+	daemonSetWatcher *IotDaemonSetWatcher
+	deviceWatcher    *IotDeviceWatcher
+	period           time.Duration
+}
+
+func NewReconciler(informers *IotInformers, daemonSetWatcher *IotDaemonSetWatcher,
+	deviceWatcher *IotDeviceWatcher, period time.Duration) *Reconciler {
+	return &Reconciler{
+		informers:        informers,
+		daemonSetWatcher: daemonSetWatcher,
+		deviceWatcher:    deviceWatcher,
+		period:           period,
+	}
+}
+
+// Run waits for informer caches to sync and reconciles all IoT resources every period. It blocks until
+// stop channel is closed.
+func (r *Reconciler) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
+	if r.period <= 0 {
+		logging.Infof("Periodic reconciliation disabled")
+		return
+	}
+
+	if !cache.WaitForCacheSync(stopCh, r.informers.HasSynced) {
+		return
+	}
+
+	// First run is delayed by one period, watchers handle the initial list on their own.
+	select {
+	case <-time.After(r.period):
+	case <-stopCh:
+		return
+	}
+
+	wait.Until(r.reconcile, r.period, stopCh)
+}
+
+func (r *Reconciler) reconcile() {
+	daemonSets := make(map[string]bool)
+	for _, key := range r.informers.DaemonSets.GetIndexer().ListKeys() {
+		daemonSets[key] = true
+		r.daemonSetWatcher.EnqueueKey(key)
+	}
+
+	// IotPods controlled by deleted IotDaemonSets are removed by syncing key of the missing IotDaemonSet.
+	orphaned := make(map[string]bool)
+	for _, obj := range r.informers.Pods.GetIndexer().List() {
+		key, ok := getPodControllerKey(*obj.(*types.IotPod))
+		if ok && !daemonSets[key] && !orphaned[key] {
+			orphaned[key] = true
+			r.daemonSetWatcher.EnqueueKey(key)
+		}
+	}
+
+	devices := make(map[string]bool)
+	for _, key := range r.informers.Devices.GetIndexer().ListKeys() {
+		devices[key] = true
+		r.deviceWatcher.EnqueueKey(key)
+	}
+
+	// IotPods bound to deleted IotDevices are removed by syncing key of the missing IotDevice.
+	missingDevices := make(map[string]bool)
+	for _, obj := range r.informers.Pods.GetIndexer().List() {
+		pod := obj.(*types.IotPod)
+		device, ok := pod.Metadata.Labels[types.DeviceSelector]
+		if !ok {
+			continue
+		}
+
+		key := pod.Metadata.Namespace + "/" + device
+		if !devices[key] && !missingDevices[key] {
+			missingDevices[key] = true
+			r.deviceWatcher.EnqueueKey(key)
+		}
+	}
+
+	logging.Infof("[Reconciler] Enqueued %d %s, %d %s, %d %s with orphaned %s and %d missing %s with bound %s",
+		len(daemonSets), types.IotDaemonSetType, len(devices), types.IotDeviceType, len(orphaned),
+		types.IotDaemonSetType, types.IotPodType, len(missingDevices), types.IotDeviceType, types.IotPodType)
+}
@@ -0,0 +1,90 @@
+package healthz
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// HealthzPath is checked by liveness probes. Failing checks mean the process is stuck and should be restarted.
+	HealthzPath = "/healthz"
+	// ReadyzPath is checked by readiness probes. Failing checks mean the process can't serve yet.
+	ReadyzPath = "/readyz"
+)
+
+// Checker is a single named check of a health endpoint.
+type Checker interface {
+	Name() string
+	Check() error
+}
+
+type namedCheck struct {
+	name  string
+	check func() error
+}
+
+func (this namedCheck) Name() string {
+	return this.name
+}
+
+func (this namedCheck) Check() error {
+	return this.check()
+}
+
+// NamedCheck creates checker with given name from function.
+func NamedCheck(name string, check func() error) Checker {
+	return namedCheck{name: name, check: check}
+}
+
+// PingCheck always passes. It shows the process is able to serve HTTP requests.
+var PingCheck = NamedCheck("ping", func() error { return nil })
+
+// Handler runs all its checks on every request. It responds with 200 when all of them pass and with 500
+// listing every check by name otherwise. Passing checks are listed with "?verbose" query parameter too.
+type Handler struct {
+	mu     sync.RWMutex
+	checks []Checker
+}
+
+func NewHandler(checks ...Checker) *Handler {
+	return &Handler{checks: checks}
+}
+
+// AddChecks registers more checks, e.g. ones available only after the process started to lead.
+func (this *Handler) AddChecks(checks ...Checker) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.checks = append(this.checks, checks...)
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mu.RLock()
+	checks := this.checks
+	this.mu.RUnlock()
+
+	failed := false
+	var output bytes.Buffer
+	for _, check := range checks {
+		if err := check.Check(); err != nil {
+			fmt.Fprintf(&output, "[-]%s failed: %s\n", check.Name(), err.Error())
+			failed = true
+		} else {
+			fmt.Fprintf(&output, "[+]%s ok\n", check.Name())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s%s check failed\n", output.String(), r.URL.Path)
+		return
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		fmt.Fprintf(w, "%s%s check passed\n", output.String(), r.URL.Path)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
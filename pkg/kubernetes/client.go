@@ -1,19 +1,21 @@
 package kubernetes
 
 import (
-	"log"
-
 	"github.com/fest-research/iot-addon/pkg/api/v1"
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/logging"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api"
+	kubeapi "k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 func NewDynamicClient(config *rest.Config) *dynamic.Client {
@@ -36,6 +38,16 @@ func NewClientset(config *rest.Config) *kubernetes.Clientset {
 	return client
 }
 
+// NewEventRecorder creates recorder posting events of given component to all namespaces. Similar events
+// are aggregated by the broadcaster, so repeated failures only increase the count of a single event.
+func NewEventRecorder(clientset *kubernetes.Clientset, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(logging.Debugf)
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(kubeapi.EventSource{Component: component})
+}
+
 func NewRESTClient(config *rest.Config) *rest.RESTClient {
 	client, err := rest.RESTClientFor(config)
 
@@ -47,7 +59,7 @@ func NewRESTClient(config *rest.Config) *rest.RESTClient {
 }
 
 func NewClientConfig(apiserver, kubeconfig string, iotDomain string) *rest.Config {
-	log.Printf("Creating client config using \"%s\" apiserver and \"%s\" kubeconfig",
+	logging.Infof("Creating client config using \"%s\" apiserver and \"%s\" kubeconfig",
 		apiserver, kubeconfig)
 
 	config, err := clientcmd.BuildConfigFromFlags(apiserver, kubeconfig)
@@ -78,6 +90,8 @@ func NewClientConfig(apiserver, kubeconfig string, iotDomain string) *rest.Confi
 				&v1.IotDaemonSetList{},
 				&v1.IotPod{},
 				&v1.IotPodList{},
+				&v1.IotCertificateRequest{},
+				&v1.IotCertificateRequestList{},
 			)
 			return nil
 		})
@@ -0,0 +1,23 @@
+package kubernetes
+
+// hasFinalizer checks if finalizer is present in the list.
+func hasFinalizer(finalizers []string, finalizer string) bool {
+	for _, f := range finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// removeFinalizer returns a copy of the list without finalizer. Given list is not modified, so it is safe
+// to use with objects from informer caches.
+func removeFinalizer(finalizers []string, finalizer string) []string {
+	result := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		if f != finalizer {
+			result = append(result, f)
+		}
+	}
+	return result
+}
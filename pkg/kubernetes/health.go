@@ -0,0 +1,42 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CheckAPIServer checks that kubernetes apiserver is reachable and reports itself healthy.
+func CheckAPIServer(clientset *kubernetes.Clientset) error {
+	return clientset.CoreV1().RESTClient().Get().AbsPath("/healthz").Do().Error()
+}
+
+// CheckRegisteredTypes checks that IotDevice, IotDaemonSet, IotPod and IotCertificateRequest resources are
+// served by kubernetes apiserver. Registered third party resources become available with a delay, so their
+// existence is not enough.
+func CheckRegisteredTypes(clientset *kubernetes.Clientset, iotDomain string) error {
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion(iotDomain + "/" + types.APIVersion)
+	if err != nil {
+		return err
+	}
+
+	served := make(map[string]bool)
+	for _, resource := range resources.APIResources {
+		served[resource.Name] = true
+	}
+
+	missing := make([]string, 0)
+	for _, resource := range []string{types.IotDeviceType, types.IotDaemonSetType, types.IotPodType,
+		types.IotCertificateRequestType} {
+		if !served[resource] {
+			missing = append(missing, resource)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("resources not served: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
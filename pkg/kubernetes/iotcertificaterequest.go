@@ -0,0 +1,28 @@
+package kubernetes
+
+import (
+	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+// UpdateCertificateRequest replaces IotCertificateRequest, status included. It fails with conflict if the
+// request changed meanwhile.
+func UpdateCertificateRequest(restClient *rest.RESTClient, request types.IotCertificateRequest) error {
+	return restClient.Put().
+		Namespace(request.Metadata.Namespace).
+		Resource(types.IotCertificateRequestType).
+		Name(request.Metadata.Name).
+		Body(&request).
+		Do().
+		Error()
+}
+
+// DeleteCertificateRequest deletes specific IotCertificateRequest.
+func DeleteCertificateRequest(restClient *rest.RESTClient, request types.IotCertificateRequest) error {
+	return restClient.Delete().
+		Namespace(request.Metadata.Namespace).
+		Resource(types.IotCertificateRequestType).
+		Name(request.Metadata.Name).
+		Do().
+		Error()
+}
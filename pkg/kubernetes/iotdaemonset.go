@@ -2,6 +2,7 @@ package kubernetes
 
 import (
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/logging"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/dynamic"
@@ -63,3 +64,22 @@ func DaemonSetToPod(ds types.IotDaemonSet) types.IotPod {
 		Spec: ds.Spec.Template.Spec,
 	}
 }
+
+// HasDaemonSetFinalizer checks if IotDaemonSet has given finalizer set.
+func HasDaemonSetFinalizer(ds types.IotDaemonSet, finalizer string) bool {
+	return hasFinalizer(ds.Metadata.Finalizers, finalizer)
+}
+
+// RemoveDaemonSetFinalizer removes finalizer from IotDaemonSet, so its deletion can continue.
+func RemoveDaemonSetFinalizer(restClient *rest.RESTClient, ds types.IotDaemonSet, finalizer string) error {
+	logging.Debugf("Trying to remove %s finalizer from %s %s", finalizer, ds.Metadata.SelfLink, ds.TypeMeta.Kind)
+	ds.Metadata.Finalizers = removeFinalizer(ds.Metadata.Finalizers, finalizer)
+
+	return restClient.Put().
+		Namespace(ds.Metadata.Namespace).
+		Resource(types.IotDaemonSetType).
+		Name(ds.Metadata.Name).
+		Body(&ds).
+		Do().
+		Error()
+}
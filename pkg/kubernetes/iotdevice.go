@@ -4,6 +4,7 @@ import (
 	"strconv"
 
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
+	"github.com/fest-research/iot-addon/pkg/logging"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/dynamic"
@@ -97,3 +98,49 @@ func GetUnschedulableLabelFromDevice(iotDevice types.IotDevice) bool {
 	}
 	return false
 }
+
+// IsDevicePending returns true for IotDevices waiting for approval.
+func IsDevicePending(iotDevice types.IotDevice) bool {
+	return iotDevice.Metadata.Labels[types.DeviceApproval] == types.ApprovalPending
+}
+
+// IsDeviceSchedulable returns true for approved IotDevices without the unschedulable label.
+func IsDeviceSchedulable(iotDevice types.IotDevice) bool {
+	return !GetUnschedulableLabelFromDevice(iotDevice) && !IsDevicePending(iotDevice)
+}
+
+// HasDeviceFinalizer checks if IotDevice has given finalizer set.
+func HasDeviceFinalizer(device types.IotDevice, finalizer string) bool {
+	return hasFinalizer(device.Metadata.Finalizers, finalizer)
+}
+
+// AddDeviceFinalizer adds finalizer to IotDevice, so its deletion waits until the finalizer is removed.
+func AddDeviceFinalizer(restClient *rest.RESTClient, device types.IotDevice, finalizer string) error {
+	logging.Debugf("Trying to add %s finalizer to %s %s", finalizer, device.Metadata.SelfLink, device.TypeMeta.Kind)
+
+	finalizers := make([]string, 0, len(device.Metadata.Finalizers)+1)
+	finalizers = append(finalizers, device.Metadata.Finalizers...)
+	device.Metadata.Finalizers = append(finalizers, finalizer)
+
+	return UpdateDevice(restClient, device)
+}
+
+// RemoveDeviceFinalizer removes finalizer from IotDevice, so its deletion can continue.
+func RemoveDeviceFinalizer(restClient *rest.RESTClient, device types.IotDevice, finalizer string) error {
+	logging.Debugf("Trying to remove %s finalizer from %s %s", finalizer, device.Metadata.SelfLink,
+		device.TypeMeta.Kind)
+	device.Metadata.Finalizers = removeFinalizer(device.Metadata.Finalizers, finalizer)
+
+	return UpdateDevice(restClient, device)
+}
+
+// UpdateDevice replaces IotDevice, status included. It fails with conflict if the device changed meanwhile.
+func UpdateDevice(restClient *rest.RESTClient, device types.IotDevice) error {
+	return restClient.Put().
+		Namespace(device.Metadata.Namespace).
+		Resource(types.IotDeviceType).
+		Name(device.Metadata.Name).
+		Body(&device).
+		Do().
+		Error()
+}
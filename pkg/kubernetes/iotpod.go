@@ -1,20 +1,21 @@
 package kubernetes
 
 import (
-	"log"
-
 	types "github.com/fest-research/iot-addon/pkg/api/v1"
 	"github.com/fest-research/iot-addon/pkg/common"
+	"github.com/fest-research/iot-addon/pkg/logging"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 )
 
 // CreateDaemonSetPod creates IotPod for IotDaemonSet on specific IotDevice.
 func CreateDaemonSetPod(ds types.IotDaemonSet, device types.IotDevice, restClient *rest.RESTClient) error {
-	log.Printf("Trying to create IotPods for %s %s\n", ds.Metadata.SelfLink, ds.TypeMeta.Kind)
+	logging.Debugf("Trying to create IotPods for %s %s", ds.Metadata.SelfLink, ds.TypeMeta.Kind)
 
 	labelsMap := map[string]string{
 		types.CreatedBy:      types.IotDaemonSetType + "." + ds.Metadata.Name,
@@ -31,9 +32,10 @@ func CreateDaemonSetPod(ds types.IotDaemonSet, device types.IotDevice, restClien
 				APIVersion: ds.APIVersion,
 			},
 			Metadata: metav1.ObjectMeta{
-				Name:      ds.Metadata.Name + "-" + string(common.NewUUID()),
-				Namespace: ds.Metadata.Namespace,
-				Labels:    labelsMap,
+				Name:            ds.Metadata.Name + "-" + string(common.NewUUID()),
+				Namespace:       ds.Metadata.Namespace,
+				Labels:          labelsMap,
+				OwnerReferences: []metav1.OwnerReference{NewDaemonSetOwnerReference(ds)},
 			},
 			Spec: ds.Spec.Template.Spec,
 		}).
@@ -41,6 +43,68 @@ func CreateDaemonSetPod(ds types.IotDaemonSet, device types.IotDevice, restClien
 		Error()
 }
 
+// NewDaemonSetOwnerReference creates controller owner reference pointing to IotDaemonSet.
+func NewDaemonSetOwnerReference(ds types.IotDaemonSet) metav1.OwnerReference {
+	isController := true
+	return metav1.OwnerReference{
+		APIVersion: ds.APIVersion,
+		Kind:       types.IotDaemonSetKind,
+		Name:       ds.Metadata.Name,
+		UID:        ds.Metadata.UID,
+		Controller: &isController,
+	}
+}
+
+// GetControllerOf returns controller owner reference of IotPod or nil if IotPod has no controller.
+func GetControllerOf(pod types.IotPod) *metav1.OwnerReference {
+	for _, ref := range pod.Metadata.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			ownerRef := ref
+			return &ownerRef
+		}
+	}
+	return nil
+}
+
+// AdoptPod sets IotDaemonSet as a controller of IotPod that has no controller.
+func AdoptPod(restClient *rest.RESTClient, pod types.IotPod, ds types.IotDaemonSet) error {
+	logging.Debugf("Trying to adopt %s %s by %s %s", pod.Metadata.SelfLink, pod.TypeMeta.Kind,
+		ds.Metadata.SelfLink, ds.TypeMeta.Kind)
+
+	ownerReferences := make([]metav1.OwnerReference, 0, len(pod.Metadata.OwnerReferences)+1)
+	ownerReferences = append(ownerReferences, pod.Metadata.OwnerReferences...)
+	pod.Metadata.OwnerReferences = append(ownerReferences, NewDaemonSetOwnerReference(ds))
+
+	return restClient.Put().
+		Namespace(pod.Metadata.Namespace).
+		Resource(types.IotPodType).
+		Name(pod.Metadata.Name).
+		Body(&pod).
+		Do().
+		Error()
+}
+
+// ReleasePod removes owner reference to the object with given UID from IotPod.
+func ReleasePod(restClient *rest.RESTClient, pod types.IotPod, ownerUID apitypes.UID) error {
+	logging.Debugf("Trying to release %s %s", pod.Metadata.SelfLink, pod.TypeMeta.Kind)
+
+	ownerReferences := make([]metav1.OwnerReference, 0, len(pod.Metadata.OwnerReferences))
+	for _, ref := range pod.Metadata.OwnerReferences {
+		if ref.UID != ownerUID {
+			ownerReferences = append(ownerReferences, ref)
+		}
+	}
+	pod.Metadata.OwnerReferences = ownerReferences
+
+	return restClient.Put().
+		Namespace(pod.Metadata.Namespace).
+		Resource(types.IotPodType).
+		Name(pod.Metadata.Name).
+		Body(&pod).
+		Do().
+		Error()
+}
+
 // isPodCorrectlyScheduled checks if pod is correctly scheduled.
 func IsPodCorrectlyScheduled(ds types.IotDaemonSet, pod types.IotPod) bool {
 	if ds.Metadata.Labels[types.DeviceSelector] == types.DevicesAll {
@@ -51,12 +115,25 @@ func IsPodCorrectlyScheduled(ds types.IotDaemonSet, pod types.IotPod) bool {
 	}
 }
 
+// IsPodUpToDate checks if IotPod spec and labels match IotDaemonSet pod template.
+func IsPodUpToDate(ds types.IotDaemonSet, pod types.IotPod) bool {
+	if !api.Semantic.DeepEqual(pod.Spec, ds.Spec.Template.Spec) {
+		return false
+	}
+
+	for key, value := range ds.Spec.Template.ObjectMeta.Labels {
+		if pod.Metadata.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
 // GetDevicesMissingPods filters daemon set destined devices and returns devices without any existing pods.
 func GetDevicesMissingPods(dsDestinedDevices []types.IotDevice, existingPods []types.IotPod) []types.IotDevice {
 	var devicesMissingPod []types.IotDevice
 	for _, device := range dsDestinedDevices {
-		unschedulable := GetUnschedulableLabelFromDevice(device)
-		if !unschedulable {
+		if IsDeviceSchedulable(device) {
 			// Assume that device has missing pod.
 			isPodMissing := true
 			for _, pod := range existingPods {
@@ -79,7 +156,7 @@ func GetDevicesMissingPods(dsDestinedDevices []types.IotDevice, existingPods []t
 
 // DeleteDaemonSetPods deletes IotPods created by specific IotDaemonSet.
 func DeleteDaemonSetPods(restClient *rest.RESTClient, ds types.IotDaemonSet) error {
-	log.Printf("Trying to delete pods created by %s %s\n", ds.Metadata.Name, ds.TypeMeta.Kind)
+	logging.Debugf("Trying to delete pods created by %s %s", ds.Metadata.Name, ds.TypeMeta.Kind)
 	return restClient.Delete().
 		Resource(types.IotPodType).
 		Namespace(ds.Metadata.Namespace).
@@ -92,7 +169,7 @@ func DeleteDaemonSetPods(restClient *rest.RESTClient, ds types.IotDaemonSet) err
 
 // DeletePod deletes specific IotPod.
 func DeletePod(restClient *rest.RESTClient, pod types.IotPod) error {
-	log.Printf("Trying to delete %s %s\n", pod.Metadata.SelfLink, pod.TypeMeta.Kind)
+	logging.Debugf("Trying to delete %s %s", pod.Metadata.SelfLink, pod.TypeMeta.Kind)
 	return restClient.Delete().
 		Resource(types.IotPodType).
 		Namespace(pod.Metadata.Namespace).
@@ -103,7 +180,7 @@ func DeletePod(restClient *rest.RESTClient, pod types.IotPod) error {
 
 // UpdatePod updates specific IotPod spec and labels.
 func UpdatePod(restClient *rest.RESTClient, pod types.IotPod, template v1.PodTemplateSpec) error {
-	log.Printf("Trying to update %s %s\n", pod.Metadata.SelfLink, pod.TypeMeta.Kind)
+	logging.Debugf("Trying to update %s %s", pod.Metadata.SelfLink, pod.TypeMeta.Kind)
 
 	// Update IotPod spec.
 	pod.Spec = template.Spec
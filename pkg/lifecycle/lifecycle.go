@@ -0,0 +1,48 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fest-research/iot-addon/pkg/logging"
+)
+
+// SetupSignalHandler returns context canceled on SIGTERM or SIGINT, so the process can shut down
+// gracefully. Second signal terminates the process immediately.
+func SetupSignalHandler() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logging.Infof("Received %s, shutting down", sig.String())
+		cancel()
+
+		sig = <-signals
+		logging.Warningf("Received %s again, exiting immediately", sig.String())
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// WaitTimeout waits for the wait group. It returns false if the timeout passed first.
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
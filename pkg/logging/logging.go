@@ -0,0 +1,193 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is severity of a log entry. Entries above configured level are dropped.
+type Level int
+
+const (
+	ErrorLevel Level = iota
+	WarningLevel
+	InfoLevel
+	DebugLevel
+)
+
+var levelNames = map[Level]string{
+	ErrorLevel:   "error",
+	WarningLevel: "warning",
+	InfoLevel:    "info",
+	DebugLevel:   "debug",
+}
+
+func (this Level) String() string {
+	return levelNames[this]
+}
+
+// ParseLevel returns level with given name.
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// Supported output formats.
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Fields are key value pairs attached to every entry of a logger.
+type Fields map[string]interface{}
+
+var (
+	mu     sync.Mutex
+	out    io.Writer = os.Stdout
+	level            = InfoLevel
+	format           = TextFormat
+
+	root = &Logger{fields: Fields{}}
+)
+
+// Configure sets verbosity and format of all loggers.
+func Configure(levelName, formatName string) error {
+	parsedLevel, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	if formatName != TextFormat && formatName != JSONFormat {
+		return fmt.Errorf("unknown log format %q", formatName)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	level = parsedLevel
+	format = formatName
+	return nil
+}
+
+// DebugEnabled returns true when debug entries are written. Callers use it to skip building expensive
+// debug messages, e.g. redacted body dumps.
+func DebugEnabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level >= DebugLevel
+}
+
+// Logger writes leveled entries with its fields attached. Loggers are immutable and safe for concurrent use.
+type Logger struct {
+	fields Fields
+}
+
+// WithFields returns logger with given fields added to the fields of this logger.
+func (this *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(this.fields)+len(fields))
+	for key, value := range this.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{fields: merged}
+}
+
+func (this *Logger) Errorf(format string, args ...interface{}) {
+	this.write(ErrorLevel, format, args...)
+}
+
+func (this *Logger) Warningf(format string, args ...interface{}) {
+	this.write(WarningLevel, format, args...)
+}
+
+func (this *Logger) Infof(format string, args ...interface{}) {
+	this.write(InfoLevel, format, args...)
+}
+
+func (this *Logger) Debugf(format string, args ...interface{}) {
+	this.write(DebugLevel, format, args...)
+}
+
+// Fatalf writes error entry and exits the process.
+func (this *Logger) Fatalf(format string, args ...interface{}) {
+	this.write(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+func (this *Logger) write(entryLevel Level, messageFormat string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if entryLevel > level {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	message := fmt.Sprintf(messageFormat, args...)
+
+	if format == JSONFormat {
+		entry := make(map[string]interface{}, len(this.fields)+3)
+		for key, value := range this.fields {
+			entry[key] = value
+		}
+		entry["time"] = now
+		entry["level"] = entryLevel.String()
+		entry["msg"] = message
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			encoded = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"cannot encode log entry: %s"}`,
+				now, err.Error()))
+		}
+		out.Write(append(encoded, '\n'))
+		return
+	}
+
+	keys := make([]string, 0, len(this.fields))
+	for key := range this.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	line := fmt.Sprintf("%s %-7s %s", now, strings.ToUpper(entryLevel.String()), strings.TrimSuffix(message, "\n"))
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=%v", key, this.fields[key])
+	}
+	fmt.Fprintln(out, line)
+}
+
+// WithFields returns root logger with given fields.
+func WithFields(fields Fields) *Logger {
+	return root.WithFields(fields)
+}
+
+func Errorf(format string, args ...interface{}) {
+	root.write(ErrorLevel, format, args...)
+}
+
+func Warningf(format string, args ...interface{}) {
+	root.write(WarningLevel, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	root.write(InfoLevel, format, args...)
+}
+
+func Debugf(format string, args ...interface{}) {
+	root.write(DebugLevel, format, args...)
+}
+
+func Fatalf(format string, args ...interface{}) {
+	root.Fatalf(format, args...)
+}
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Redacted replaces sensitive values in logged payloads.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are redacted wherever they appear in a payload, matching is case insensitive and by substring.
+var sensitiveKeys = []string{"token", "password", "secret", "authorization", "bearer", "credential",
+	"privatekey", "private-key", "tls.key"}
+
+// RedactBody returns JSON payload with data of Secrets and values of sensitive keys replaced. Payloads that
+// are not JSON are never logged, only their size is.
+func RedactBody(body []byte) string {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fmt.Sprintf("<%d bytes of non-JSON payload>", len(body))
+	}
+
+	redacted, err := json.Marshal(redactValue(payload, false))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes of payload>", len(body))
+	}
+	return string(redacted)
+}
+
+// redactValue replaces sensitive values in decoded JSON. Items of SecretList don't have kind set, so
+// inSecret is inherited by children of Secret and SecretList objects.
+func redactValue(value interface{}, inSecret bool) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		inSecret = inSecret || typed["kind"] == "Secret" || typed["kind"] == "SecretList"
+		for key, child := range typed {
+			if (inSecret && (key == "data" || key == "stringData")) || isSensitiveKey(key) {
+				typed[key] = Redacted
+				continue
+			}
+			typed[key] = redactValue(child, inSecret)
+		}
+		return typed
+	case []interface{}:
+		for i, child := range typed {
+			typed[i] = redactValue(child, inSecret)
+		}
+		return typed
+	default:
+		return value
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	lowerKey := strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(lowerKey, sensitive) {
+			return true
+		}
+	}
+	return false
+}
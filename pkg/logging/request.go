@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"github.com/emicklei/go-restful"
+)
+
+// requestLoggerAttribute is the restful.Request attribute holding logger of the request.
+const requestLoggerAttribute = "logger"
+
+// SetRequestLogger attaches logger to the request, so handlers, proxies and notifiers log with its fields.
+func SetRequestLogger(req *restful.Request, logger *Logger) {
+	req.SetAttribute(requestLoggerAttribute, logger)
+}
+
+// RequestLogger returns logger attached to the request or the root logger if there is none.
+func RequestLogger(req *restful.Request) *Logger {
+	if logger, ok := req.Attribute(requestLoggerAttribute).(*Logger); ok {
+		return logger
+	}
+	return root
+}